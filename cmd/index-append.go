@@ -0,0 +1,298 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// indexAppendCmd represents the index append command
+var indexAppendCmd = &cobra.Command{
+	Use:   "append <index> <archive> [<tar>]",
+	Short: "Adds the entries appended to an uncompressed tar archive to its index",
+	Long: `Adds the entries appended to an uncompressed tar archive to its index, e.g. after
+"tar --append". Only the part of the archive after the previous end is read. If a
+second tar file is passed, it's concatenated to the archive first.
+
+Like extracting the archive, appended entries replace earlier entries of the same path.
+The index may be a badger index directory or a compact or paged index file. It's
+updated in a copy which then replaces the original, so that mounts which reload their
+index (see mount --reload) pick up the appended entries without ever seeing a partial
+update. The new content digest of the index is printed.
+
+Appended entries are indexed with the options the index was produced with, i.e. they get
+content digests if the index has them, and the content index next to the index, e.g.
+foo.trigrams for foo.index, is updated as well if there is one.`,
+	Args: cobra.RangeArgs(2, 3),
+	Run: func(cmd *cobra.Command, args []string) {
+		index, archive := args[0], args[1]
+		stat, err := os.Stat(index)
+		if err != nil {
+			log.WithError(err).Fatal("cannot open index")
+		}
+
+		// we work on a copy of the index and replace the original once we're done, so that
+		// mounts never see a partially updated index
+		var (
+			format = indexFormatBadger
+			dbDir  string
+		)
+		if stat.IsDir() {
+			dbDir, err = os.MkdirTemp(filepath.Dir(index), "."+filepath.Base(index)+".append-*")
+			if err == nil {
+				err = copyBadgerDir(index, dbDir)
+			}
+		} else {
+			format, err = indexFileFormat(index)
+			if err == nil {
+				dbDir, err = os.MkdirTemp("", "wsfs-index-*")
+			}
+		}
+		if err != nil {
+			log.WithError(err).Fatal("cannot copy index")
+		}
+		defer os.RemoveAll(dbDir)
+
+		db, err := badger.Open(badger.DefaultOptions(dbDir))
+		if err != nil {
+			log.WithError(err).Fatal("cannot open database")
+		}
+		defer db.Close()
+		if format != indexFormatBadger {
+			err = readIndexFile(db, index)
+			if err != nil {
+				log.WithError(err).Fatal("cannot read index")
+			}
+		}
+
+		if len(args) == 3 {
+			end, err := idx.ArchiveEnd(db)
+			if err != nil {
+				log.WithError(err).Fatal("cannot concatenate archives")
+			}
+			err = concatenateTar(archive, args[2], end)
+			if err != nil {
+				log.WithError(err).Fatal("cannot concatenate archives")
+			}
+		}
+
+		in, err := os.Open(archive)
+		if err != nil {
+			log.WithError(err).Fatal("cannot open archive")
+		}
+		defer in.Close()
+		stat, err = in.Stat()
+		if err != nil {
+			log.WithError(err).Fatal("cannot open archive")
+		}
+		var (
+			opts    idx.ProduceOptions
+			content = idx.ContentIndexPath(index)
+		)
+		if _, err := os.Stat(content); err == nil {
+			opts.ContentIndex, err = loadContentIndex(content)
+			if err != nil {
+				log.WithError(err).Fatal("cannot read content index")
+			}
+		}
+		var stopProgress func()
+		opts.Progress, stopProgress = reportIndexingProgress()
+		err = idx.AppendIndex(db, in, stat.Size(), opts)
+		stopProgress()
+		if err != nil {
+			log.WithError(err).Fatal("cannot append to index")
+		}
+		if opts.ContentIndex != nil {
+			// the content index replaces the original along with the index
+			err = writeContentIndexFile(opts.ContentIndex, content+".append")
+			if err != nil {
+				os.Remove(content + ".append")
+				log.WithError(err).Fatal("cannot write content index")
+			}
+		}
+
+		digest, err := idx.StoreIndexDigest(db)
+		if err != nil {
+			log.WithError(err).Fatal("cannot compute index digest")
+		}
+		if format != indexFormatBadger {
+			tmp := index + ".append"
+			err = writeIndexFile(db, tmp, format)
+			if err == nil {
+				err = os.Rename(tmp, index)
+			}
+			if err != nil {
+				os.Remove(tmp)
+				log.WithError(err).Fatal("cannot write index")
+			}
+		} else {
+			err = db.Close()
+			if err == nil {
+				err = replaceDir(index, dbDir)
+			}
+			if err != nil {
+				log.WithError(err).Fatal("cannot write index")
+			}
+		}
+		if opts.ContentIndex != nil {
+			err = os.Rename(content+".append", content)
+			if err != nil {
+				log.WithError(err).Fatal("cannot write content index")
+			}
+		}
+		fmt.Println(digest)
+	},
+}
+
+func init() {
+	indexCmd.AddCommand(indexAppendCmd)
+}
+
+// indexFileFormat detects whether an index file is a compact or paged index
+func indexFileFormat(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	_, err = io.ReadFull(f, header)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case idx.IsPagedIndex(header):
+		return indexFormatPaged, nil
+	case idx.IsCompactIndex(header):
+		return indexFormatCompact, nil
+	default:
+		return "", fmt.Errorf("%s is neither a compact nor a paged index", fn)
+	}
+}
+
+// loadContentIndex reads a content index into a builder, so that files can be added to it
+func loadContentIndex(fn string) (*idx.ContentIndexBuilder, error) {
+	ci, err := idx.OpenContentIndexFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer ci.Close()
+	res := idx.NewContentIndexBuilder()
+	err = res.AddContentIndex(ci)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readIndexFile reads a compact or paged index file into db
+func readIndexFile(db *badger.DB, fn string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return idx.ReadCompactIndex(f, stat.Size(), db)
+}
+
+// copyBadgerDir copies the files of a badger database. The lock file is left out, so that the
+// copy can be opened while the original is in use.
+func copyBadgerDir(src, dst string) error {
+	files, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if !fi.Type().IsRegular() || fi.Name() == "LOCK" {
+			continue
+		}
+		err = copyFile(filepath.Join(src, fi.Name()), filepath.Join(dst, fi.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// replaceDir replaces the directory dst with src. Processes which have files of dst open keep
+// reading the previous version.
+func replaceDir(dst, src string) error {
+	tmpdir, err := os.MkdirTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".old-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpdir)
+	old := filepath.Join(tmpdir, filepath.Base(dst))
+	err = os.Rename(dst, old)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(src, dst)
+	if err != nil {
+		// put the previous version back in place
+		_ = os.Rename(old, dst)
+		return err
+	}
+	return nil
+}
+
+// concatenateTar writes the tar file src to archive, replacing the end-of-archive marker of archive
+// which starts at end
+func concatenateTar(archive, src string, end int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r := bufio.NewReader(in)
+	magic, err := r.Peek(2)
+	if err != nil {
+		return err
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return fmt.Errorf("cannot concatenate compressed tar files")
+	}
+
+	out, err := os.OpenFile(archive, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	_, err = out.Seek(end, io.SeekStart)
+	if err == nil {
+		_, err = io.Copy(out, r)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var indexConvertOpts struct {
+	Paged bool
+}
+
+// indexConvertCmd represents the index convert command
+var indexConvertCmd = &cobra.Command{
+	Use:   "convert <src> <dst>",
+	Short: "Converts between badger and compact indices",
+	Long: `Converts between badger and compact indices. If src is a badger index directory,
+dst becomes a compact index file, and vice versa.
+
+Compact indices are a single file which is memory mapped locally and read using range
+requests remotely, rather than being downloaded and extracted.
+
+With --paged the compact index is paged by directory. Only the root directory is read when
+mounting, all other directories are read when they're first listed. Use this for archives
+with a very large number of entries.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		src, dst := args[0], args[1]
+		stat, err := os.Stat(src)
+		if err != nil {
+			log.WithError(err).Fatal("cannot open source index")
+		}
+
+		if stat.IsDir() {
+			db, err := badger.Open(badger.DefaultOptions(src).WithReadOnly(true))
+			if err != nil {
+				log.WithError(err).Fatal("cannot open database")
+			}
+			defer db.Close()
+
+			out, err := os.Create(dst)
+			if err != nil {
+				log.WithError(err).Fatal("cannot create compact index")
+			}
+			if indexConvertOpts.Paged {
+				err = idx.WritePagedIndex(db, out)
+			} else {
+				err = idx.WriteCompactIndex(db, out)
+			}
+			if err != nil {
+				out.Close()
+				log.WithError(err).Fatal("cannot write compact index")
+			}
+			err = out.Close()
+			if err != nil {
+				log.WithError(err).Fatal("cannot write compact index")
+			}
+			return
+		}
+
+		in, err := os.Open(src)
+		if err != nil {
+			log.WithError(err).Fatal("cannot open source index")
+		}
+		defer in.Close()
+
+		db, err := badger.Open(badger.DefaultOptions(dst))
+		if err != nil {
+			log.WithError(err).Fatal("cannot open database")
+		}
+		defer db.Close()
+
+		err = idx.ReadCompactIndex(in, stat.Size(), db)
+		if err != nil {
+			log.WithError(err).Fatal("cannot convert compact index")
+		}
+	},
+}
+
+func init() {
+	indexCmd.AddCommand(indexConvertCmd)
+	indexConvertCmd.Flags().BoolVar(&indexConvertOpts.Paged, "paged", false, "Produce a compact index which is paged by directory")
+}
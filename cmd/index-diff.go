@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var indexDiffOpts struct {
+	OldIndex string
+	NewIndex string
+	Platform string
+	JSON     bool
+}
+
+// indexDiffCmd represents the index diff command
+var indexDiffCmd = &cobra.Command{
+	Use:   "diff <old-uri> <new-uri>",
+	Short: "Lists the files which were added, removed or modified between two sources",
+	Long: `Lists the files which were added, removed or modified between two sources, e.g. two
+releases of an archive or two revisions of a GitHub repository:
+
+  wsfs index diff https://example.com/release-1.tar https://example.com/release-2.tar
+  wsfs index diff github://owner/repo?revision=v1 github://owner/repo?revision=v2
+
+Sources are opened like "wsfs mount" opens them, and only their indices are compared.
+No content is fetched. Files are modified if their type, size, mode, modification time
+or symlink target differ, or their digests if both sources know them. Directories with
+the same digest, e.g. the same git tree, are skipped.
+
+Each line of the output starts with A (added), D (removed) or M (modified). Use --json
+for a machine-readable list of changes.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		open := func(source, index string) idx.Index {
+			res, err := idx.Open(ctx, source, idx.OpenOptions{
+				Index:    index,
+				Platform: indexDiffOpts.Platform,
+				Username: os.Getenv("REGISTRY_USERNAME"),
+				Password: os.Getenv("REGISTRY_PASSWORD"),
+				Token:    os.Getenv("GITHUB_TOKEN"),
+			})
+			if err != nil {
+				log.WithError(err).Fatal("cannot open source")
+			}
+			return res
+		}
+		from := open(args[0], indexDiffOpts.OldIndex)
+		defer from.Close()
+		to := open(args[1], indexDiffOpts.NewIndex)
+		defer to.Close()
+
+		changes, err := idx.Diff(ctx, from, to)
+		if err != nil {
+			log.WithError(err).Fatal("cannot compare sources")
+		}
+
+		if indexDiffOpts.JSON {
+			if changes == nil {
+				changes = []idx.Change{}
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(changes)
+			if err != nil {
+				log.WithError(err).Fatal("cannot write changes")
+			}
+			return
+		}
+		for _, c := range changes {
+			fmt.Println(formatChange(c))
+		}
+	},
+}
+
+// formatChange describes a change in a single line
+func formatChange(c idx.Change) string {
+	switch c.Kind {
+	case idx.ChangeAdded:
+		return "A " + c.Path
+	case idx.ChangeRemoved:
+		return "D " + c.Path
+	}
+
+	details := make([]string, 0, len(c.Fields))
+	for _, f := range c.Fields {
+		var from, to interface{}
+		switch f {
+		case "type":
+			from, to = entryType(c.Old), entryType(c.New)
+		case "size":
+			from, to = c.Old.Size, c.New.Size
+		case "mode":
+			from, to = fmt.Sprintf("%04o", c.Old.Mode&07777), fmt.Sprintf("%04o", c.New.Mode&07777)
+		case "mtime":
+			from, to = c.Old.Mtime.Format(time.RFC3339), c.New.Mtime.Format(time.RFC3339)
+		case "target":
+			from, to = c.Old.Target, c.New.Target
+		default:
+			details = append(details, f)
+			continue
+		}
+		details = append(details, fmt.Sprintf("%s %v -> %v", f, from, to))
+	}
+	return fmt.Sprintf("M %s (%s)", c.Path, strings.Join(details, ", "))
+}
+
+func entryType(e *idx.EntryInfo) string {
+	switch e.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return "dir"
+	case syscall.S_IFLNK:
+		return "symlink"
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		return "device"
+	case syscall.S_IFIFO:
+		return "fifo"
+	default:
+		return "file"
+	}
+}
+
+func init() {
+	indexCmd.AddCommand(indexDiffCmd)
+	indexDiffCmd.Flags().StringVar(&indexDiffOpts.OldIndex, "old-index", "", "Location of the index of the old source, if it needs one")
+	indexDiffCmd.Flags().StringVar(&indexDiffOpts.NewIndex, "new-index", "", "Location of the index of the new source, if it needs one")
+	indexDiffCmd.Flags().StringVar(&indexDiffOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform OCI images")
+	indexDiffCmd.Flags().BoolVar(&indexDiffOpts.JSON, "json", false, "Print the changes as JSON")
+}
@@ -4,63 +4,125 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"bufio"
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"fmt"
 	"os"
+	"runtime"
+	"strconv"
+	"time"
 
 	"github.com/csweichel/wsfs/pkg/idx"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
+var indexDumpOpts struct {
+	Index    string
+	Platform string
+	Format   string
+}
+
 // indexDumpCmd represents the indexDump command
 var indexDumpCmd = &cobra.Command{
-	Use:   "dump <remoteIndexURL>",
-	Short: "Dumps an entire index as JSON",
-	Args:  cobra.ExactArgs(1),
+	Use:   "dump <uri>",
+	Short: "Dumps an entire index as JSON lines, CSV or mtree specification",
+	Long: `Dumps an entire index, depth-first and sorted by name. Sources are opened like
+"wsfs mount" opens them, and entries are written while the index is read.
+
+Formats:
+  jsonl  a JSON object per entry with the fields path, dir, size, mode, mtime, digest
+         and target, like "index query --output jsonl" prints them
+  csv    a header followed by the columns path, type, size, mode, mtime, digest and
+         target, where type is a letter like find -type uses and mode is octal
+  mtree  a BSD mtree specification with full paths, which "index mtree-check", mtree -f
+         and bsdtar understand`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		ridx, err := idx.OpenRemoteTarIndex(context.Background(), args[0])
+		ctx := context.Background()
+		index, err := idx.Open(ctx, args[0], idx.OpenOptions{
+			Index:    indexDumpOpts.Index,
+			Platform: indexDumpOpts.Platform,
+			Username: os.Getenv("REGISTRY_USERNAME"),
+			Password: os.Getenv("REGISTRY_PASSWORD"),
+			Token:    os.Getenv("GITHUB_TOKEN"),
+		})
 		if err != nil {
 			log.WithError(err).Fatal("cannot open index")
 		}
+		defer index.Close()
 
-		entries, err := ridx.RootEntries(context.Background())
-		if err != nil {
-			log.WithError(err).Fatal("cannot get root index")
-		}
-
+		out := bufio.NewWriter(os.Stdout)
 		var (
-			res  []idx.Entry
-			dirs []idx.Entry
+			write func(p string, info *idx.EntryInfo) error
+			flush func() error
 		)
-		for _, f := range entries {
-			f := f
-			res = append(res, f)
-			if f.Dir() {
-				dirs = append(dirs, f)
+		switch indexDumpOpts.Format {
+		case "jsonl":
+			enc := json.NewEncoder(out)
+			write = func(p string, info *idx.EntryInfo) error {
+				return enc.Encode(entryRecord{Path: p, EntryInfo: info})
 			}
-		}
-
-		for _, d := range dirs {
-			children, err := ridx.Children(context.Background(), d)
+			flush = out.Flush
+		case "csv":
+			w := csv.NewWriter(out)
+			err = w.Write([]string{"path", "type", "size", "mode", "mtime", "digest", "target"})
 			if err != nil {
-				log.WithError(err).WithField("entry", d).Fatal("cannot get children")
+				log.WithError(err).Fatal("cannot write dump")
+			}
+			write = func(p string, info *idx.EntryInfo) error {
+				return w.Write([]string{
+					p,
+					string(findType(info)),
+					strconv.FormatUint(info.Size, 10),
+					fmt.Sprintf("%04o", info.Mode&07777),
+					info.Mtime.Format(time.RFC3339Nano),
+					info.Digest,
+					info.Target,
+				})
 			}
-			for _, c := range children {
-				c := c
-				res = append(res, c)
-				if c.Dir() {
-					dirs = append(dirs, c)
+			flush = func() error {
+				w.Flush()
+				if err := w.Error(); err != nil {
+					return err
 				}
+				return out.Flush()
 			}
+		case "mtree":
+			w, err := idx.NewMtreeWriter(out)
+			if err != nil {
+				log.WithError(err).Fatal("cannot write dump")
+			}
+			write = func(p string, info *idx.EntryInfo) error {
+				return w.Write(idx.NewMtreeEntry(p, info))
+			}
+			flush = out.Flush
+		default:
+			log.WithField("format", indexDumpOpts.Format).Fatal("unknown format, must be jsonl, csv or mtree")
 		}
 
-		enc := json.NewEncoder(os.Stdout)
-		enc.SetIndent("", "  ")
-		enc.Encode(res)
+		err = idx.QueryIndex(ctx, index, idx.Query{MaxSize: -1}, write)
+		if err == nil {
+			err = flush()
+		}
+		if err != nil {
+			log.WithError(err).Fatal("cannot dump index")
+		}
 	},
 }
 
+// entryRecord is an entry as JSON lines output prints it
+type entryRecord struct {
+	Source string `json:"source,omitempty"`
+	Path   string `json:"path"`
+	*idx.EntryInfo
+}
+
 func init() {
 	indexCmd.AddCommand(indexDumpCmd)
+	indexDumpCmd.Flags().StringVar(&indexDumpOpts.Index, "index", "", "Location of the index, if the source needs one")
+	indexDumpCmd.Flags().StringVar(&indexDumpOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform OCI images")
+	indexDumpCmd.Flags().StringVar(&indexDumpOpts.Format, "format", "jsonl", "Output format: jsonl, csv or mtree")
 }
@@ -1,7 +1,10 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/csweichel/wsfs/pkg/idx"
 	"github.com/dgraph-io/badger/v3"
@@ -9,31 +12,231 @@ import (
 	"github.com/spf13/cobra"
 )
 
+var indexGenerateOpts struct {
+	URL            string
+	Embed          bool
+	Format         string
+	ContentDigests bool
+	ContentIndex   bool
+}
+
 // indexGenerateCmd represents the indexGenerate command
 var indexGenerateCmd = &cobra.Command{
-	Use:   "generate <dst> <src.tar>",
-	Short: "Generate an index from a tar file",
-	Args:  cobra.ExactArgs(2),
+	Use:   "generate <dst> [<src>]",
+	Short: "Generate an index from a tar or cpio file, optionally gzip compressed",
+	Long: `Generate an index from a tar or cpio file, optionally gzip compressed.
+
+With --url an uncompressed tar file is indexed in place, reading only its headers
+using HTTP range requests.
+
+With --embed the index is appended to an uncompressed tar source file, so that the
+archive can be mounted without a separate index.
+
+The content digest of the index is printed and stored in the index. It depends on the
+archive and options only, so that builders indexing the same archive agree on it. The index
+is written as compact index by default. --format compact, paged and archive write dst as a
+single file which is byte-for-byte reproducible, while badger directories differ from run
+to run.
+
+With --content-digests the SHA-256 of each file is recorded, so that "index verify --content"
+can check the content of the archive. Only badger indices and index archives keep content
+digests, hence the format defaults to badger then, as it does with --embed.
+
+With --content-index the trigrams of each file are written to a content index next to dst,
+e.g. foo.trigrams for foo.index, which lets "wsfs search" skip files that cannot match.`,
+	Args: cobra.RangeArgs(1, 2),
 	Run: func(cmd *cobra.Command, args []string) {
-		in, err := os.Open(args[1])
-		if err != nil {
-			log.WithError(err).Fatal("cannot open source file")
+		if (indexGenerateOpts.URL == "") == (len(args) == 1) {
+			log.Fatal("either pass a source file or --url")
+		}
+		if indexGenerateOpts.Embed && indexGenerateOpts.URL != "" {
+			log.Fatal("cannot embed the index with --url")
+		}
+		format := indexGenerateOpts.Format
+		if !cmd.Flags().Changed("format") && (indexGenerateOpts.Embed || indexGenerateOpts.ContentDigests) {
+			format = indexFormatBadger
+		}
+		if format != indexFormatBadger && format != indexFormatArchive && format != indexFormatCompact && format != indexFormatPaged {
+			log.WithField("format", format).Fatal("unsupported index format")
+		}
+		if indexGenerateOpts.Embed && format != indexFormatBadger {
+			log.Fatal("can only embed badger indices")
+		}
+		if indexGenerateOpts.ContentDigests && (indexGenerateOpts.URL != "" || (format != indexFormatBadger && format != indexFormatArchive)) {
+			log.Fatal("content digests require a local source file and the badger or archive format")
+		}
+		if indexGenerateOpts.ContentIndex && indexGenerateOpts.URL != "" {
+			log.Fatal("a content index requires a local source file")
 		}
-		defer in.Close()
 
-		db, err := badger.Open(badger.DefaultOptions(args[0]))
+		dbDir := args[0]
+		if format != indexFormatBadger {
+			tmpdir, err := os.MkdirTemp("", "wsfs-index-*")
+			if err != nil {
+				log.WithError(err).Fatal("cannot create temporary directory")
+			}
+			defer os.RemoveAll(tmpdir)
+			dbDir = tmpdir
+		}
+		db, err := badger.Open(badger.DefaultOptions(dbDir))
 		if err != nil {
 			log.WithError(err).Fatal("cannot open database")
 		}
 		defer db.Close()
 
-		err = idx.ProduceIndexFromTarFile(db, in)
+		var content *idx.ContentIndexBuilder
+		progress, stopProgress := reportIndexingProgress()
+		if indexGenerateOpts.URL != "" {
+			err = idx.ProduceIndexFromRemoteTarFile(db, indexGenerateOpts.URL, progress)
+		} else {
+			var in *os.File
+			in, err = os.Open(args[1])
+			if err != nil {
+				log.WithError(err).Fatal("cannot open source file")
+			}
+			defer in.Close()
+			opts := idx.ProduceOptions{
+				ContentDigests: indexGenerateOpts.ContentDigests,
+				Progress:       progress,
+			}
+			if indexGenerateOpts.ContentIndex {
+				content = idx.NewContentIndexBuilder()
+				opts.ContentIndex = content
+			}
+			err = idx.ProduceIndexWithOptions(db, in, opts)
+		}
+		stopProgress()
 		if err != nil {
 			log.WithError(err).Fatal("cannot produce index")
 		}
+
+		digest, err := idx.StoreIndexDigest(db)
+		if err != nil {
+			log.WithError(err).Fatal("cannot compute index digest")
+		}
+		err = writeIndexFile(db, args[0], format)
+		if err != nil {
+			log.WithError(err).Fatal("cannot write index")
+		}
+		if content != nil {
+			err = writeContentIndexFile(content, idx.ContentIndexPath(args[0]))
+			if err != nil {
+				log.WithError(err).Fatal("cannot write content index")
+			}
+		}
+		fmt.Println(digest)
+
+		if indexGenerateOpts.Embed {
+			err = db.Close()
+			if err != nil {
+				log.WithError(err).Fatal("cannot close database")
+			}
+			err = idx.EmbedIndex(args[1], args[0])
+			if err != nil {
+				log.WithError(err).Fatal("cannot embed index")
+			}
+		}
 	},
 }
 
 func init() {
 	indexCmd.AddCommand(indexGenerateCmd)
+	indexGenerateCmd.Flags().BoolVar(&indexGenerateOpts.Embed, "embed", false, "Append the index to the source tar file")
+	indexGenerateCmd.Flags().StringVar(&indexGenerateOpts.URL, "url", "", "URL of an uncompressed tar file to index using range requests")
+	indexGenerateCmd.Flags().BoolVar(&indexGenerateOpts.ContentDigests, "content-digests", false, "Record the SHA-256 of each file, see index verify --content")
+	indexGenerateCmd.Flags().BoolVar(&indexGenerateOpts.ContentIndex, "content-index", false, "Write a content index of the trigrams of each file, see wsfs search")
+	indexGenerateCmd.Flags().StringVar(&indexGenerateOpts.Format, "format", indexFormatCompact, "Index format: compact, paged, archive (a single file) or badger (a directory)")
+}
+
+const (
+	indexFormatBadger  = "badger"
+	indexFormatArchive = "archive"
+	indexFormatCompact = "compact"
+	indexFormatPaged   = "paged"
+)
+
+// writeIndexFile writes the index in db to dst in a single file format. Badger indices live in
+// their database directory already, hence there's nothing to write for them.
+func writeIndexFile(db *badger.DB, dst, format string) error {
+	if format == indexFormatBadger {
+		return nil
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case indexFormatCompact:
+		err = idx.WriteCompactIndex(db, out)
+	case indexFormatPaged:
+		err = idx.WritePagedIndex(db, out)
+	case indexFormatArchive:
+		err = idx.WriteIndexArchive(db, out)
+	default:
+		err = fmt.Errorf("unsupported index format %s", format)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeContentIndexFile writes a content index to dst
+func writeContentIndexFile(content *idx.ContentIndexBuilder, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	err = idx.WriteContentIndex(content, out)
+	if err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// indexingProgressInterval is how often reportIndexingProgress logs
+const indexingProgressInterval = 2 * time.Second
+
+// reportIndexingProgress periodically logs the number of entries and bytes indexed so far, as
+// recorded in p, and the rate at which that happens. Calling stop logs a summary and stops.
+func reportIndexingProgress() (p *idx.Progress, stop func()) {
+	p = &idx.Progress{}
+	var (
+		t0   = time.Now()
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	report := func(msg string) {
+		dur := time.Since(t0)
+		entries, bytes := p.Entries(), p.Bytes()
+		log.WithField("entries", entries).
+			WithField("bytes", bytes).
+			WithField("entriesPerSec", int64(float64(entries)/dur.Seconds())).
+			WithField("MiBPerSec", fmt.Sprintf("%.1f", float64(bytes)/dur.Seconds()/(1<<20))).
+			WithField("duration", dur.Round(time.Millisecond)).
+			Info(msg)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t := time.NewTicker(indexingProgressInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				report("indexing")
+			case <-done:
+				return
+			}
+		}
+	}()
+	return p, func() {
+		close(done)
+		wg.Wait()
+		report("indexed archive")
+	}
 }
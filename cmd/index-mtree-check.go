@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var indexMtreeCheckOpts struct {
+	Index    string
+	Platform string
+	File     string
+}
+
+// indexMtreeCheckCmd represents the index mtree-check command
+var indexMtreeCheckCmd = &cobra.Command{
+	Use:   "mtree-check <dir> [<uri>]",
+	Short: "Checks a directory tree against the index of a source or an mtree specification",
+	Long: `Checks a directory tree, e.g. an extracted archive, against the index of a source:
+
+  wsfs index mtree-check ./extracted https://example.com/release.tar
+
+The index is turned into an mtree specification like "index dump --format mtree" does.
+Use --file to check against a specification instead, which may also come from mtree -c
+or bsdtar. Type, mode, size, modification time and symlink target are compared, and if
+the specification has sha256 digests, the content of files too.
+
+Each line of the output starts with A (not part of the specification), D (missing) or
+M (modified), and any difference makes the command exit with a non-zero status.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if (len(args) == 2) == (indexMtreeCheckOpts.File != "") {
+			log.Fatal("either a source or --file is required")
+		}
+
+		var (
+			spec []idx.MtreeEntry
+			err  error
+		)
+		if fn := indexMtreeCheckOpts.File; fn != "" {
+			f, err := os.Open(fn)
+			if err != nil {
+				log.WithError(err).Fatal("cannot open specification")
+			}
+			spec, err = idx.ParseMtree(f)
+			f.Close()
+			if err != nil {
+				log.WithError(err).WithField("file", fn).Fatal("cannot parse specification")
+			}
+		} else {
+			ctx := context.Background()
+			index, err := idx.Open(ctx, args[1], idx.OpenOptions{
+				Index:    indexMtreeCheckOpts.Index,
+				Platform: indexMtreeCheckOpts.Platform,
+				Username: os.Getenv("REGISTRY_USERNAME"),
+				Password: os.Getenv("REGISTRY_PASSWORD"),
+				Token:    os.Getenv("GITHUB_TOKEN"),
+			})
+			if err != nil {
+				log.WithError(err).Fatal("cannot open index")
+			}
+			err = idx.QueryIndex(ctx, index, idx.Query{MaxSize: -1}, func(p string, info *idx.EntryInfo) error {
+				spec = append(spec, idx.NewMtreeEntry(p, info))
+				return nil
+			})
+			index.Close()
+			if err != nil {
+				log.WithError(err).Fatal("cannot read index")
+			}
+		}
+
+		changes, err := idx.CheckMtree(args[0], spec)
+		if err != nil {
+			log.WithError(err).Fatal("cannot check directory")
+		}
+		for _, c := range changes {
+			fmt.Println(formatChange(c))
+		}
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	indexCmd.AddCommand(indexMtreeCheckCmd)
+	indexMtreeCheckCmd.Flags().StringVar(&indexMtreeCheckOpts.Index, "index", "", "Location of the index, if the source needs one")
+	indexMtreeCheckCmd.Flags().StringVar(&indexMtreeCheckOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform OCI images")
+	indexMtreeCheckCmd.Flags().StringVarP(&indexMtreeCheckOpts.File, "file", "f", "", "Check against this mtree specification instead of an index")
+}
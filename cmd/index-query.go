@@ -0,0 +1,295 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var indexQueryOpts struct {
+	Index    string
+	Platform string
+	Name     string
+	Path     string
+	Type     string
+	MinSize  string
+	MaxSize  string
+	Newer    string
+	Older    string
+	Perm     string
+	Output   string
+	Printf   string
+}
+
+// indexQueryCmd represents the index query command
+var indexQueryCmd = &cobra.Command{
+	Use:   "query <uri>...",
+	Short: "Finds files in the index of one or more sources",
+	Long: `Finds files in the index of one or more sources without mounting them or fetching
+their content, e.g. to find out which archive contains a library:
+
+  wsfs index query --name 'libfoo.so*' release-1.tar https://example.com/release-2.tar
+  wsfs index query --path 'usr/lib/**/*.so' --type f --min-size 1M oci://ubuntu:22.04
+
+Sources are opened like "wsfs mount" opens them. Filters are combined, i.e. files have
+to pass all of them:
+  --name and --path   globs for the base name and the path; ** in --path matches any
+                      number of directories
+  --type              one or more of f (file), d (directory), l (symlink), c, b and p
+  --min-size and
+  --max-size          sizes in bytes, or with a k, M or G suffix; the size of directories
+                      is the total size of the files below them
+  --newer and --older modification times as RFC3339 timestamp or as duration, e.g. 24h
+  --perm              permission bits like find -perm does: 644 for exactly these bits,
+                      -4000 for all of them and /111 for any of them
+
+Use --output jsonl for a JSON object per file, or --printf for a format like find -printf
+supports: %p (path), %f (base name), %h (directory), %s (size), %m (octal permissions),
+%y (type), %l (symlink target), %t (modification time), %H (source) and %%. \n and \t
+are escaped, and no newline is added. Indices produced by "index generate" record the
+totals of each directory, which %S (total size), %N (number of files) and %T (latest
+modification time) print without walking the directory, e.g. to list the largest
+top-level directories:
+
+  wsfs index query --path '*' --type d --min-size 100M --printf '%S\t%p\n' release.tar
+
+With more than one source, paths are prefixed with their source.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if indexQueryOpts.Index != "" && len(args) > 1 {
+			log.Fatal("--index can only be used with a single source")
+		}
+		q, err := parseQuery()
+		if err != nil {
+			log.WithError(err).Fatal("invalid query")
+		}
+
+		var print func(source, p string, info *idx.EntryInfo) error
+		switch {
+		case indexQueryOpts.Printf != "":
+			format := strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\\`, `\`).Replace(indexQueryOpts.Printf)
+			print = func(source, p string, info *idx.EntryInfo) error {
+				_, err := fmt.Print(formatEntry(format, source, p, info))
+				return err
+			}
+		case indexQueryOpts.Output == "paths":
+			print = func(source, p string, info *idx.EntryInfo) error {
+				if len(args) > 1 {
+					p = source + ":" + p
+				}
+				_, err := fmt.Println(p)
+				return err
+			}
+		case indexQueryOpts.Output == "jsonl":
+			enc := json.NewEncoder(os.Stdout)
+			print = func(source, p string, info *idx.EntryInfo) error {
+				return enc.Encode(entryRecord{Source: source, Path: p, EntryInfo: info})
+			}
+		default:
+			log.WithField("output", indexQueryOpts.Output).Fatal("unknown output, must be paths or jsonl")
+		}
+
+		ctx := context.Background()
+		for _, source := range args {
+			index, err := idx.Open(ctx, source, idx.OpenOptions{
+				Index:    indexQueryOpts.Index,
+				Platform: indexQueryOpts.Platform,
+				Username: os.Getenv("REGISTRY_USERNAME"),
+				Password: os.Getenv("REGISTRY_PASSWORD"),
+				Token:    os.Getenv("GITHUB_TOKEN"),
+			})
+			if err != nil {
+				log.WithError(err).Fatal("cannot open source")
+			}
+			err = idx.QueryIndex(ctx, index, q, func(p string, info *idx.EntryInfo) error {
+				return print(source, p, info)
+			})
+			index.Close()
+			if err != nil {
+				log.WithError(err).WithField("source", source).Fatal("cannot query index")
+			}
+		}
+	},
+}
+
+func parseQuery() (q idx.Query, err error) {
+	opts := indexQueryOpts
+	q = idx.Query{Name: opts.Name, Path: opts.Path, Types: strings.ReplaceAll(opts.Type, ",", ""), MaxSize: -1}
+	if opts.MinSize != "" {
+		q.MinSize, err = parseSize(opts.MinSize)
+		if err != nil {
+			return q, fmt.Errorf("invalid --min-size: %w", err)
+		}
+	}
+	if opts.MaxSize != "" {
+		q.MaxSize, err = parseSize(opts.MaxSize)
+		if err != nil {
+			return q, fmt.Errorf("invalid --max-size: %w", err)
+		}
+	}
+	if opts.Newer != "" {
+		q.NewerThan, err = parseTime(opts.Newer)
+		if err != nil {
+			return q, fmt.Errorf("invalid --newer: %w", err)
+		}
+	}
+	if opts.Older != "" {
+		q.OlderThan, err = parseTime(opts.Older)
+		if err != nil {
+			return q, fmt.Errorf("invalid --older: %w", err)
+		}
+	}
+	if opts.Perm != "" {
+		perm := opts.Perm
+		switch perm[0] {
+		case '-':
+			q.PermMatch, perm = idx.PermAll, perm[1:]
+		case '/':
+			q.PermMatch, perm = idx.PermAny, perm[1:]
+		default:
+			q.PermMatch = idx.PermExact
+		}
+		bits, err := strconv.ParseUint(perm, 8, 32)
+		if err != nil || bits > 07777 {
+			return q, fmt.Errorf("invalid --perm %q: must be octal permission bits", opts.Perm)
+		}
+		q.Perm = uint32(bits)
+	}
+	return q, nil
+}
+
+// parseSize parses a size in bytes with an optional k, M or G suffix
+func parseSize(s string) (int64, error) {
+	unit := int64(1)
+	switch {
+	case strings.HasSuffix(s, "k"), strings.HasSuffix(s, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		unit = 1 << 30
+	}
+	if unit > 1 {
+		s = s[:len(s)-1]
+	}
+	res, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || res < 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+	return res * unit, nil
+}
+
+// parseTime parses an RFC3339 timestamp, or a duration which is relative to now
+func parseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	res, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC3339 timestamp nor a duration", s)
+	}
+	return res, nil
+}
+
+// formatEntry expands the directives of a find -printf like format
+func formatEntry(format, source, p string, info *idx.EntryInfo) string {
+	var res strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i == len(format)-1 {
+			res.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'p':
+			res.WriteString(p)
+		case 'f':
+			res.WriteString(path.Base(p))
+		case 'h':
+			res.WriteString(path.Dir(p))
+		case 's':
+			res.WriteString(strconv.FormatUint(info.Size, 10))
+		case 'm':
+			res.WriteString(strconv.FormatUint(uint64(info.Mode&07777), 8))
+		case 'y':
+			res.WriteByte(findType(info))
+		case 'l':
+			res.WriteString(info.Target)
+		case 't':
+			res.WriteString(info.Mtime.Format(time.RFC3339))
+		case 'S', 'N', 'T':
+			a := entryAggregate(info)
+			switch {
+			case a == nil:
+				res.WriteByte('?')
+			case format[i] == 'S':
+				res.WriteString(strconv.FormatUint(a.Size, 10))
+			case format[i] == 'N':
+				res.WriteString(strconv.FormatUint(a.Files, 10))
+			default:
+				res.WriteString(a.Mtime.UTC().Format(time.RFC3339))
+			}
+		case 'H':
+			res.WriteString(source)
+		case '%':
+			res.WriteByte('%')
+		default:
+			res.WriteByte('%')
+			res.WriteByte(format[i])
+		}
+	}
+	return res.String()
+}
+
+// entryAggregate returns the totals of a directory, or of a file itself
+func entryAggregate(info *idx.EntryInfo) *idx.DirAggregate {
+	if info.Dir {
+		return info.Aggregate
+	}
+	return &idx.DirAggregate{Size: info.Size, Files: 1, Mtime: info.Mtime}
+}
+
+// findType returns the letter find uses for the type of an entry
+func findType(info *idx.EntryInfo) byte {
+	switch info.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return 'd'
+	case syscall.S_IFLNK:
+		return 'l'
+	case syscall.S_IFCHR:
+		return 'c'
+	case syscall.S_IFBLK:
+		return 'b'
+	case syscall.S_IFIFO:
+		return 'p'
+	default:
+		return 'f'
+	}
+}
+
+func init() {
+	indexCmd.AddCommand(indexQueryCmd)
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Index, "index", "", "Location of the index, if the source needs one")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform OCI images")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Name, "name", "", "Glob the base name of files has to match")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Path, "path", "", "Glob the path of files has to match, ** matches any number of directories")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Type, "type", "", "Types of files to list, e.g. f or f,l")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.MinSize, "min-size", "", "Smallest size of files to list, e.g. 10k")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.MaxSize, "max-size", "", "Largest size of files to list, e.g. 1G")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Newer, "newer", "", "List files modified after this RFC3339 timestamp or duration ago")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Older, "older", "", "List files modified before this RFC3339 timestamp or duration ago")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Perm, "perm", "", "Permission bits of files to list, like find -perm")
+	indexQueryCmd.Flags().StringVarP(&indexQueryOpts.Output, "output", "o", "paths", "Output format: paths or jsonl")
+	indexQueryCmd.Flags().StringVar(&indexQueryOpts.Printf, "printf", "", "Print files using a find -printf like format")
+}
@@ -0,0 +1,84 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// defaultRemoteVerifySample is the number of entries verified by default if the archive is remote
+const defaultRemoteVerifySample = 1000
+
+var indexVerifyOpts struct {
+	Sample  int
+	Content bool
+}
+
+// indexVerifyCmd represents the index verify command
+var indexVerifyCmd = &cobra.Command{
+	Use:   "verify <index> <tar|url>",
+	Short: "Checks that an index matches its tar archive",
+	Long: `Checks that an index matches its tar archive. Each entry has to be preceded by a
+tar header of the same name, type and size at the offset recorded in the index. With
+--content, the content of files is checked against the digests recorded using
+"index generate --content-digests" as well.
+
+The index may be a badger index directory or a compact or paged index file. Remote
+archives are read using range requests, hence only a random sample of entries is
+checked unless --sample says otherwise. Mismatches are printed and make the command
+exit with a non-zero status.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		index, archive := args[0], args[1]
+		stat, err := os.Stat(index)
+		if err != nil {
+			log.WithError(err).Fatal("cannot open index")
+		}
+		var db *badger.DB
+		if stat.IsDir() {
+			db, err = badger.Open(badger.DefaultOptions(index).WithReadOnly(true))
+		} else {
+			db, err = badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+			if err == nil {
+				err = readIndexFile(db, index)
+			}
+		}
+		if err != nil {
+			log.WithError(err).Fatal("cannot open index")
+		}
+		defer db.Close()
+
+		opts := idx.VerifyOptions{
+			Sample:  indexVerifyOpts.Sample,
+			Content: indexVerifyOpts.Content,
+		}
+		isURL := strings.HasPrefix(archive, "http://") || strings.HasPrefix(archive, "https://")
+		if isURL && !cmd.Flags().Changed("sample") {
+			opts.Sample = defaultRemoteVerifySample
+		}
+		res, err := idx.VerifyIndex(db, archive, opts)
+		if err != nil {
+			log.WithError(err).Fatal("cannot verify index")
+		}
+
+		for _, m := range res.Mismatches {
+			fmt.Printf("%s (offset %d): %s\n", m.Name, m.Offset, m.Reason)
+		}
+		fmt.Printf("checked %d of %d entries, %d mismatches\n", res.Checked, res.Entries, len(res.Mismatches))
+		if len(res.Mismatches) > 0 {
+			db.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	indexCmd.AddCommand(indexVerifyCmd)
+	indexVerifyCmd.Flags().IntVar(&indexVerifyOpts.Sample, "sample", 0, "Number of randomly chosen entries to check, 0 checks all - URLs default to 1000")
+	indexVerifyCmd.Flags().BoolVar(&indexVerifyOpts.Content, "content", false, "Check the content of files against the digests recorded in the index")
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// mountCARCmd represents the mountCAR command
+var mountCARCmd = &cobra.Command{
+	Use:   "car <url|path> <mountpoint>",
+	Short: "Mounts the UnixFS DAG of a CARv1 or CARv2 file, reading blocks lazily",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		t0 := time.Now()
+
+		fsIndex, err := idx.OpenCAR(args[0])
+		if err != nil {
+			log.WithError(err).Fatal("cannot open car file")
+		}
+
+		serve(fsIndex, args[1], t0, nil)
+	},
+}
+
+func init() {
+	mountCmd.AddCommand(mountCARCmd)
+}
@@ -5,14 +5,11 @@ package cmd
 
 import (
 	"context"
-	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/csweichel/wsfs/pkg/idx"
-	"github.com/csweichel/wsfs/pkg/wsfs"
-	"github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
@@ -27,6 +24,8 @@ var mountGithubCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(2),
 	Short: "Mounts a GitHub repo as filesystem. Use $GITHUB_TOKEN to pass in the token.",
 	Run: func(cmd *cobra.Command, args []string) {
+		t0 := time.Now()
+
 		token := os.Getenv("GITHUB_TOKEN")
 		if token == "" {
 			log.Fatal("missing $GITHUB_TOKEN environment variable")
@@ -43,25 +42,7 @@ var mountGithubCmd = &cobra.Command{
 			log.WithError(err).Fatal("cannot build GitHub index")
 		}
 
-		idxfs := wsfs.New(idx, wsfs.Options{
-			DefaultUID: mountOpts.DefaultUID,
-			DefaultGID: mountOpts.DefaultGID,
-		})
-
-		mnt := args[1]
-		os.Mkdir(mnt, 0755)
-		server, err := fs.Mount(mnt, idxfs, &fs.Options{
-			MountOptions: fuse.MountOptions{
-				Debug:      rootOpts.Verbose,
-				AllowOther: mountOpts.AllowOther,
-			},
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		fmt.Printf("to unmount: fusermount -u %s\n", mnt)
-		server.Wait()
+		serve(idx, args[1], t0, nil)
 	},
 }
 
@@ -0,0 +1,33 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// mountISOCmd represents the mountISO command
+var mountISOCmd = &cobra.Command{
+	Use:   "iso <url|path> <mountpoint>",
+	Short: "Mounts an ISO 9660 image, reading it lazily",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		t0 := time.Now()
+
+		fsIndex, err := idx.OpenISO9660(args[0])
+		if err != nil {
+			log.WithError(err).Fatal("cannot open iso image")
+		}
+
+		serve(fsIndex, args[1], t0, nil)
+	},
+}
+
+func init() {
+	mountCmd.AddCommand(mountISOCmd)
+}
@@ -0,0 +1,54 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"runtime"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var mountOCIOpts struct {
+	Ref      string
+	Platform string
+}
+
+// mountOCICmd represents the mountOCI command
+var mountOCICmd = &cobra.Command{
+	Use:   "oci <layout-dir|layout-url> <mountpoint>",
+	Short: "Mounts the merged root filesystem of an image in an OCI image layout",
+	Long: `Mounts the merged root filesystem of an image in an OCI image layout.
+
+Layers come without an index, hence the first mount reads through every layer once to index
+it. The indices are kept in the index cache, keyed by the digest of their layer, so that later
+mounts of images which share layers start right away.
+
+Layers compressed as a single gzip member can only be decompressed front to back. What's been
+decompressed is kept in a temporary file, so that reading files in any order doesn't decompress
+the layer over and over again.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		t0 := time.Now()
+
+		fsIndex, err := idx.OpenOCILayout(context.Background(), args[0], idx.OCIOptions{
+			Ref:      mountOCIOpts.Ref,
+			Platform: mountOCIOpts.Platform,
+		})
+		if err != nil {
+			log.WithError(err).Fatal("cannot open OCI image")
+		}
+
+		serve(fsIndex, args[1], t0, nil)
+	},
+}
+
+func init() {
+	mountCmd.AddCommand(mountOCICmd)
+	mountOCICmd.Flags().StringVar(&mountOCIOpts.Ref, "ref", "", "Select the image by its org.opencontainers.image.ref.name annotation")
+	mountOCICmd.Flags().StringVar(&mountOCIOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform images")
+}
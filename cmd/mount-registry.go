@@ -0,0 +1,56 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var mountRegistryOpts struct {
+	Platform  string
+	PlainHTTP bool
+}
+
+// mountRegistryCmd represents the mountRegistry command
+var mountRegistryCmd = &cobra.Command{
+	Use:   "registry <image-ref> <mountpoint>",
+	Short: "Mounts an image from an OCI distribution registry. Use $REGISTRY_USERNAME and $REGISTRY_PASSWORD to pass in credentials.",
+	Long: `Mounts an image from an OCI distribution registry. Use $REGISTRY_USERNAME and $REGISTRY_PASSWORD
+to pass in credentials.
+
+Registries serve layers without an index, hence the first mount downloads every layer in full
+once to index it. The indices are written to disk rather than kept in memory, and are kept in
+the index cache, keyed by the digest of their layer, so that later mounts of the image, or of
+other images sharing its layers, only resolve the manifests and read files through range
+requests.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		t0 := time.Now()
+
+		fsIndex, err := idx.OpenRegistryImage(context.Background(), args[0], idx.RegistryOptions{
+			Platform:  mountRegistryOpts.Platform,
+			Username:  os.Getenv("REGISTRY_USERNAME"),
+			Password:  os.Getenv("REGISTRY_PASSWORD"),
+			PlainHTTP: mountRegistryOpts.PlainHTTP,
+		})
+		if err != nil {
+			log.WithError(err).Fatal("cannot open image")
+		}
+
+		serve(fsIndex, args[1], t0, nil)
+	},
+}
+
+func init() {
+	mountCmd.AddCommand(mountRegistryCmd)
+	mountRegistryCmd.Flags().StringVar(&mountRegistryOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform images")
+	mountRegistryCmd.Flags().BoolVar(&mountRegistryOpts.PlainHTTP, "plain-http", false, "Talk to the registry without TLS")
+}
@@ -5,67 +5,38 @@ package cmd
 
 import (
 	"context"
-	"fmt"
-	"os"
 	"time"
 
 	"github.com/csweichel/wsfs/pkg/idx"
-	"github.com/csweichel/wsfs/pkg/wsfs"
-	"github.com/hanwen/go-fuse/v2/fs"
-	"github.com/hanwen/go-fuse/v2/fuse"
-	"github.com/sevlyar/go-daemon"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 // mountRemoteCmd represents the mountRemote command
 var mountRemoteCmd = &cobra.Command{
-	Use:  "remote <baseURL> <mountpoint>",
-	Args: cobra.ExactArgs(2),
+	Use:   "remote <baseURL> <mountpoint>",
+	Short: "Mounts <baseURL>.tar, using the index embedded in the archive or <baseURL>.index",
+	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		if daemon.WasReborn() {
-			// let's go
-		} else if mountOpts.Daemonise {
-			ctx := daemon.Context{
-				PidFileName: "/tmp/wsfs.pid",
-				LogFileName: "/tmp/wsfs.log",
-			}
-			d, err := ctx.Reborn()
-			if err != nil {
-				log.WithError(err).Fatal("cannot daemonise")
-			}
-			if d != nil {
-				return
-			}
-
-			log.Fatal("cannot daemonise")
+		if daemonise() {
+			return
 		}
 
 		t0 := time.Now()
 
-		fsIndex, err := idx.OpenRemoteTarIndex(context.Background(), args[0])
-		if err != nil {
-			log.WithError(err).Fatal("cannot open remote index")
-		}
-		indexedRoot := wsfs.New(fsIndex, wsfs.Options{
-			DefaultUID: mountOpts.DefaultUID,
-			DefaultGID: mountOpts.DefaultGID,
-		})
-
-		mnt := args[1]
-		os.Mkdir(mnt, 0755)
-		server, err := fs.Mount(mnt, indexedRoot, &fs.Options{
-			MountOptions: fuse.MountOptions{
-				Debug:      rootOpts.Verbose,
-				AllowOther: mountOpts.AllowOther,
+		src := &reloadableSource{
+			Open: func() (idx.Index, error) {
+				return idx.OpenRemoteTarIndex(context.Background(), args[0])
+			},
+			Version: func() (string, error) {
+				return idx.LocationVersion(args[0]+".tar", args[0]+".index")
 			},
-		})
+		}
+		fsIndex, err := src.open()
 		if err != nil {
-			log.Fatal(err)
+			log.WithError(err).Fatal("cannot open remote index")
 		}
-		fmt.Printf("mounted in %v\n", time.Since(t0))
-		fmt.Printf("to unmount: fusermount -u %s\n", mnt)
-		server.Wait()
+		serve(fsIndex, args[1], t0, src)
 	},
 }
 
@@ -0,0 +1,33 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// mountSquashfsCmd represents the mountSquashfs command
+var mountSquashfsCmd = &cobra.Command{
+	Use:   "squashfs <url|path> <mountpoint>",
+	Short: "Mounts a SquashFS image, reading it lazily",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		t0 := time.Now()
+
+		fsIndex, err := idx.OpenSquashfs(args[0])
+		if err != nil {
+			log.WithError(err).Fatal("cannot open squashfs image")
+		}
+
+		serve(fsIndex, args[1], t0, nil)
+	},
+}
+
+func init() {
+	mountCmd.AddCommand(mountSquashfsCmd)
+}
@@ -0,0 +1,33 @@
+/*
+Copyright © 2022 NAME HERE <EMAIL ADDRESS>
+*/
+package cmd
+
+import (
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// mountZipCmd represents the mountZip command
+var mountZipCmd = &cobra.Command{
+	Use:   "zip <url|path> <mountpoint>",
+	Short: "Mounts a zip archive (e.g. .zip or .jar) using its central directory",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		t0 := time.Now()
+
+		fsIndex, err := idx.OpenZip(args[0])
+		if err != nil {
+			log.WithError(err).Fatal("cannot open zip archive")
+		}
+
+		serve(fsIndex, args[1], t0, nil)
+	},
+}
+
+func init() {
+	mountCmd.AddCommand(mountZipCmd)
+}
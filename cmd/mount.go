@@ -4,6 +4,20 @@ Copyright © 2022 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/csweichel/wsfs/pkg/wsfs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/sevlyar/go-daemon"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
@@ -12,12 +26,198 @@ var mountOpts struct {
 	DefaultGID uint32
 	DefaultUID uint32
 	AllowOther bool
+	Reload     time.Duration
+
+	Index    string
+	Platform string
 }
 
 // mountCmd represents the mount command
 var mountCmd = &cobra.Command{
-	Use:  "mount",
-	Args: cobra.ExactArgs(1),
+	Use:   "mount <uri> <mountpoint>",
+	Short: "Mounts an archive, image or repository",
+	Long: `Mounts an archive, image or repository. The URI scheme selects the backend, e.g.
+
+  wsfs mount github://owner/repo?revision=main /mnt
+  wsfs mount oci://ghcr.io/owner/image:tag /mnt
+  wsfs mount oci-layout:///path/to/layout?ref=v1 /mnt
+
+For local paths, file://, http:// and https:// URIs the format is detected from the
+beginning of the file. Tar and cpio archives need an index, which by default lives next
+to the archive, e.g. foo.index for foo.tar.gz.
+
+Use $GITHUB_TOKEN to pass in a GitHub token, and $REGISTRY_USERNAME and $REGISTRY_PASSWORD
+to pass in registry credentials.
+
+Supported schemes: ` + strings.Join(idx.Schemes(), ", "),
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if daemonise() {
+			return
+		}
+
+		t0 := time.Now()
+
+		opts := idx.OpenOptions{
+			Index:    mountOpts.Index,
+			Platform: mountOpts.Platform,
+			Username: os.Getenv("REGISTRY_USERNAME"),
+			Password: os.Getenv("REGISTRY_PASSWORD"),
+			Token:    os.Getenv("GITHUB_TOKEN"),
+		}
+		src := &reloadableSource{
+			Open: func() (idx.Index, error) {
+				return idx.Open(context.Background(), args[0], opts)
+			},
+			Version: func() (string, error) {
+				return idx.SourceVersion(args[0], opts)
+			},
+		}
+		fsIndex, err := src.open()
+		if err != nil {
+			log.WithError(err).Fatal("cannot open source")
+		}
+
+		serve(fsIndex, args[1], t0, src)
+	},
+}
+
+// daemonise runs the mount in a background process if --daemonise is set. It returns true in
+// the process which started the background one, which has nothing left to do.
+func daemonise() bool {
+	if daemon.WasReborn() || !mountOpts.Daemonise {
+		return false
+	}
+
+	ctx := daemon.Context{
+		PidFileName: "/tmp/wsfs.pid",
+		LogFileName: "/tmp/wsfs.log",
+	}
+	d, err := ctx.Reborn()
+	if err != nil {
+		log.WithError(err).Fatal("cannot daemonise")
+	}
+	if d == nil {
+		log.Fatal("cannot daemonise")
+	}
+	return true
+}
+
+// reloadableSource is a source which serve can open again to swap in a new version
+type reloadableSource struct {
+	Open func() (idx.Index, error)
+	// Version identifies the version of the source, or returns an empty string if it can't tell
+	Version func() (string, error)
+
+	version string
+}
+
+// open opens the source and remembers its version. The version is determined first, so that a
+// change while the source is being opened is picked up by the next reload.
+func (s *reloadableSource) open() (idx.Index, error) {
+	version, err := s.Version()
+	if err != nil {
+		log.WithError(err).Warn("cannot determine version of source")
+		version = ""
+	}
+	index, err := s.Open()
+	if err != nil {
+		return nil, err
+	}
+	s.version = version
+	return index, nil
+}
+
+// changed returns true unless the version of the source is known and the same as when it was last opened
+func (s *reloadableSource) changed() bool {
+	if s.version == "" {
+		return true
+	}
+	version, err := s.Version()
+	if err != nil {
+		log.WithError(err).Warn("cannot determine version of source")
+		return true
+	}
+	return version != s.version
+}
+
+// serve mounts index at mnt and blocks until it's unmounted, either using fusermount or because
+// we received SIGINT or SIGTERM. The index is closed once the filesystem is unmounted.
+//
+// If src is not nil, the source is opened again on SIGHUP, and every --reload interval if it
+// changed, and the mounted index is swapped for the new one.
+func serve(index idx.Index, mnt string, t0 time.Time, src *reloadableSource) {
+	os.Mkdir(mnt, 0755)
+	server, err := wsfs.Mount(mnt, index, wsfs.Options{
+		DefaultUID: mountOpts.DefaultUID,
+		DefaultGID: mountOpts.DefaultGID,
+	}, fuse.MountOptions{
+		Debug:      rootOpts.Verbose,
+		AllowOther: mountOpts.AllowOther,
+	})
+	if err != nil {
+		log.WithError(err).Fatal("cannot mount")
+	}
+	fmt.Printf("mounted in %v\n", time.Since(t0))
+	fmt.Printf("to unmount: fusermount -u %s\n", mnt)
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+	go func() {
+		for range sigs {
+			err := server.Unmount()
+			if err != nil {
+				log.WithError(err).Warn("cannot unmount")
+			}
+		}
+	}()
+
+	if src != nil {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		defer signal.Stop(reload)
+
+		var tick <-chan time.Time
+		if mountOpts.Reload > 0 {
+			ticker := time.NewTicker(mountOpts.Reload)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-reload:
+				case <-tick:
+					if !src.changed() {
+						log.Debug("source is unchanged")
+						continue
+					}
+				}
+
+				index, err := src.open()
+				if err != nil {
+					log.WithError(err).Warn("cannot reload source")
+					continue
+				}
+				err = server.Swap(context.Background(), index)
+				if err != nil {
+					log.WithError(err).Warn("cannot swap index")
+					continue
+				}
+				log.Info("reloaded source")
+			}
+		}()
+	}
+
+	err = server.Wait()
+	if err != nil {
+		log.WithError(err).Warn("cannot close index")
+	}
 }
 
 func init() {
@@ -27,4 +227,8 @@ func init() {
 	mountCmd.PersistentFlags().BoolVar(&mountOpts.AllowOther, "allow-other", true, "Allow other processes to access the mount")
 	mountCmd.PersistentFlags().Uint32Var(&mountOpts.DefaultGID, "default-gid", 33333, "Default GID")
 	mountCmd.PersistentFlags().Uint32Var(&mountOpts.DefaultUID, "default-uid", 33333, "Default UID")
+	mountCmd.PersistentFlags().DurationVar(&mountOpts.Reload, "reload", 0, "Interval at which to reload the source and swap in a new version, if supported. SIGHUP reloads immediately.")
+
+	mountCmd.Flags().StringVar(&mountOpts.Index, "index", "", "Location of the index for archives which need one, e.g. tar files")
+	mountCmd.Flags().StringVar(&mountOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform OCI images")
 }
@@ -0,0 +1,125 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var packOpts struct {
+	ModTime      string
+	KeepOwner    bool
+	UID          int
+	GID          int
+	Format       string
+	ContentIndex bool
+}
+
+// packCmd represents the pack command
+var packCmd = &cobra.Command{
+	Use:   "pack <dir> <out-base>",
+	Short: "Packs a directory into <out-base>.tar and <out-base>.index, ready to be served",
+	Long: `Packs a directory into <out-base>.tar and <out-base>.index, ready to be served and
+mounted using "wsfs mount remote <baseURL>".
+
+The tar file is written and indexed in a single pass. Entries are sorted and access and
+change times are dropped, so that packing the same content produces the same tar file.
+Use --mtime to normalise modification times as well. Unless --keep-owner is set, all
+entries are owned by --uid and --gid.
+
+The index is written in the compact format by default. Use --format paged for very large
+trees, or --format archive for a gzip compressed archive of the index records. All formats
+are byte-for-byte reproducible as well. The content digest of the index is printed and
+stored in the index.
+
+With --content-index the trigrams of each file are written to <out-base>.trigrams as well,
+which lets "wsfs search" skip files that cannot match.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, outBase := args[0], args[1]
+		format := packOpts.Format
+		if format != indexFormatArchive && format != indexFormatCompact && format != indexFormatPaged {
+			log.WithField("format", format).Fatal("unsupported index format")
+		}
+
+		opts := idx.PackOptions{
+			KeepOwner: packOpts.KeepOwner,
+			UID:       packOpts.UID,
+			GID:       packOpts.GID,
+		}
+		if packOpts.ModTime != "" {
+			mtime, err := time.Parse(time.RFC3339, packOpts.ModTime)
+			if err != nil {
+				log.WithError(err).Fatal("invalid --mtime")
+			}
+			opts.ModTime = mtime
+		}
+		if packOpts.ContentIndex {
+			opts.ContentIndex = idx.NewContentIndexBuilder()
+		}
+
+		tmpdir, err := os.MkdirTemp("", "wsfs-pack-*")
+		if err != nil {
+			log.WithError(err).Fatal("cannot create temporary directory")
+		}
+		defer os.RemoveAll(tmpdir)
+		db, err := badger.Open(badger.DefaultOptions(tmpdir).WithLogger(nil))
+		if err != nil {
+			log.WithError(err).Fatal("cannot open database")
+		}
+
+		tarf, err := os.Create(outBase + ".tar")
+		if err != nil {
+			log.WithError(err).Fatal("cannot create tar file")
+		}
+		out := bufio.NewWriter(tarf)
+		var stopProgress func()
+		opts.Progress, stopProgress = reportIndexingProgress()
+		err = idx.Pack(dir, out, db, opts)
+		stopProgress()
+		if err == nil {
+			err = out.Flush()
+		}
+		if err == nil {
+			err = tarf.Close()
+		}
+		if err != nil {
+			log.WithError(err).Fatal("cannot pack directory")
+		}
+		digest, err := idx.StoreIndexDigest(db)
+		if err != nil {
+			log.WithError(err).Fatal("cannot compute index digest")
+		}
+		if opts.ContentIndex != nil {
+			err = writeContentIndexFile(opts.ContentIndex, outBase+".trigrams")
+			if err != nil {
+				log.WithError(err).Fatal("cannot write content index")
+			}
+		}
+
+		err = writeIndexFile(db, outBase+".index", format)
+		if err == nil {
+			err = db.Close()
+		}
+		if err != nil {
+			log.WithError(err).Fatal("cannot write index")
+		}
+		fmt.Println(digest)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(packCmd)
+	packCmd.Flags().StringVar(&packOpts.ModTime, "mtime", "", "Modification time of all entries (RFC 3339), e.g. 2022-01-01T00:00:00Z")
+	packCmd.Flags().BoolVar(&packOpts.KeepOwner, "keep-owner", false, "Keep the owner of files")
+	packCmd.Flags().IntVar(&packOpts.UID, "uid", 0, "Owner UID of all entries unless --keep-owner is set")
+	packCmd.Flags().IntVar(&packOpts.GID, "gid", 0, "Owner GID of all entries unless --keep-owner is set")
+	packCmd.Flags().BoolVar(&packOpts.ContentIndex, "content-index", false, "Write a content index of the trigrams of each file to <out-base>.trigrams, see wsfs search")
+	packCmd.Flags().StringVar(&packOpts.Format, "format", indexFormatCompact, "Index format: compact, paged or archive")
+}
@@ -5,13 +5,16 @@ package cmd
 
 import (
 	"os"
+	"path/filepath"
 
+	"github.com/csweichel/wsfs/pkg/idx"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var rootOpts struct {
-	Verbose bool
+	Verbose    bool
+	IndexCache string
 }
 
 // rootCmd represents the base command when called without any subcommands
@@ -28,6 +31,11 @@ to quickly create a Cobra application.`,
 		if rootOpts.Verbose {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+		if rootOpts.IndexCache == "" {
+			idx.DefaultIndexCache = nil
+		} else {
+			idx.DefaultIndexCache = idx.NewIndexCache(rootOpts.IndexCache)
+		}
 	},
 }
 
@@ -42,4 +50,10 @@ func Execute() {
 
 func init() {
 	rootCmd.PersistentFlags().BoolVarP(&rootOpts.Verbose, "verbose", "v", false, "Enable verbose/debug output")
+
+	var defaultIndexCache string
+	if dir, err := os.UserCacheDir(); err == nil {
+		defaultIndexCache = filepath.Join(dir, "wsfs", "index")
+	}
+	rootCmd.PersistentFlags().StringVar(&rootOpts.IndexCache, "index-cache", defaultIndexCache, "Directory in which downloaded indices are cached - empty disables the cache")
 }
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var searchOpts struct {
+	Index        string
+	Platform     string
+	ContentIndex string
+	IgnoreCase   bool
+	FilesOnly    bool
+}
+
+// searchCmd represents the search command
+var searchCmd = &cobra.Command{
+	Use:   "search <source> <regex>",
+	Short: "Searches the content of the files of a source for a regular expression, like grep -r",
+	Long: `Searches the content of the files of a source for a Go regular expression, and prints
+each matching line as path:line:text like "grep -rn" does. Files which contain a NUL byte
+are considered binary and skipped. If no line matches, the command exits with status 1.
+
+Sources are opened like "wsfs mount" opens them. Without a content index every file is
+read, which for a remote archive means fetching all of it. A content index, written by
+"index generate --content-index" or "pack --content-index", lists the trigrams of each
+file, so that only the files which can match are read, using range requests for remote
+archives. It is expected next to the index, e.g. foo.trigrams for foo.index, unless
+--content-index points elsewhere:
+
+  wsfs pack ./src release --content-index
+  wsfs search https://example.com/release.tar 'func \w+Index\('
+
+The content index has to be written along with the index it belongs to, as files which
+it doesn't list are never searched. "index append" updates both of them.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		pattern := args[1]
+		if searchOpts.IgnoreCase {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.WithError(err).Fatal("invalid regular expression")
+		}
+
+		ctx := context.Background()
+		opts := idx.OpenOptions{
+			Index:    searchOpts.Index,
+			Platform: searchOpts.Platform,
+			Username: os.Getenv("REGISTRY_USERNAME"),
+			Password: os.Getenv("REGISTRY_PASSWORD"),
+			Token:    os.Getenv("GITHUB_TOKEN"),
+		}
+		index, err := idx.Open(ctx, args[0], opts)
+		if err != nil {
+			log.WithError(err).Fatal("cannot open index")
+		}
+		defer index.Close()
+
+		var candidates []string
+		content, err := openSearchContentIndex(args[0], opts)
+		if err != nil {
+			log.WithError(err).Fatal("cannot open content index")
+		}
+		if content != nil {
+			candidates, err = content.Candidates(pattern)
+			content.Close()
+			if err != nil {
+				log.WithError(err).Fatal("cannot query content index")
+			}
+			log.WithField("candidates", len(candidates)).Debug("queried content index")
+		}
+
+		var (
+			out     = bufio.NewWriter(os.Stdout)
+			matches int
+			last    string
+		)
+		err = idx.Search(ctx, index, re, candidates, func(m idx.SearchMatch) error {
+			matches++
+			if searchOpts.FilesOnly {
+				if m.Path == last {
+					return nil
+				}
+				last = m.Path
+				_, err := fmt.Fprintln(out, m.Path)
+				return err
+			}
+			_, err := fmt.Fprintf(out, "%s:%d:%s\n", m.Path, m.Line, m.Text)
+			return err
+		})
+		if ferr := out.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			log.WithError(err).Fatal("cannot search")
+		}
+		if matches == 0 {
+			index.Close()
+			os.Exit(1)
+		}
+	},
+}
+
+// openSearchContentIndex opens the content index given by --content-index, or the one next to the
+// index of the source if there is one
+func openSearchContentIndex(source string, opts idx.OpenOptions) (*idx.ContentIndex, error) {
+	if searchOpts.ContentIndex != "" {
+		return idx.OpenContentIndexFile(searchOpts.ContentIndex)
+	}
+	loc, err := idx.DefaultContentIndexLocation(source, opts)
+	if err != nil || loc == "" {
+		return nil, err
+	}
+	res, err := idx.OpenContentIndexFile(loc)
+	if err != nil {
+		log.WithError(err).WithField("location", loc).Warn("no content index - reading all files")
+		return nil, nil
+	}
+	return res, nil
+}
+
+func init() {
+	rootCmd.AddCommand(searchCmd)
+	searchCmd.Flags().StringVar(&searchOpts.Index, "index", "", "Location of the index, if the source needs one")
+	searchCmd.Flags().StringVar(&searchOpts.Platform, "platform", runtime.GOOS+"/"+runtime.GOARCH, "Platform to select from multi-platform OCI images")
+	searchCmd.Flags().StringVar(&searchOpts.ContentIndex, "content-index", "", "Location of the content index, if it's not next to the index")
+	searchCmd.Flags().BoolVarP(&searchOpts.IgnoreCase, "ignore-case", "i", false, "Ignore case distinctions")
+	searchCmd.Flags().BoolVarP(&searchOpts.FilesOnly, "files-with-matches", "l", false, "Print the paths of matching files only")
+}
@@ -8,15 +8,7 @@ prepare_demo_content() {
     pushd /workspace/wsfs-demo
 
     git clone https://github.com/gitpod-io/gitpod /tmp/gitpod
-    cd /tmp/gitpod
-    tar cf /workspace/wsfs-demo/remote/gitpod.tar .
-    cd ..
-
-    wsfs index generate index /workspace/wsfs-demo/remote/gitpod.tar
-    cd index
-    tar cfz /workspace/wsfs-demo/remote/gitpod.index .
-    cd ..
-    rm -rf index
+    wsfs pack /tmp/gitpod /workspace/wsfs-demo/remote/gitpod
     popd
 
     echo -e "\n\e[1;32mPrepared demo content in /workspace/wsfs-demo/remote:\e[0m"
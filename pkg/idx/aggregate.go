@@ -0,0 +1,166 @@
+package idx
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// DirAggregate holds the totals of a directory and everything below it, so that the size of a
+// subtree is known without walking it
+type DirAggregate struct {
+	// Size is the sum of the sizes of all files below the directory
+	Size uint64 `json:"size"`
+	// Files is the number of entries below the directory which aren't directories
+	Files uint64 `json:"files"`
+	// Mtime is the latest modification time of the directory and everything below it
+	Mtime time.Time `json:"mtime"`
+}
+
+// add accounts for an entry below the directory
+func (a *DirAggregate) add(dir bool, size uint64, mtime time.Time) {
+	if !dir {
+		a.Size += size
+		a.Files++
+	}
+	if mtime.After(a.Mtime) {
+		a.Mtime = mtime
+	}
+}
+
+// dirAggregates computes the aggregates of all directories of an index, including the root directory ""
+func dirAggregates(entries []indexEntry) map[string]*DirAggregate {
+	res := map[string]*DirAggregate{"": {}}
+	for _, e := range entries {
+		addToDirAggregates(res, e.TarHeader)
+	}
+	return res
+}
+
+// addToDirAggregates accounts for an entry in the aggregates of its directories
+func addToDirAggregates(aggregates map[string]*DirAggregate, h *tar.Header) {
+	get := func(p string) *DirAggregate {
+		a, ok := aggregates[p]
+		if !ok {
+			a = &DirAggregate{}
+			aggregates[p] = a
+		}
+		return a
+	}
+	dir := h.Typeflag == tar.TypeDir
+	if dir {
+		get(h.Name).add(true, 0, h.ModTime)
+	}
+	for p := h.Name; p != ""; {
+		p, _ = compactSplitPath(p)
+		get(p).add(dir, uint64(h.Size), h.ModTime)
+	}
+}
+
+// storeDirAggregates computes the aggregates of all directories of a badger index and stores them
+// with the directory entries
+func storeDirAggregates(db *badger.DB) error {
+	var (
+		aggregates = map[string]*DirAggregate{"": {}}
+		dirs       = make(map[string]indexEntry)
+	)
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := string(item.Key())
+			if k == "" || strings.HasPrefix(k, metaKeyPrefix) {
+				continue
+			}
+			var e indexEntry
+			err := item.Value(func(val []byte) error {
+				return json.Unmarshal(val, &e)
+			})
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal entry %s: %w", k, err)
+			}
+			e.TarHeader.Name = k
+			addToDirAggregates(aggregates, e.TarHeader)
+			if e.TarHeader.Typeflag == tar.TypeDir {
+				dirs[k] = e
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for name, e := range dirs {
+		e.Aggregate = aggregates[name]
+		val, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		err = wb.Set([]byte(name), val)
+		if err != nil {
+			return fmt.Errorf("cannot store aggregate of %s: %w", name, err)
+		}
+	}
+	return wb.Flush()
+}
+
+// RootAggregate computes the aggregate of the root directory of an index from its root entries.
+// It returns nil if the index doesn't record the aggregates of its directories.
+func RootAggregate(ctx context.Context, index Index) (*DirAggregate, error) {
+	entries, err := index.RootEntries(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res := &DirAggregate{}
+	for _, e := range entries {
+		info, err := entryInfo(e)
+		if err != nil {
+			return nil, err
+		}
+		if !e.Dir() {
+			res.add(false, info.Size, info.Mtime)
+			continue
+		}
+		ae, ok := e.(AggregateEntry)
+		if !ok {
+			return nil, nil
+		}
+		a, err := ae.Aggregate()
+		if err != nil || a == nil {
+			return nil, err
+		}
+		res.Size += a.Size
+		res.Files += a.Files
+		res.add(true, 0, a.Mtime)
+	}
+	return res, nil
+}
+
+// compactAggregateSize is the size of an aggregate in compact and paged indices: the size, the
+// number of files and the modification time in seconds
+const compactAggregateSize = 24
+
+func putCompactAggregate(rec []byte, a *DirAggregate) {
+	binary.LittleEndian.PutUint64(rec[0:], a.Size)
+	binary.LittleEndian.PutUint64(rec[8:], a.Files)
+	binary.LittleEndian.PutUint64(rec[16:], uint64(a.Mtime.Unix()))
+}
+
+func compactAggregate(rec []byte) *DirAggregate {
+	return &DirAggregate{
+		Size:  binary.LittleEndian.Uint64(rec[0:]),
+		Files: binary.LittleEndian.Uint64(rec[8:]),
+		Mtime: time.Unix(int64(binary.LittleEndian.Uint64(rec[16:])), 0),
+	}
+}
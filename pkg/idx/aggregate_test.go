@@ -0,0 +1,155 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDirAggregates(t *testing.T) {
+	mtime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "a/"},
+		{Typeflag: tar.TypeReg, Name: "a/one", Size: 1},
+		{Typeflag: tar.TypeDir, Name: "a/b/", ModTime: mtime.Add(time.Hour)},
+		{Typeflag: tar.TypeReg, Name: "a/b/ten", Size: 10},
+		{Typeflag: tar.TypeSymlink, Name: "a/b/link", Linkname: "ten"},
+		{Typeflag: tar.TypeDir, Name: "a/empty/"},
+		{Typeflag: tar.TypeReg, Name: "a/b/hundred", Size: 100, ModTime: mtime.Add(2 * time.Hour)},
+		{Typeflag: tar.TypeReg, Name: "top", Size: 1000},
+		{Typeflag: tar.TypeReg, Name: "a/one", Size: 2},
+	} {
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = mtime
+		}
+		hdr.Mode = 0644
+		tarw.WriteHeader(hdr)
+		tarw.Write(make([]byte, hdr.Size))
+	}
+	tarw.Close()
+	archive := buf.Bytes()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = idx.ProduceIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := bytes.NewBuffer(nil)
+	err = idx.WriteCompactIndex(db, compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	paged := bytes.NewBuffer(nil)
+	err = idx.WritePagedIndex(db, paged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// compact indices written before aggregates were introduced have no aggregate table
+	legacy := append([]byte(nil), compact.Bytes()...)
+	binary.LittleEndian.PutUint64(legacy[72:], 0)
+
+	aggregate := func(size, files uint64, mtime time.Time) string {
+		return fmt.Sprintf("%d bytes in %d files, %s", size, files, mtime.UTC().Format(time.RFC3339))
+	}
+	expectation := map[string]string{
+		"":        aggregate(1112, 5, mtime.Add(2*time.Hour)),
+		"a":       aggregate(112, 4, mtime.Add(2*time.Hour)),
+		"a/b":     aggregate(110, 3, mtime.Add(2*time.Hour)),
+		"a/empty": aggregate(0, 0, mtime),
+	}
+
+	tests := []struct {
+		Name  string
+		Open  func() (idx.Index, error)
+		NoAgg bool
+	}{
+		{Name: "badger", Open: func() (idx.Index, error) { return idx.OpenTarIndex(db, bytes.NewReader(archive)) }},
+		{Name: "compact", Open: func() (idx.Index, error) {
+			return idx.OpenCompactIndex(bytes.NewReader(compact.Bytes()), int64(compact.Len()), bytes.NewReader(archive))
+		}},
+		{Name: "paged", Open: func() (idx.Index, error) {
+			return idx.OpenPagedIndex(bytes.NewReader(paged.Bytes()), int64(paged.Len()), bytes.NewReader(archive))
+		}},
+		{Name: "compact without aggregates", NoAgg: true, Open: func() (idx.Index, error) {
+			return idx.OpenCompactIndex(bytes.NewReader(legacy), int64(len(legacy)), bytes.NewReader(archive))
+		}},
+		{Name: "converted from compact without aggregates", Open: func() (idx.Index, error) {
+			converted, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+			if err != nil {
+				return nil, err
+			}
+			t.Cleanup(func() { converted.Close() })
+			err = idx.ReadCompactIndex(bytes.NewReader(legacy), int64(len(legacy)), converted)
+			if err != nil {
+				return nil, err
+			}
+			return idx.OpenTarIndex(converted, bytes.NewReader(archive))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index, err := test.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			act := make(map[string]string)
+			err = idx.QueryIndex(context.Background(), index, idx.Query{Types: "d", MaxSize: -1}, func(p string, info *idx.EntryInfo) error {
+				if info.Aggregate != nil {
+					act[p] = aggregate(info.Aggregate.Size, info.Aggregate.Files, info.Aggregate.Mtime)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			root, err := idx.RootAggregate(context.Background(), index)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if root != nil {
+				act[""] = aggregate(root.Size, root.Files, root.Mtime)
+			}
+
+			exp := expectation
+			if test.NoAgg {
+				exp = map[string]string{}
+			}
+			if diff := cmp.Diff(exp, act); diff != "" {
+				t.Errorf("aggregates mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("query directories by size", func(t *testing.T) {
+		index, err := idx.OpenCompactIndex(bytes.NewReader(compact.Bytes()), int64(compact.Len()), bytes.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var act []string
+		err = idx.QueryIndex(context.Background(), index, idx.Query{Types: "d", MinSize: 111, MaxSize: -1}, func(p string, info *idx.EntryInfo) error {
+			act = append(act, p)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]string{"a"}, act); diff != "" {
+			t.Errorf("QueryIndex() mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package idx
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// indexArchiveRecords is the name of the tar entry of an index archive which holds the records
+// of the index: the uvarint length prefixed key and value of each record, in key order.
+// Older index archives hold the files of the badger database directory instead.
+const indexArchiveRecords = "wsfs-index.records"
+
+// maxIndexRecordSize limits the size of the keys and values read from an index archive
+const maxIndexRecordSize = 64 << 20
+
+// WriteIndexArchive writes an index as gzip compressed tar file, the form in which indices are
+// served next to the archive. The archive holds the records of the index rather than the files
+// of its database, so that it's byte-for-byte reproducible.
+func WriteIndexArchive(db *badger.DB, out io.Writer) error {
+	var size int64
+	err := iterateIndexRecords(db, func(k, v []byte) error {
+		size += int64(uvarintLen(uint64(len(k))) + len(k) + uvarintLen(uint64(len(v))) + len(v))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	gzw := gzip.NewWriter(out)
+	tarw := tar.NewWriter(gzw)
+	err = tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: indexArchiveRecords, Mode: 0644, Size: size, ModTime: time.Unix(0, 0), Format: tar.FormatUSTAR})
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(tarw)
+	var buf []byte
+	err = iterateIndexRecords(db, func(k, v []byte) error {
+		buf = binary.AppendUvarint(buf[:0], uint64(len(k)))
+		buf = append(buf, k...)
+		buf = binary.AppendUvarint(buf, uint64(len(v)))
+		buf = append(buf, v...)
+		_, err := bw.Write(buf)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = bw.Flush()
+	if err != nil {
+		return err
+	}
+	err = tarw.Close()
+	if err != nil {
+		return err
+	}
+	return gzw.Close()
+}
+
+// iterateIndexRecords calls fn for each record of an index in key order
+func iterateIndexRecords(db *badger.DB, fn func(k, v []byte) error) error {
+	return db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				return fn(item.Key(), val)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// loadIndexArchiveRecords turns the records extracted from an index archive to dir into a badger
+// database in dir. Older archives which hold the database files already are left as they are.
+func loadIndexArchiveRecords(dir string) error {
+	fn := filepath.Join(dir, indexArchiveRecords)
+	f, err := os.Open(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		return err
+	}
+	wb := db.NewWriteBatch()
+	r := bufio.NewReader(f)
+	readField := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(maxIndexRecordSize) {
+			return nil, fmt.Errorf("index record is too large")
+		}
+		res := make([]byte, n)
+		_, err = io.ReadFull(r, res)
+		return res, err
+	}
+	for {
+		var k, v []byte
+		k, err = readField()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err == nil {
+			v, err = readField()
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			err = wb.Set(k, v)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = wb.Flush()
+	} else {
+		wb.Cancel()
+	}
+	err = firstError(err, db.Close())
+	if err != nil {
+		return fmt.Errorf("cannot load index archive: %w", err)
+	}
+	f.Close()
+	return os.Remove(fn)
+}
@@ -0,0 +1,227 @@
+package idx
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sniffSize is the number of bytes read from the beginning of a file to detect its format.
+// It's large enough to cover the first volume descriptor of ISO 9660 images.
+const sniffSize = 64 << 10
+
+// Backend makes an Index implementation available through Open
+type Backend struct {
+	// Name identifies the backend, e.g. in error messages
+	Name string
+
+	// Schemes are the URI schemes handled by this backend, e.g. github
+	Schemes []string
+
+	// Detect is called for sources whose scheme does not identify the backend, i.e. local paths,
+	// file, http and https URIs. header holds the beginning of the file, or nil if the
+	// source is a local directory.
+	Detect func(src *url.URL, header []byte) bool
+
+	// Open produces the index for the source
+	Open func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error)
+}
+
+// OpenOptions configure backends opened using Open. Backends ignore options they have no use for.
+type OpenOptions struct {
+	// Index is the location of a separately stored index, e.g. for tar files
+	Index string
+	// Platform selects the image of a multi-platform OCI image, e.g. linux/amd64
+	Platform string
+	// Username and Password authenticate with OCI registries
+	Username string
+	Password string
+	// Token authenticates with the GitHub API
+	Token string
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   []Backend
+)
+
+// RegisterBackend makes a backend available to Open. Backends whose format is detected by
+// sniffing are consulted in the order they were registered.
+// RegisterBackend panics if one of the schemes is already registered.
+func RegisterBackend(b Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if b.Open == nil {
+		panic(fmt.Sprintf("backend %s has no Open function", b.Name))
+	}
+	for _, other := range backends {
+		for _, s := range b.Schemes {
+			for _, o := range other.Schemes {
+				if s == o {
+					panic(fmt.Sprintf("scheme %s is already registered by %s", s, other.Name))
+				}
+			}
+		}
+	}
+	backends = append(backends, b)
+}
+
+// Backends lists all registered backends
+func Backends() []Backend {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	res := make([]Backend, len(backends))
+	copy(res, backends)
+	return res
+}
+
+// Schemes lists the URI schemes of all registered backends
+func Schemes() []string {
+	res := []string{"file", "http", "https"}
+	for _, b := range Backends() {
+		res = append(res, b.Schemes...)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Open produces an index for the source using a registered backend. Sources are either local paths
+// or URIs. The scheme of the URI selects the backend. For local paths, file, http and https URIs the
+// format is detected from the first bytes of the file, which are fetched using a range request
+// for remote files.
+func Open(ctx context.Context, source string, opts OpenOptions) (Index, error) {
+	src, err := ParseSource(source)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := selectBackend(src)
+	if err != nil {
+		return nil, err
+	}
+	res, err := b.Open(ctx, src, opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s using the %s backend: %w", source, b.Name, err)
+	}
+	return res, nil
+}
+
+// SourceVersion identifies the version of file-like sources and their index, see LocationVersion,
+// so that a source is only opened again once it changed. It returns an empty string for sources
+// whose version it can't tell.
+func SourceVersion(source string, opts OpenOptions) (string, error) {
+	src, err := ParseSource(source)
+	if err != nil {
+		return "", err
+	}
+	switch src.Scheme {
+	case "file", "http", "https":
+	default:
+		return "", nil
+	}
+	index := opts.Index
+	if index == "" {
+		idxURL := *src
+		idxURL.Path, idxURL.RawPath = defaultIndexPath(src.Path), ""
+		index = sourceLocation(&idxURL)
+	}
+	return LocationVersion(sourceLocation(src), index)
+}
+
+// ParseSource turns a local path or URI into a URI. Local paths become absolute file URIs.
+// URIs which don't parse as URLs, e.g. oci://ubuntu:22.04 whose tag looks like an invalid port,
+// keep everything following the scheme in Opaque.
+func ParseSource(source string) (*url.URL, error) {
+	scheme, rest, ok := strings.Cut(source, "://")
+	if !ok {
+		abs, err := filepath.Abs(source)
+		if err != nil {
+			return nil, err
+		}
+		return &url.URL{Scheme: "file", Path: abs}, nil
+	}
+
+	res, err := url.Parse(source)
+	if err != nil {
+		switch scheme {
+		case "file", "http", "https":
+			return nil, err
+		}
+		return &url.URL{Scheme: scheme, Opaque: rest}, nil
+	}
+	return res, nil
+}
+
+// sourceLocation returns the path or URL of file-like sources in the form openLocation expects
+func sourceLocation(src *url.URL) string {
+	if src.Scheme == "file" {
+		return src.Path
+	}
+	return src.String()
+}
+
+func selectBackend(src *url.URL) (Backend, error) {
+	all := Backends()
+	for _, b := range all {
+		for _, s := range b.Schemes {
+			if s == src.Scheme {
+				return b, nil
+			}
+		}
+	}
+	switch src.Scheme {
+	case "file", "http", "https":
+	default:
+		return Backend{}, fmt.Errorf("unsupported scheme %s - supported schemes are: %s", src.Scheme, strings.Join(Schemes(), ", "))
+	}
+
+	header, err := sniff(src)
+	if err != nil {
+		return Backend{}, fmt.Errorf("cannot detect format of %s: %w", src, err)
+	}
+	for _, b := range all {
+		if b.Detect != nil && b.Detect(src, header) {
+			return b, nil
+		}
+	}
+	return Backend{}, fmt.Errorf("cannot detect format of %s", src)
+}
+
+// sniff reads the beginning of a file-like source
+func sniff(src *url.URL) ([]byte, error) {
+	if src.Scheme == "file" {
+		stat, err := os.Stat(src.Path)
+		if err != nil {
+			return nil, err
+		}
+		if stat.IsDir() {
+			return nil, nil
+		}
+	}
+
+	r, size, err := openLocation(sourceLocation(src))
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	if size > sniffSize {
+		size = sniffSize
+	}
+	res := make([]byte, size)
+	n, err := r.ReadAt(res, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	return res[:n], nil
+}
@@ -0,0 +1,148 @@
+package idx_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func init() {
+	idx.RegisterBackend(idx.Backend{
+		Name:    "test",
+		Schemes: []string{"test"},
+		Open: func(ctx context.Context, src *url.URL, opts idx.OpenOptions) (idx.Index, error) {
+			// serves a single empty file named after the host
+			buf := bytes.NewBuffer(nil)
+			zw := zip.NewWriter(buf)
+			_, err := zw.Create(src.Host)
+			if err != nil {
+				return nil, err
+			}
+			err = zw.Close()
+			if err != nil {
+				return nil, err
+			}
+			return idx.NewZipIndex(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		},
+	})
+}
+
+func TestOpen(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		fn := filepath.Join(dir, name)
+		err := os.WriteFile(fn, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+
+	hello := strings.Repeat("hello ", 1000)
+	squashfs := write("image.sqfs", buildSquashfs(t, hello, "tiny"))
+	iso := write("image.iso", buildISO(t, hello[:3000], "tiny", false, false))
+	carBuilder, carRoot := buildCAR(hello)
+	car, _ := carBuilder.carV1(carRoot)
+	carFile := write("data.car", car)
+
+	cpio := write("initrd.cpio.gz", gzipMembers(t, buildCpio(t,
+		cpioFile{Name: "init", Mode: 0100755, Ino: 1, Content: "#!/bin/sh"},
+	)))
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(dir, "initrd.index")).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := os.Open(cpio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.ProduceIndex(db, in)
+	in.Close()
+	// the same index as archive, as written by pack --format archive
+	indexArchive := bytes.NewBuffer(nil)
+	if err == nil {
+		err = idx.WriteIndexArchive(db, indexArchive)
+	}
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpioContent, err := os.ReadFile(cpio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivedCpio := write("archived.cpio.gz", cpioContent)
+	write("archived.index", indexArchive.Bytes())
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	tests := []struct {
+		Name        string
+		Source      string
+		Expectation []string
+		Err         string
+	}{
+		{Name: "squashfs path", Source: squashfs, Expectation: []string{"dir/", "dir/link->../hello.txt", "dir/small:tiny", "hello.txt:" + hello}},
+		{Name: "squashfs http", Source: srv.URL + "/image.sqfs", Expectation: []string{"dir/", "dir/link->../hello.txt", "dir/small:tiny", "hello.txt:" + hello}},
+		{Name: "iso file", Source: "file://" + iso, Expectation: []string{"dir/", "dir/small:tiny", "hello.txt:" + hello[:3000]}},
+		{Name: "car", Source: carFile, Expectation: []string{"hello.txt:" + hello, "link->hello.txt", "shard/", "shard/deep:deep", "shard/small:tiny"}},
+		{Name: "cpio with index", Source: cpio, Expectation: []string{"init:#!/bin/sh"}},
+		{Name: "cpio with index archive", Source: archivedCpio, Expectation: []string{"init:#!/bin/sh"}},
+		{Name: "registered scheme", Source: "test://foobar", Expectation: []string{"foobar:"}},
+		{Name: "unknown format", Source: write("unknown", []byte("foobar")), Err: "cannot detect format of file://" + dir + "/unknown"},
+		{Name: "unsupported scheme", Source: "ftp://example.com/foo.tar", Err: "unsupported scheme ftp - supported schemes are: " + strings.Join(idx.Schemes(), ", ")},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index, err := idx.Open(context.Background(), test.Source, idx.OpenOptions{})
+			if err != nil {
+				if diff := cmp.Diff(test.Err, err.Error()); diff != "" {
+					t.Errorf("Open() error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+			if test.Err != "" {
+				t.Fatalf("expected error %q", test.Err)
+			}
+
+			if diff := cmp.Diff(test.Expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("Open() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		Source      string
+		Expectation string
+	}{
+		{Source: "/tmp/foo.tar", Expectation: "file:///tmp/foo.tar"},
+		{Source: "https://example.com/foo.tar?sig=abc", Expectation: "https://example.com/foo.tar?sig=abc"},
+		{Source: "github://csweichel/wsfs?revision=main", Expectation: "github://csweichel/wsfs?revision=main"},
+		{Source: "oci://ubuntu:22.04", Expectation: "oci:ubuntu:22.04"},
+	}
+	for _, test := range tests {
+		t.Run(test.Source, func(t *testing.T) {
+			act, err := idx.ParseSource(test.Source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Expectation, act.String()); diff != "" {
+				t.Errorf("ParseSource() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
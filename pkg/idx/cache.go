@@ -0,0 +1,465 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// IndexCache keeps downloaded indices, keyed by their URL. Cached indices are revalidated
+// using a conditional GET, so that an unchanged index costs a single round trip.
+type IndexCache struct {
+	// Dir is the directory in which the cache lives
+	Dir string
+	// MaxAge is how long an index is kept after it was last used
+	MaxAge time.Duration
+}
+
+// DefaultIndexCache is used when downloading indices and indexing OCI layers. If nil, which is
+// the default, indices are downloaded into a temporary directory every time.
+var DefaultIndexCache *IndexCache
+
+const (
+	// indexCacheMetaFile holds the indexCacheMeta of a cache entry
+	indexCacheMetaFile = "meta.json"
+	// indexCacheVersionPrefix starts the names of the directories which hold the extracted versions
+	// of an index within a cache entry. Each download gets a new one, so that versions which are
+	// still in use are kept until they're released.
+	indexCacheVersionPrefix = "db-"
+	// indexCacheTmpPrefix starts the names of versions which are still being extracted
+	indexCacheTmpPrefix = "db.tmp-"
+	// indexCacheTmpMaxAge is the age after which left-over temporary directories are removed
+	indexCacheTmpMaxAge = time.Hour
+	// indexCacheBlobsDir holds the compact indices of content addressed blobs, e.g. OCI layers
+	indexCacheBlobsDir = "blobs"
+	// indexCacheTouchInterval is how often LastUsed is updated while a cached index is in use
+	indexCacheTouchInterval = time.Hour
+)
+
+// errNotIndexArchive is returned by IndexCache.Open if the index isn't a gzip compressed tar file of
+// an index database, e.g. because it's been replaced by a compact index
+var errNotIndexArchive = errors.New("index is not an index archive")
+
+type indexCacheMeta struct {
+	URL          string
+	ETag         string
+	LastModified string
+	LastUsed     time.Time
+	// Version is the directory within the entry which holds the current version of the index
+	Version string
+}
+
+// NewIndexCache returns a cache in dir, which keeps indices for 30 days after they were last used
+func NewIndexCache(dir string) *IndexCache {
+	return &IndexCache{
+		Dir:    dir,
+		MaxAge: 30 * 24 * time.Hour,
+	}
+}
+
+// CachedIndex is an index opened from the cache. Its version of the index is kept until it's released,
+// even if the cache downloads a newer version meanwhile.
+type CachedIndex struct {
+	DB *badger.DB
+
+	cache *IndexCache
+	entry string
+	lock  io.Closer
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// Release marks the version of the index as no longer in use, and removes it if it's been superseded.
+// It doesn't close DB.
+func (ci *CachedIndex) Release() error {
+	var err error
+	ci.once.Do(func() {
+		close(ci.stop)
+		err = ci.lock.Close()
+		if err != nil {
+			return
+		}
+		err = ci.cache.gcEntry(ci.entry, time.Now())
+	})
+	return err
+}
+
+// touch updates LastUsed of the cache entry until the index is released, so that GC doesn't remove it
+func (ci *CachedIndex) touch() {
+	t := time.NewTicker(indexCacheTouchInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ci.stop:
+			return
+		case <-t.C:
+		}
+		meta, err := readIndexCacheMeta(ci.entry)
+		if err != nil || meta == nil {
+			continue
+		}
+		meta.LastUsed = time.Now()
+		err = writeIndexCacheMeta(ci.entry, meta)
+		if err != nil {
+			log.WithError(err).WithField("entry", ci.entry).Warn("cannot update index cache entry")
+		}
+	}
+}
+
+// Open returns the index at url, downloading and extracting it unless the cached copy is still valid.
+// The caller has to release the index once it closed its database.
+func (c *IndexCache) Open(ctx context.Context, client *http.Client, url string) (*CachedIndex, error) {
+	entry := c.entry(url)
+	err := os.MkdirAll(entry, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := readIndexCacheMeta(entry)
+	if err != nil {
+		log.WithError(err).WithField("url", url).Warn("ignoring invalid index cache entry")
+		meta = nil
+	}
+	if meta != nil && (meta.URL != url || meta.Version == "") {
+		meta = nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil && meta.ETag != "" {
+		req.Header.Set("If-None-Match", meta.ETag)
+	}
+	if meta != nil && meta.LastModified != "" {
+		req.Header.Set("If-Modified-Since", meta.LastModified)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot download index: %w", err)
+	}
+	defer res.Body.Close()
+
+	var lock io.Closer
+	switch {
+	case res.StatusCode == http.StatusNotModified && meta != nil:
+		log.WithField("url", url).Debug("using cached index")
+		lock, err = lockDir(filepath.Join(entry, meta.Version))
+		if err != nil {
+			return nil, fmt.Errorf("cannot use cached index: %w", err)
+		}
+		meta.LastUsed = time.Now()
+		err = writeIndexCacheMeta(entry, meta)
+		if err != nil {
+			lock.Close()
+			return nil, err
+		}
+	case res.StatusCode == http.StatusOK:
+		body := bufio.NewReader(res.Body)
+		magic, _ := body.Peek(2)
+		if !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+			// forget the archive we might have cached before
+			os.Remove(filepath.Join(entry, indexCacheMetaFile))
+			return nil, errNotIndexArchive
+		}
+
+		tmpdir, err := os.MkdirTemp(entry, indexCacheTmpPrefix+"*")
+		if err != nil {
+			return nil, err
+		}
+		// the lock is held from the start, so that GC doesn't remove the version before it's in use
+		lock, err = lockDir(tmpdir)
+		if err != nil {
+			os.RemoveAll(tmpdir)
+			return nil, err
+		}
+		err = extractIndexArchive(body, tmpdir)
+		if err != nil {
+			lock.Close()
+			os.RemoveAll(tmpdir)
+			return nil, err
+		}
+		version := indexCacheVersionPrefix + strings.TrimPrefix(filepath.Base(tmpdir), indexCacheTmpPrefix)
+		err = os.Rename(tmpdir, filepath.Join(entry, version))
+		if err != nil {
+			lock.Close()
+			os.RemoveAll(tmpdir)
+			return nil, err
+		}
+		meta = &indexCacheMeta{
+			URL:          url,
+			ETag:         res.Header.Get("ETag"),
+			LastModified: res.Header.Get("Last-Modified"),
+			LastUsed:     time.Now(),
+			Version:      version,
+		}
+		err = writeIndexCacheMeta(entry, meta)
+		if err != nil {
+			lock.Close()
+			os.RemoveAll(filepath.Join(entry, version))
+			return nil, err
+		}
+		log.WithField("url", url).WithField("etag", meta.ETag).Debug("downloaded index")
+	default:
+		return nil, fmt.Errorf("cannot download index: %s", res.Status)
+	}
+
+	err = c.GC()
+	if err != nil {
+		log.WithError(err).Warn("cannot garbage collect index cache")
+	}
+
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(entry, meta.Version)).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	ci := &CachedIndex{
+		DB:    db,
+		cache: c,
+		entry: entry,
+		lock:  lock,
+		stop:  make(chan struct{}),
+	}
+	go ci.touch()
+	return ci, nil
+}
+
+// has returns true if the cache holds a copy of the index archive at url, regardless of whether it's
+// up to date and whether url still serves an index archive
+func (c *IndexCache) has(url string) bool {
+	meta, err := readIndexCacheMeta(c.entry(url))
+	return err == nil && meta != nil && meta.URL == url
+}
+
+func (c *IndexCache) entry(url string) string {
+	key := sha256.Sum256([]byte(url))
+	return filepath.Join(c.Dir, hex.EncodeToString(key[:]))
+}
+
+// GC removes indices which were not used for MaxAge, superseded versions of indices which are no
+// longer in use, and left-over temporary directories
+func (c *IndexCache) GC() error {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if e.Name() == indexCacheBlobsDir {
+			err = c.gcBlobIndices(now)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = c.gcEntry(filepath.Join(c.Dir, e.Name()), now)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gcEntry removes the versions of a cache entry which are neither current nor in use, and the entire
+// entry once it wasn't used for MaxAge
+func (c *IndexCache) gcEntry(entry string, now time.Time) error {
+	var current string
+	meta, err := readIndexCacheMeta(entry)
+	if err == nil && meta != nil {
+		current = meta.Version
+	}
+	stale := meta == nil || (c.MaxAge > 0 && now.Sub(meta.LastUsed) >= c.MaxAge)
+
+	versions, err := os.ReadDir(entry)
+	if err != nil {
+		return err
+	}
+	var inUse bool
+	for _, v := range versions {
+		if !v.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(v.Name(), indexCacheTmpPrefix) {
+			fi, err := v.Info()
+			if err != nil || now.Sub(fi.ModTime()) < indexCacheTmpMaxAge {
+				inUse = true
+				continue
+			}
+		} else if v.Name() == current && !stale {
+			continue
+		}
+
+		fn := filepath.Join(entry, v.Name())
+		removed, err := removeDirUnlessLocked(fn)
+		if err != nil {
+			return err
+		}
+		if !removed {
+			inUse = true
+			continue
+		}
+		log.WithField("version", fn).Debug("removed index cache version")
+	}
+
+	if !stale || inUse {
+		return nil
+	}
+	log.WithField("entry", entry).Debug("removing stale index cache entry")
+	return os.RemoveAll(entry)
+}
+
+// blobIndexPath returns where the index of the blob with the given digest is cached
+func (c *IndexCache) blobIndexPath(digest string) (string, error) {
+	alg, hash, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hash == "" || strings.ContainsAny(digest, "/\\.") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return filepath.Join(c.Dir, indexCacheBlobsDir, alg+"-"+hash+".index"), nil
+}
+
+// openBlobIndex opens the cached index of a blob, or returns nil if the cache doesn't hold one
+func (c *IndexCache) openBlobIndex(digest string, blob io.ReaderAt) (Index, error) {
+	fn, err := c.blobIndexPath(digest)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(fn)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// the modification time tells GC when the index was used last
+	now := time.Now()
+	err = os.Chtimes(fn, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// once mapped, GC can remove the file while the index is still in use
+	r, err := mmapFile(f, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("cannot map index: %w", err)
+	}
+	res, err := OpenCompactIndex(r, stat.Size(), blob)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	return res, nil
+}
+
+// storeBlobIndex caches the index of a blob as compact index
+func (c *IndexCache) storeBlobIndex(digest string, db *badger.DB) error {
+	fn, err := c.blobIndexPath(digest)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(fn), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(fn), indexCacheTmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	out := bufio.NewWriter(f)
+	err = WriteCompactIndex(db, out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// gcBlobIndices removes the indices of blobs which were not used for MaxAge, and left-over temporary files
+func (c *IndexCache) gcBlobIndices(now time.Time) error {
+	dir := filepath.Join(c.Dir, indexCacheBlobsDir)
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		fi, err := f.Info()
+		if err != nil {
+			continue
+		}
+		maxAge := c.MaxAge
+		if strings.HasPrefix(f.Name(), indexCacheTmpPrefix) {
+			maxAge = indexCacheTmpMaxAge
+		}
+		if maxAge <= 0 || now.Sub(fi.ModTime()) < maxAge {
+			continue
+		}
+
+		fn := filepath.Join(dir, f.Name())
+		log.WithField("index", fn).Debug("removing stale blob index")
+		err = os.Remove(fn)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func readIndexCacheMeta(entry string) (*indexCacheMeta, error) {
+	fc, err := os.ReadFile(filepath.Join(entry, indexCacheMetaFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var res indexCacheMeta
+	err = json.Unmarshal(fc, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+func writeIndexCacheMeta(entry string, meta *indexCacheMeta) error {
+	fc, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(entry, indexCacheMetaFile+".tmp")
+	err = os.WriteFile(tmp, fc, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(entry, indexCacheMetaFile))
+}
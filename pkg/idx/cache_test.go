@@ -0,0 +1,196 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestIndexCache(t *testing.T) {
+	cache := &idx.IndexCache{Dir: t.TempDir(), MaxAge: time.Hour}
+	defer func(c *idx.IndexCache) { idx.DefaultIndexCache = c }(idx.DefaultIndexCache)
+	idx.DefaultIndexCache = cache
+
+	// buildIndex produces a badger index of the archive and packs it the way it's served
+	buildIndex := func(archive []byte) []byte {
+		dir := t.TempDir()
+		db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.ProduceIndex(db, bytes.NewReader(archive))
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entries []tarFile
+		for _, f := range files {
+			fc, err := os.ReadFile(filepath.Join(dir, f.Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, tarFile{Name: f.Name(), Type: tar.TypeReg, Content: string(fc)})
+		}
+		return gzipMembers(t, buildTar(t, entries...))
+	}
+
+	var (
+		mu       sync.Mutex
+		archive  = buildTar(t, tarFile{Name: "hello.txt", Type: tar.TypeReg, Content: fileHelloTXT})
+		index    = buildIndex(archive)
+		etag     = `"v1"`
+		statuses []int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/archive.tar":
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(archive))
+		case "/archive.index":
+			rec := &statusRecorder{ResponseWriter: w, Status: http.StatusOK}
+			rec.Header().Set("ETag", etag)
+			http.ServeContent(rec, r, "", time.Time{}, bytes.NewReader(index))
+			statuses = append(statuses, rec.Status)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	openIndex := func() idx.Index {
+		res, err := idx.OpenRemoteTarIndex(context.Background(), srv.URL+"/archive")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	open := func() []string {
+		res := openIndex()
+		defer res.Close()
+		return dumpIndex(t, res)
+	}
+
+	if diff := cmp.Diff([]string{"hello.txt:" + fileHelloTXT}, open()); diff != "" {
+		t.Errorf("first open mismatch (-want +got):\n%s", diff)
+	}
+	// the first version stays in use while the index changes
+	mounted := openIndex()
+	defer mounted.Close()
+
+	mu.Lock()
+	archive = buildTar(t,
+		tarFile{Name: "hello.txt", Type: tar.TypeReg, Content: fileHelloTXT},
+		tarFile{Name: "new.txt", Type: tar.TypeReg, Content: "new"},
+	)
+	index = buildIndex(archive)
+	etag = `"v2"`
+	mu.Unlock()
+	if diff := cmp.Diff([]string{"hello.txt:" + fileHelloTXT, "new.txt:new"}, open()); diff != "" {
+		t.Errorf("changed open mismatch (-want +got):\n%s", diff)
+	}
+	// the archive changed as well, hence only the superseded index can still be read
+	roots, err := mounted.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0].Name() != "hello.txt" {
+		t.Errorf("superseded index has %d root entries, expected hello.txt only", len(roots))
+	}
+	if n := countCacheVersions(t, cache.Dir); n != 2 {
+		t.Errorf("cache has %d versions while the first one is in use, expected 2", n)
+	}
+	err = mounted.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countCacheVersions(t, cache.Dir); n != 1 {
+		t.Errorf("cache has %d versions after the first one was released, expected 1", n)
+	}
+
+	mu.Lock()
+	// the first open detects the index format using range requests, after which the index is known to the cache
+	expectedStatuses := []int{http.StatusPartialContent, http.StatusPartialContent, http.StatusOK, http.StatusNotModified, http.StatusOK}
+	if diff := cmp.Diff(expectedStatuses, statuses); diff != "" {
+		t.Errorf("index response status mismatch (-want +got):\n%s", diff)
+	}
+	mu.Unlock()
+
+	// a compact index replacing the cached index archive is detected as well
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	mu.Lock()
+	err = idx.ProduceIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := bytes.NewBuffer(nil)
+	err = idx.WriteCompactIndex(db, compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index = compact.Bytes()
+	etag = `"v3"`
+	mu.Unlock()
+	if diff := cmp.Diff([]string{"hello.txt:" + fileHelloTXT, "new.txt:new"}, open()); diff != "" {
+		t.Errorf("compact open mismatch (-want +got):\n%s", diff)
+	}
+
+	entries, err := os.ReadDir(cache.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("cache has %d entries, expected 1", len(entries))
+	}
+	cache.MaxAge = time.Nanosecond
+	err = cache.GC()
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err = os.ReadDir(cache.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("cache has %d entries after GC, expected none", len(entries))
+	}
+}
+
+// countCacheVersions counts the versions of indices the cache holds
+func countCacheVersions(t *testing.T, dir string) int {
+	versions, err := filepath.Glob(filepath.Join(dir, "*", "db-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(versions)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,550 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+const (
+	carV2HeaderSize = 40
+
+	// CARv2 index formats, identified by their multicodec
+	carIndexSorted          = 0x0400
+	carMultihashIndexSorted = 0x0401
+
+	multicodecDagPB   = 0x70
+	multicodecRaw     = 0x55
+	multihashIdentity = 0x00
+	multihashSHA256   = 0x12
+	multihashSHA512   = 0x13
+
+	// carSectionPeekSize is what we read when we don't know the size of a section yet.
+	// Most sections of small blocks are read in a single request.
+	carSectionPeekSize = 4096
+	// carMaxSectionHeader is the maximum size of the length and CID preceding a block
+	carMaxSectionHeader = 128
+
+	// carCacheSize is the number of blocks we keep around
+	carCacheSize = 64
+	// carConcurrency limits the number of blocks fetched in parallel when listing a directory
+	carConcurrency = 8
+)
+
+// carV2Pragma is the fixed beginning of every CARv2 file
+var carV2Pragma = []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+
+func init() {
+	RegisterBackend(Backend{
+		Name: "car",
+		Detect: func(src *url.URL, header []byte) bool {
+			if bytes.HasPrefix(header, carV2Pragma) {
+				return true
+			}
+			// CARv1 files start with the length of a DAG-CBOR map holding roots and version
+			l, n := binary.Uvarint(header)
+			if n <= 0 || uint64(len(header)-n) < l || l == 0 {
+				return false
+			}
+			hdr := header[n : n+int(l)]
+			return hdr[0]&0xe0 == 0xa0 && bytes.Contains(hdr, []byte("roots")) && bytes.Contains(hdr, []byte("version"))
+		},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			return OpenCAR(sourceLocation(src))
+		},
+	})
+}
+
+// OpenCAR opens a CARv1 or CARv2 file from a local path or HTTP(S) URL
+func OpenCAR(location string) (Index, error) {
+	r, size, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	res, err := NewCARIndex(r, size)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	return res, nil
+}
+
+// NewCARIndex serves the UnixFS DAG of the first root of the CAR file in r. CARv2 files carry
+// an index of their blocks which we load upfront. For all other files we build that index by
+// walking the section headers. Blocks are read on demand and verified against their CID.
+func NewCARIndex(r io.ReaderAt, size int64) (Index, error) {
+	var (
+		dataOffset, dataSize, indexOffset int64 = 0, size, 0
+		pragma                                  = make([]byte, len(carV2Pragma)+carV2HeaderSize)
+	)
+	n, err := r.ReadAt(pragma, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if n == len(pragma) && bytes.Equal(pragma[:len(carV2Pragma)], carV2Pragma) {
+		// the header starts with 16 bytes of characteristics we don't need
+		hdr := pragma[len(carV2Pragma):]
+		dataOffset = int64(binary.LittleEndian.Uint64(hdr[16:]))
+		dataSize = int64(binary.LittleEndian.Uint64(hdr[24:]))
+		indexOffset = int64(binary.LittleEndian.Uint64(hdr[32:]))
+	}
+
+	res := &carIndex{
+		r:     r,
+		data:  io.NewSectionReader(r, dataOffset, dataSize),
+		cache: make(map[string][]byte),
+	}
+	roots, headerSize, err := readCARHeader(res.data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CAR header: %w", err)
+	}
+	if len(roots) == 0 {
+		return nil, fmt.Errorf("CAR file has no roots")
+	}
+
+	if indexOffset != 0 {
+		res.offsets, err = readCARIndex(io.NewSectionReader(r, indexOffset, size-indexOffset))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read CARv2 index: %w", err)
+		}
+	} else {
+		res.offsets, err = scanCARSections(res.data, headerSize)
+		if err != nil {
+			return nil, fmt.Errorf("cannot index CAR sections: %w", err)
+		}
+	}
+
+	res.root, err = res.loadNode(roots[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root %s: %w", roots[0], err)
+	}
+	if !res.root.isDir() {
+		return nil, fmt.Errorf("root %s is not a UnixFS directory", roots[0])
+	}
+
+	return res, nil
+}
+
+var _ Index = (*carIndex)(nil)
+
+type carIndex struct {
+	r    io.ReaderAt
+	data *io.SectionReader
+	root *unixfsNode
+
+	// offsets maps the multihash digest of each block to the position of its section within data
+	offsets map[string]int64
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// Close implements Index
+func (c *carIndex) Close() error {
+	c.mu.Lock()
+	c.cache = make(map[string][]byte)
+	c.mu.Unlock()
+	return closeReader(c.r)
+}
+
+// RootEntries implements Index
+func (c *carIndex) RootEntries(ctx context.Context) ([]Entry, error) {
+	return c.listDir(c.root)
+}
+
+// Children implements Index
+func (c *carIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
+	e, ok := of.(*unixfsEntry)
+	if !ok {
+		return nil, fmt.Errorf("entry %s does not belong to this index", of.Name())
+	}
+	return c.listDir(e.node)
+}
+
+// block returns the verified content of the block identified by id
+func (c *carIndex) block(id cid) ([]byte, error) {
+	if id.HashCode == multihashIdentity {
+		// the content is inlined into the CID
+		return id.Digest, nil
+	}
+
+	key := string(id.Digest)
+	c.mu.Lock()
+	blk, ok := c.cache[key]
+	c.mu.Unlock()
+	if ok {
+		return blk, nil
+	}
+
+	off, ok := c.offsets[key]
+	if !ok {
+		return nil, fmt.Errorf("block %s is not part of the CAR file", id)
+	}
+	buf := make([]byte, carSectionPeekSize)
+	n, err := c.data.ReadAt(buf, off)
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return nil, err
+	}
+	buf = buf[:n]
+	l, vn := binary.Uvarint(buf)
+	if vn <= 0 {
+		return nil, fmt.Errorf("invalid section length at offset %d", off)
+	}
+	end := vn + int(l)
+	if end > len(buf) {
+		full := make([]byte, end)
+		copy(full, buf)
+		_, err = c.data.ReadAt(full[len(buf):], off+int64(len(buf)))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		buf = full
+	}
+
+	section := buf[vn:end]
+	sid, cn, err := parseCID(section)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(sid.Multihash, id.Multihash) {
+		return nil, fmt.Errorf("expected block %s at offset %d, found %s", id, off, sid)
+	}
+	blk = section[cn:]
+	err = verifyMultihash(id, blk)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if len(c.cache) >= carCacheSize {
+		for k := range c.cache {
+			delete(c.cache, k)
+			break
+		}
+	}
+	c.cache[key] = blk
+	c.mu.Unlock()
+	return blk, nil
+}
+
+// readCARHeader reads the CARv1 header and returns its roots and size
+func readCARHeader(r io.ReaderAt) (roots []cid, size int64, err error) {
+	buf := make([]byte, carSectionPeekSize)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return nil, 0, err
+	}
+	buf = buf[:n]
+	l, vn := binary.Uvarint(buf)
+	if vn <= 0 {
+		return nil, 0, fmt.Errorf("invalid header length")
+	}
+	if vn+int(l) > len(buf) {
+		buf = make([]byte, vn+int(l))
+		_, err = r.ReadAt(buf, 0)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, 0, err
+		}
+	}
+
+	v, _, err := decodeCBOR(buf[vn : vn+int(l)])
+	if err != nil {
+		return nil, 0, err
+	}
+	hdr, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, 0, fmt.Errorf("header is not a map")
+	}
+	if version, _ := hdr["version"].(uint64); version != 1 {
+		return nil, 0, fmt.Errorf("unsupported CAR version %v", hdr["version"])
+	}
+	rs, _ := hdr["roots"].([]interface{})
+	for _, r := range rs {
+		link, ok := r.(cborTag)
+		if !ok || link.Number != 42 {
+			return nil, 0, fmt.Errorf("root is not a CID")
+		}
+		// CIDs in DAG-CBOR carry the identity multibase prefix
+		b, _ := link.Content.([]byte)
+		if len(b) < 1 || b[0] != 0 {
+			return nil, 0, fmt.Errorf("invalid root CID")
+		}
+		c, _, err := parseCID(b[1:])
+		if err != nil {
+			return nil, 0, err
+		}
+		roots = append(roots, c)
+	}
+	return roots, int64(vn) + int64(l), nil
+}
+
+// readCARIndex loads a CARv2 index in the IndexSorted or MultihashIndexSorted format
+func readCARIndex(r *io.SectionReader) (map[string]int64, error) {
+	buf, err := io.ReadAll(bufio.NewReaderSize(r, streamBufferSize))
+	if err != nil {
+		return nil, err
+	}
+	codec, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid index codec")
+	}
+	buf = buf[n:]
+
+	res := make(map[string]int64)
+	switch codec {
+	case carIndexSorted:
+		_, err = readCARIndexBuckets(buf, res)
+	case carMultihashIndexSorted:
+		if len(buf) < 4 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		count := binary.LittleEndian.Uint32(buf)
+		buf = buf[4:]
+		for i := uint32(0); i < count && err == nil; i++ {
+			// each hash function has its own set of buckets, prefixed by the multihash code
+			if len(buf) < 8 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			buf, err = readCARIndexBuckets(buf[8:], res)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported index format 0x%x", codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readCARIndexBuckets reads buckets of sorted digest and offset pairs, grouped by digest size
+func readCARIndexBuckets(buf []byte, into map[string]int64) (rest []byte, err error) {
+	if len(buf) < 4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	count := binary.LittleEndian.Uint32(buf)
+	buf = buf[4:]
+	for i := uint32(0); i < count; i++ {
+		if len(buf) < 12 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		width := int(binary.LittleEndian.Uint32(buf))
+		size := int(binary.LittleEndian.Uint64(buf[4:]))
+		buf = buf[12:]
+		if width <= 8 || size > len(buf) {
+			return nil, fmt.Errorf("invalid index bucket")
+		}
+		for entry := buf[:size]; len(entry) >= width; entry = entry[width:] {
+			into[string(entry[:width-8])] = int64(binary.LittleEndian.Uint64(entry[width-8:]))
+		}
+		buf = buf[size:]
+	}
+	return buf, nil
+}
+
+// scanCARSections produces an index by walking the section headers of a CARv1 payload.
+// We read ahead to avoid a request per section if the file lives on a remote server.
+func scanCARSections(data *io.SectionReader, start int64) (map[string]int64, error) {
+	var (
+		res      = make(map[string]int64)
+		buf      []byte
+		bufStart int64
+	)
+	for pos := start; pos < data.Size(); {
+		bufEnd := bufStart + int64(len(buf))
+		if pos < bufStart || (pos+carMaxSectionHeader > bufEnd && bufEnd < data.Size()) {
+			buf = make([]byte, streamBufferSize)
+			n, err := data.ReadAt(buf, pos)
+			if err != nil && !errors.Is(err, io.EOF) {
+				return nil, err
+			}
+			buf, bufStart = buf[:n], pos
+		}
+
+		hdr := buf[pos-bufStart:]
+		l, vn := binary.Uvarint(hdr)
+		if vn <= 0 {
+			return nil, fmt.Errorf("invalid section length at offset %d", pos)
+		}
+		if l == 0 {
+			// some writers pad the file with zeros
+			break
+		}
+		c, _, err := parseCID(hdr[vn:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid section at offset %d: %w", pos, err)
+		}
+		res[string(c.Digest)] = pos
+		pos += int64(vn) + int64(l)
+	}
+	return res, nil
+}
+
+// cid is a content identifier, i.e. a multihash of a block and the codec of its content
+type cid struct {
+	Version   uint64
+	Codec     uint64
+	Multihash []byte
+	HashCode  uint64
+	Digest    []byte
+}
+
+// parseCID parses a binary CIDv0 or CIDv1 and returns the number of bytes it occupies
+func parseCID(b []byte) (c cid, n int, err error) {
+	if len(b) >= 34 && b[0] == multihashSHA256 && b[1] == 32 {
+		// CIDv0 are bare sha256 multihashes of dag-pb blocks
+		return cid{Version: 0, Codec: multicodecDagPB, Multihash: b[:34], HashCode: multihashSHA256, Digest: b[2:34]}, 34, nil
+	}
+
+	var vals [4]uint64
+	for i := range vals {
+		v, vn := binary.Uvarint(b[n:])
+		if vn <= 0 {
+			return cid{}, 0, fmt.Errorf("invalid CID")
+		}
+		vals[i] = v
+		n += vn
+	}
+	if vals[0] != 1 {
+		return cid{}, 0, fmt.Errorf("unsupported CID version %d", vals[0])
+	}
+	if uint64(len(b)-n) < vals[3] {
+		return cid{}, 0, fmt.Errorf("CID digest exceeds input")
+	}
+	end := n + int(vals[3])
+	mhStart := uvarintLen(vals[0]) + uvarintLen(vals[1])
+	return cid{Version: 1, Codec: vals[1], Multihash: b[mhStart:end], HashCode: vals[2], Digest: b[n:end]}, end, nil
+}
+
+// String renders the CID in its canonical base32 CIDv1 form
+func (c cid) String() string {
+	b := binary.AppendUvarint(nil, 1)
+	b = binary.AppendUvarint(b, c.Codec)
+	b = append(b, c.Multihash...)
+	return "b" + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(b))
+}
+
+func uvarintLen(v uint64) int {
+	return len(binary.AppendUvarint(nil, v))
+}
+
+// verifyMultihash checks the content of a block against its CID. Blocks hashed using
+// functions we don't know are not verified.
+func verifyMultihash(id cid, content []byte) error {
+	var sum []byte
+	switch id.HashCode {
+	case multihashSHA256:
+		s := sha256.Sum256(content)
+		sum = s[:]
+	case multihashSHA512:
+		s := sha512.Sum512(content)
+		sum = s[:]
+	default:
+		return nil
+	}
+	if !bytes.Equal(sum, id.Digest) {
+		return fmt.Errorf("content of block %s does not match its hash", id)
+	}
+	return nil
+}
+
+// cborTag is a tagged CBOR value. DAG-CBOR uses tag 42 for links.
+type cborTag struct {
+	Number  uint64
+	Content interface{}
+}
+
+// decodeCBOR decodes the DAG-CBOR subset of CBOR, i.e. without indefinite length items
+func decodeCBOR(b []byte) (v interface{}, rest []byte, err error) {
+	if len(b) == 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		n := 1 << (info - 24)
+		if len(b) < n {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		for _, c := range b[:n] {
+			arg = arg<<8 | uint64(c)
+		}
+		b = b[n:]
+	default:
+		return nil, nil, fmt.Errorf("unsupported CBOR item 0x%x", info)
+	}
+
+	switch major {
+	case 0:
+		return arg, b, nil
+	case 1:
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if uint64(len(b)) < arg {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if major == 2 {
+			return b[:arg], b[arg:], nil
+		}
+		return string(b[:arg]), b[arg:], nil
+	case 4:
+		res := make([]interface{}, 0, minInt64(int64(arg), int64(len(b))))
+		for i := uint64(0); i < arg; i++ {
+			v, b, err = decodeCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			res = append(res, v)
+		}
+		return res, b, nil
+	case 5:
+		res := make(map[string]interface{})
+		for i := uint64(0); i < arg; i++ {
+			var k interface{}
+			k, b, err = decodeCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, nil, fmt.Errorf("map keys must be strings")
+			}
+			res[ks], b, err = decodeCBOR(b)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return res, b, nil
+	case 6:
+		v, b, err = decodeCBOR(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cborTag{Number: arg, Content: v}, b, nil
+	default:
+		switch info {
+		case 20:
+			return false, b, nil
+		case 21:
+			return true, b, nil
+		case 22:
+			return nil, b, nil
+		}
+		// floats, which we have no use for
+		return arg, b, nil
+	}
+}
@@ -0,0 +1,220 @@
+package idx_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/google/go-cmp/cmp"
+)
+
+type carBlock struct {
+	CID  []byte
+	Data []byte
+}
+
+type carBuilder struct {
+	Blocks []carBlock
+}
+
+func (b *carBuilder) add(codec uint64, data []byte) []byte {
+	sum := sha256.Sum256(data)
+	var c []byte
+	if codec == 0x70 {
+		// CIDv0
+		c = append([]byte{0x12, 0x20}, sum[:]...)
+	} else {
+		c = binary.AppendUvarint([]byte{1}, codec)
+		c = append(append(c, 0x12, 0x20), sum[:]...)
+	}
+	b.Blocks = append(b.Blocks, carBlock{CID: c, Data: data})
+	return c
+}
+
+func pbField(field uint64, data []byte) []byte {
+	res := binary.AppendUvarint(nil, field<<3|2)
+	res = binary.AppendUvarint(res, uint64(len(data)))
+	return append(res, data...)
+}
+
+func pbVarint(field, v uint64) []byte {
+	return binary.AppendUvarint(binary.AppendUvarint(nil, field<<3), v)
+}
+
+type pbTestLink struct {
+	Name string
+	CID  []byte
+}
+
+// dagPB encodes a dag-pb node whose data field holds UnixFS metadata
+func dagPB(typ uint64, data []byte, fileSize uint64, blockSizes []uint64, fanout uint64, links ...pbTestLink) []byte {
+	fs := pbVarint(1, typ)
+	if data != nil {
+		fs = append(fs, pbField(2, data)...)
+	}
+	if fileSize > 0 {
+		fs = append(fs, pbVarint(3, fileSize)...)
+	}
+	for _, s := range blockSizes {
+		fs = append(fs, pbVarint(4, s)...)
+	}
+	if fanout > 0 {
+		fs = append(fs, pbVarint(6, fanout)...)
+	}
+
+	var res []byte
+	for _, l := range links {
+		res = append(res, pbField(2, append(pbField(1, l.CID), pbField(2, []byte(l.Name))...))...)
+	}
+	return append(res, pbField(1, fs)...)
+}
+
+// carV1 produces a CARv1 file and returns the offsets of each block's section
+func (b *carBuilder) carV1(root []byte) ([]byte, []int) {
+	rootLink := append([]byte{0}, root...)
+	var buf bytes.Buffer
+	hdr := []byte{0xa2, 0x65}
+	hdr = append(hdr, "roots"...)
+	hdr = append(hdr, 0x81, 0xd8, 0x2a, 0x58, byte(len(rootLink)))
+	hdr = append(hdr, rootLink...)
+	hdr = append(hdr, 0x67)
+	hdr = append(hdr, "version"...)
+	hdr = append(hdr, 0x01)
+	buf.Write(binary.AppendUvarint(nil, uint64(len(hdr))))
+	buf.Write(hdr)
+
+	offsets := make([]int, len(b.Blocks))
+	for i, blk := range b.Blocks {
+		offsets[i] = buf.Len()
+		buf.Write(binary.AppendUvarint(nil, uint64(len(blk.CID)+len(blk.Data))))
+		buf.Write(blk.CID)
+		buf.Write(blk.Data)
+	}
+	return buf.Bytes(), offsets
+}
+
+// carV2 wraps a CARv1 file and adds an IndexSorted index
+func (b *carBuilder) carV2(root []byte) []byte {
+	v1, offsets := b.carV1(root)
+
+	type entry struct {
+		Digest []byte
+		Offset int
+	}
+	var entries []entry
+	for i, blk := range b.Blocks {
+		entries = append(entries, entry{Digest: blk.CID[len(blk.CID)-32:], Offset: offsets[i]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].Digest, entries[j].Digest) < 0 })
+
+	le := binary.LittleEndian
+	index := binary.AppendUvarint(nil, 0x0400)
+	index = le.AppendUint32(index, 1)
+	index = le.AppendUint32(index, 40)
+	index = le.AppendUint64(index, uint64(40*len(entries)))
+	for _, e := range entries {
+		index = append(index, e.Digest...)
+		index = le.AppendUint64(index, uint64(e.Offset))
+	}
+
+	res := []byte{0x0a, 0xa1, 0x67, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x02}
+	dataOffset := len(res) + 40
+	res = append(res, make([]byte, 16)...)
+	res = le.AppendUint64(res, uint64(dataOffset))
+	res = le.AppendUint64(res, uint64(len(v1)))
+	res = le.AppendUint64(res, uint64(dataOffset+len(v1)))
+	res = append(res, v1...)
+	return append(res, index...)
+}
+
+// buildCAR produces a UnixFS DAG:
+//
+//	/hello.txt      chunked into two raw leaves
+//	/link ->        hello.txt
+//	/shard/         HAMT sharded directory
+//	/shard/small    inline data
+//	/shard/deep     raw leaf in a sub-shard
+func buildCAR(hello string) (b *carBuilder, root []byte) {
+	b = &carBuilder{}
+	chunk1 := b.add(0x55, []byte(hello[:100]))
+	chunk2 := b.add(0x55, []byte(hello[100:]))
+	file := b.add(0x70, dagPB(2, nil, uint64(len(hello)), []uint64{100, uint64(len(hello) - 100)}, 0,
+		pbTestLink{CID: chunk1}, pbTestLink{CID: chunk2},
+	))
+	link := b.add(0x70, dagPB(4, []byte("hello.txt"), 0, nil, 0))
+	small := b.add(0x70, dagPB(2, []byte("tiny"), 4, nil, 0))
+	deep := b.add(0x55, []byte("deep"))
+	subShard := b.add(0x70, dagPB(5, nil, 0, nil, 256, pbTestLink{Name: "05deep", CID: deep}))
+	shard := b.add(0x70, dagPB(5, nil, 0, nil, 256,
+		pbTestLink{Name: "1F", CID: subShard},
+		pbTestLink{Name: "A0small", CID: small},
+	))
+	root = b.add(0x70, dagPB(1, nil, 0, nil, 0,
+		pbTestLink{Name: "hello.txt", CID: file},
+		pbTestLink{Name: "link", CID: link},
+		pbTestLink{Name: "shard", CID: shard},
+	))
+	return b, root
+}
+
+func TestCARIndex(t *testing.T) {
+	hello := strings.Repeat("hello car ", 30)
+	expectation := []string{
+		"hello.txt:" + hello,
+		"link->hello.txt",
+		"shard/",
+		"shard/deep:deep",
+		"shard/small:tiny",
+	}
+
+	b, root := buildCAR(hello)
+	v1, _ := b.carV1(root)
+	tests := []struct {
+		Name string
+		CAR  []byte
+	}{
+		{Name: "v1", CAR: v1},
+		{Name: "v2", CAR: b.carV2(root)},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index, err := idx.NewCARIndex(bytes.NewReader(test.CAR), int64(len(test.CAR)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("NewCARIndex() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCARIndexVerifiesBlocks(t *testing.T) {
+	hello := strings.Repeat("hello car ", 30)
+	b, root := buildCAR(hello)
+	car, _ := b.carV1(root)
+	car = bytes.Replace(car, []byte(hello[:100]), []byte(strings.ToUpper(hello[:100])), 1)
+
+	index, err := idx.NewCARIndex(bytes.NewReader(car), int64(len(car)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() != "hello.txt" {
+			continue
+		}
+		_, err = e.Read(make([]byte, 10), 0)
+		if err == nil || !strings.Contains(err.Error(), "does not match its hash") {
+			t.Errorf("expected hash mismatch, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,577 @@
+package idx
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// The compact index is a read-only, single file alternative to the badger index. It is read
+// using random access, which means it can be memory mapped or fetched using range requests.
+//
+// All integers are little endian. The file consists of
+//   - a header, see compactHeader
+//   - the entry table: fixed size records, grouped by parent directory and sorted by name
+//     within each group, so that the children of a directory are a single contiguous run
+//   - the string table: the path and link name of each entry, in the order of the entry table
+//   - the directory table: the run of children of each directory, the root directory first
+//   - metadata: a JSON object of the index meta keys
+//   - the aggregate table, unless the header's offset of it is zero: the aggregate of each
+//     directory in the order of the directory table, see putCompactAggregate
+const (
+	compactMagic      = "WSFSCIX1"
+	compactHeaderSize = 80
+	compactEntrySize  = 80
+	compactDirSize    = 8
+
+	// compactNoDir marks entries which are not a directory
+	compactNoDir = math.MaxUint32
+)
+
+type compactHeader struct {
+	Entries     uint32
+	EntriesOff  uint64
+	StringsOff  uint64
+	StringsSize uint64
+	DirsOff     uint64
+	Dirs        uint64
+	MetaOff     uint64
+	MetaSize    uint64
+	// AggregatesOff is zero for indices which were written before aggregates were introduced
+	AggregatesOff uint64
+}
+
+func (h *compactHeader) marshal() []byte {
+	res := make([]byte, compactHeaderSize)
+	copy(res, compactMagic)
+	binary.LittleEndian.PutUint32(res[8:], 1)
+	binary.LittleEndian.PutUint32(res[12:], h.Entries)
+	binary.LittleEndian.PutUint64(res[16:], h.EntriesOff)
+	binary.LittleEndian.PutUint64(res[24:], h.StringsOff)
+	binary.LittleEndian.PutUint64(res[32:], h.StringsSize)
+	binary.LittleEndian.PutUint64(res[40:], h.DirsOff)
+	binary.LittleEndian.PutUint64(res[48:], h.Dirs)
+	binary.LittleEndian.PutUint64(res[56:], h.MetaOff)
+	binary.LittleEndian.PutUint64(res[64:], h.MetaSize)
+	binary.LittleEndian.PutUint64(res[72:], h.AggregatesOff)
+	return res
+}
+
+func (h *compactHeader) unmarshal(buf []byte, size int64) error {
+	if len(buf) < compactHeaderSize || string(buf[:8]) != compactMagic {
+		return fmt.Errorf("not a compact index")
+	}
+	if v := binary.LittleEndian.Uint32(buf[8:]); v != 1 {
+		return fmt.Errorf("unsupported compact index version %d", v)
+	}
+	h.Entries = binary.LittleEndian.Uint32(buf[12:])
+	h.EntriesOff = binary.LittleEndian.Uint64(buf[16:])
+	h.StringsOff = binary.LittleEndian.Uint64(buf[24:])
+	h.StringsSize = binary.LittleEndian.Uint64(buf[32:])
+	h.DirsOff = binary.LittleEndian.Uint64(buf[40:])
+	h.Dirs = binary.LittleEndian.Uint64(buf[48:])
+	h.MetaOff = binary.LittleEndian.Uint64(buf[56:])
+	h.MetaSize = binary.LittleEndian.Uint64(buf[64:])
+	h.AggregatesOff = binary.LittleEndian.Uint64(buf[72:])
+
+	sections := [][2]uint64{
+		{h.EntriesOff, uint64(h.Entries) * compactEntrySize},
+		{h.StringsOff, h.StringsSize},
+		{h.DirsOff, h.Dirs * compactDirSize},
+		{h.MetaOff, h.MetaSize},
+	}
+	if h.AggregatesOff != 0 {
+		sections = append(sections, [2]uint64{h.AggregatesOff, h.Dirs * compactAggregateSize})
+	}
+	for _, section := range sections {
+		if section[0] > uint64(size) || section[1] > uint64(size)-section[0] {
+			return fmt.Errorf("compact index is truncated")
+		}
+	}
+	if h.Dirs == 0 {
+		return fmt.Errorf("compact index has no root directory")
+	}
+	return nil
+}
+
+// IsCompactIndex returns true if the header, i.e. the beginning of a file, belongs to a compact index
+func IsCompactIndex(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(compactMagic))
+}
+
+// WriteCompactIndex converts a badger index to the compact index format
+func WriteCompactIndex(db *badger.DB, out io.Writer) error {
+	entries, meta, err := loadIndexEntries(db)
+	if err != nil {
+		return err
+	}
+	if uint64(len(entries)) >= compactNoDir {
+		return fmt.Errorf("too many entries for a compact index")
+	}
+
+	type run struct{ Start, Count uint32 }
+	runs := make(map[string]run)
+	for i, e := range entries {
+		parent, _ := compactSplitPath(e.TarHeader.Name)
+		r, ok := runs[parent]
+		if !ok {
+			r.Start = uint32(i)
+		}
+		r.Count++
+		runs[parent] = r
+	}
+
+	var (
+		hdr        compactHeader
+		entryTb    = make([]byte, 0, len(entries)*compactEntrySize)
+		strTb      bytes.Buffer
+		dirTb      = make([]byte, 0, compactDirSize)
+		aggregates = dirAggregates(entries)
+		aggrTb     = make([]byte, 0, compactAggregateSize)
+	)
+	addDir := func(path string) uint32 {
+		r := runs[path]
+		dirTb = binary.LittleEndian.AppendUint32(dirTb, r.Start)
+		dirTb = binary.LittleEndian.AppendUint32(dirTb, r.Count)
+		aggr := make([]byte, compactAggregateSize)
+		putCompactAggregate(aggr, aggregates[path])
+		aggrTb = append(aggrTb, aggr...)
+		hdr.Dirs++
+		return uint32(hdr.Dirs - 1)
+	}
+	addDir("")
+	for _, e := range entries {
+		h := e.TarHeader
+		if uint64(strTb.Len())+uint64(len(h.Name))+uint64(len(h.Linkname)) > math.MaxUint32 {
+			return fmt.Errorf("string table is too large for a compact index")
+		}
+
+		rec := make([]byte, compactEntrySize)
+		putCompactEntry(rec, e, uint32(strTb.Len()), uint32(strTb.Len()+len(h.Name)))
+		strTb.WriteString(h.Name)
+		strTb.WriteString(h.Linkname)
+		dir := uint32(compactNoDir)
+		if h.Typeflag == tar.TypeDir {
+			dir = addDir(h.Name)
+		}
+		binary.LittleEndian.PutUint32(rec[68:], dir)
+		entryTb = append(entryTb, rec...)
+	}
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	hdr.Entries = uint32(len(entries))
+	hdr.EntriesOff = compactHeaderSize
+	hdr.StringsOff = hdr.EntriesOff + uint64(len(entryTb))
+	hdr.StringsSize = uint64(strTb.Len())
+	hdr.DirsOff = hdr.StringsOff + hdr.StringsSize
+	hdr.MetaOff = hdr.DirsOff + uint64(len(dirTb))
+	hdr.MetaSize = uint64(len(metaJSON))
+	hdr.AggregatesOff = hdr.MetaOff + hdr.MetaSize
+
+	for _, section := range [][]byte{hdr.marshal(), entryTb, strTb.Bytes(), dirTb, metaJSON, aggrTb} {
+		_, err = out.Write(section)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadIndexEntries reads all entries of a badger index, grouped by parent directory and sorted by
+// name within each group, and the index metadata
+func loadIndexEntries(db *badger.DB) (entries []indexEntry, meta map[string][]byte, err error) {
+	meta = make(map[string][]byte)
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			k := string(item.Key())
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if strings.HasPrefix(k, metaKeyPrefix) {
+				meta[strings.TrimPrefix(k, metaKeyPrefix)] = val
+				continue
+			}
+
+			var e indexEntry
+			err = json.Unmarshal(val, &e)
+			if err != nil {
+				return fmt.Errorf("cannot unmarshal entry %s: %w", k, err)
+			}
+			if k == "" {
+				continue
+			}
+			e.TarHeader.Name = k
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		pi, ni := compactSplitPath(entries[i].TarHeader.Name)
+		pj, nj := compactSplitPath(entries[j].TarHeader.Name)
+		if pi != pj {
+			return pi < pj
+		}
+		return ni < nj
+	})
+	return entries, meta, nil
+}
+
+// putCompactEntry encodes an entry into a record, except for the directory field at rec[68:72]
+func putCompactEntry(rec []byte, e indexEntry, nameOff, linkOff uint32) {
+	h := e.TarHeader
+	binary.LittleEndian.PutUint32(rec[0:], nameOff)
+	binary.LittleEndian.PutUint32(rec[4:], uint32(len(h.Name)))
+	binary.LittleEndian.PutUint32(rec[8:], linkOff)
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(h.Linkname)))
+	binary.LittleEndian.PutUint64(rec[16:], uint64(e.Offset))
+	binary.LittleEndian.PutUint64(rec[24:], uint64(h.Size))
+	binary.LittleEndian.PutUint64(rec[32:], uint64(h.ModTime.Unix()))
+	binary.LittleEndian.PutUint64(rec[40:], uint64(h.AccessTime.Unix()))
+	binary.LittleEndian.PutUint32(rec[48:], uint32(h.Mode))
+	binary.LittleEndian.PutUint32(rec[52:], uint32(h.Uid))
+	binary.LittleEndian.PutUint32(rec[56:], uint32(h.Gid))
+	binary.LittleEndian.PutUint32(rec[60:], uint32(h.Devmajor))
+	binary.LittleEndian.PutUint32(rec[64:], uint32(h.Devminor))
+	rec[72] = h.Typeflag
+}
+
+// compactEntry decodes a record produced by putCompactEntry
+func compactEntry(rec []byte, name, link string) indexEntry {
+	return indexEntry{
+		Offset: int64(binary.LittleEndian.Uint64(rec[16:])),
+		TarHeader: &tar.Header{
+			Typeflag:   rec[72],
+			Name:       name,
+			Linkname:   link,
+			Size:       int64(binary.LittleEndian.Uint64(rec[24:])),
+			ModTime:    time.Unix(int64(binary.LittleEndian.Uint64(rec[32:])), 0),
+			AccessTime: time.Unix(int64(binary.LittleEndian.Uint64(rec[40:])), 0),
+			Mode:       int64(binary.LittleEndian.Uint32(rec[48:])),
+			Uid:        int(binary.LittleEndian.Uint32(rec[52:])),
+			Gid:        int(binary.LittleEndian.Uint32(rec[56:])),
+			Devmajor:   int64(binary.LittleEndian.Uint32(rec[60:])),
+			Devminor:   int64(binary.LittleEndian.Uint32(rec[64:])),
+		},
+	}
+}
+
+// compactSplitPath splits a path into its parent directory and name
+func compactSplitPath(p string) (parent, name string) {
+	i := strings.LastIndex(p, "/")
+	if i < 0 {
+		return "", p
+	}
+	return p[:i], p[i+1:]
+}
+
+// ReadCompactIndex converts a compact or paged index to a badger index
+func ReadCompactIndex(r io.ReaderAt, size int64, db *badger.DB) error {
+	header := make([]byte, len(pagedMagic))
+	_, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if IsPagedIndex(header) {
+		return readPagedIndex(r, size, db)
+	}
+
+	ci, err := newCompactIndex(r, size)
+	if err != nil {
+		return err
+	}
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for k, v := range ci.Meta {
+		err = wb.Set([]byte(metaKeyPrefix+k), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	const batch = 4096
+	for start := uint32(0); start < ci.Header.Entries; start += batch {
+		count := ci.Header.Entries - start
+		if count > batch {
+			count = batch
+		}
+		entries, err := ci.readEntries(start, count)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			val, err := json.Marshal(e.Entry)
+			if err != nil {
+				return err
+			}
+			err = wb.Set([]byte(e.Entry.TarHeader.Name), val)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err = wb.Flush()
+	if err != nil {
+		return err
+	}
+	return storeDirAggregates(db)
+}
+
+// OpenCompactIndexFile opens a compact or paged index file, memory mapped where supported, for a local or remote archive
+func OpenCompactIndexFile(index, archive string) (Index, error) {
+	f, err := os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r, err := mmapFile(f, stat.Size())
+	if err != nil {
+		return nil, fmt.Errorf("cannot map index: %w", err)
+	}
+
+	tarfile, _, err := openLocation(archive)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	header := make([]byte, len(pagedMagic))
+	_, _ = r.ReadAt(header, 0)
+	var res Index
+	if IsPagedIndex(header) {
+		res, err = OpenPagedIndex(r, stat.Size(), tarfile)
+	} else {
+		res, err = OpenCompactIndex(r, stat.Size(), tarfile)
+	}
+	if err != nil {
+		closeReader(r)
+		closeReader(tarfile)
+		return nil, err
+	}
+	return res, nil
+}
+
+// OpenCompactIndex opens a compact index for an archive. The index is read on demand.
+// Closing the index closes both the index and the archive reader.
+func OpenCompactIndex(index io.ReaderAt, size int64, tarfile io.ReaderAt) (Index, error) {
+	ci, err := newCompactIndex(index, size)
+	if err != nil {
+		return nil, err
+	}
+
+	ci.TarFile, err = compactArchiveReader(tarfile, ci.Meta)
+	if err != nil {
+		return nil, err
+	}
+	return ci, nil
+}
+
+// compactArchiveReader decompresses archives which were gzip compressed when indexed
+func compactArchiveReader(tarfile io.ReaderAt, meta map[string][]byte) (io.ReaderAt, error) {
+	val, ok := meta[strings.TrimPrefix(metaKeyGzip, metaKeyPrefix)]
+	if !ok {
+		return tarfile, nil
+	}
+	var gz gzipMeta
+	err := json.Unmarshal(val, &gz)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal gzip metadata: %w", err)
+	}
+	return NewGzipReaderAt(tarfile, gz.Size, gz.Checkpoints), nil
+}
+
+func newCompactIndex(r io.ReaderAt, size int64) (*compactIndex, error) {
+	buf := make([]byte, compactHeaderSize)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read compact index header: %w", err)
+	}
+	res := &compactIndex{R: r}
+	err = res.Header.unmarshal(buf, size)
+	if err != nil {
+		return nil, err
+	}
+
+	metaJSON := make([]byte, res.Header.MetaSize)
+	_, err = r.ReadAt(metaJSON, int64(res.Header.MetaOff))
+	if err != nil && !(err == io.EOF && len(metaJSON) == 0) {
+		return nil, fmt.Errorf("cannot read compact index metadata: %w", err)
+	}
+	err = json.Unmarshal(metaJSON, &res.Meta)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal compact index metadata: %w", err)
+	}
+
+	return res, nil
+}
+
+var _ Index = (*compactIndex)(nil)
+
+type compactIndex struct {
+	R       io.ReaderAt
+	Header  compactHeader
+	Meta    map[string][]byte
+	TarFile io.ReaderAt
+}
+
+// Close implements Index
+func (ci *compactIndex) Close() error {
+	return firstError(closeReader(ci.R), closeReader(ci.TarFile))
+}
+
+// RootEntries implements Index
+func (ci *compactIndex) RootEntries(ctx context.Context) ([]Entry, error) {
+	return ci.children(0)
+}
+
+// Children implements Index
+func (ci *compactIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
+	e, ok := of.(*compactIndexEntry)
+	if !ok {
+		return nil, fmt.Errorf("entry does not belong to a compact index")
+	}
+	if e.DirIdx == compactNoDir {
+		return nil, nil
+	}
+	return ci.children(e.DirIdx)
+}
+
+func (ci *compactIndex) children(dir uint32) ([]Entry, error) {
+	if uint64(dir) >= ci.Header.Dirs {
+		return nil, fmt.Errorf("invalid directory %d", dir)
+	}
+	buf := make([]byte, compactDirSize)
+	_, err := ci.R.ReadAt(buf, int64(ci.Header.DirsOff)+int64(dir)*compactDirSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read directory %d: %w", dir, err)
+	}
+	start, count := binary.LittleEndian.Uint32(buf[0:]), binary.LittleEndian.Uint32(buf[4:])
+
+	entries, err := ci.readEntries(start, count)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Entry, len(entries))
+	for i := range entries {
+		res[i] = entries[i]
+	}
+	return res, nil
+}
+
+// readEntries reads a run of the entry table and the strings it references using two reads
+func (ci *compactIndex) readEntries(start, count uint32) ([]*compactIndexEntry, error) {
+	if count == 0 {
+		return nil, nil
+	}
+	if uint64(start)+uint64(count) > uint64(ci.Header.Entries) {
+		return nil, fmt.Errorf("invalid entry range %d+%d", start, count)
+	}
+
+	recs := make([]byte, int(count)*compactEntrySize)
+	_, err := ci.R.ReadAt(recs, int64(ci.Header.EntriesOff)+int64(start)*compactEntrySize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read entries: %w", err)
+	}
+
+	// strings are stored in the order of the entry table
+	strStart := uint64(binary.LittleEndian.Uint32(recs[0:]))
+	last := recs[len(recs)-compactEntrySize:]
+	strEnd := uint64(binary.LittleEndian.Uint32(last[8:])) + uint64(binary.LittleEndian.Uint32(last[12:]))
+	if strEnd < strStart || strEnd > ci.Header.StringsSize {
+		return nil, fmt.Errorf("invalid string table range %d-%d", strStart, strEnd)
+	}
+	strs := make([]byte, strEnd-strStart)
+	if len(strs) > 0 {
+		_, err = ci.R.ReadAt(strs, int64(ci.Header.StringsOff+strStart))
+		if err != nil {
+			return nil, fmt.Errorf("cannot read strings: %w", err)
+		}
+	}
+	str := func(off, l uint32) (string, error) {
+		if uint64(off) < strStart || uint64(off)+uint64(l) > strEnd {
+			return "", fmt.Errorf("invalid string %d+%d", off, l)
+		}
+		return string(strs[uint64(off)-strStart : uint64(off)-strStart+uint64(l)]), nil
+	}
+
+	res := make([]*compactIndexEntry, count)
+	for i := range res {
+		rec := recs[i*compactEntrySize : (i+1)*compactEntrySize]
+		name, err := str(binary.LittleEndian.Uint32(rec[0:]), binary.LittleEndian.Uint32(rec[4:]))
+		if err != nil {
+			return nil, err
+		}
+		link, err := str(binary.LittleEndian.Uint32(rec[8:]), binary.LittleEndian.Uint32(rec[12:]))
+		if err != nil {
+			return nil, err
+		}
+		res[i] = &compactIndexEntry{
+			fileBackedIndexEntry: fileBackedIndexEntry{
+				TarFile: ci.TarFile,
+				Entry:   compactEntry(rec, name, link),
+			},
+			DirIdx: binary.LittleEndian.Uint32(rec[68:]),
+			Index:  ci,
+		}
+	}
+	return res, nil
+}
+
+// compactIndexEntry is a tar entry read from a compact index
+type compactIndexEntry struct {
+	fileBackedIndexEntry
+
+	DirIdx uint32
+	Index  *compactIndex
+}
+
+// Aggregate implements AggregateEntry
+func (e *compactIndexEntry) Aggregate() (*DirAggregate, error) {
+	if e.DirIdx == compactNoDir {
+		return nil, nil
+	}
+	return e.Index.aggregate(e.DirIdx)
+}
+
+// aggregate reads the aggregate of a directory, if the index has an aggregate table
+func (ci *compactIndex) aggregate(dir uint32) (*DirAggregate, error) {
+	if ci.Header.AggregatesOff == 0 {
+		return nil, nil
+	}
+	if uint64(dir) >= ci.Header.Dirs {
+		return nil, fmt.Errorf("invalid directory %d", dir)
+	}
+	rec := make([]byte, compactAggregateSize)
+	_, err := ci.R.ReadAt(rec, int64(ci.Header.AggregatesOff)+int64(dir)*compactAggregateSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read aggregate of directory %d: %w", dir, err)
+	}
+	return compactAggregate(rec), nil
+}
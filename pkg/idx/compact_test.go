@@ -0,0 +1,165 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestCompactIndex(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "foo/", Mode: 0755, Uid: 1000, Gid: 1000})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "foo/bar.txt", Mode: 0644, Size: int64(len(fileFooSlashBarTXT))})
+	tarw.Write([]byte(fileFooSlashBarTXT))
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "foo/empty/", Mode: 0700})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "foo/link", Linkname: "../hello.txt", Mode: 0777})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeChar, Name: "null", Mode: 0666, Devmajor: 1, Devminor: 3})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hello.txt", Mode: 0600, Uid: 33333, Gid: 33333, Size: int64(len(fileHelloTXT))})
+	tarw.Write([]byte(fileHelloTXT))
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "foo-bar/", Mode: 0755})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "foo-bar/baz", Mode: 0644, Size: int64(len(fileHidden))})
+	tarw.Write([]byte(fileHidden))
+	tarw.Close()
+	archive := buf.Bytes()
+
+	dir := t.TempDir()
+	badgerDir := filepath.Join(dir, "badger")
+	db, err := badger.Open(badger.DefaultOptions(badgerDir).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.ProduceIndex(db, bytes.NewReader(gzipMembers(t, archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := bytes.NewBuffer(nil)
+	err = idx.WriteCompactIndex(db, compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexArchive := bytes.NewBuffer(nil)
+	err = idx.WriteIndexArchive(db, indexArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	indexArchiveFile := filepath.Join(dir, "archive.index.tar.gz")
+	err = os.WriteFile(indexArchiveFile, indexArchive.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	compactFile := filepath.Join(dir, "archive.index")
+	err = os.WriteFile(compactFile, compact.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveFile := filepath.Join(dir, "archive.tar.gz")
+	err = os.WriteFile(archiveFile, gzipMembers(t, archive), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectation := []string{
+		"foo-bar/",
+		"foo-bar/baz:" + fileHidden,
+		"foo/",
+		"foo/bar.txt:" + fileFooSlashBarTXT,
+		"foo/empty/",
+		"foo/link->../hello.txt",
+		"hello.txt:" + fileHelloTXT,
+		"null:",
+	}
+	attrs := []string{
+		"foo 40755 1000:1000 rdev=0",
+		"foo-bar 40755 0:0 rdev=0",
+		"foo-bar/baz 644 0:0 rdev=0",
+		"foo/bar.txt 644 0:0 rdev=0",
+		"foo/empty 40700 0:0 rdev=0",
+		"foo/link 120777 0:0 rdev=0",
+		"hello.txt 600 33333:33333 rdev=0",
+		"null 20666 0:0 rdev=259",
+	}
+	tests := []struct {
+		Name string
+		Open func() (idx.Index, error)
+	}{
+		{Name: "badger", Open: func() (idx.Index, error) { return idx.OpenFileBackedTarIndex(badgerDir, archiveFile) }},
+		{Name: "compact reader", Open: func() (idx.Index, error) {
+			return idx.OpenCompactIndex(bytes.NewReader(compact.Bytes()), int64(compact.Len()), bytes.NewReader(gzipMembers(t, archive)))
+		}},
+		{Name: "compact file", Open: func() (idx.Index, error) { return idx.OpenFileBackedTarIndex(compactFile, archiveFile) }},
+		{Name: "index archive file", Open: func() (idx.Index, error) { return idx.OpenFileBackedTarIndex(indexArchiveFile, archiveFile) }},
+		{Name: "backend", Open: func() (idx.Index, error) { return idx.Open(context.Background(), archiveFile, idx.OpenOptions{}) }},
+		{Name: "converted back", Open: func() (idx.Index, error) {
+			db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+			if err != nil {
+				return nil, err
+			}
+			err = idx.ReadCompactIndex(bytes.NewReader(compact.Bytes()), int64(compact.Len()), db)
+			if err != nil {
+				return nil, err
+			}
+			return idx.OpenTarIndex(db, bytes.NewReader(gzipMembers(t, archive)))
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index, err := test.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("compact index mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(attrs, dumpAttrs(t, index)); diff != "" {
+				t.Errorf("compact index attributes mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// dumpAttrs lists the mode, owner and device of all entries, sorted by path
+func dumpAttrs(t *testing.T, index idx.Index) []string {
+	var (
+		res  []string
+		walk func(prefix string, entries []idx.Entry)
+	)
+	walk = func(prefix string, entries []idx.Entry) {
+		for _, e := range entries {
+			var attr fuse.Attr
+			_, err := e.Getattr(&attr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res = append(res, fmt.Sprintf("%s%s %o %d:%d rdev=%d", prefix, e.Name(), e.StableMode()|attr.Mode, attr.Uid, attr.Gid, attr.Rdev))
+			if e.Dir() {
+				children, err := index.Children(context.Background(), e)
+				if err != nil {
+					t.Fatal(err)
+				}
+				walk(prefix+e.Name()+"/", children)
+			}
+		}
+	}
+	root, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	walk("", root)
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,561 @@
+package idx
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The content index is an optional companion of an index which lets Search narrow down the files
+// that can match a regular expression without reading them. Like codesearch, it holds a posting
+// list per trigram, i.e. sequence of three bytes, which lists the files that contain the trigram.
+// ASCII letters are folded to lower case, so that case-insensitive patterns can use it as well.
+// Files which contain a NUL byte are considered binary and aren't indexed.
+//
+// The content index is read using random access, which means it can be fetched using range requests.
+// All integers are little endian. The file consists of
+//   - a header, see contentHeader
+//   - the path table: the length of the path of each file as uint32 followed by the path, in the
+//     order in which files were indexed. Files which were replaced by a later entry have no path.
+//   - the fanout table: for each byte, the number of trigrams which start with that byte or a smaller one
+//   - the trigram table: fixed size records of the trigram and the offset of its posting list
+//     relative to the beginning of the posting lists, sorted by trigram, followed by a record
+//     which marks the end of the last posting list
+//   - the posting lists: the delta-encoded numbers of the files which contain the trigram as uvarint
+const (
+	contentMagic       = "WSFSTRI1"
+	contentHeaderSize  = 48
+	contentFanoutSize  = 256 * 4
+	contentTrigramSize = 12
+)
+
+type contentHeader struct {
+	Files       uint32
+	Trigrams    uint32
+	PathsOff    uint64
+	PathsSize   uint64
+	FanoutOff   uint64
+	PostingsOff uint64
+}
+
+func (h *contentHeader) marshal() []byte {
+	res := make([]byte, contentHeaderSize)
+	copy(res, contentMagic)
+	binary.LittleEndian.PutUint32(res[8:], 1)
+	binary.LittleEndian.PutUint32(res[12:], h.Files)
+	binary.LittleEndian.PutUint64(res[16:], h.PathsOff)
+	binary.LittleEndian.PutUint64(res[24:], h.PathsSize)
+	binary.LittleEndian.PutUint64(res[32:], h.FanoutOff)
+	binary.LittleEndian.PutUint32(res[40:], h.Trigrams)
+	return res
+}
+
+func (h *contentHeader) unmarshal(buf []byte, size int64) error {
+	if len(buf) < contentHeaderSize || string(buf[:8]) != contentMagic {
+		return fmt.Errorf("not a content index")
+	}
+	if v := binary.LittleEndian.Uint32(buf[8:]); v != 1 {
+		return fmt.Errorf("unsupported content index version %d", v)
+	}
+	h.Files = binary.LittleEndian.Uint32(buf[12:])
+	h.PathsOff = binary.LittleEndian.Uint64(buf[16:])
+	h.PathsSize = binary.LittleEndian.Uint64(buf[24:])
+	h.FanoutOff = binary.LittleEndian.Uint64(buf[32:])
+	h.Trigrams = binary.LittleEndian.Uint32(buf[40:])
+	h.PostingsOff = h.FanoutOff + contentFanoutSize + (uint64(h.Trigrams)+1)*contentTrigramSize
+
+	if h.PathsOff+h.PathsSize > uint64(size) || h.FanoutOff < h.PathsOff+h.PathsSize || h.PostingsOff > uint64(size) {
+		return fmt.Errorf("content index is truncated")
+	}
+	return nil
+}
+
+// IsContentIndex returns true if header is the beginning of a content index
+func IsContentIndex(header []byte) bool {
+	return len(header) >= len(contentMagic) && string(header[:len(contentMagic)]) == contentMagic
+}
+
+// ContentIndexPath derives the location of the content index from the location of the index,
+// e.g. foo.trigrams for foo.index
+func ContentIndexPath(index string) string {
+	return strings.TrimSuffix(index, ".index") + ".trigrams"
+}
+
+// DefaultContentIndexLocation returns where the content index of a tar source is expected, i.e.
+// next to its index. It returns an empty string for sources which aren't files.
+func DefaultContentIndexLocation(source string, opts OpenOptions) (string, error) {
+	if opts.Index != "" {
+		return ContentIndexPath(opts.Index), nil
+	}
+	src, err := ParseSource(source)
+	if err != nil {
+		return "", err
+	}
+	switch src.Scheme {
+	case "file", "http", "https":
+	default:
+		return "", nil
+	}
+	loc := *src
+	loc.Path, loc.RawPath = ContentIndexPath(defaultIndexPath(src.Path)), ""
+	return sourceLocation(&loc), nil
+}
+
+// foldASCII folds ASCII letters to lower case
+func foldASCII(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// ContentIndexBuilder collects the trigrams of files, see WriteContentIndex
+type ContentIndexBuilder struct {
+	paths    []string
+	files    map[string]uint32
+	postings map[uint32]*contentPostings
+
+	// seen marks the trigrams of the file being added, which are listed in trigrams
+	seen     []uint64
+	trigrams []uint32
+	buf      []byte
+}
+
+type contentPostings struct {
+	Buf  []byte
+	Last uint32
+}
+
+// NewContentIndexBuilder creates an empty content index
+func NewContentIndexBuilder() *ContentIndexBuilder {
+	return &ContentIndexBuilder{
+		files:    make(map[string]uint32),
+		postings: make(map[uint32]*contentPostings),
+		seen:     make([]uint64, 1<<24/64),
+		buf:      make([]byte, 32<<10),
+	}
+}
+
+// Add indexes the content of a file, reading r to the end. Adding a path again replaces the file,
+// like later entries of an archive replace earlier ones.
+func (b *ContentIndexBuilder) Add(path string, r io.Reader) error {
+	defer func() {
+		for _, t := range b.trigrams {
+			b.seen[t/64] &^= 1 << (t % 64)
+		}
+		b.trigrams = b.trigrams[:0]
+	}()
+
+	var (
+		tri      uint32
+		n        int
+		isBinary bool
+	)
+	for !isBinary {
+		k, err := r.Read(b.buf)
+		for _, c := range b.buf[:k] {
+			if c == 0 {
+				isBinary = true
+				break
+			}
+			tri = (tri<<8 | uint32(foldASCII(c))) & 0xffffff
+			n++
+			if n < 3 || b.seen[tri/64]&(1<<(tri%64)) != 0 {
+				continue
+			}
+			b.seen[tri/64] |= 1 << (tri % 64)
+			b.trigrams = append(b.trigrams, tri)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if isBinary {
+		_, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return err
+		}
+	}
+	return b.addTrigrams(path, b.trigrams, isBinary)
+}
+
+// AddContentIndex adds the files of a content index, e.g. to update it with the files which were
+// appended to its archive. Like Add, files which are added later replace files of the same path.
+func (b *ContentIndexBuilder) AddContentIndex(ci *ContentIndex) error {
+	trigrams := make([][]uint32, len(ci.paths))
+	for c := 0; c < 256; c++ {
+		bucket, err := ci.bucket(byte(c))
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(bucket)/contentTrigramSize-1; i++ {
+			tri := binary.LittleEndian.Uint32(bucket[i*contentTrigramSize:])
+			ids, err := ci.postings(tri)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				trigrams[id] = append(trigrams[id], tri)
+			}
+		}
+	}
+	for id, p := range ci.paths {
+		if p == "" {
+			continue
+		}
+		err := b.addTrigrams(p, trigrams[id], false)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addTrigrams adds a file which contains the trigrams, or removes it if it's binary
+func (b *ContentIndexBuilder) addTrigrams(path string, trigrams []uint32, isBinary bool) error {
+	if id, ok := b.files[path]; ok {
+		b.paths[id] = ""
+		delete(b.files, path)
+	}
+	if isBinary {
+		return nil
+	}
+	if uint64(len(b.paths)) >= 1<<32-1 {
+		return fmt.Errorf("too many files for a content index")
+	}
+	id := uint32(len(b.paths))
+	b.paths = append(b.paths, path)
+	b.files[path] = id
+	for _, t := range trigrams {
+		p, ok := b.postings[t]
+		if !ok {
+			p = &contentPostings{}
+			b.postings[t] = p
+		}
+		p.Buf = binary.AppendUvarint(p.Buf, uint64(id-p.Last))
+		p.Last = id
+	}
+	return nil
+}
+
+// WriteContentIndex writes the files added to a content index builder to out
+func WriteContentIndex(b *ContentIndexBuilder, out io.Writer) error {
+	var pathTb []byte
+	for _, p := range b.paths {
+		pathTb = binary.LittleEndian.AppendUint32(pathTb, uint32(len(p)))
+		pathTb = append(pathTb, p...)
+	}
+
+	trigrams := make([]uint32, 0, len(b.postings))
+	for t := range b.postings {
+		trigrams = append(trigrams, t)
+	}
+	sort.Slice(trigrams, func(i, j int) bool { return trigrams[i] < trigrams[j] })
+
+	var (
+		fanout   [256]uint32
+		trigTb   = make([]byte, 0, (len(trigrams)+1)*contentTrigramSize)
+		postings uint64
+	)
+	for _, t := range trigrams {
+		fanout[t>>16]++
+		rec := make([]byte, contentTrigramSize)
+		binary.LittleEndian.PutUint32(rec, t)
+		binary.LittleEndian.PutUint64(rec[4:], postings)
+		trigTb = append(trigTb, rec...)
+		postings += uint64(len(b.postings[t].Buf))
+	}
+	end := make([]byte, contentTrigramSize)
+	binary.LittleEndian.PutUint32(end, 1<<24)
+	binary.LittleEndian.PutUint64(end[4:], postings)
+	trigTb = append(trigTb, end...)
+
+	fanoutTb := make([]byte, 0, contentFanoutSize)
+	var total uint32
+	for _, n := range fanout {
+		total += n
+		fanoutTb = binary.LittleEndian.AppendUint32(fanoutTb, total)
+	}
+
+	hdr := contentHeader{
+		Files:     uint32(len(b.paths)),
+		Trigrams:  uint32(len(trigrams)),
+		PathsOff:  contentHeaderSize,
+		PathsSize: uint64(len(pathTb)),
+	}
+	hdr.FanoutOff = hdr.PathsOff + hdr.PathsSize
+
+	w := bufio.NewWriter(out)
+	for _, section := range [][]byte{hdr.marshal(), pathTb, fanoutTb, trigTb} {
+		_, err := w.Write(section)
+		if err != nil {
+			return err
+		}
+	}
+	for _, t := range trigrams {
+		_, err := w.Write(b.postings[t].Buf)
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// ContentIndex is a content index opened for reading, see OpenContentIndex
+type ContentIndex struct {
+	r      io.ReaderAt
+	hdr    contentHeader
+	fanout [256]uint32
+	paths  []string
+
+	mu sync.Mutex
+	// buckets caches the records of the trigrams which start with the same byte, including the record that follows them
+	buckets map[byte][]byte
+}
+
+// OpenContentIndexFile opens a content index at a local path or HTTP(S) URL
+func OpenContentIndexFile(location string) (*ContentIndex, error) {
+	r, size, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	res, err := OpenContentIndex(r, size)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	return res, nil
+}
+
+// OpenContentIndex reads the header and the paths of a content index. Once opened, the content index
+// owns r, i.e. closing the content index closes r.
+func OpenContentIndex(r io.ReaderAt, size int64) (*ContentIndex, error) {
+	buf := make([]byte, contentHeaderSize)
+	_, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("cannot read content index header: %w", err)
+	}
+	res := &ContentIndex{r: r, buckets: make(map[byte][]byte)}
+	err = res.hdr.unmarshal(buf, size)
+	if err != nil {
+		return nil, err
+	}
+
+	buf = make([]byte, res.hdr.PathsSize+contentFanoutSize)
+	n, err := r.ReadAt(buf, int64(res.hdr.PathsOff))
+	if err != nil && !(errors.Is(err, io.EOF) && n == len(buf)) {
+		return nil, fmt.Errorf("cannot read content index paths: %w", err)
+	}
+	pathTb, fanoutTb := buf[:res.hdr.PathsSize], buf[res.hdr.PathsSize:]
+	res.paths = make([]string, 0, res.hdr.Files)
+	for len(pathTb) >= 4 {
+		n := binary.LittleEndian.Uint32(pathTb)
+		if uint64(n) > uint64(len(pathTb)-4) {
+			break
+		}
+		res.paths = append(res.paths, string(pathTb[4:4+n]))
+		pathTb = pathTb[4+n:]
+	}
+	if len(res.paths) != int(res.hdr.Files) || len(pathTb) != 0 {
+		return nil, fmt.Errorf("content index has an invalid path table")
+	}
+	for i := range res.fanout {
+		res.fanout[i] = binary.LittleEndian.Uint32(fanoutTb[i*4:])
+		if res.fanout[i] > res.hdr.Trigrams || (i > 0 && res.fanout[i] < res.fanout[i-1]) {
+			return nil, fmt.Errorf("content index has an invalid fanout table")
+		}
+	}
+	return res, nil
+}
+
+// Close releases the reader of the content index
+func (ci *ContentIndex) Close() error {
+	return closeReader(ci.r)
+}
+
+// Paths lists the paths of the indexed files
+func (ci *ContentIndex) Paths() []string {
+	res := make([]string, 0, len(ci.paths))
+	for _, p := range ci.paths {
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// bucket reads the records of the trigrams which start with b, followed by the record of the next trigram
+func (ci *ContentIndex) bucket(b byte) ([]byte, error) {
+	ci.mu.Lock()
+	defer ci.mu.Unlock()
+
+	if res, ok := ci.buckets[b]; ok {
+		return res, nil
+	}
+	var start uint32
+	if b > 0 {
+		start = ci.fanout[b-1]
+	}
+	count := ci.fanout[b] - start + 1
+	res := make([]byte, int(count)*contentTrigramSize)
+	off := ci.hdr.FanoutOff + contentFanoutSize + uint64(start)*contentTrigramSize
+	n, err := ci.r.ReadAt(res, int64(off))
+	if err != nil && !(errors.Is(err, io.EOF) && n == len(res)) {
+		return nil, fmt.Errorf("cannot read trigrams: %w", err)
+	}
+	ci.buckets[b] = res
+	return res, nil
+}
+
+// postings returns the numbers of the files which contain a trigram
+func (ci *ContentIndex) postings(tri uint32) ([]uint32, error) {
+	bucket, err := ci.bucket(byte(tri >> 16))
+	if err != nil {
+		return nil, err
+	}
+	count := len(bucket)/contentTrigramSize - 1
+	i := sort.Search(count, func(i int) bool {
+		return binary.LittleEndian.Uint32(bucket[i*contentTrigramSize:]) >= tri
+	})
+	if i == count || binary.LittleEndian.Uint32(bucket[i*contentTrigramSize:]) != tri {
+		return nil, nil
+	}
+	start := binary.LittleEndian.Uint64(bucket[i*contentTrigramSize+4:])
+	end := binary.LittleEndian.Uint64(bucket[(i+1)*contentTrigramSize+4:])
+	if end < start {
+		return nil, fmt.Errorf("content index has an invalid trigram table")
+	}
+
+	buf := make([]byte, end-start)
+	n, err := ci.r.ReadAt(buf, int64(ci.hdr.PostingsOff+start))
+	if err != nil && !(errors.Is(err, io.EOF) && n == len(buf)) {
+		return nil, fmt.Errorf("cannot read posting list: %w", err)
+	}
+	var (
+		res  []uint32
+		last uint64
+	)
+	for len(buf) > 0 {
+		d, k := binary.Uvarint(buf)
+		if k <= 0 || last+d >= uint64(ci.hdr.Files) {
+			return nil, fmt.Errorf("content index has an invalid posting list")
+		}
+		last += d
+		res = append(res, uint32(last))
+		buf = buf[k:]
+	}
+	return res, nil
+}
+
+// Candidates lists the paths of the files which can contain a match of the regular expression, sorted.
+// Files which aren't part of the content index are never listed.
+func (ci *ContentIndex) Candidates(pattern string) ([]string, error) {
+	q, err := trigramQueryOf(pattern)
+	if err != nil {
+		return nil, err
+	}
+	ids, all, err := ci.eval(q)
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		res := ci.Paths()
+		sort.Strings(res)
+		return res, nil
+	}
+	res := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if p := ci.paths[id]; p != "" {
+			res = append(res, p)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// eval returns the sorted numbers of the files which pass a query, or all if it doesn't restrict them
+func (ci *ContentIndex) eval(q *trigramQuery) (ids []uint32, all bool, err error) {
+	switch q.Op {
+	case queryAll:
+		return nil, true, nil
+	case queryNone:
+		return nil, false, nil
+	}
+
+	// an and query starts out with all files and narrows them down, an or query starts with none
+	all = q.Op == queryAnd
+	add := func(p []uint32, pAll bool) {
+		switch {
+		case q.Op == queryOr && (all || pAll):
+			ids, all = nil, true
+		case q.Op == queryOr:
+			ids = mergePostings(ids, p)
+		case pAll:
+		case all:
+			ids, all = p, false
+		default:
+			ids = intersectPostings(ids, p)
+		}
+	}
+	for _, t := range q.Trigrams {
+		p, err := ci.postings(t)
+		if err != nil {
+			return nil, false, err
+		}
+		add(p, false)
+	}
+	for _, sub := range q.Sub {
+		p, pAll, err := ci.eval(sub)
+		if err != nil {
+			return nil, false, err
+		}
+		add(p, pAll)
+	}
+	return ids, all, nil
+}
+
+func intersectPostings(a, b []uint32) []uint32 {
+	var res []uint32
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	return res
+}
+
+func mergePostings(a, b []uint32) []uint32 {
+	res := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] < b[j]:
+			res = append(res, a[i])
+			i++
+		case a[i] > b[j]:
+			res = append(res, b[j])
+			j++
+		default:
+			res = append(res, a[i])
+			i++
+			j++
+		}
+	}
+	res = append(res, a[i:]...)
+	return append(res, b[j:]...)
+}
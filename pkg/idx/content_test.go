@@ -0,0 +1,216 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestContentIndex(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "b/", Mode: 0755})
+	for _, f := range []struct{ Name, Content string }{
+		{"a/hello.go", "package a\n\nfunc HelloWorld() {}\n"},
+		{"a/bye.go", "package a\n\nfunc Goodbye() {}\n\nvar x = 42\n"},
+		{"b/kelvin.txt", "0 Kelvin\n"},
+		{"b/blob", "Hello\x00World"},
+		{"dup.txt", "Hello"},
+		{"dup.txt", "second version"},
+	} {
+		tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.Name, Mode: 0644, Size: int64(len(f.Content))})
+		tarw.Write([]byte(f.Content))
+	}
+	tarw.Close()
+	archive := buf.Bytes()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	builder := idx.NewContentIndexBuilder()
+	err = idx.ProduceIndexWithOptions(db, bytes.NewReader(archive), idx.ProduceOptions{ContentIndex: builder})
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact := bytes.NewBuffer(nil)
+	err = idx.WriteCompactIndex(db, compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.NewBuffer(nil)
+	err = idx.WriteContentIndex(builder, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for fn, c := range map[string][]byte{"archive.tar": archive, "archive.index": compact.Bytes(), "archive.trigrams": content.Bytes()} {
+		err = os.WriteFile(filepath.Join(dir, fn), c, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	tests := []struct {
+		Pattern    string
+		Candidates []string
+		Matches    []string
+	}{
+		{
+			Pattern:    "Hello",
+			Candidates: []string{"a/hello.go"},
+			Matches:    []string{"a/hello.go:3:func HelloWorld() {}"},
+		},
+		{
+			Pattern:    "(?i)HELLO",
+			Candidates: []string{"a/hello.go"},
+			Matches:    []string{"a/hello.go:3:func HelloWorld() {}"},
+		},
+		{
+			Pattern:    "(?i)kelvin",
+			Candidates: []string{"b/kelvin.txt"},
+			Matches:    []string{"b/kelvin.txt:1:0 Kelvin"},
+		},
+		{
+			Pattern:    `Good(bye|night)\(`,
+			Candidates: []string{"a/bye.go"},
+			Matches:    []string{"a/bye.go:3:func Goodbye() {}"},
+		},
+		{
+			Pattern:    `x = \d+$`,
+			Candidates: []string{"a/bye.go"},
+			Matches:    []string{"a/bye.go:5:var x = 42"},
+		},
+		{
+			Pattern:    "^package a",
+			Candidates: []string{"a/bye.go", "a/hello.go"},
+			Matches:    []string{"a/bye.go:1:package a", "a/hello.go:1:package a"},
+		},
+		{
+			Pattern:    "^$",
+			Candidates: []string{"a/bye.go", "a/hello.go", "b/kelvin.txt", "dup.txt"},
+			Matches:    []string{"a/bye.go:2:", "a/bye.go:4:", "a/hello.go:2:"},
+		},
+		{
+			Pattern:    "sec.*version",
+			Candidates: []string{"dup.txt"},
+			Matches:    []string{"dup.txt:1:second version"},
+		},
+		{
+			Pattern:    "World",
+			Candidates: []string{"a/hello.go"},
+			Matches:    []string{"a/hello.go:3:func HelloWorld() {}"},
+		},
+		{
+			Pattern:    "nowhere",
+			Candidates: []string{},
+		},
+	}
+
+	loc, err := idx.DefaultContentIndexLocation(srv.URL+"/archive.tar", idx.OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := srv.URL + "/archive.trigrams"; loc != exp {
+		t.Errorf("DefaultContentIndexLocation() = %s, want %s", loc, exp)
+	}
+	for name, location := range map[string]string{"local": filepath.Join(dir, "archive.tar"), "remote": srv.URL + "/archive.tar"} {
+		t.Run(name, func(t *testing.T) {
+			index, err := idx.Open(context.Background(), location, idx.OpenOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer index.Close()
+			loc, err := idx.DefaultContentIndexLocation(location, idx.OpenOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ci, err := idx.OpenContentIndexFile(loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ci.Close()
+
+			for _, test := range tests {
+				candidates, err := ci.Candidates(test.Pattern)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(test.Candidates, candidates); diff != "" {
+					t.Errorf("Candidates(%q) mismatch (-want +got):\n%s", test.Pattern, diff)
+				}
+
+				var matches []string
+				err = idx.Search(context.Background(), index, regexp.MustCompile(test.Pattern), candidates, func(m idx.SearchMatch) error {
+					matches = append(matches, fmt.Sprintf("%s:%d:%s", m.Path, m.Line, m.Text))
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff(test.Matches, matches); diff != "" {
+					t.Errorf("Search(%q) mismatch (-want +got):\n%s", test.Pattern, diff)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchLargeFile(t *testing.T) {
+	// lines span buffer boundaries, and a line longer than the buffer comes first
+	lines := []string{strings.Repeat("x", 100<<10) + "needle"}
+	for i := 2; i <= 20000; i++ {
+		lines = append(lines, fmt.Sprintf("line %d", i))
+	}
+	lines[14999] = "another needle"
+	content := strings.Join(lines, "\n") + "\n"
+
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "big.txt", Mode: 0644, Size: int64(len(content))})
+	tarw.Write([]byte(content))
+	tarw.Close()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.ProduceIndex(db, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := idx.OpenTarIndex(db, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	var matches []string
+	err = idx.Search(context.Background(), index, regexp.MustCompile("needle$"), nil, func(m idx.SearchMatch) error {
+		matches = append(matches, fmt.Sprintf("%s:%d:%d", m.Path, m.Line, len(m.Text)))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{fmt.Sprintf("big.txt:1:%d", len(lines[0])), "big.txt:15000:14"}, matches); diff != "" {
+		t.Errorf("Search() mismatch (-want +got):\n%s", diff)
+	}
+}
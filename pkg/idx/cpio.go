@@ -0,0 +1,275 @@
+package idx
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	cpioHeaderSize   = 110
+	cpioMagicNewc    = "070701"
+	cpioMagicCRC     = "070702"
+	cpioTrailerName  = "TRAILER!!!"
+	cpioModeTypeMask = 0170000
+)
+
+const (
+	cpioTypeSocket  = 0140000
+	cpioTypeSymlink = 0120000
+	cpioTypeReg     = 0100000
+	cpioTypeBlock   = 0060000
+	cpioTypeDir     = 0040000
+	cpioTypeChar    = 0020000
+	cpioTypeFifo    = 0010000
+)
+
+type cpioHeader struct {
+	Ino       uint32
+	Mode      uint32
+	UID       uint32
+	GID       uint32
+	Nlink     uint32
+	Mtime     uint32
+	FileSize  uint32
+	DevMajor  uint32
+	DevMinor  uint32
+	RDevMajor uint32
+	RDevMinor uint32
+	NameSize  uint32
+	Check     uint32
+}
+
+// cpioInode identifies the inode an entry belongs to, which is how cpio expresses hard links
+type cpioInode struct {
+	DevMajor, DevMinor, Ino uint32
+}
+
+// ProduceIndexFromCpioFile indexes a cpio archive in the newc or crc format, e.g. an initramfs image.
+// Entries are stored in the same layout as ProduceIndexFromTarFile produces it. Hard links are resolved
+// to regular files pointing to the content of their inode.
+func ProduceIndexFromCpioFile(db *badger.DB, in io.Reader) error {
+	return produceCpioIndex(db, in, nil)
+}
+
+func produceCpioIndex(db *badger.DB, in io.Reader, progress *Progress) error {
+	indexingR := &indexingReader{
+		Reader: in,
+	}
+	r := bufio.NewReaderSize(indexingR, streamBufferSize)
+	offset := func() int64 { return indexingR.Offset - int64(r.Buffered()) }
+	w := newIndexWriter(db, progress)
+	defer w.Cancel()
+
+	// Hard links share an inode and only one of the links carries the content.
+	// We hold off on writing them until we've seen the entire archive.
+	hardlinks := make(map[cpioInode][]indexEntry)
+
+	var rawHdr [cpioHeaderSize]byte
+	for {
+		pfx, err := r.Peek(4)
+		if err == io.EOF && len(pfx) == 0 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(pfx, []byte{0, 0, 0, 0}) {
+			// padding after the trailer of an archive
+			_, _ = r.Discard(4)
+			continue
+		}
+
+		_, err = io.ReadFull(r, rawHdr[:])
+		if err != nil {
+			return fmt.Errorf("cannot read cpio header at offset %d: %w", offset(), err)
+		}
+		magic := string(rawHdr[:6])
+		if magic != cpioMagicNewc && magic != cpioMagicCRC {
+			return fmt.Errorf("unsupported cpio header at offset %d: %q", offset()-cpioHeaderSize, rawHdr[:6])
+		}
+
+		hdr, err := parseCpioHeader(rawHdr[:])
+		if err != nil {
+			return err
+		}
+		name := make([]byte, hdr.NameSize)
+		_, err = io.ReadFull(r, name)
+		if err != nil {
+			return fmt.Errorf("cannot read cpio entry name: %w", err)
+		}
+		_, err = r.Discard(cpioPadding(cpioHeaderSize + int64(hdr.NameSize)))
+		if err != nil {
+			return err
+		}
+
+		entry := indexEntry{
+			Offset: offset(),
+			TarHeader: &tar.Header{
+				Name:     string(bytes.TrimRight(name, "\x00")),
+				Mode:     int64(hdr.Mode &^ cpioModeTypeMask),
+				Uid:      int(hdr.UID),
+				Gid:      int(hdr.GID),
+				Size:     int64(hdr.FileSize),
+				ModTime:  time.Unix(int64(hdr.Mtime), 0),
+				Devmajor: int64(hdr.RDevMajor),
+				Devminor: int64(hdr.RDevMinor),
+			},
+		}
+		if entry.TarHeader.Name == cpioTrailerName {
+			// concatenated archives, e.g. early microcode followed by the actual initramfs, may follow
+			continue
+		}
+
+		var (
+			content []byte
+			sum     uint32
+		)
+		switch hdr.Mode & cpioModeTypeMask {
+		case cpioTypeSymlink:
+			content = make([]byte, hdr.FileSize)
+			_, err = io.ReadFull(r, content)
+			for _, b := range content {
+				sum += uint32(b)
+			}
+		default:
+			sum, err = discardCpioContent(r, int64(hdr.FileSize))
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read content of %s: %w", entry.TarHeader.Name, err)
+		}
+		if magic == cpioMagicCRC && sum != hdr.Check {
+			return fmt.Errorf("checksum mismatch for %s", entry.TarHeader.Name)
+		}
+		_, err = r.Discard(cpioPadding(int64(hdr.FileSize)))
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		th := entry.TarHeader
+		th.Name = strings.TrimSuffix(strings.TrimPrefix(th.Name, "./"), "/")
+		if th.Name == "." || th.Name == "" {
+			continue
+		}
+		switch hdr.Mode & cpioModeTypeMask {
+		case cpioTypeReg:
+			th.Typeflag = tar.TypeReg
+		case cpioTypeDir:
+			th.Typeflag, th.Size = tar.TypeDir, 0
+		case cpioTypeSymlink:
+			th.Typeflag, th.Linkname, th.Size = tar.TypeSymlink, string(content), 0
+		case cpioTypeChar:
+			th.Typeflag = tar.TypeChar
+		case cpioTypeBlock:
+			th.Typeflag = tar.TypeBlock
+		case cpioTypeFifo:
+			th.Typeflag = tar.TypeFifo
+		default:
+			log.WithField("name", th.Name).WithField("mode", strconv.FormatUint(uint64(hdr.Mode), 8)).Warn("skipping unsupported cpio entry")
+			continue
+		}
+
+		if th.Typeflag == tar.TypeReg && hdr.Nlink > 1 {
+			ino := cpioInode{DevMajor: hdr.DevMajor, DevMinor: hdr.DevMinor, Ino: hdr.Ino}
+			hardlinks[ino] = append(hardlinks[ino], entry)
+			continue
+		}
+
+		err = w.Put(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, links := range hardlinks {
+		var data *indexEntry
+		for i := range links {
+			if links[i].TarHeader.Size > 0 {
+				data = &links[i]
+			}
+		}
+		for _, l := range links {
+			if data != nil {
+				l.Offset, l.TarHeader.Size = data.Offset, data.TarHeader.Size
+			}
+			err := w.Put(l)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	w.SetBytes(offset())
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	_ = db.Flatten(5)
+
+	return nil
+}
+
+func parseCpioHeader(raw []byte) (*cpioHeader, error) {
+	var fields [13]uint32
+	for i := range fields {
+		s := raw[6+i*8 : 6+(i+1)*8]
+		v, err := strconv.ParseUint(string(s), 16, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cpio header field %q: %w", s, err)
+		}
+		fields[i] = uint32(v)
+	}
+	return &cpioHeader{
+		Ino:       fields[0],
+		Mode:      fields[1],
+		UID:       fields[2],
+		GID:       fields[3],
+		Nlink:     fields[4],
+		Mtime:     fields[5],
+		FileSize:  fields[6],
+		DevMajor:  fields[7],
+		DevMinor:  fields[8],
+		RDevMajor: fields[9],
+		RDevMinor: fields[10],
+		NameSize:  fields[11],
+		Check:     fields[12],
+	}, nil
+}
+
+// cpioPadding returns the number of bytes needed to align n to four bytes
+func cpioPadding(n int64) int {
+	return int((4 - n%4) % 4)
+}
+
+// discardCpioContent skips over the content of an entry and computes the checksum used by the crc format
+func discardCpioContent(r *bufio.Reader, n int64) (sum uint32, err error) {
+	for n > 0 {
+		buf, err := r.Peek(int(minInt64(n, int64(r.Size()))))
+		if len(buf) == 0 && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		for _, b := range buf {
+			sum += uint32(b)
+		}
+		_, _ = r.Discard(len(buf))
+		n -= int64(len(buf))
+	}
+	return sum, nil
+}
+
+func minInt64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,154 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type cpioFile struct {
+	Name    string
+	Content string
+	Mode    uint32
+	Ino     uint32
+	Nlink   uint32
+	RDev    [2]uint32
+}
+
+// buildCpio produces a cpio archive in the newc format
+func buildCpio(t *testing.T, files ...cpioFile) []byte {
+	buf := bytes.NewBuffer(nil)
+	pad := func() {
+		for buf.Len()%4 != 0 {
+			buf.WriteByte(0)
+		}
+	}
+	write := func(f cpioFile) {
+		nlink := f.Nlink
+		if nlink == 0 {
+			nlink = 1
+		}
+		fmt.Fprintf(buf, "070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+			f.Ino, f.Mode, 0, 33333, nlink, 1234567890, len(f.Content), 0, 0, f.RDev[0], f.RDev[1], len(f.Name)+1, 0)
+		buf.WriteString(f.Name + "\x00")
+		pad()
+		buf.WriteString(f.Content)
+		pad()
+	}
+	for _, f := range files {
+		write(f)
+	}
+	write(cpioFile{Name: "TRAILER!!!"})
+	// archives are commonly padded to a multiple of 512 bytes
+	buf.Write(make([]byte, 512-buf.Len()%512))
+	return buf.Bytes()
+}
+
+func TestProduceIndex(t *testing.T) {
+	archive := buildCpio(t,
+		cpioFile{Name: ".", Mode: syscall.S_IFDIR | 0755, Ino: 1},
+		cpioFile{Name: "etc", Mode: syscall.S_IFDIR | 0755, Ino: 2},
+		cpioFile{Name: "etc/hostname", Mode: syscall.S_IFREG | 0644, Ino: 3, Content: "initrd"},
+		cpioFile{Name: "bin", Mode: syscall.S_IFDIR | 0755, Ino: 4},
+		cpioFile{Name: "bin/sh", Mode: syscall.S_IFREG | 0755, Ino: 5, Nlink: 2},
+		cpioFile{Name: "bin/busybox", Mode: syscall.S_IFREG | 0755, Ino: 5, Nlink: 2, Content: "busybox"},
+		cpioFile{Name: "init", Mode: syscall.S_IFLNK | 0777, Ino: 6, Content: "bin/sh"},
+		cpioFile{Name: "dev", Mode: syscall.S_IFDIR | 0755, Ino: 7},
+		cpioFile{Name: "dev/console", Mode: syscall.S_IFCHR | 0600, Ino: 8, RDev: [2]uint32{5, 1}},
+	)
+	cpioExpectation := []string{
+		"bin/",
+		"bin/busybox:busybox",
+		"bin/sh:busybox",
+		"dev/",
+		"dev/console:",
+		"etc/",
+		"etc/hostname:initrd",
+		"init->bin/sh",
+	}
+
+	tests := []struct {
+		Name        string
+		Archive     []byte
+		Expectation []string
+	}{
+		{Name: "cpio", Archive: archive, Expectation: cpioExpectation},
+		{Name: "cpio gzip", Archive: gzipMembers(t, archive[:200], archive[200:]), Expectation: cpioExpectation},
+		{
+			Name: "tar gzip",
+			Archive: gzipMembers(t, buildTar(t,
+				tarFile{Name: "etc/", Type: tar.TypeDir},
+				tarFile{Name: "etc/hostname", Type: tar.TypeReg, Content: "tar"},
+			)),
+			Expectation: []string{"etc/", "etc/hostname:tar"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			err = idx.ProduceIndex(db, bytes.NewReader(test.Archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			index, err := idx.OpenTarIndex(db, bytes.NewReader(test.Archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(test.Expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("ProduceIndex() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProduceIndexFromCpioFileDevices(t *testing.T) {
+	archive := buildCpio(t,
+		cpioFile{Name: "console", Mode: syscall.S_IFCHR | 0600, Ino: 1, RDev: [2]uint32{5, 1}},
+	)
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = idx.ProduceIndexFromCpioFile(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := idx.OpenTarIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(root) != 1 {
+		t.Fatalf("expected a single entry, got %d", len(root))
+	}
+
+	var attr fuse.Attr
+	_, err = root[0].Getattr(&attr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := root[0].StableMode(); mode != syscall.S_IFCHR {
+		t.Errorf("unexpected mode %o", mode)
+	}
+	if attr.Rdev != 5<<8|1 {
+		t.Errorf("unexpected rdev %x", attr.Rdev)
+	}
+}
@@ -0,0 +1,239 @@
+package idx
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// ChangeKind describes how an entry changed between two indices
+type ChangeKind string
+
+const (
+	ChangeAdded    ChangeKind = "added"
+	ChangeRemoved  ChangeKind = "removed"
+	ChangeModified ChangeKind = "modified"
+)
+
+// Change is an entry which differs between two indices
+type Change struct {
+	Path string     `json:"path"`
+	Kind ChangeKind `json:"kind"`
+	// Fields lists what changed about modified entries: type, size, mode, mtime, digest or target
+	Fields []string   `json:"fields,omitempty"`
+	Old    *EntryInfo `json:"old,omitempty"`
+	New    *EntryInfo `json:"new,omitempty"`
+}
+
+// EntryInfo is the metadata Diff compares entries by
+type EntryInfo struct {
+	Dir    bool      `json:"dir,omitempty"`
+	Size   uint64    `json:"size"`
+	Mode   uint32    `json:"mode"`
+	Mtime  time.Time `json:"mtime"`
+	Digest string    `json:"digest,omitempty"`
+	Target string    `json:"target,omitempty"`
+	// Aggregate holds the totals of directories if the index records them. Only QueryIndex sets it.
+	Aggregate *DirAggregate `json:"aggregate,omitempty"`
+}
+
+// Diff compares two indices using their metadata only, i.e. without reading any content. Entries
+// are modified if their type, size, mode, modification time, symlink target or, if both indices
+// know it, digest differ. Directories whose digests are equal are not descended into.
+// Changes are ordered depth-first and by name, and the content of added and removed directories is
+// listed too.
+func Diff(ctx context.Context, from, to Index) ([]Change, error) {
+	oldRoot, err := from.RootEntries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list old root: %w", err)
+	}
+	newRoot, err := to.RootEntries(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list new root: %w", err)
+	}
+	d := &differ{Old: from, New: to}
+	err = d.diff(ctx, "", oldRoot, newRoot)
+	if err != nil {
+		return nil, err
+	}
+	return d.Changes, nil
+}
+
+type differ struct {
+	Old, New Index
+	Changes  []Change
+}
+
+func (d *differ) diff(ctx context.Context, prefix string, from, to []Entry) error {
+	oldByName := make(map[string]Entry, len(from))
+	for _, e := range from {
+		oldByName[e.Name()] = e
+	}
+	newByName := make(map[string]Entry, len(to))
+	names := make([]string, 0, len(from)+len(to))
+	for _, e := range to {
+		newByName[e.Name()] = e
+		names = append(names, e.Name())
+	}
+	for _, e := range from {
+		if _, ok := newByName[e.Name()]; !ok {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := prefix + name
+		o, n := oldByName[name], newByName[name]
+		switch {
+		case o == nil:
+			err := d.all(ctx, ChangeAdded, p, d.New, n)
+			if err != nil {
+				return err
+			}
+			continue
+		case n == nil:
+			err := d.all(ctx, ChangeRemoved, p, d.Old, o)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		oi, err := entryInfo(o)
+		if err != nil {
+			return fmt.Errorf("cannot stat old %s: %w", p, err)
+		}
+		ni, err := entryInfo(n)
+		if err != nil {
+			return fmt.Errorf("cannot stat new %s: %w", p, err)
+		}
+		if fields := changedFields(oi, ni); len(fields) > 0 {
+			d.Changes = append(d.Changes, Change{Path: p, Kind: ChangeModified, Fields: fields, Old: oi, New: ni})
+		}
+
+		switch {
+		case o.Dir() && n.Dir():
+			if oi.Digest != "" && oi.Digest == ni.Digest {
+				continue
+			}
+			oc, err := d.Old.Children(ctx, o)
+			if err != nil {
+				return fmt.Errorf("cannot list old %s: %w", p, err)
+			}
+			nc, err := d.New.Children(ctx, n)
+			if err != nil {
+				return fmt.Errorf("cannot list new %s: %w", p, err)
+			}
+			err = d.diff(ctx, p+"/", oc, nc)
+			if err != nil {
+				return err
+			}
+		case o.Dir():
+			err = d.children(ctx, ChangeRemoved, p, d.Old, o)
+		case n.Dir():
+			err = d.children(ctx, ChangeAdded, p, d.New, n)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// all records an entry and, if it's a directory, everything below it as added or removed
+func (d *differ) all(ctx context.Context, kind ChangeKind, p string, index Index, e Entry) error {
+	info, err := entryInfo(e)
+	if err != nil {
+		return fmt.Errorf("cannot stat %s: %w", p, err)
+	}
+	c := Change{Path: p, Kind: kind}
+	if kind == ChangeAdded {
+		c.New = info
+	} else {
+		c.Old = info
+	}
+	d.Changes = append(d.Changes, c)
+
+	if !e.Dir() {
+		return nil
+	}
+	return d.children(ctx, kind, p, index, e)
+}
+
+// children records everything below the directory e as added or removed
+func (d *differ) children(ctx context.Context, kind ChangeKind, p string, index Index, e Entry) error {
+	children, err := index.Children(ctx, e)
+	if err != nil {
+		return fmt.Errorf("cannot list %s: %w", p, err)
+	}
+	sort.Slice(children, func(i, j int) bool { return children[i].Name() < children[j].Name() })
+	for _, c := range children {
+		err = d.all(ctx, kind, p+"/"+c.Name(), index, c)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func entryInfo(e Entry) (*EntryInfo, error) {
+	var attr fuse.Attr
+	_, err := e.Getattr(&attr)
+	if err != nil {
+		return nil, err
+	}
+	// backends differ in whether they include the type in the mode, hence we take it from the stable mode
+	typ := e.StableMode()
+	if typ == 0 {
+		typ = syscall.S_IFREG
+	}
+	res := &EntryInfo{
+		Dir:   e.Dir(),
+		Mode:  typ&syscall.S_IFMT | attr.Mode&07777,
+		Mtime: time.Unix(int64(attr.Mtime), int64(attr.Mtimensec)).UTC(),
+	}
+	if !res.Dir {
+		res.Size = attr.Size
+	}
+	if de, ok := e.(DigestEntry); ok {
+		res.Digest = de.Digest()
+	}
+	if se, ok := e.(SymlinkEntry); ok && e.StableMode() == syscall.S_IFLNK {
+		res.Target, err = se.Readlink()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func changedFields(a, b *EntryInfo) []string {
+	var res []string
+	if a.Dir != b.Dir || a.Mode&syscall.S_IFMT != b.Mode&syscall.S_IFMT {
+		res = append(res, "type")
+	}
+	if a.Size != b.Size {
+		res = append(res, "size")
+	}
+	if a.Mode&07777 != b.Mode&07777 {
+		res = append(res, "mode")
+	}
+	if !a.Mtime.Equal(b.Mtime) {
+		res = append(res, "mtime")
+	}
+	if a.Digest != "" && b.Digest != "" && a.Digest != b.Digest && !a.Dir && !b.Dir {
+		res = append(res, "digest")
+	}
+	if a.Target != b.Target {
+		res = append(res, "target")
+	}
+	return res
+}
@@ -0,0 +1,127 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDiff(t *testing.T) {
+	mtime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	type tarEntry struct {
+		Header  *tar.Header
+		Content string
+	}
+	index := func(entries ...tarEntry) idx.Index {
+		buf := bytes.NewBuffer(nil)
+		tarw := tar.NewWriter(buf)
+		for _, e := range entries {
+			e.Header.Size = int64(len(e.Content))
+			if e.Header.Mode == 0 {
+				e.Header.Mode = 0644
+			}
+			if e.Header.ModTime.IsZero() {
+				e.Header.ModTime = mtime
+			}
+			tarw.WriteHeader(e.Header)
+			tarw.Write([]byte(e.Content))
+		}
+		tarw.Close()
+
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.ProduceIndexWithOptions(db, bytes.NewReader(buf.Bytes()), idx.ProduceOptions{ContentDigests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := idx.OpenTarIndex(db, bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Close() })
+		return res
+	}
+	dir := func(name string) tarEntry {
+		return tarEntry{Header: &tar.Header{Typeflag: tar.TypeDir, Name: name, Mode: 0755}}
+	}
+	file := func(name, content string) tarEntry {
+		return tarEntry{Header: &tar.Header{Typeflag: tar.TypeReg, Name: name}, Content: content}
+	}
+	symlink := func(name, target string) tarEntry {
+		return tarEntry{Header: &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: target, Mode: 0777}}
+	}
+
+	from := index(
+		dir("a/"),
+		file("a/x", "1"),
+		file("a/y", "y"),
+		symlink("link", "a/x"),
+		dir("gone/"),
+		file("gone/f", "f"),
+		file("same.txt", "same"),
+		file("mode.txt", "mode"),
+		file("touched.txt", "touched"),
+		dir("t/"),
+		file("t/child", "c"),
+	)
+	touched := file("touched.txt", "touched")
+	touched.Header.ModTime = mtime.Add(time.Hour)
+	mode := file("mode.txt", "mode")
+	mode.Header.Mode = 0755
+	to := index(
+		dir("a/"),
+		file("a/x", "2"),
+		file("a/y", "y"),
+		file("a/z", "zzz"),
+		symlink("link", "a/y"),
+		mode,
+		dir("new/"),
+		file("new/g", "g"),
+		file("same.txt", "same"),
+		touched,
+		file("t", "now a file"),
+	)
+
+	changes, err := idx.Diff(context.Background(), from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	act := make([]string, 0, len(changes))
+	for _, c := range changes {
+		act = append(act, strings.TrimSpace(fmt.Sprintf("%s %s %s", c.Kind, c.Path, strings.Join(c.Fields, ","))))
+	}
+	expectation := []string{
+		"modified a/x digest",
+		"added a/z",
+		"removed gone",
+		"removed gone/f",
+		"modified link target",
+		"modified mode.txt mode",
+		"added new",
+		"added new/g",
+		"modified t type,size,mode",
+		"removed t/child",
+		"modified touched.txt mtime",
+	}
+	if diff := cmp.Diff(expectation, act); diff != "" {
+		t.Errorf("Diff() mismatch (-want +got):\n%s", diff)
+	}
+
+	changes, err = idx.Diff(context.Background(), from, from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("an index differs from itself: %v", changes)
+	}
+}
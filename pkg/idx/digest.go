@@ -0,0 +1,83 @@
+package idx
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// metaKeyDigest holds the content digest of the index, see IndexDigest
+const metaKeyDigest = metaKeyPrefix + "digest"
+
+// IndexDigest computes the content digest of an index: the SHA-256 of its entries, encoded like
+// compact index records followed by their names and content digests, the directory aggregates
+// and the metadata. The digest depends on the archive the index was produced from and the options
+// it was produced with only, not on when the index was produced, or the format it's stored in.
+// Compact indices don't keep content digests, but carry over the digest stored in the index.
+func IndexDigest(db *badger.DB) (string, error) {
+	entries, meta, err := loadIndexEntries(db)
+	if err != nil {
+		return "", err
+	}
+	delete(meta, strings.TrimPrefix(metaKeyDigest, metaKeyPrefix))
+
+	h := sha256.New()
+	rec := make([]byte, compactEntrySize)
+	writeString := func(s string) {
+		h.Write(binary.AppendUvarint(nil, uint64(len(s))))
+		h.Write([]byte(s))
+	}
+	for _, e := range entries {
+		for i := range rec {
+			rec[i] = 0
+		}
+		putCompactEntry(rec, e, 0, 0)
+		h.Write(rec)
+		writeString(e.TarHeader.Name)
+		writeString(e.TarHeader.Linkname)
+		writeString(e.Digest)
+	}
+
+	aggregates := dirAggregates(entries)
+	dirs := make([]string, 0, len(aggregates))
+	for dir := range aggregates {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	aggr := make([]byte, compactAggregateSize)
+	for _, dir := range dirs {
+		writeString(dir)
+		putCompactAggregate(aggr, aggregates[dir])
+		h.Write(aggr)
+	}
+	// maps are marshalled in key order
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return "", err
+	}
+	h.Write(metaJSON)
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// StoreIndexDigest computes the content digest of an index and stores it in the index metadata,
+// from where it's carried over into compact and paged indices
+func StoreIndexDigest(db *badger.DB) (string, error) {
+	digest, err := IndexDigest(db)
+	if err != nil {
+		return "", err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(metaKeyDigest), []byte(digest))
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot store index digest: %w", err)
+	}
+	return digest, nil
+}
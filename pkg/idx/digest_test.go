@@ -0,0 +1,155 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+)
+
+func TestIndexDigest(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "foo/", Mode: 0755, Uid: 1000, Gid: 1000})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "foo/bar.txt", Mode: 0644, Size: int64(len(fileFooSlashBarTXT))})
+	tarw.Write([]byte(fileFooSlashBarTXT))
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "foo/link", Linkname: "../hello.txt", Mode: 0777})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hello.txt", Mode: 0600, Uid: 33333, Gid: 33333, Size: int64(len(fileHelloTXT))})
+	tarw.Write([]byte(fileHelloTXT))
+	tarw.Close()
+	archive := buf.Bytes()
+
+	type build struct {
+		Digest  string
+		Compact []byte
+		Paged   []byte
+		Archive []byte
+	}
+	produce := func(archive []byte, opts idx.ProduceOptions) build {
+		// badger directories differ between runs, hence produce into a fresh one every time
+		db, err := badger.Open(badger.DefaultOptions(t.TempDir()).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		err = idx.ProduceIndexWithOptions(db, bytes.NewReader(archive), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res build
+		res.Digest, err = idx.StoreIndexDigest(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compact, paged, indexArchive := bytes.NewBuffer(nil), bytes.NewBuffer(nil), bytes.NewBuffer(nil)
+		err = idx.WriteCompactIndex(db, compact)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.WritePagedIndex(db, paged)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.WriteIndexArchive(db, indexArchive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Compact, res.Paged, res.Archive = compact.Bytes(), paged.Bytes(), indexArchive.Bytes()
+		return res
+	}
+
+	first := produce(archive, idx.ProduceOptions{})
+	time.Sleep(10 * time.Millisecond)
+	second := produce(archive, idx.ProduceOptions{})
+	if first.Digest != second.Digest {
+		t.Errorf("digests differ: %s != %s", first.Digest, second.Digest)
+	}
+	if !bytes.Equal(first.Compact, second.Compact) {
+		t.Error("compact indices differ")
+	}
+	if !bytes.Equal(first.Paged, second.Paged) {
+		t.Error("paged indices differ")
+	}
+	if !bytes.Equal(first.Archive, second.Archive) {
+		t.Error("index archives differ")
+	}
+
+	// content digests are part of the digest
+	if digests := produce(archive, idx.ProduceOptions{ContentDigests: true}); digests.Digest == first.Digest {
+		t.Error("indices with and without content digests have the same digest")
+	}
+
+	// the digest is carried over into compact and paged indices, and doesn't depend on the format
+	for name, index := range map[string][]byte{"compact": first.Compact, "paged": first.Paged} {
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.ReadCompactIndex(bytes.NewReader(index), int64(len(index)), db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte("\x00wsfs/digest"))
+			if err != nil {
+				return err
+			}
+			return item.Value(func(val []byte) error {
+				if string(val) != first.Digest {
+					t.Errorf("%s index: embedded digest %s, expected %s", name, val, first.Digest)
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			t.Errorf("%s index: cannot read embedded digest: %v", name, err)
+		}
+		digest, err := idx.IndexDigest(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if digest != first.Digest {
+			t.Errorf("%s index: digest %s, expected %s", name, digest, first.Digest)
+		}
+		db.Close()
+	}
+
+	// a different archive yields a different digest
+	buf = bytes.NewBuffer(nil)
+	tarw = tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hello.txt", Mode: 0644, Size: int64(len(fileHelloTXT))})
+	tarw.Write([]byte(fileHelloTXT))
+	tarw.Close()
+	if other := produce(buf.Bytes(), idx.ProduceOptions{}); other.Digest == first.Digest {
+		t.Error("different archives have the same digest")
+	}
+
+	// packing a directory yields the same digest as indexing the packed archive
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "hello.txt"), []byte(fileHelloTXT), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	packed := bytes.NewBuffer(nil)
+	err = idx.Pack(dir, packed, db, idx.PackOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest, err := idx.StoreIndexDigest(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if generated := produce(packed.Bytes(), idx.ProduceOptions{}); generated.Digest != digest {
+		t.Errorf("packed digest %s, expected %s", digest, generated.Digest)
+	}
+}
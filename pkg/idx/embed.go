@@ -0,0 +1,240 @@
+package idx
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+const (
+	// embeddedIndexName is the name of the tar entry which holds an embedded index
+	embeddedIndexName = ".wsfs-index.tar.gz"
+	// embeddedFooterName is the name of the tar entry which points to the embedded index
+	embeddedFooterName = ".wsfs-footer"
+
+	// embeddedFooterMagic starts the content of the footer entry
+	embeddedFooterMagic = "WSFSIDX1"
+	// embeddedFooterSize is the size of the footer content: magic, trailer start, index offset and index size
+	embeddedFooterSize = len(embeddedFooterMagic) + 3*8
+
+	// embeddedFooterSearch is the number of bytes at the end of an archive which we search for the footer.
+	// Tar files end in at least two empty blocks, and are commonly padded to 10KiB records.
+	embeddedFooterSearch = 16 << 10
+)
+
+// embeddedIndex describes an index embedded at the end of a tar file
+type embeddedIndex struct {
+	// Start is the offset of the first trailer entry header, i.e. the end of the original archive
+	Start int64
+	// Offset is the offset of the index content
+	Offset int64
+	// Size is the size of the index content
+	Size int64
+}
+
+// EmbedIndex appends the index to an uncompressed tar file as a trailing tar entry, followed
+// by a fixed footer entry pointing at it. Ordinary tar tools see two extra files. If the
+// archive already has an embedded index, it is replaced.
+//
+// The index must have been produced from the archive and must not be open.
+func EmbedIndex(archive, index string) error {
+	f, err := os.OpenFile(archive, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, 2)
+	_, err = f.ReadAt(magic, 0)
+	if err != nil {
+		return fmt.Errorf("cannot detect archive type: %w", err)
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return fmt.Errorf("can only embed an index in uncompressed tar files")
+	}
+
+	var end int64
+	existing, err := findEmbeddedIndex(f, stat.Size())
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		end = existing.Start
+	} else {
+		end, err = tarEnd(f)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the index archive goes to a temporary file first, so that its size is known and the archive
+	// is left alone until we're ready to write the trailer
+	content, err := os.CreateTemp("", "wsfs-embed-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(content.Name())
+	defer content.Close()
+	db, err := badger.Open(badger.DefaultOptions(index).WithReadOnly(true).WithLogger(nil))
+	if err != nil {
+		return fmt.Errorf("cannot open index: %w", err)
+	}
+	err = firstError(WriteIndexArchive(db, content), db.Close())
+	if err != nil {
+		return fmt.Errorf("cannot pack index: %w", err)
+	}
+	size, err := content.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = content.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Seek(end, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	out := &countingWriter{W: f, N: end}
+	tarw := tar.NewWriter(out)
+	err = tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: embeddedIndexName, Mode: 0644, Size: size, ModTime: time.Unix(0, 0), Format: tar.FormatUSTAR})
+	if err != nil {
+		return err
+	}
+	// the header has been written, so the content starts here
+	footer := embeddedIndex{Start: end, Offset: out.N, Size: size}
+	_, err = io.Copy(tarw, content)
+	if err != nil {
+		return err
+	}
+
+	footerContent := make([]byte, 0, embeddedFooterSize)
+	footerContent = append(footerContent, embeddedFooterMagic...)
+	footerContent = binary.BigEndian.AppendUint64(footerContent, uint64(footer.Start))
+	footerContent = binary.BigEndian.AppendUint64(footerContent, uint64(footer.Offset))
+	footerContent = binary.BigEndian.AppendUint64(footerContent, uint64(footer.Size))
+	err = tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: embeddedFooterName, Mode: 0644, Size: int64(len(footerContent)), ModTime: time.Unix(0, 0), Format: tar.FormatUSTAR})
+	if err != nil {
+		return err
+	}
+	_, err = tarw.Write(footerContent)
+	if err != nil {
+		return err
+	}
+	err = tarw.Close()
+	if err != nil {
+		return err
+	}
+	// drop what's left of a previous, larger trailer
+	return f.Truncate(out.N)
+}
+
+// findEmbeddedIndex looks for the footer of an embedded index at the end of a tar file.
+// It returns nil if the archive has no embedded index.
+func findEmbeddedIndex(r io.ReaderAt, size int64) (*embeddedIndex, error) {
+	n := int64(embeddedFooterSearch)
+	if n > size {
+		n = size
+	}
+	tail := make([]byte, n)
+	_, err := r.ReadAt(tail, size-n)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read end of archive: %w", err)
+	}
+
+	// the footer content starts at a block boundary, right after the header of the footer entry
+	pos := -1
+	for off := (size - 512) &^ 511; off >= size-n+512; off -= 512 {
+		p := int(off - (size - n))
+		if bytes.HasPrefix(tail[p:], []byte(embeddedFooterMagic)) && isEmbeddedFooterHeader(tail[p-512:p]) {
+			pos = p
+			break
+		}
+	}
+	if pos < 0 {
+		return nil, nil
+	}
+	footer := tail[pos+len(embeddedFooterMagic) : pos+embeddedFooterSize]
+	res := &embeddedIndex{
+		Start:  int64(binary.BigEndian.Uint64(footer[0:8])),
+		Offset: int64(binary.BigEndian.Uint64(footer[8:16])),
+		Size:   int64(binary.BigEndian.Uint64(footer[16:24])),
+	}
+	if res.Start < 0 || res.Offset < res.Start || res.Size < 0 || res.Offset+res.Size > size-n+int64(pos) {
+		return nil, fmt.Errorf("invalid embedded index footer")
+	}
+	return res, nil
+}
+
+// isEmbeddedFooterHeader returns true if blk is the tar header of the footer entry, rather than
+// part of a file which happens to start like a footer
+func isEmbeddedFooterHeader(blk []byte) bool {
+	hdr, err := tar.NewReader(bytes.NewReader(blk)).Next()
+	return err == nil && hdr.Typeflag == tar.TypeReg && hdr.Name == embeddedFooterName && hdr.Size == int64(embeddedFooterSize)
+}
+
+// openEmbeddedIndex opens the index embedded in a tar file
+func openEmbeddedIndex(r io.ReaderAt, embedded *embeddedIndex) (Index, error) {
+	db, tmpdir, err := loadIndexArchive(io.NewSectionReader(r, embedded.Offset, embedded.Size))
+	if err != nil {
+		closeReader(r)
+		return nil, fmt.Errorf("cannot load embedded index: %w", err)
+	}
+	res, err := openTarIndex(db, r)
+	if err != nil {
+		firstError(db.Close(), closeReader(r), removeTmpdir(tmpdir))
+		return nil, err
+	}
+	res.Tmpdir = tmpdir
+	return res, nil
+}
+
+// tarEnd finds the end of the last entry of a tar file, i.e. the start of the end-of-archive marker
+func tarEnd(f io.ReadSeeker) (int64, error) {
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	in := &indexingReader{Reader: f}
+	tarf := tar.NewReader(in)
+	var end int64
+	for {
+		_, err := tarf.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("cannot read archive: %w", err)
+		}
+		// reading the content tells where it ends, sparse files included
+		_, err = io.Copy(io.Discard, tarf)
+		if err != nil {
+			return 0, fmt.Errorf("cannot read archive: %w", err)
+		}
+		end = (in.Offset + 511) &^ 511
+	}
+	// whatever follows the last entry, usually the end-of-archive marker, is replaced by the index
+	return end, nil
+}
+
+type countingWriter struct {
+	W io.Writer
+	N int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.W.Write(p)
+	w.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,202 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEmbedIndex(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "foo/", Mode: 0755})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "foo/bar.txt", Mode: 0644, Size: int64(len(fileFooSlashBarTXT))})
+	tarw.Write([]byte(fileFooSlashBarTXT))
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hello.txt", Mode: 0644, Size: int64(len(fileHelloTXT))})
+	tarw.Write([]byte(fileHelloTXT))
+	tarw.Close()
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive.tar")
+	err := os.WriteFile(archive, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embed := func() {
+		index := t.TempDir()
+		db, err := badger.Open(badger.DefaultOptions(index).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, err := os.Open(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = idx.ProduceIndex(db, in)
+		in.Close()
+		db.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = idx.EmbedIndex(archive, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	embed()
+	// embedding again replaces the previous index
+	embed()
+
+	// failing to embed an index leaves the archive alone
+	embedded, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.EmbedIndex(archive, filepath.Join(dir, "missing"))
+	if err == nil {
+		t.Fatal("expected an error embedding a missing index")
+	}
+	if current, err := os.ReadFile(archive); err != nil || !bytes.Equal(embedded, current) {
+		t.Errorf("archive changed after failing to embed an index: %v", err)
+	}
+
+	in, err := os.Open(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	var names []string
+	tarf := tar.NewReader(in)
+	for hdr, err := tarf.Next(); err != io.EOF; hdr, err = tarf.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if diff := cmp.Diff([]string{"foo/", "foo/bar.txt", "hello.txt", ".wsfs-index.tar.gz", ".wsfs-footer"}, names); diff != "" {
+		t.Errorf("archive entries mismatch (-want +got):\n%s", diff)
+	}
+
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer srv.Close()
+
+	// embedded indices are extracted to a temporary directory which is removed on Close
+	tmpdir := t.TempDir()
+	t.Setenv("TMPDIR", tmpdir)
+	extracted := func() int {
+		res, err := filepath.Glob(filepath.Join(tmpdir, "wsfs-index-*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(res)
+	}
+
+	expectation := []string{"foo/", "foo/bar.txt:" + fileFooSlashBarTXT, "hello.txt:" + fileHelloTXT}
+	tests := []struct {
+		Name string
+		Open func() (idx.Index, error)
+	}{
+		{Name: "local", Open: func() (idx.Index, error) { return idx.Open(context.Background(), archive, idx.OpenOptions{}) }},
+		{Name: "http", Open: func() (idx.Index, error) {
+			return idx.Open(context.Background(), srv.URL+"/archive.tar", idx.OpenOptions{})
+		}},
+		{Name: "remote", Open: func() (idx.Index, error) {
+			return idx.OpenRemoteTarIndex(context.Background(), srv.URL+"/archive")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index, err := test.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("embedded index mismatch (-want +got):\n%s", diff)
+			}
+			if n := extracted(); n != 1 {
+				t.Errorf("found %d extracted indices before Close, expected 1", n)
+			}
+			err = index.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := extracted(); n != 0 {
+				t.Errorf("found %d extracted indices after Close, expected none", n)
+			}
+		})
+	}
+}
+
+func TestEmbedIndexUnterminated(t *testing.T) {
+	// a file which looks like a footer and ends in an empty block, without an end-of-archive marker
+	content := "WSFSIDX1" + strings.Repeat("\x00", 1016)
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hello.txt", Mode: 0644, Size: int64(len(fileHelloTXT))})
+	tarw.Write([]byte(fileHelloTXT))
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "footer.bin", Mode: 0644, Size: int64(len(content))})
+	tarw.Write([]byte(content))
+	tarw.Flush()
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive.tar")
+	err := os.WriteFile(archive, buf.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := filepath.Join(dir, "index")
+	db, err := badger.Open(badger.DefaultOptions(index).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.ProduceIndex(db, bytes.NewReader(buf.Bytes()))
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = idx.EmbedIndex(archive, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := idx.Open(context.Background(), archive, idx.OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Close()
+	if diff := cmp.Diff([]string{"footer.bin:" + content, "hello.txt:" + fileHelloTXT}, dumpIndex(t, res)); diff != "" {
+		t.Errorf("embedded index mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestEmbedIndexCompressed(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "archive.tar.gz")
+	err := os.WriteFile(fn, gzipMembers(t, []byte(strings.Repeat("x", 1024))), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.EmbedIndex(fn, t.TempDir())
+	if diff := cmp.Diff("can only embed an index in uncompressed tar files", errString(err)); diff != "" {
+		t.Errorf("EmbedIndex() error mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -5,7 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 	"os"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -17,6 +19,28 @@ import (
 	"golang.org/x/oauth2"
 )
 
+func init() {
+	RegisterBackend(Backend{
+		Name:    "github",
+		Schemes: []string{"github"},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			// github://owner/repo?revision=main
+			if opts.Token == "" {
+				return nil, fmt.Errorf("missing GitHub token")
+			}
+			repo := strings.Trim(src.Path, "/")
+			if src.Host == "" || repo == "" || strings.Contains(repo, "/") {
+				return nil, fmt.Errorf("invalid repo format - must be github://owner/repo")
+			}
+			revision := src.Query().Get("revision")
+			if revision == "" {
+				revision = "main"
+			}
+			return NewGitHubIndex(ctx, opts.Token, src.Host, repo, revision)
+		},
+	})
+}
+
 func NewGitHubIndex(ctx context.Context, ghToken, owner, repo, revision string) (Index, error) {
 	src := oauth2.StaticTokenSource(
 		&oauth2.Token{AccessToken: ghToken},
@@ -29,7 +53,8 @@ func NewGitHubIndex(ctx context.Context, ghToken, owner, repo, revision string)
 		HTTPClient: httpClient,
 		Owner:      owner,
 		Repo:       repo,
-		Revision: revision,
+		Revision:   revision,
+		done:       make(chan struct{}),
 	}
 
 	err := res.fetchRoot(ctx)
@@ -41,7 +66,11 @@ func NewGitHubIndex(ctx context.Context, ghToken, owner, repo, revision string)
 		go func() {
 			var cnt int
 			for {
-				time.Sleep(5 * time.Second)
+				select {
+				case <-res.done:
+					return
+				case <-time.After(5 * time.Second):
+				}
 
 				res.mu.RLock()
 				if cnt == len(res.children) {
@@ -69,6 +98,23 @@ type githubIndex struct {
 
 	children map[string][]*githubEntry
 	mu       sync.RWMutex
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Close implements Index
+func (n *githubIndex) Close() error {
+	n.closeOnce.Do(func() { close(n.done) })
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	for _, children := range n.children {
+		for _, c := range children {
+			c.Close()
+		}
+	}
+	return nil
 }
 
 func (n *githubIndex) fetch(ctx context.Context, path string) ([]*githubEntry, error) {
@@ -81,6 +127,7 @@ func (n *githubIndex) fetch(ctx context.Context, path string) ([]*githubEntry, e
 						Type   githubv4.String
 						Path   githubv4.String
 						Mode   githubv4.Int
+						Oid    githubv4.String
 						Object struct {
 							Blob struct {
 								ByteSize githubv4.Int
@@ -110,6 +157,7 @@ func (n *githubIndex) fetch(ctx context.Context, path string) ([]*githubEntry, e
 	for _, entry := range query.Repository.Object.Tree.Entries {
 		child := &githubEntry{
 			idx:      n,
+			ID:       string(entry.Oid),
 			Fullpath: string(entry.Path),
 			Nme:      string(entry.Name),
 			Mde:      uint32(entry.Mode),
@@ -144,7 +192,7 @@ func (n *githubIndex) RootEntries(ctx context.Context) ([]Entry, error) {
 }
 
 func (n *githubIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
-	
+
 	entry := of.(*githubEntry)
 	n.mu.RLock()
 	children, ok := n.children[entry.Fullpath]
@@ -170,7 +218,7 @@ func (n *githubIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
 	return res, nil
 }
 
-var _ Entry = (*githubEntry)(nil)
+var _ DigestEntry = (*githubEntry)(nil)
 
 type githubEntry struct {
 	idx *githubIndex
@@ -211,6 +259,22 @@ func (e *githubEntry) Name() string {
 	return e.Nme
 }
 
+// Digest implements DigestEntry. Git object IDs cover the content of trees as well as blobs.
+func (e *githubEntry) Digest() string {
+	if e.ID == "" {
+		return ""
+	}
+	return "git:" + e.ID
+}
+
+// Close drops the reader of the entry
+func (e *githubEntry) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.r = nil
+	return nil
+}
+
 // Read implements File
 func (e *githubEntry) Read(dst []byte, offset int64) (n int, err error) {
 	e.mu.Lock()
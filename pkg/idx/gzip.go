@@ -0,0 +1,320 @@
+package idx
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// streamBufferSize is the size of the reads we issue when streaming through a blob.
+// When the blob is served via HTTP this is the size of a single range request.
+const streamBufferSize = 1 << 20
+
+// GzipCheckpoint marks a position in a gzip stream where decompression can start,
+// i.e. the beginning of a gzip member.
+type GzipCheckpoint struct {
+	Compressed   int64
+	Uncompressed int64
+}
+
+// gzipSpillDistance is the distance between checkpoints, in compressed bytes, beyond which
+// gzipReaderAt keeps what it decompressed in a temporary file
+const gzipSpillDistance = 1 << 20
+
+// NewGzipReaderAt provides random access to the uncompressed content of a gzip stream.
+// Decompression starts at the closest checkpoint before the requested offset. Sequential
+// reads continue where the previous read left off, so reading a file front to back
+// does not decompress its predecessors over and over again.
+//
+// Streams whose checkpoints are far apart, e.g. single-member streams which have a checkpoint
+// at their start only, would decompress everything up to the requested offset again on every
+// backward read. For those the decompressed content is kept in a temporary file, so that it's
+// decompressed once at most, at the cost of up to the uncompressed size in disk space.
+func NewGzipReaderAt(r io.ReaderAt, size int64, checkpoints []GzipCheckpoint) io.ReaderAt {
+	cps := make([]GzipCheckpoint, 0, len(checkpoints)+1)
+	cps = append(cps, GzipCheckpoint{})
+	for _, cp := range checkpoints {
+		if cp.Compressed == 0 {
+			continue
+		}
+		cps = append(cps, cp)
+	}
+	sort.Slice(cps, func(i, j int) bool { return cps[i].Uncompressed < cps[j].Uncompressed })
+
+	res := &gzipReaderAt{
+		r:           r,
+		size:        size,
+		checkpoints: cps,
+	}
+	for i, cp := range cps {
+		next := size
+		if i+1 < len(cps) {
+			next = cps[i+1].Compressed
+		}
+		if next-cp.Compressed > gzipSpillDistance {
+			res.spill = &gzipSpill{}
+			break
+		}
+	}
+	return res
+}
+
+type gzipReaderAt struct {
+	r           io.ReaderAt
+	size        int64
+	checkpoints []GzipCheckpoint
+	spill       *gzipSpill
+
+	mu     sync.Mutex
+	cur    *gzip.Reader
+	curOff int64
+}
+
+// ReadAt implements io.ReaderAt
+func (g *gzipReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.spill != nil {
+		// serve what we decompressed before from the spill file, and decompress the rest
+		n, err = g.spill.ReadAt(p, off)
+		if err != nil || n == len(p) {
+			return n, err
+		}
+		m, err := g.decompressAt(p[n:], off+int64(n))
+		return n + m, err
+	}
+	return g.decompressAt(p, off)
+}
+
+func (g *gzipReaderAt) decompressAt(p []byte, off int64) (n int, err error) {
+	cp := g.checkpointFor(off)
+	if g.cur == nil || g.curOff > off || cp.Uncompressed > g.curOff {
+		err = g.restart(cp)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	var r io.Reader = g.cur
+	if g.spill != nil {
+		r = io.TeeReader(g.cur, &gzipSpillWriter{spill: g.spill, off: g.curOff})
+	}
+
+	if skip := off - g.curOff; skip > 0 {
+		n, err := io.CopyN(io.Discard, r, skip)
+		g.curOff += n
+		if err != nil {
+			g.cur = nil
+			return 0, err
+		}
+	}
+
+	n, err = io.ReadFull(r, p)
+	g.curOff += int64(n)
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		err = io.EOF
+	}
+	if err != nil {
+		// the reader is unusable after an error - start over next time
+		g.cur = nil
+	}
+	return n, err
+}
+
+// Close closes the underlying reader if it holds resources
+func (g *gzipReaderAt) Close() error {
+	g.mu.Lock()
+	g.cur = nil
+	var err error
+	if g.spill != nil {
+		err = g.spill.Close()
+	}
+	g.mu.Unlock()
+	return firstError(closeReader(g.r), err)
+}
+
+func (g *gzipReaderAt) checkpointFor(off int64) GzipCheckpoint {
+	i := sort.Search(len(g.checkpoints), func(i int) bool { return g.checkpoints[i].Uncompressed > off })
+	return g.checkpoints[i-1]
+}
+
+func (g *gzipReaderAt) restart(cp GzipCheckpoint) error {
+	br := bufio.NewReaderSize(io.NewSectionReader(g.r, cp.Compressed, g.size-cp.Compressed), streamBufferSize)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	g.cur = zr
+	g.curOff = cp.Uncompressed
+	return nil
+}
+
+// gzipSpill keeps decompressed content in a temporary file, which is created on first write
+type gzipSpill struct {
+	f *os.File
+	// spans are the sorted, non-overlapping ranges of the content the file holds
+	spans []gzipSpan
+}
+
+type gzipSpan struct {
+	Start, End int64
+}
+
+// ReadAt reads the prefix of p the spill file holds, which may be nothing
+func (s *gzipSpill) ReadAt(p []byte, off int64) (int, error) {
+	i := sort.Search(len(s.spans), func(i int) bool { return s.spans[i].End > off })
+	if i == len(s.spans) || s.spans[i].Start > off {
+		return 0, nil
+	}
+	if avail := s.spans[i].End - off; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	n, err := s.f.ReadAt(p, off)
+	if err != nil {
+		return n, fmt.Errorf("cannot read decompressed content: %w", err)
+	}
+	return n, nil
+}
+
+// WriteAt stores decompressed content in the spill file
+func (s *gzipSpill) WriteAt(p []byte, off int64) (int, error) {
+	if s.f == nil {
+		f, err := os.CreateTemp("", "wsfs-gzip-*")
+		if err != nil {
+			return 0, fmt.Errorf("cannot create spill file: %w", err)
+		}
+		s.f = f
+	}
+	n, err := s.f.WriteAt(p, off)
+	if n > 0 {
+		s.add(gzipSpan{Start: off, End: off + int64(n)})
+	}
+	if err != nil {
+		return n, fmt.Errorf("cannot write spill file: %w", err)
+	}
+	return n, nil
+}
+
+// add records that the spill file holds a span, merging it with the spans it touches
+func (s *gzipSpill) add(span gzipSpan) {
+	i := sort.Search(len(s.spans), func(i int) bool { return s.spans[i].End >= span.Start })
+	j := i
+	for j < len(s.spans) && s.spans[j].Start <= span.End {
+		if s.spans[j].Start < span.Start {
+			span.Start = s.spans[j].Start
+		}
+		if s.spans[j].End > span.End {
+			span.End = s.spans[j].End
+		}
+		j++
+	}
+	s.spans = append(s.spans[:i], append([]gzipSpan{span}, s.spans[j:]...)...)
+}
+
+// Close removes the spill file
+func (s *gzipSpill) Close() error {
+	if s.f == nil {
+		return nil
+	}
+	f := s.f
+	s.f, s.spans = nil, nil
+	return firstError(f.Close(), os.Remove(f.Name()))
+}
+
+// gzipSpillWriter writes what's decompressed sequentially from off into the spill file
+type gzipSpillWriter struct {
+	spill *gzipSpill
+	off   int64
+}
+
+func (w *gzipSpillWriter) Write(p []byte) (int, error) {
+	n, err := w.spill.WriteAt(p, w.off)
+	w.off += int64(n)
+	return n, err
+}
+
+// GzipMemberReader decompresses a (possibly multi-member) gzip stream and records a checkpoint
+// at the beginning of every member.
+type GzipMemberReader struct {
+	in  *countingByteReader
+	zr  *gzip.Reader
+	off int64
+	eof bool
+
+	Checkpoints []GzipCheckpoint
+}
+
+// NewGzipMemberReader starts decompressing the gzip stream in
+func NewGzipMemberReader(in io.Reader) (*GzipMemberReader, error) {
+	cr := &countingByteReader{R: bufio.NewReaderSize(in, streamBufferSize)}
+	zr, err := gzip.NewReader(cr)
+	if err != nil {
+		return nil, err
+	}
+	zr.Multistream(false)
+
+	return &GzipMemberReader{
+		in:          cr,
+		zr:          zr,
+		Checkpoints: []GzipCheckpoint{{}},
+	}, nil
+}
+
+// Read implements io.Reader
+func (g *GzipMemberReader) Read(p []byte) (int, error) {
+	for !g.eof {
+		n, err := g.zr.Read(p)
+		g.off += int64(n)
+		if err != io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			return n, nil
+		}
+
+		cp := GzipCheckpoint{Compressed: g.in.N, Uncompressed: g.off}
+		err = g.zr.Reset(g.in)
+		if err == io.EOF {
+			g.eof = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		g.zr.Multistream(false)
+		g.Checkpoints = append(g.Checkpoints, cp)
+	}
+	return 0, io.EOF
+}
+
+// CompressedSize returns the number of compressed bytes consumed so far
+func (g *GzipMemberReader) CompressedSize() int64 {
+	return g.in.N
+}
+
+// countingByteReader implements io.ByteReader so that the flate decompressor does not
+// add its own buffering, which keeps N in sync with the end of the consumed gzip member.
+type countingByteReader struct {
+	R *bufio.Reader
+	N int64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.R.Read(p)
+	c.N += int64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.R.ReadByte()
+	if err == nil {
+		c.N++
+	}
+	return b, err
+}
@@ -2,6 +2,7 @@ package idx
 
 import (
 	"context"
+	"io"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
@@ -9,6 +10,10 @@ import (
 type Index interface {
 	RootEntries(ctx context.Context) ([]Entry, error)
 	Children(ctx context.Context, of Entry) ([]Entry, error)
+
+	// Close releases the files, databases and temporary state held by the index.
+	// Entries of the index must not be used once it's closed.
+	io.Closer
 }
 
 type Entry interface {
@@ -21,3 +26,46 @@ type Entry interface {
 
 	Read(dst []byte, offset int64) (n int, err error)
 }
+
+// SymlinkEntry is implemented by entries which can point to another path
+type SymlinkEntry interface {
+	Entry
+
+	Readlink() (string, error)
+}
+
+// DigestEntry is implemented by entries which know a digest of their content, e.g. a SHA-256 or
+// a git object ID. Digests carry their algorithm as prefix, e.g. sha256:, hence they're comparable.
+type DigestEntry interface {
+	Entry
+
+	// Digest returns the digest of the content, or an empty string if it's unknown
+	Digest() string
+}
+
+// AggregateEntry is implemented by directory entries of indices which record the totals of
+// everything below a directory, see DirAggregate
+type AggregateEntry interface {
+	Entry
+
+	// Aggregate returns the totals of the directory, or nil if they're unknown
+	Aggregate() (*DirAggregate, error)
+}
+
+// closeReader closes r if it holds resources
+func closeReader(r io.ReaderAt) error {
+	if c, ok := r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// firstError returns the first non-nil error of errs
+func firstError(errs ...error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
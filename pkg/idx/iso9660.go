@@ -0,0 +1,590 @@
+package idx
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf16"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	isoSectorSize            = 2048
+	isoVolumeDescriptorStart = 16
+	// isoMaxVolumeDescriptors limits how far we look for the descriptor set terminator
+	isoMaxVolumeDescriptors = 64
+
+	isoVDPrimary       = 1
+	isoVDSupplementary = 2
+	isoVDTerminator    = 255
+
+	isoRecordMinSize   = 33
+	isoFlagDir         = 1 << 1
+	isoFlagMultiExtent = 1 << 7
+)
+
+func init() {
+	RegisterBackend(Backend{
+		Name: "iso9660",
+		Detect: func(src *url.URL, header []byte) bool {
+			vd := isoVolumeDescriptorStart * isoSectorSize
+			return len(header) >= vd+6 && string(header[vd+1:vd+6]) == "CD001"
+		},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			return OpenISO9660(sourceLocation(src))
+		},
+	})
+}
+
+// OpenISO9660 opens an ISO 9660 image from a local path or HTTP(S) URL
+func OpenISO9660(location string) (Index, error) {
+	r, _, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	res, err := NewISO9660Index(r)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	return res, nil
+}
+
+// NewISO9660Index reads the volume descriptors of the ISO 9660 image in r. Directories and file
+// content are read on demand. Rock Ridge extensions are preferred for names, modes and symlinks.
+// Images without Rock Ridge fall back to the Joliet directory tree if present, and to the plain
+// ISO 9660 names otherwise.
+func NewISO9660Index(r io.ReaderAt) (Index, error) {
+	var primary, joliet []byte
+	for i := 0; i < isoMaxVolumeDescriptors; i++ {
+		vd := make([]byte, isoSectorSize)
+		_, err := r.ReadAt(vd, int64(isoVolumeDescriptorStart+i)*isoSectorSize)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read volume descriptor: %w", err)
+		}
+		if string(vd[1:6]) != "CD001" {
+			return nil, fmt.Errorf("not an ISO 9660 image")
+		}
+
+		switch vd[0] {
+		case isoVDPrimary:
+			if primary == nil {
+				primary = vd
+			}
+		case isoVDSupplementary:
+			// Joliet is identified by the UCS-2 escape sequences of level 1, 2 or 3
+			esc := string(vd[88:91])
+			if joliet == nil && (esc == "%/@" || esc == "%/C" || esc == "%/E") {
+				joliet = vd
+			}
+		}
+		if vd[0] == isoVDTerminator {
+			break
+		}
+	}
+	if primary == nil {
+		return nil, fmt.Errorf("image has no primary volume descriptor")
+	}
+
+	res := &isoIndex{
+		r:         r,
+		blockSize: int64(binary.LittleEndian.Uint16(primary[128:])),
+	}
+	if res.blockSize == 0 {
+		res.blockSize = isoSectorSize
+	}
+
+	root, err := res.parseRecord(primary[156 : 156+34])
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root directory record: %w", err)
+	}
+	// Rock Ridge announces itself using a SUSP SP entry in the first record of the root directory
+	rootDir, err := res.readExtents(root)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root directory: %w", err)
+	}
+	if len(rootDir) > isoRecordMinSize && int(rootDir[0]) <= len(rootDir) {
+		su := rootDir[isoRecordMinSize+1 : rootDir[0]]
+		if len(su) >= 7 && string(su[:2]) == "SP" && su[4] == 0xbe && su[5] == 0xef {
+			res.rockRidge = true
+			res.suspSkip = int(su[6])
+		}
+	}
+
+	if !res.rockRidge && joliet != nil {
+		res.joliet = true
+		root, err = res.parseRecord(joliet[156 : 156+34])
+		if err != nil {
+			return nil, fmt.Errorf("cannot read Joliet root directory record: %w", err)
+		}
+	}
+	res.root = root
+
+	return res, nil
+}
+
+var _ Index = (*isoIndex)(nil)
+
+type isoIndex struct {
+	r         io.ReaderAt
+	blockSize int64
+	root      *isoEntry
+
+	joliet    bool
+	rockRidge bool
+	suspSkip  int
+}
+
+// Close implements Index
+func (s *isoIndex) Close() error {
+	return closeReader(s.r)
+}
+
+// RootEntries implements Index
+func (s *isoIndex) RootEntries(ctx context.Context) ([]Entry, error) {
+	return s.readDir(s.root)
+}
+
+// Children implements Index
+func (s *isoIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
+	e, ok := of.(*isoEntry)
+	if !ok {
+		return nil, fmt.Errorf("entry %s does not belong to this index", of.Name())
+	}
+	return s.readDir(e)
+}
+
+// readExtents reads the entire content of an entry
+func (s *isoIndex) readExtents(e *isoEntry) ([]byte, error) {
+	res := make([]byte, e.size)
+	n, err := e.Read(res, 0)
+	if err != nil && !(errors.Is(err, io.EOF) && n == len(res)) {
+		return nil, err
+	}
+	return res, nil
+}
+
+// readDir lists a directory. Directory records never cross a sector boundary, the remainder
+// of a sector that can't hold the next record is zero padded.
+func (s *isoIndex) readDir(dir *isoEntry) ([]Entry, error) {
+	if !dir.Dir() {
+		return nil, syscall.ENOTDIR
+	}
+	data, err := s.readExtents(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		res     []Entry
+		pending *isoEntry
+	)
+	for pos := 0; pos < len(data); {
+		l := int(data[pos])
+		if l == 0 {
+			pos = (pos/isoSectorSize + 1) * isoSectorSize
+			continue
+		}
+		if l < isoRecordMinSize || pos+l > len(data) {
+			return nil, fmt.Errorf("invalid directory record at offset %d", pos)
+		}
+		rec := data[pos : pos+l]
+		pos += l
+
+		e, err := s.parseRecord(rec)
+		if err != nil {
+			return nil, err
+		}
+		if pending != nil {
+			// files larger than 4GiB are split across several records of the same name
+			pending.extents = append(pending.extents, e.extents...)
+			pending.size += e.size
+			if rec[25]&isoFlagMultiExtent == 0 {
+				pending = nil
+			}
+			continue
+		}
+		if rec[25]&isoFlagMultiExtent != 0 {
+			pending = e
+		}
+		if e.name == "" || e.relocated {
+			// skips . and .. as well as the original location of relocated directories
+			continue
+		}
+		if e.childLink != 0 {
+			err = s.resolveChildLink(e)
+			if err != nil {
+				return nil, fmt.Errorf("cannot resolve relocated directory %s: %w", e.name, err)
+			}
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// resolveChildLink turns the placeholder of a relocated directory into the directory itself
+func (s *isoIndex) resolveChildLink(e *isoEntry) error {
+	buf := make([]byte, s.blockSize)
+	n, err := s.r.ReadAt(buf, int64(e.childLink)*s.blockSize)
+	if err != nil && !(errors.Is(err, io.EOF) && n > isoRecordMinSize) {
+		return err
+	}
+	l := int(buf[0])
+	if l < isoRecordMinSize || l > n {
+		return fmt.Errorf("invalid directory record")
+	}
+	self, err := s.parseRecord(buf[:l])
+	if err != nil {
+		return err
+	}
+	e.dir, e.extents, e.size = true, self.extents, self.size
+	return nil
+}
+
+// parseRecord parses a directory record, including its Rock Ridge extensions
+func (s *isoIndex) parseRecord(rec []byte) (*isoEntry, error) {
+	if len(rec) < isoRecordMinSize {
+		return nil, fmt.Errorf("directory record is too short")
+	}
+	nameLen := int(rec[32])
+	if isoRecordMinSize+nameLen > len(rec) {
+		return nil, fmt.Errorf("directory record name exceeds record")
+	}
+	res := &isoEntry{
+		idx: s,
+		dir: rec[25]&isoFlagDir != 0,
+		extents: []isoExtent{{
+			Start: int64(binary.LittleEndian.Uint32(rec[2:])) * s.blockSize,
+			Size:  int64(binary.LittleEndian.Uint32(rec[10:])),
+		}},
+		mtime: isoRecordingTime(rec[18:25]),
+	}
+	res.size = res.extents[0].Size
+
+	ident := rec[isoRecordMinSize : isoRecordMinSize+nameLen]
+	if nameLen == 1 && (ident[0] == 0 || ident[0] == 1) {
+		return res, nil
+	}
+	if s.joliet {
+		res.name = isoTrimVersion(decodeUCS2(ident), false)
+	} else {
+		res.name = isoTrimVersion(string(ident), true)
+	}
+
+	if s.rockRidge {
+		// the system use area follows the name, which is padded to an even length
+		su := isoRecordMinSize + nameLen + 1 - nameLen%2 + s.suspSkip
+		if su < len(rec) {
+			err := s.parseRockRidge(res, rec[su:])
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse Rock Ridge entries of %s: %w", res.name, err)
+			}
+		}
+	}
+	return res, nil
+}
+
+// parseRockRidge applies the SUSP entries in area to e, following continuation areas
+func (s *isoIndex) parseRockRidge(e *isoEntry, area []byte) error {
+	var (
+		name, target   strings.Builder
+		hasName        bool
+		linkComponents int
+		continueComp   bool
+		continuations  int
+	)
+	for len(area) >= 4 {
+		sig, l := string(area[:2]), int(area[2])
+		if l < 4 || l > len(area) {
+			break
+		}
+		body := area[4:l]
+		area = area[l:]
+
+		le := binary.LittleEndian
+		switch sig {
+		case "PX":
+			if len(body) < 32 {
+				return fmt.Errorf("PX entry is too short")
+			}
+			e.rr = true
+			e.mode = le.Uint32(body)
+			e.nlink = le.Uint32(body[8:])
+			e.uid = le.Uint32(body[16:])
+			e.gid = le.Uint32(body[24:])
+			if len(body) >= 40 {
+				e.ino = uint64(le.Uint32(body[32:]))
+			}
+		case "PN":
+			if len(body) < 16 {
+				return fmt.Errorf("PN entry is too short")
+			}
+			e.rdev = mkdev(int64(le.Uint32(body)), int64(le.Uint32(body[8:])))
+		case "NM":
+			if len(body) < 1 || body[0]&(1<<1|1<<2) != 0 {
+				// refers to . or ..
+				continue
+			}
+			name.Write(body[1:])
+			hasName = true
+		case "SL":
+			if len(body) < 1 {
+				continue
+			}
+			comps := body[1:]
+			for len(comps) >= 2 {
+				flags, cl := comps[0], int(comps[1])
+				if 2+cl > len(comps) {
+					return fmt.Errorf("SL component exceeds entry")
+				}
+				content := string(comps[2 : 2+cl])
+				comps = comps[2+cl:]
+
+				switch {
+				case flags&(1<<3) != 0:
+					target.Reset()
+					target.WriteString("/")
+					linkComponents = 0
+					continueComp = false
+					continue
+				case flags&(1<<1) != 0:
+					content = "."
+				case flags&(1<<2) != 0:
+					content = ".."
+				}
+				if linkComponents > 0 && !continueComp && !strings.HasSuffix(target.String(), "/") {
+					target.WriteString("/")
+				}
+				target.WriteString(content)
+				linkComponents++
+				continueComp = flags&1 != 0
+			}
+		case "TF":
+			if len(body) < 1 {
+				continue
+			}
+			flags, stamps := body[0], body[1:]
+			size := 7
+			if flags&(1<<7) != 0 {
+				size = 17
+			}
+			for bit := 0; bit < 7; bit++ {
+				if flags&(1<<bit) == 0 {
+					continue
+				}
+				if len(stamps) < size {
+					break
+				}
+				if bit == 1 {
+					if size == 7 {
+						e.mtime = isoRecordingTime(stamps[:size])
+					} else {
+						e.mtime = isoVolumeTime(stamps[:size])
+					}
+				}
+				stamps = stamps[size:]
+			}
+		case "CL":
+			if len(body) >= 4 {
+				e.childLink = le.Uint32(body)
+			}
+		case "RE":
+			e.relocated = true
+		case "CE":
+			if len(body) < 24 {
+				return fmt.Errorf("CE entry is too short")
+			}
+			// guard against continuation areas which point to each other
+			continuations++
+			if continuations > isoMaxVolumeDescriptors {
+				return fmt.Errorf("too many continuation areas")
+			}
+			block, offset, size := le.Uint32(body), le.Uint32(body[8:]), le.Uint32(body[16:])
+			cont := make([]byte, size)
+			n, err := s.r.ReadAt(cont, int64(block)*s.blockSize+int64(offset))
+			if err != nil && !(errors.Is(err, io.EOF) && n == len(cont)) {
+				return fmt.Errorf("cannot read continuation area: %w", err)
+			}
+			// the CE entry is the last one of an area
+			area = cont
+		case "ST":
+			area = nil
+		}
+	}
+
+	if hasName {
+		e.name = name.String()
+	}
+	if linkComponents > 0 || target.Len() > 0 {
+		e.target = target.String()
+	}
+	return nil
+}
+
+// isoTrimVersion removes the file version, e.g. ;1, from a name. Plain ISO 9660 names
+// are upper case and carry a trailing dot if they have no extension, which we remove as well.
+func isoTrimVersion(name string, plain bool) string {
+	if i := strings.LastIndexByte(name, ';'); i > 0 {
+		name = name[:i]
+	}
+	if plain {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+	}
+	return name
+}
+
+// decodeUCS2 decodes the big endian UCS-2 names used by Joliet
+func decodeUCS2(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
+
+// isoRecordingTime parses the seven byte date format used in directory records
+func isoRecordingTime(b []byte) time.Time {
+	if b[0] == 0 && b[1] == 0 {
+		return time.Time{}
+	}
+	loc := time.FixedZone("", int(int8(b[6]))*15*60)
+	return time.Date(1900+int(b[0]), time.Month(b[1]), int(b[2]), int(b[3]), int(b[4]), int(b[5]), 0, loc)
+}
+
+// isoVolumeTime parses the seventeen byte date format used in volume descriptors
+func isoVolumeTime(b []byte) time.Time {
+	digits := func(from, to int) int {
+		v, _ := strconv.Atoi(string(b[from:to]))
+		return v
+	}
+	if bytes.Count(b[:16], []byte("0")) == 16 {
+		return time.Time{}
+	}
+	loc := time.FixedZone("", int(int8(b[16]))*15*60)
+	return time.Date(digits(0, 4), time.Month(digits(4, 6)), digits(6, 8), digits(8, 10), digits(10, 12), digits(12, 14), digits(14, 16)*int(time.Millisecond)*10, loc)
+}
+
+type isoExtent struct {
+	Start int64
+	Size  int64
+}
+
+var _ SymlinkEntry = (*isoEntry)(nil)
+
+type isoEntry struct {
+	idx     *isoIndex
+	name    string
+	dir     bool
+	extents []isoExtent
+	size    int64
+	mtime   time.Time
+
+	// rr is true if the entry carries Rock Ridge POSIX attributes
+	rr        bool
+	mode      uint32
+	nlink     uint32
+	uid, gid  uint32
+	ino       uint64
+	rdev      uint32
+	target    string
+	childLink uint32
+	relocated bool
+}
+
+// Name implements Entry
+func (e *isoEntry) Name() string {
+	return e.name
+}
+
+// Dir implements Entry
+func (e *isoEntry) Dir() bool {
+	return e.dir
+}
+
+// Getattr implements Entry
+func (e *isoEntry) Getattr(out *fuse.Attr) (applyDefaults bool, err error) {
+	mtime := uint64(e.mtime.Unix())
+	out.Mtime, out.Atime, out.Ctime = mtime, mtime, mtime
+	if !e.Dir() {
+		out.Size = uint64(e.size)
+	}
+	if e.StableMode() == syscall.S_IFLNK {
+		out.Size = uint64(len(e.target))
+	}
+
+	if !e.rr {
+		out.Mode = 0644
+		if e.Dir() {
+			out.Mode = 0755
+		}
+		return true, nil
+	}
+
+	out.Ino = e.ino
+	out.Mode = e.mode & 07777
+	out.Nlink = e.nlink
+	out.Uid, out.Gid = e.uid, e.gid
+	out.Rdev = e.rdev
+	return false, nil
+}
+
+// StableMode implements Entry
+func (e *isoEntry) StableMode() uint32 {
+	if e.Dir() {
+		return syscall.S_IFDIR
+	}
+	if e.rr && e.mode&syscall.S_IFMT != 0 {
+		return e.mode & syscall.S_IFMT
+	}
+	if e.target != "" {
+		return syscall.S_IFLNK
+	}
+	return syscall.S_IFREG
+}
+
+// Read implements Entry
+func (e *isoEntry) Read(dst []byte, offset int64) (n int, err error) {
+	var start int64
+	for _, ext := range e.extents {
+		if n == len(dst) {
+			break
+		}
+		pos := offset + int64(n)
+		if pos >= start+ext.Size {
+			start += ext.Size
+			continue
+		}
+
+		chunk := dst[n:]
+		if rem := start + ext.Size - pos; int64(len(chunk)) > rem {
+			chunk = chunk[:rem]
+		}
+		c, err := e.idx.r.ReadAt(chunk, ext.Start+pos-start)
+		n += c
+		if err != nil && !(errors.Is(err, io.EOF) && c == len(chunk)) {
+			return n, err
+		}
+		start += ext.Size
+	}
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Readlink implements SymlinkEntry
+func (e *isoEntry) Readlink() (string, error) {
+	if e.StableMode() != syscall.S_IFLNK {
+		return "", syscall.EINVAL
+	}
+	return e.target, nil
+}
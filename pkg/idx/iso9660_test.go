@@ -0,0 +1,220 @@
+package idx_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"strings"
+	"syscall"
+	"testing"
+	"unicode/utf16"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// buildISO produces a tiny ISO 9660 image:
+//
+//	/HELLO.TXT      spanning two sectors, "Hello World.txt" with Rock Ridge, "Grüße.txt" with Joliet
+//	/DIR/SMALL.     one sector
+//	/DIR/LINK.      only with Rock Ridge, pointing to ../Hello World.txt
+func buildISO(t *testing.T, hello, small string, rockRidge, joliet bool) []byte {
+	const (
+		sector     = 2048
+		pvd        = 16
+		svd        = 17
+		terminator = 18
+		root       = 19
+		sub        = 20
+		jolietRoot = 21
+		jolietSub  = 22
+		helloData  = 23
+		smallData  = 25
+		sectors    = 26
+	)
+	le, be := binary.LittleEndian, binary.BigEndian
+
+	record := func(name []byte, lba, size int, dir bool, su []byte) []byte {
+		n := 33 + len(name)
+		if len(name)%2 == 0 {
+			n++
+		}
+		rec := make([]byte, n+len(su)+len(su)%2)
+		rec[0] = byte(len(rec))
+		le.PutUint32(rec[2:], uint32(lba))
+		be.PutUint32(rec[6:], uint32(lba))
+		le.PutUint32(rec[10:], uint32(size))
+		be.PutUint32(rec[14:], uint32(size))
+		copy(rec[18:], []byte{122, 1, 2, 3, 4, 5, 0})
+		if dir {
+			rec[25] = 2
+		}
+		rec[32] = byte(len(name))
+		copy(rec[33:], name)
+		copy(rec[n:], su)
+		return rec
+	}
+	susp := func(sig string, body ...byte) []byte {
+		return append([]byte{sig[0], sig[1], byte(4 + len(body)), 1}, body...)
+	}
+	px := func(mode, uid uint32) []byte {
+		var b bytes.Buffer
+		for _, v := range []uint32{mode, 1, uid, uid} {
+			binary.Write(&b, le, v)
+			binary.Write(&b, be, v)
+		}
+		return susp("PX", b.Bytes()...)
+	}
+	nm := func(name string) []byte {
+		return susp("NM", append([]byte{0}, name...)...)
+	}
+	ucs2 := func(s string) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, be, utf16.Encode([]rune(s)))
+		return b.Bytes()
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	img := make([]byte, sectors*sector)
+	vd := func(at int, typ byte, rootLBA int, escape string) {
+		b := img[at*sector:]
+		b[0] = typ
+		copy(b[1:], "CD001")
+		b[6] = 1
+		copy(b[88:], escape)
+		le.PutUint16(b[128:], sector)
+		be.PutUint16(b[130:], sector)
+		copy(b[156:], record([]byte{0}, rootLBA, sector, true, nil))
+	}
+	dir := func(at, parent int, records ...[]byte) {
+		var selfSU []byte
+		if rockRidge && at == root {
+			selfSU = susp("SP", 0xbe, 0xef, 0)
+		}
+		b := bytes.NewBuffer(nil)
+		b.Write(record([]byte{0}, at, sector, true, selfSU))
+		b.Write(record([]byte{1}, parent, sector, true, nil))
+		for _, r := range records {
+			b.Write(r)
+		}
+		copy(img[at*sector:], b.Bytes())
+	}
+
+	vd(pvd, 1, root, "")
+	if joliet {
+		vd(svd, 2, jolietRoot, "%/E")
+	} else {
+		vd(svd, 2, jolietRoot, "")
+	}
+	img[terminator*sector] = 255
+	copy(img[terminator*sector+1:], "CD001")
+
+	rr := func(entries ...[]byte) []byte {
+		if !rockRidge {
+			return nil
+		}
+		return join(entries...)
+	}
+	dir(root, root,
+		record([]byte("DIR"), sub, sector, true, rr(px(syscall.S_IFDIR|0755, 0), nm("dir"))),
+		record([]byte("HELLO.TXT;1"), helloData, len(hello), false, rr(px(syscall.S_IFREG|0600, 33333), nm("Hello World.txt"))),
+	)
+	subRecords := [][]byte{
+		record([]byte("SMALL.;1"), smallData, len(small), false, rr(px(syscall.S_IFREG|0644, 0), nm("small"))),
+	}
+	if rockRidge {
+		sl := susp("SL", join([]byte{0, 4, 0}, []byte{0, 15}, []byte("Hello World.txt"))...)
+		subRecords = append(subRecords, record([]byte("LINK.;1"), 0, 0, false, join(px(syscall.S_IFLNK|0777, 0), nm("link"), sl)))
+	}
+	dir(sub, root, subRecords...)
+
+	dir(jolietRoot, jolietRoot,
+		record(ucs2("Dir"), jolietSub, sector, true, nil),
+		record(ucs2("Grüße.txt;1"), helloData, len(hello), false, nil),
+	)
+	dir(jolietSub, jolietRoot,
+		record(ucs2("Small"), smallData, len(small), false, nil),
+	)
+
+	copy(img[helloData*sector:], hello)
+	copy(img[smallData*sector:], small)
+	return img
+}
+
+func TestISO9660Index(t *testing.T) {
+	hello := strings.Repeat("hello iso ", 300)
+
+	tests := []struct {
+		Name        string
+		RockRidge   bool
+		Joliet      bool
+		Expectation []string
+	}{
+		{
+			Name:        "plain",
+			Expectation: []string{"dir/", "dir/small:tiny", "hello.txt:" + hello},
+		},
+		{
+			Name:        "joliet",
+			Joliet:      true,
+			Expectation: []string{"Dir/", "Dir/Small:tiny", "Grüße.txt:" + hello},
+		},
+		{
+			Name:        "rock ridge",
+			RockRidge:   true,
+			Joliet:      true,
+			Expectation: []string{"Hello World.txt:" + hello, "dir/", "dir/link->../Hello World.txt", "dir/small:tiny"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			img := buildISO(t, hello, "tiny", test.RockRidge, test.Joliet)
+			index, err := idx.NewISO9660Index(bytes.NewReader(img))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(test.Expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("NewISO9660Index() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestISO9660RockRidgeAttributes(t *testing.T) {
+	img := buildISO(t, "hello", "tiny", true, false)
+	index, err := idx.NewISO9660Index(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type attrs struct {
+		Mode, Uid uint32
+		Size      uint64
+		Mtime     uint64
+	}
+	var act []attrs
+	for _, e := range root {
+		var attr fuse.Attr
+		_, err := e.Getattr(&attr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		act = append(act, attrs{Mode: attr.Mode, Uid: attr.Uid, Size: attr.Size, Mtime: attr.Mtime})
+	}
+	mtime := uint64(1641092645)
+	expectation := []attrs{
+		{Mode: 0755, Mtime: mtime},
+		{Mode: 0600, Uid: 33333, Size: 5, Mtime: mtime},
+	}
+	if diff := cmp.Diff(expectation, act); diff != "" {
+		t.Errorf("Getattr() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,245 @@
+package idx
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// whiteoutPrefix marks a file which hides the same-named entry in lower layers
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaque marks a directory which hides all content of lower layers
+	whiteoutOpaque = whiteoutPrefix + whiteoutPrefix + ".opq"
+)
+
+// NewLayeredIndex produces the union of several indices following the OCI image layer semantics.
+// Layers are ordered bottom to top, i.e. entries of later layers override entries of earlier ones.
+// Whiteout files (.wh.<name>) and opaque directories (.wh..wh..opq) hide the content of lower layers.
+func NewLayeredIndex(layers ...Index) Index {
+	return &layeredIndex{Layers: layers}
+}
+
+var _ Index = (*layeredIndex)(nil)
+
+type layeredIndex struct {
+	Layers []Index
+
+	mu   sync.Mutex
+	root []Entry
+}
+
+// Close implements Index
+func (li *layeredIndex) Close() error {
+	var err error
+	for _, l := range li.Layers {
+		err = firstError(err, l.Close())
+	}
+	return err
+}
+
+// layerDir is a directory contributing content to a merged directory
+type layerDir struct {
+	Layer int
+	Entry Entry
+}
+
+// RootEntries implements Index
+func (li *layeredIndex) RootEntries(ctx context.Context) ([]Entry, error) {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	if li.root != nil {
+		return li.root, nil
+	}
+
+	dirs := make([]layerDir, len(li.Layers))
+	for i := range li.Layers {
+		dirs[i] = layerDir{Layer: len(li.Layers) - 1 - i}
+	}
+	res, err := li.merge(ctx, dirs)
+	if err != nil {
+		return nil, err
+	}
+	li.root = res
+	return res, nil
+}
+
+// Children implements Index
+func (li *layeredIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
+	e, ok := of.(*layeredEntry)
+	if !ok {
+		return nil, fmt.Errorf("entry %s does not belong to this index", of.Name())
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.children != nil {
+		return e.children, nil
+	}
+
+	res, err := li.merge(ctx, e.dirs)
+	if err != nil {
+		return nil, err
+	}
+	e.children = res
+	return res, nil
+}
+
+// merge combines the content of the directories. The directories are ordered top to bottom.
+// A directory with a nil entry is the root of its layer.
+func (li *layeredIndex) merge(ctx context.Context, dirs []layerDir) ([]Entry, error) {
+	var (
+		entries = make(map[string]*layeredEntry)
+		hidden  = make(map[string]struct{})
+	)
+	for _, dir := range dirs {
+		var (
+			children []Entry
+			err      error
+		)
+		layer := li.Layers[dir.Layer]
+		if dir.Entry == nil {
+			children, err = layer.RootEntries(ctx)
+		} else {
+			children, err = layer.Children(ctx, dir.Entry)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot list layer %d: %w", dir.Layer, err)
+		}
+
+		var (
+			opaque    bool
+			whiteouts []string
+		)
+		for _, c := range children {
+			name := c.Name()
+			if name == whiteoutOpaque {
+				opaque = true
+				continue
+			}
+			if strings.HasPrefix(name, whiteoutPrefix) {
+				whiteouts = append(whiteouts, strings.TrimPrefix(name, whiteoutPrefix))
+				continue
+			}
+			if _, ok := hidden[name]; ok {
+				continue
+			}
+
+			if upper, ok := entries[name]; ok {
+				// An upper directory is merged with lower ones until a lower layer
+				// has something other than a directory in its place.
+				if !upper.sealed && upper.Dir() && c.Dir() {
+					upper.dirs = append(upper.dirs, layerDir{Layer: dir.Layer, Entry: c})
+				} else {
+					upper.sealed = true
+				}
+				continue
+			}
+
+			le := &layeredEntry{Entry: c, li: li}
+			if c.Dir() {
+				le.dirs = []layerDir{{Layer: dir.Layer, Entry: c}}
+			}
+			entries[name] = le
+		}
+
+		// whiteouts only affect the layers below the one they're in
+		for _, w := range whiteouts {
+			hidden[w] = struct{}{}
+		}
+		if opaque {
+			break
+		}
+	}
+
+	res := make([]Entry, 0, len(entries))
+	for _, e := range entries {
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Name() < res[j].Name() })
+	return res, nil
+}
+
+var (
+	_ SymlinkEntry   = (*layeredEntry)(nil)
+	_ DigestEntry    = (*layeredEntry)(nil)
+	_ AggregateEntry = (*layeredEntry)(nil)
+)
+
+// layeredEntry is the top-most version of an entry. Directories keep track of all
+// lower directories they've been merged with.
+type layeredEntry struct {
+	Entry
+
+	li     *layeredIndex
+	dirs   []layerDir
+	sealed bool
+
+	mu       sync.Mutex
+	children []Entry
+}
+
+// Readlink implements SymlinkEntry
+func (e *layeredEntry) Readlink() (string, error) {
+	lnk, ok := e.Entry.(SymlinkEntry)
+	if !ok {
+		return "", syscall.EINVAL
+	}
+	return lnk.Readlink()
+}
+
+// Digest implements DigestEntry
+func (e *layeredEntry) Digest() string {
+	de, ok := e.Entry.(DigestEntry)
+	if !ok {
+		return ""
+	}
+	return de.Digest()
+}
+
+// Aggregate implements AggregateEntry. Directories of a single layer have the aggregate of their
+// layer, merged directories sum up their merged children.
+func (e *layeredEntry) Aggregate() (*DirAggregate, error) {
+	if !e.Dir() {
+		return nil, nil
+	}
+	if len(e.dirs) <= 1 {
+		ae, ok := e.Entry.(AggregateEntry)
+		if !ok {
+			return nil, nil
+		}
+		return ae.Aggregate()
+	}
+
+	children, err := e.li.Children(context.Background(), e)
+	if err != nil {
+		return nil, err
+	}
+	info, err := entryInfo(e)
+	if err != nil {
+		return nil, err
+	}
+	res := &DirAggregate{}
+	res.add(true, 0, info.Mtime)
+	for _, c := range children {
+		info, err := entryInfo(c)
+		if err != nil {
+			return nil, err
+		}
+		if !c.Dir() {
+			res.add(false, info.Size, info.Mtime)
+			continue
+		}
+		a, err := c.(*layeredEntry).Aggregate()
+		if err != nil || a == nil {
+			return nil, err
+		}
+		res.Size += a.Size
+		res.Files += a.Files
+		res.add(true, 0, a.Mtime)
+	}
+	return res, nil
+}
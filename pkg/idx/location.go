@@ -0,0 +1,92 @@
+package idx
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/snabb/httpreaderat"
+)
+
+// isURL returns true if location points to an HTTP(S) server rather than the local filesystem
+func isURL(location string) bool {
+	return strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://")
+}
+
+// openLocation provides random access to a local file or a file served via HTTP(S).
+// Remote files are read using range requests.
+func openLocation(location string) (r io.ReaderAt, size int64, err error) {
+	if isURL(location) {
+		req, err := http.NewRequest(http.MethodGet, location, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		htrdr, err := httpreaderat.New(nil, req, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		return htrdr, htrdr.Size(), nil
+	}
+
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, stat.Size(), nil
+}
+
+// LocationVersion identifies the version of files at local paths or HTTP(S) URLs by their size and
+// modification time, or the ETag remote servers send. Locations which don't exist are part of the
+// version as well. It returns an empty string if a server doesn't tell the version of a file.
+func LocationVersion(locations ...string) (string, error) {
+	var res []string
+	for _, location := range locations {
+		v, err := locationVersion(location)
+		if err != nil {
+			return "", err
+		}
+		if v == "" {
+			return "", nil
+		}
+		res = append(res, v)
+	}
+	return strings.Join(res, ";"), nil
+}
+
+func locationVersion(location string) (string, error) {
+	if !isURL(location) {
+		stat, err := os.Stat(location)
+		if errors.Is(err, os.ErrNotExist) {
+			return "none", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d@%d", stat.Size(), stat.ModTime().UnixNano()), nil
+	}
+
+	resp, err := http.Head(location)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return "none", nil
+	case resp.StatusCode != http.StatusOK:
+		return "", fmt.Errorf("cannot stat %s: %s", location, resp.Status)
+	case resp.Header.Get("ETag") != "":
+		return resp.Header.Get("ETag"), nil
+	case resp.Header.Get("Last-Modified") != "":
+		return fmt.Sprintf("%d@%s", resp.ContentLength, resp.Header.Get("Last-Modified")), nil
+	}
+	return "", nil
+}
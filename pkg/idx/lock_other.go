@@ -0,0 +1,26 @@
+//go:build !unix
+
+package idx
+
+import (
+	"io"
+	"os"
+)
+
+// lockDir doesn't lock on platforms without flock, where files which are in use can't be removed anyway
+func lockDir(dir string) (io.Closer, error) {
+	_, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	return io.NopCloser(nil), nil
+}
+
+// removeDirUnlessLocked removes a directory
+func removeDirUnlessLocked(dir string) (removed bool, err error) {
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,48 @@
+//go:build unix
+
+package idx
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// lockDir takes a shared lock on a directory, which keeps removeDirUnlessLocked from removing it
+// until the lock is closed
+func lockDir(dir string) (io.Closer, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// removeDirUnlessLocked removes a directory unless someone holds a lock on it
+func removeDirUnlessLocked(dir string) (removed bool, err error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package idx
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// mmapFile reads the file into memory on platforms without mmap support
+func mmapFile(f *os.File, size int64) (io.ReaderAt, error) {
+	data := make([]byte, size)
+	_, err := io.ReadFull(f, data)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package idx
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// mmapFile maps a file into memory. The mapping outlives the file and is released by closing the reader.
+func mmapFile(f *os.File, size int64) (io.ReaderAt, error) {
+	if size == 0 {
+		return bytes.NewReader(nil), nil
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapReader{data: data}, nil
+}
+
+// mmapReader reads a mapped file. Close waits for pending reads, which would fault once the file is unmapped.
+type mmapReader struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+// ReadAt implements io.ReaderAt
+func (m *mmapReader) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.data == nil {
+		return 0, os.ErrClosed
+	}
+	return bytes.NewReader(m.data).ReadAt(p, off)
+}
+
+// Close unmaps the file
+func (m *mmapReader) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return syscall.Munmap(data)
+}
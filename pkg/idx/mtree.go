@@ -0,0 +1,474 @@
+package idx
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// MtreeEntry is an entry of a BSD mtree specification, see mtree(5)
+type MtreeEntry struct {
+	// Path is relative to the root of the specification, which itself is "."
+	Path string
+	// Keywords maps keywords to their value. Keywords without value, e.g. optional, map to "".
+	Keywords map[string]string
+}
+
+// mtreeKeywordOrder is the order in which keywords are written
+var mtreeKeywordOrder = []string{"type", "mode", "size", "time", "link", "sha256digest"}
+
+var mtreeTypes = map[string]uint32{
+	"file":   syscall.S_IFREG,
+	"dir":    syscall.S_IFDIR,
+	"link":   syscall.S_IFLNK,
+	"char":   syscall.S_IFCHR,
+	"block":  syscall.S_IFBLK,
+	"fifo":   syscall.S_IFIFO,
+	"socket": syscall.S_IFSOCK,
+}
+
+// NewMtreeEntry describes an index entry using the type, mode, size, time, link and, if the index
+// records sha256 digests, sha256digest keywords
+func NewMtreeEntry(p string, info *EntryInfo) MtreeEntry {
+	kw := map[string]string{
+		"type": mtreeTypeName(info.Mode),
+		"mode": fmt.Sprintf("%#o", info.Mode&07777),
+		"time": fmt.Sprintf("%d.%09d", info.Mtime.Unix(), info.Mtime.Nanosecond()),
+	}
+	if kw["type"] == "file" {
+		kw["size"] = strconv.FormatUint(info.Size, 10)
+		if strings.HasPrefix(info.Digest, "sha256:") {
+			kw["sha256digest"] = strings.TrimPrefix(info.Digest, "sha256:")
+		}
+	}
+	if info.Target != "" {
+		kw["link"] = info.Target
+	}
+	return MtreeEntry{Path: p, Keywords: kw}
+}
+
+// String formats the entry as a line of a specification which uses full paths
+func (e MtreeEntry) String() string {
+	keys := make([]string, 0, len(e.Keywords))
+	for k := range e.Keywords {
+		keys = append(keys, k)
+	}
+	rank := func(k string) int {
+		for i, o := range mtreeKeywordOrder {
+			if o == k {
+				return i
+			}
+		}
+		return len(mtreeKeywordOrder)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		ri, rj := rank(keys[i]), rank(keys[j])
+		if ri != rj {
+			return ri < rj
+		}
+		return keys[i] < keys[j]
+	})
+
+	var res strings.Builder
+	if e.Path == "." {
+		res.WriteString(".")
+	} else {
+		res.WriteString(mtreeEscape("./" + e.Path))
+	}
+	for _, k := range keys {
+		res.WriteString(" " + k)
+		if v := e.Keywords[k]; v != "" {
+			res.WriteString("=" + mtreeEscape(v))
+		}
+	}
+	return res.String()
+}
+
+// MtreeWriter writes a specification which uses full paths, as mtree -C and bsdtar do
+type MtreeWriter struct {
+	w io.Writer
+}
+
+// NewMtreeWriter writes the header of a specification
+func NewMtreeWriter(w io.Writer) (*MtreeWriter, error) {
+	_, err := io.WriteString(w, "#mtree v2.0\n")
+	if err != nil {
+		return nil, err
+	}
+	return &MtreeWriter{w: w}, nil
+}
+
+// Write writes an entry
+func (m *MtreeWriter) Write(e MtreeEntry) error {
+	_, err := io.WriteString(m.w, e.String()+"\n")
+	return err
+}
+
+// ParseMtree reads a specification. Entries may use full paths or the hierarchical format mtree -c
+// produces, and /set and /unset are supported.
+func ParseMtree(r io.Reader) ([]MtreeEntry, error) {
+	var (
+		res      []MtreeEntry
+		defaults = make(map[string]string)
+		dirs     []string
+		scanner  = bufio.NewScanner(r)
+		lineNo   int
+		line     string
+	)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		lineNo++
+		line += scanner.Text()
+		if strings.HasSuffix(line, "\\") && !strings.HasSuffix(line, "\\\\") {
+			line = strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+		fields := strings.Fields(line)
+		line = ""
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		kw := func(fields []string) map[string]string {
+			res := make(map[string]string, len(fields))
+			for _, f := range fields {
+				k, v, _ := strings.Cut(f, "=")
+				res[k] = mtreeUnescape(v)
+			}
+			return res
+		}
+		switch fields[0] {
+		case "/set":
+			for k, v := range kw(fields[1:]) {
+				defaults[k] = v
+			}
+			continue
+		case "/unset":
+			for _, k := range fields[1:] {
+				if k == "all" {
+					defaults = make(map[string]string)
+				}
+				delete(defaults, k)
+			}
+			continue
+		case "..":
+			if len(dirs) == 0 {
+				return nil, fmt.Errorf("line %d: .. outside of any directory", lineNo)
+			}
+			dirs = dirs[:len(dirs)-1]
+			continue
+		}
+
+		name := mtreeUnescape(fields[0])
+		keywords := make(map[string]string, len(defaults)+len(fields)-1)
+		for k, v := range defaults {
+			keywords[k] = v
+		}
+		for k, v := range kw(fields[1:]) {
+			keywords[k] = v
+		}
+
+		var p string
+		switch {
+		case strings.Contains(name, "/"):
+			// full paths don't change the current directory
+			p = path.Clean(name)
+		case len(dirs) > 0:
+			p = path.Join(dirs[len(dirs)-1], name)
+		default:
+			p = name
+		}
+		if p != "." {
+			p = strings.TrimPrefix(p, "./")
+		}
+		if !strings.Contains(name, "/") && keywords["type"] == "dir" {
+			dirs = append(dirs, p)
+		}
+		res = append(res, MtreeEntry{Path: p, Keywords: keywords})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CheckMtree compares the directory tree at root with a specification, like mtree -f does. Entries
+// which are missing are reported as removed, entries which aren't part of the specification as added
+// and entries whose type, mode, size, time, link or sha256digest don't match as modified. Entries
+// with the optional keyword may be missing, and the content of directories with the ignore keyword
+// isn't checked.
+func CheckMtree(root string, spec []MtreeEntry) ([]Change, error) {
+	var (
+		res     []Change
+		known   = make(map[string]bool, len(spec))
+		ignored = make(map[string]bool)
+	)
+	for _, e := range spec {
+		for p := e.Path; p != "." && !known[p]; p = path.Dir(p) {
+			known[p] = true
+		}
+		if _, ok := e.Keywords["ignore"]; ok {
+			ignored[e.Path] = true
+		}
+
+		expected, err := mtreeEntryInfo(e)
+		if err != nil {
+			return nil, err
+		}
+		actual, err := fileEntryInfo(filepath.Join(root, filepath.FromSlash(e.Path)), e.Keywords["sha256digest"] != "")
+		if errors.Is(err, fs.ErrNotExist) {
+			if _, ok := e.Keywords["optional"]; !ok {
+				res = append(res, Change{Path: e.Path, Kind: ChangeRemoved, Old: expected})
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if fields := mtreeChangedFields(e, expected, actual); len(fields) > 0 {
+			res = append(res, Change{Path: e.Path, Kind: ChangeModified, Fields: fields, Old: expected, New: actual})
+		}
+	}
+
+	err := filepath.WalkDir(root, func(fn string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, fn)
+		if err != nil {
+			return err
+		}
+		p := filepath.ToSlash(rel)
+		if ignored[p] && d.IsDir() {
+			return filepath.SkipDir
+		}
+		if p == "." || known[p] {
+			return nil
+		}
+		info, err := fileEntryInfo(fn, false)
+		if err != nil {
+			return err
+		}
+		res = append(res, Change{Path: p, Kind: ChangeAdded, New: info})
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res, nil
+}
+
+// mtreeEntryInfo converts the keywords of an entry, leaving out those which aren't set
+func mtreeEntryInfo(e MtreeEntry) (*EntryInfo, error) {
+	res := &EntryInfo{Target: e.Keywords["link"]}
+	if t, ok := e.Keywords["type"]; ok {
+		mode, ok := mtreeTypes[t]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown type %q", e.Path, t)
+		}
+		res.Mode = mode
+		res.Dir = mode == syscall.S_IFDIR
+	}
+	if m, ok := e.Keywords["mode"]; ok {
+		perm, err := strconv.ParseUint(m, 8, 32)
+		if err != nil || perm > 07777 {
+			return nil, fmt.Errorf("%s: unsupported mode %q, must be octal", e.Path, m)
+		}
+		res.Mode |= uint32(perm)
+	}
+	if s, ok := e.Keywords["size"]; ok {
+		size, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid size %q", e.Path, s)
+		}
+		res.Size = size
+	}
+	if t, ok := e.Keywords["time"]; ok {
+		sec, nsec, _ := strings.Cut(t, ".")
+		s, err := strconv.ParseInt(sec, 10, 64)
+		var ns int64
+		if err == nil && nsec != "" {
+			ns, err = strconv.ParseInt(nsec, 10, 64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid time %q", e.Path, t)
+		}
+		res.Mtime = time.Unix(s, ns).UTC()
+	}
+	if d := e.Keywords["sha256digest"]; d != "" {
+		res.Digest = "sha256:" + d
+	}
+	return res, nil
+}
+
+// fileEntryInfo describes a local file in the way entryInfo describes index entries
+func fileEntryInfo(fn string, digest bool) (*EntryInfo, error) {
+	stat, err := os.Lstat(fn)
+	if err != nil {
+		return nil, err
+	}
+	mode := stat.Mode()
+	res := &EntryInfo{
+		Dir:   mode.IsDir(),
+		Mode:  uint32(mode.Perm()),
+		Mtime: stat.ModTime().UTC(),
+	}
+	switch {
+	case mode.IsDir():
+		res.Mode |= syscall.S_IFDIR
+	case mode&fs.ModeSymlink != 0:
+		res.Mode |= syscall.S_IFLNK
+	case mode&fs.ModeCharDevice != 0:
+		res.Mode |= syscall.S_IFCHR
+	case mode&fs.ModeDevice != 0:
+		res.Mode |= syscall.S_IFBLK
+	case mode&fs.ModeNamedPipe != 0:
+		res.Mode |= syscall.S_IFIFO
+	case mode&fs.ModeSocket != 0:
+		res.Mode |= syscall.S_IFSOCK
+	default:
+		res.Mode |= syscall.S_IFREG
+		res.Size = uint64(stat.Size())
+	}
+	if mode&fs.ModeSetuid != 0 {
+		res.Mode |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		res.Mode |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		res.Mode |= syscall.S_ISVTX
+	}
+
+	if mode&fs.ModeSymlink != 0 {
+		res.Target, err = os.Readlink(fn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if digest && mode.IsRegular() {
+		f, err := os.Open(fn)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		if err != nil {
+			return nil, err
+		}
+		res.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+	return res, nil
+}
+
+// mtreeChangedFields compares the fields whose keywords are set, using the field names of Diff
+func mtreeChangedFields(e MtreeEntry, expected, actual *EntryInfo) []string {
+	var res []string
+	has := func(k string) bool {
+		_, ok := e.Keywords[k]
+		return ok
+	}
+	if has("type") && expected.Mode&syscall.S_IFMT != actual.Mode&syscall.S_IFMT {
+		res = append(res, "type")
+	}
+	if has("size") && !actual.Dir && expected.Size != actual.Size {
+		res = append(res, "size")
+	}
+	if has("mode") && expected.Mode&07777 != actual.Mode&07777 {
+		res = append(res, "mode")
+	}
+	if has("time") {
+		mtime := actual.Mtime
+		if expected.Mtime.Nanosecond() == 0 {
+			// specifications and file systems which don't record nanoseconds are common
+			mtime = mtime.Truncate(time.Second)
+		}
+		if !expected.Mtime.Equal(mtime) {
+			res = append(res, "mtime")
+		}
+	}
+	if has("sha256digest") && actual.Digest != "" && expected.Digest != actual.Digest {
+		res = append(res, "digest")
+	}
+	if has("link") && expected.Target != actual.Target {
+		res = append(res, "target")
+	}
+	return res
+}
+
+func mtreeTypeName(mode uint32) string {
+	for name, t := range mtreeTypes {
+		if mode&syscall.S_IFMT == t {
+			return name
+		}
+	}
+	return "file"
+}
+
+// mtreeEscape encodes whitespace, special and non-printable characters as octal escapes like vis(3)
+func mtreeEscape(s string) string {
+	var res strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == '\\' || c == '#' || c == '=' {
+			fmt.Fprintf(&res, "\\%03o", c)
+			continue
+		}
+		res.WriteByte(c)
+	}
+	return res.String()
+}
+
+// mtreeUnescape decodes the octal and C-style escapes of vis(3)
+func mtreeUnescape(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var res strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i == len(s)-1 {
+			res.WriteByte(c)
+			continue
+		}
+		if i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				res.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			res.WriteByte('\n')
+		case 't':
+			res.WriteByte('\t')
+		case 'r':
+			res.WriteByte('\r')
+		case 's':
+			res.WriteByte(' ')
+		default:
+			res.WriteByte(s[i])
+		}
+	}
+	return res.String()
+}
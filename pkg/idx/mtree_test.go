@@ -0,0 +1,157 @@
+package idx_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseMtree(t *testing.T) {
+	mtime := time.Date(2022, 1, 1, 0, 0, 0, 5, time.UTC)
+	buf := bytes.NewBuffer(nil)
+	w, err := idx.NewMtreeWriter(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for p, info := range map[string]*idx.EntryInfo{
+		"dir":           {Dir: true, Mode: 040755, Mtime: mtime},
+		"dir/with file": {Size: 42, Mode: 0100644, Mtime: mtime, Digest: "sha256:abcd"},
+		"dir/l#nk=":     {Mode: 0120777, Mtime: mtime, Target: "with file"},
+	} {
+		err = w.Write(idx.NewMtreeEntry(p, info))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		Name        string
+		Spec        string
+		Expectation []string
+	}{
+		{
+			Name: "full paths",
+			Spec: buf.String(),
+			Expectation: []string{
+				"dir mode=0755 time=1640995200.000000005 type=dir",
+				"dir/l#nk= link=with file mode=0777 time=1640995200.000000005 type=link",
+				"dir/with file mode=0644 sha256digest=abcd size=42 time=1640995200.000000005 type=file",
+			},
+		},
+		{
+			Name: "hierarchical",
+			Spec: `#mtree
+/set type=file mode=0644
+. type=dir mode=0755
+    hello.txt size=5 \
+        time=10.0
+    sub type=dir
+        deep\040file
+        nested type=dir
+        ..
+        ./full/path
+    ..
+    after optional
+..
+`,
+			Expectation: []string{
+				". mode=0755 type=dir",
+				"after mode=0644 optional= type=file",
+				"full/path mode=0644 type=file",
+				"hello.txt mode=0644 size=5 time=10.0 type=file",
+				"sub mode=0644 type=dir",
+				"sub/deep file mode=0644 type=file",
+				"sub/nested mode=0644 type=dir",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			spec, err := idx.ParseMtree(strings.NewReader(test.Spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var act []string
+			for _, e := range spec {
+				var kw []string
+				for k, v := range e.Keywords {
+					kw = append(kw, k+"="+v)
+				}
+				sort.Strings(kw)
+				act = append(act, strings.Join(append([]string{e.Path}, kw...), " "))
+			}
+			sort.Strings(act)
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("ParseMtree() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCheckMtree(t *testing.T) {
+	mtime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	root := t.TempDir()
+	write := func(name, content string, mode os.FileMode) {
+		fn := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fn, []byte(content), mode)
+		if err == nil {
+			err = os.Chmod(fn, mode)
+		}
+		if err == nil {
+			err = os.Chtimes(fn, mtime, mtime)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("dir/hello.txt", "hello", 0644)
+	write("dir/changed.txt", "changed", 0644)
+	write("run.sh", "#!/bin/sh", 0600)
+	write("extra/file", "", 0644)
+	err := os.Symlink("hello.txt", filepath.Join(root, "dir/link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spec, err := idx.ParseMtree(strings.NewReader(`#mtree
+./dir/hello.txt type=file mode=0644 size=5 time=1640995200.0 sha256digest=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824
+./dir/changed.txt type=file mode=0644 size=7 sha256digest=2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824
+./dir/link type=link link=other.txt
+./dir/missing type=file
+./dir/optional type=file optional
+./run.sh type=file mode=0755 time=1640995201.0
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := idx.CheckMtree(root, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var act []string
+	for _, c := range changes {
+		act = append(act, strings.TrimSpace(fmt.Sprintf("%s %s %s", c.Kind, c.Path, strings.Join(c.Fields, ","))))
+	}
+	expectation := []string{
+		"modified dir/changed.txt digest",
+		"modified dir/link target",
+		"removed dir/missing",
+		"added extra",
+		"modified run.sh mode,mtime",
+	}
+	if diff := cmp.Diff(expectation, act); diff != "" {
+		t.Errorf("CheckMtree() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,474 @@
+package idx
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+	"github.com/snabb/httpreaderat"
+)
+
+const (
+	mediaTypeOCIIndex        = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest     = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCILayer        = "application/vnd.oci.image.layer.v1.tar"
+	mediaTypeOCILayerGzip    = "application/vnd.oci.image.layer.v1.tar+gzip"
+	mediaTypeDockerList      = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeDockerManifest  = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerLayerGzip = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	mediaTypeDockerForeign   = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
+
+	annotationRefName = "org.opencontainers.image.ref.name"
+)
+
+// OCIOptions select an image from an OCI image index
+type OCIOptions struct {
+	// Ref selects the manifest by its org.opencontainers.image.ref.name annotation
+	Ref string
+	// Platform selects a manifest from an image index, e.g. linux/amd64 or linux/arm64/v8
+	Platform string
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *ociPlatform      `json:"platform,omitempty"`
+}
+
+type ociPlatform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p *ociPlatform) String() string {
+	if p == nil {
+		return ""
+	}
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// ociIndex is an OCI image index or Docker manifest list
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// ociManifest is an OCI image manifest or Docker image manifest
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+// blobStore provides access to content-addressed blobs
+type blobStore interface {
+	// Fetch downloads a small blob, e.g. a manifest, in its entirety
+	Fetch(ctx context.Context, desc ociDescriptor) ([]byte, error)
+	// Open provides random access to a potentially large blob
+	Open(ctx context.Context, desc ociDescriptor) (io.ReaderAt, error)
+}
+
+func init() {
+	RegisterBackend(Backend{
+		Name:    "oci-layout",
+		Schemes: []string{"oci-layout", "oci-layout+http", "oci-layout+https"},
+		Detect: func(src *url.URL, header []byte) bool {
+			if src.Scheme != "file" || header != nil {
+				return false
+			}
+			_, err := os.Stat(filepath.Join(src.Path, "oci-layout"))
+			return err == nil
+		},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			// oci-layout:///path/to/dir?ref=v1 or oci-layout+https://host/path?ref=v1
+			loc := *src
+			loc.Scheme = strings.TrimPrefix(strings.TrimPrefix(src.Scheme, "oci-layout"), "+")
+			if loc.Scheme == "" {
+				loc.Scheme = "file"
+			}
+			ref := loc.Query().Get("ref")
+			loc.RawQuery = ""
+			return OpenOCILayout(ctx, sourceLocation(&loc), OCIOptions{
+				Ref:      ref,
+				Platform: opts.Platform,
+			})
+		},
+	})
+}
+
+// OpenOCILayout opens an image from an OCI image layout. The location is either a directory
+// or an HTTP(S) URL under which the layout is served.
+func OpenOCILayout(ctx context.Context, location string, opts OCIOptions) (Index, error) {
+	var store *ociLayoutStore
+	if isURL(location) {
+		store = &ociLayoutStore{BaseURL: strings.TrimSuffix(location, "/"), Client: http.DefaultClient}
+	} else {
+		store = &ociLayoutStore{Dir: location}
+	}
+
+	idxJSON, err := store.fetchPath(ctx, "index.json")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read index.json: %w", err)
+	}
+	var index ociIndex
+	err = json.Unmarshal(idxJSON, &index)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse index.json: %w", err)
+	}
+
+	if opts.Ref != "" {
+		var found []ociDescriptor
+		for _, m := range index.Manifests {
+			if m.Annotations[annotationRefName] == opts.Ref {
+				found = append(found, m)
+			}
+		}
+		if len(found) == 0 {
+			return nil, fmt.Errorf("no manifest with ref %s", opts.Ref)
+		}
+		index.Manifests = found
+	}
+
+	desc, err := selectManifest(index, opts.Platform)
+	if err != nil {
+		return nil, err
+	}
+	return openOCIImage(ctx, store, desc, opts.Platform)
+}
+
+// openOCIImage resolves the descriptor to an image manifest and opens its layers
+func openOCIImage(ctx context.Context, store blobStore, desc ociDescriptor, platform string) (Index, error) {
+	for {
+		content, err := store.Fetch(ctx, desc)
+		if err != nil {
+			return nil, fmt.Errorf("cannot fetch %s: %w", desc.Digest, err)
+		}
+
+		switch desc.MediaType {
+		case mediaTypeOCIIndex, mediaTypeDockerList:
+			var index ociIndex
+			err = json.Unmarshal(content, &index)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse image index %s: %w", desc.Digest, err)
+			}
+			desc, err = selectManifest(index, platform)
+			if err != nil {
+				return nil, err
+			}
+			continue
+
+		case mediaTypeOCIManifest, mediaTypeDockerManifest:
+			var manifest ociManifest
+			err = json.Unmarshal(content, &manifest)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse image manifest %s: %w", desc.Digest, err)
+			}
+			return openOCILayers(ctx, store, manifest.Layers)
+
+		default:
+			return nil, fmt.Errorf("unsupported media type %s for %s", desc.MediaType, desc.Digest)
+		}
+	}
+}
+
+// selectManifest picks a manifest from an index based on its platform
+func selectManifest(index ociIndex, platform string) (ociDescriptor, error) {
+	switch len(index.Manifests) {
+	case 0:
+		return ociDescriptor{}, fmt.Errorf("image index has no manifests")
+	case 1:
+		return index.Manifests[0], nil
+	}
+
+	var available []string
+	for _, m := range index.Manifests {
+		if m.Platform == nil {
+			continue
+		}
+		p := m.Platform.String()
+		if p == platform || (m.Platform.Variant != "" && platform == m.Platform.OS+"/"+m.Platform.Architecture) {
+			return m, nil
+		}
+		available = append(available, p)
+	}
+	return ociDescriptor{}, fmt.Errorf("no manifest for platform %s - available platforms are: %s", platform, strings.Join(available, ", "))
+}
+
+// openOCILayers indexes all layers concurrently and produces their union
+func openOCILayers(ctx context.Context, store blobStore, layers []ociDescriptor) (Index, error) {
+	// once a layer fails, there's no point in reading through the others
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		res  = make([]Index, len(layers))
+		errs = make([]error, len(layers))
+		wg   sync.WaitGroup
+	)
+	for i, layer := range layers {
+		wg.Add(1)
+		go func(i int, layer ociDescriptor) {
+			defer wg.Done()
+			res[i], errs[i] = openOCILayer(ctx, store, layer)
+			if errs[i] != nil {
+				cancel()
+			}
+		}(i, layer)
+	}
+	wg.Wait()
+
+	// report the layer which failed rather than those we cancelled because of it
+	failed := -1
+	for i, err := range errs {
+		if err != nil && (failed < 0 || errors.Is(errs[failed], context.Canceled)) {
+			failed = i
+		}
+	}
+	if failed >= 0 {
+		closeIndices(res)
+		return nil, fmt.Errorf("cannot open layer %s: %w", layers[failed].Digest, errs[failed])
+	}
+	return NewLayeredIndex(res...), nil
+}
+
+// closeIndices closes the indices which were opened
+func closeIndices(indices []Index) {
+	for _, index := range indices {
+		if index != nil {
+			index.Close()
+		}
+	}
+}
+
+// openOCILayer opens the index of the layer DefaultIndexCache holds, or reads through the layer
+// once to produce it. Layers are content addressed, hence their cached index never goes stale.
+// Producing the index downloads the whole layer, as tar files have no table of contents, but
+// only once: the index is kept on disk as compact index, not in memory. File content is read
+// from the blob on demand.
+func openOCILayer(ctx context.Context, store blobStore, layer ociDescriptor) (res Index, err error) {
+	switch layer.MediaType {
+	case mediaTypeOCILayer, mediaTypeOCILayerGzip, mediaTypeDockerLayerGzip, mediaTypeDockerForeign:
+	default:
+		return nil, fmt.Errorf("unsupported layer media type %s", layer.MediaType)
+	}
+
+	blob, err := store.Open(ctx, layer)
+	if err != nil {
+		return nil, err
+	}
+	if DefaultIndexCache != nil {
+		res, err := DefaultIndexCache.openBlobIndex(layer.Digest, blob)
+		if err != nil {
+			log.WithError(err).WithField("layer", layer.Digest).Warn("cannot open cached layer index")
+		}
+		if res != nil {
+			log.WithField("layer", layer.Digest).Debug("using cached layer index")
+			return res, nil
+		}
+	}
+	defer func() {
+		if err != nil {
+			closeReader(blob)
+		}
+	}()
+
+	// the database only lives until it's written as compact index, which is what we read from
+	tmpdir, err := os.MkdirTemp("", "wsfs-layer-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpdir)
+	db, err := badger.Open(badger.DefaultOptions(tmpdir).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// the index is cached by the digest of the layer, hence we verify it while reading through the layer
+	hash := sha256.New()
+	r := io.TeeReader(&contextReader{Ctx: ctx, R: io.NewSectionReader(blob, 0, layer.Size)}, hash)
+	if layer.MediaType == mediaTypeOCILayer {
+		err = ProduceIndexFromTarFile(db, bufio.NewReaderSize(r, streamBufferSize))
+	} else {
+		// records the gzip members, so that reads can start decompressing from the closest one
+		err = ProduceIndexWithOptions(db, r, ProduceOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(io.Discard, r)
+	if err != nil {
+		return nil, err
+	}
+	if act := "sha256:" + hex.EncodeToString(hash.Sum(nil)); strings.HasPrefix(layer.Digest, "sha256:") && act != layer.Digest {
+		return nil, fmt.Errorf("digest mismatch: expected %s, got %s", layer.Digest, act)
+	}
+	log.WithField("layer", layer.Digest).Debug("indexed layer")
+
+	if DefaultIndexCache != nil {
+		err := DefaultIndexCache.storeBlobIndex(layer.Digest, db)
+		if err != nil {
+			log.WithError(err).WithField("layer", layer.Digest).Warn("cannot cache layer index")
+		}
+		res, err := DefaultIndexCache.openBlobIndex(layer.Digest, blob)
+		if err != nil {
+			log.WithError(err).WithField("layer", layer.Digest).Warn("cannot open cached layer index")
+		}
+		if res != nil {
+			return res, nil
+		}
+	}
+	return openTemporaryCompactIndex(db, blob)
+}
+
+// openTemporaryCompactIndex writes the index in db to a temporary compact index file and opens
+// it. The file is mapped into memory and removed right away.
+func openTemporaryCompactIndex(db *badger.DB, blob io.ReaderAt) (Index, error) {
+	f, err := os.CreateTemp("", "wsfs-layer-*.index")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	out := bufio.NewWriter(f)
+	err = WriteCompactIndex(db, out)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		return nil, err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	r, err := mmapFile(f, size)
+	if err != nil {
+		return nil, fmt.Errorf("cannot map index: %w", err)
+	}
+	res, err := OpenCompactIndex(r, size, blob)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	return res, nil
+}
+
+// contextReader stops reading once its context is done
+type contextReader struct {
+	Ctx context.Context
+	R   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.Ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.R.Read(p)
+}
+
+// ociLayoutStore reads blobs from an OCI image layout on disk or served via HTTP
+type ociLayoutStore struct {
+	Dir     string
+	BaseURL string
+	Client  *http.Client
+}
+
+func (s *ociLayoutStore) blobPath(digest string) (string, error) {
+	alg, hash, ok := strings.Cut(digest, ":")
+	if !ok || alg == "" || hash == "" || strings.ContainsAny(digest, "/\\") {
+		return "", fmt.Errorf("invalid digest %q", digest)
+	}
+	return "blobs/" + alg + "/" + hash, nil
+}
+
+func (s *ociLayoutStore) fetchPath(ctx context.Context, path string) ([]byte, error) {
+	if s.BaseURL == "" {
+		return os.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(path)))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.BaseURL+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Fetch implements blobStore
+func (s *ociLayoutStore) Fetch(ctx context.Context, desc ociDescriptor) ([]byte, error) {
+	path, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	content, err := s.fetchPath(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyDigest(desc.Digest, content)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Open implements blobStore
+func (s *ociLayoutStore) Open(ctx context.Context, desc ociDescriptor) (io.ReaderAt, error) {
+	path, err := s.blobPath(desc.Digest)
+	if err != nil {
+		return nil, err
+	}
+	if s.BaseURL == "" {
+		return os.Open(filepath.Join(s.Dir, filepath.FromSlash(path)))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, s.BaseURL+"/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return httpreaderat.New(s.Client, req, nil)
+}
+
+// verifyDigest checks that content matches a sha256 digest. Other algorithms are not verified.
+func verifyDigest(digest string, content []byte) error {
+	if !strings.HasPrefix(digest, "sha256:") {
+		return nil
+	}
+	if act := digestOf(content); act != digest {
+		return fmt.Errorf("digest mismatch: expected %s, got %s", digest, act)
+	}
+	return nil
+}
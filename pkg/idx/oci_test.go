@@ -0,0 +1,370 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/google/go-cmp/cmp"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+type tarFile struct {
+	Name    string
+	Content string
+	Type    byte
+	Link    string
+}
+
+func buildTar(t *testing.T, files ...tarFile) []byte {
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	for _, f := range files {
+		hdr := &tar.Header{Typeflag: f.Type, Name: f.Name, Linkname: f.Link, Mode: 0644, Uid: 33333, Gid: 33333}
+		switch f.Type {
+		case tar.TypeReg:
+			hdr.Size = int64(len(f.Content))
+		case tar.TypeDir:
+			hdr.Mode = 0755
+		}
+		err := tarw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tarw.Write([]byte(f.Content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := tarw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// gzipMembers compresses each part as a separate gzip member
+func gzipMembers(t *testing.T, parts ...[]byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	for _, p := range parts {
+		w := gzip.NewWriter(buf)
+		_, err := w.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+// dumpIndex lists all entries of an index as path:content, path/ or path->target
+func dumpIndex(t *testing.T, index idx.Index) []string {
+	var (
+		res  []string
+		walk func(prefix string, entries []idx.Entry)
+	)
+	walk = func(prefix string, entries []idx.Entry) {
+		for _, e := range entries {
+			p := prefix + e.Name()
+			switch {
+			case e.Dir():
+				res = append(res, p+"/")
+				children, err := index.Children(context.Background(), e)
+				if err != nil {
+					t.Fatalf("cannot list %s: %v", p, err)
+				}
+				walk(p+"/", children)
+			case e.StableMode() == syscall.S_IFLNK:
+				target, err := e.(idx.SymlinkEntry).Readlink()
+				if err != nil {
+					t.Fatalf("cannot read link %s: %v", p, err)
+				}
+				res = append(res, p+"->"+target)
+			default:
+				var attr fuse.Attr
+				_, err := e.Getattr(&attr)
+				if err != nil {
+					t.Fatalf("cannot getattr %s: %v", p, err)
+				}
+				buf := make([]byte, attr.Size)
+				n, err := e.Read(buf, 0)
+				if err != nil && n != len(buf) {
+					t.Fatalf("cannot read %s: %v", p, err)
+				}
+				res = append(res, p+":"+string(buf[:n]))
+			}
+		}
+	}
+	root, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	walk("", root)
+	sort.Strings(res)
+	return res
+}
+
+func TestLayeredIndex(t *testing.T) {
+	lower := buildTar(t,
+		tarFile{Name: "etc/", Type: tar.TypeDir},
+		tarFile{Name: "etc/passwd", Type: tar.TypeReg, Content: "root"},
+		tarFile{Name: "etc/hosts", Type: tar.TypeReg, Content: "localhost"},
+		tarFile{Name: "opt/", Type: tar.TypeDir},
+		tarFile{Name: "opt/a", Type: tar.TypeReg, Content: "a"},
+		tarFile{Name: "var/", Type: tar.TypeDir},
+		tarFile{Name: "var/log", Type: tar.TypeReg, Content: "log"},
+		tarFile{Name: "bin", Type: tar.TypeReg, Content: "bin"},
+	)
+	upper := buildTar(t,
+		tarFile{Name: "etc/", Type: tar.TypeDir},
+		tarFile{Name: "etc/passwd", Type: tar.TypeReg, Content: "root,user"},
+		tarFile{Name: "etc/.wh.hosts", Type: tar.TypeReg},
+		tarFile{Name: "opt/", Type: tar.TypeDir},
+		tarFile{Name: "opt/.wh..wh..opq", Type: tar.TypeReg},
+		tarFile{Name: "opt/b", Type: tar.TypeReg, Content: "b"},
+		tarFile{Name: ".wh.var", Type: tar.TypeReg},
+		tarFile{Name: "bin", Type: tar.TypeSymlink, Link: "usr/bin"},
+	)
+
+	layout := t.TempDir()
+	writeBlob := func(content []byte) (digest string) {
+		sum := sha256.Sum256(content)
+		digest = "sha256:" + hex.EncodeToString(sum[:])
+		fn := filepath.Join(layout, "blobs", "sha256", hex.EncodeToString(sum[:]))
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fn, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return digest
+	}
+	writeJSON := func(obj interface{}) (digest string, size int64) {
+		content, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writeBlob(content), int64(len(content))
+	}
+
+	half := len(lower) / 1024 * 512
+	lowerBlob := gzipMembers(t, lower[:half], lower[half:])
+	configDigest, configSize := writeJSON(map[string]interface{}{})
+	manifestDigest, manifestSize := writeJSON(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": configDigest, "size": configSize},
+		"layers": []interface{}{
+			map[string]interface{}{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": writeBlob(lowerBlob), "size": len(lowerBlob)},
+			map[string]interface{}{"mediaType": "application/vnd.oci.image.layer.v1.tar", "digest": writeBlob(upper), "size": len(upper)},
+		},
+	})
+	indexJSON, _ := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests": []interface{}{
+			map[string]interface{}{
+				"mediaType":   "application/vnd.oci.image.manifest.v1+json",
+				"digest":      manifestDigest,
+				"size":        manifestSize,
+				"annotations": map[string]string{"org.opencontainers.image.ref.name": "latest"},
+			},
+		},
+	})
+	err := os.WriteFile(filepath.Join(layout, "index.json"), indexJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := idx.NewIndexCache(t.TempDir())
+	defer func(c *idx.IndexCache) { idx.DefaultIndexCache = c }(idx.DefaultIndexCache)
+	idx.DefaultIndexCache = cache
+
+	tests := []struct {
+		Name        string
+		Opts        idx.OCIOptions
+		Expectation []string
+		Err         string
+	}{
+		{
+			Name: "merged",
+			Expectation: []string{
+				"bin->usr/bin",
+				"etc/",
+				"etc/passwd:root,user",
+				"opt/",
+				"opt/b:b",
+			},
+		},
+		{
+			// the layers are indexed once and their indices are cached
+			Name: "cached",
+			Expectation: []string{
+				"bin->usr/bin",
+				"etc/",
+				"etc/passwd:root,user",
+				"opt/",
+				"opt/b:b",
+			},
+		},
+		{
+			Name: "unknown ref",
+			Opts: idx.OCIOptions{Ref: "foo"},
+			Err:  "no manifest with ref foo",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index, err := idx.OpenOCILayout(context.Background(), layout, test.Opts)
+			if err != nil {
+				if diff := cmp.Diff(test.Err, err.Error()); diff != "" {
+					t.Errorf("OpenOCILayout() error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			defer index.Close()
+
+			if diff := cmp.Diff(test.Expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("OpenOCILayout() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	cached, err := filepath.Glob(filepath.Join(cache.Dir, "blobs", "sha256-*.index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cached) != 2 {
+		t.Errorf("cache holds %d layer indices, expected 2", len(cached))
+	}
+
+	// without a cache the layers are indexed into temporary compact indices
+	idx.DefaultIndexCache = nil
+	index, err := idx.OpenOCILayout(context.Background(), layout, idx.OCIOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if diff := cmp.Diff(tests[0].Expectation, dumpIndex(t, index)); diff != "" {
+		t.Errorf("OpenOCILayout() without cache mismatch (-want +got):\n%s", diff)
+	}
+
+	// merged directories sum up what's visible of their layers
+	root, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	aggregates := make(map[string]uint64)
+	for _, e := range root {
+		ae, ok := e.(idx.AggregateEntry)
+		if !ok || !e.Dir() {
+			continue
+		}
+		a, err := ae.Aggregate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a == nil {
+			t.Fatalf("%s has no aggregate", e.Name())
+		}
+		aggregates[e.Name()+" size"], aggregates[e.Name()+" files"] = a.Size, a.Files
+	}
+	if diff := cmp.Diff(map[string]uint64{"etc size": 9, "etc files": 1, "opt size": 1, "opt files": 1}, aggregates); diff != "" {
+		t.Errorf("aggregates mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestGzipReaderAt(t *testing.T) {
+	var parts [][]byte
+	var content []byte
+	for i := 0; i < 4; i++ {
+		p := []byte(fmt.Sprintf("member %d;", i))
+		parts = append(parts, p)
+		content = append(content, p...)
+	}
+	compressed := gzipMembers(t, parts...)
+
+	zr, err := idx.NewGzipMemberReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	_, err = buf.ReadFrom(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(content), buf.String()); diff != "" {
+		t.Fatalf("GzipMemberReader mismatch (-want +got):\n%s", diff)
+	}
+	if len(zr.Checkpoints) != len(parts) {
+		t.Fatalf("expected %d checkpoints, got %d", len(parts), len(zr.Checkpoints))
+	}
+
+	ra := idx.NewGzipReaderAt(bytes.NewReader(compressed), int64(len(compressed)), zr.Checkpoints)
+	for _, off := range []int64{20, 3, 0, 31, 9, 10} {
+		dst := make([]byte, 5)
+		n, err := ra.ReadAt(dst, off)
+		if err != nil {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		if diff := cmp.Diff(string(content[off:off+5]), string(dst[:n])); diff != "" {
+			t.Errorf("ReadAt(%d) mismatch (-want +got):\n%s", off, diff)
+		}
+	}
+}
+
+func TestGzipReaderAtSpill(t *testing.T) {
+	// random content doesn't compress, hence a single member whose only checkpoint is far from its end
+	content := make([]byte, 3<<20)
+	rand.New(rand.NewSource(42)).Read(content)
+	compressed := gzipMembers(t, content)
+	blob := &countingReaderAt{R: bytes.NewReader(compressed)}
+
+	ra := idx.NewGzipReaderAt(blob, int64(len(compressed)), nil)
+	defer ra.(io.Closer).Close()
+	for i, off := range []int64{int64(len(content)) - 100, 10, 1 << 20, int64(len(content)) - 50} {
+		dst := make([]byte, 100)
+		n, err := ra.ReadAt(dst, off)
+		if err != nil && err != io.EOF {
+			t.Fatalf("ReadAt(%d): %v", off, err)
+		}
+		if !bytes.Equal(content[off:off+int64(n)], dst[:n]) {
+			t.Errorf("ReadAt(%d) returned wrong content", off)
+		}
+		if i == 0 {
+			blob.N = 0
+		}
+	}
+	if blob.N != 0 {
+		t.Errorf("backward reads read %d bytes of the compressed stream, expected none", blob.N)
+	}
+}
+
+type countingReaderAt struct {
+	R io.ReaderAt
+	N int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.R.ReadAt(p, off)
+	c.N += int64(n)
+	return n, err
+}
@@ -0,0 +1,140 @@
+package idx
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// PackOptions control the metadata of the entries Pack writes
+type PackOptions struct {
+	// ModTime replaces the modification time of all entries unless it's zero
+	ModTime time.Time
+	// KeepOwner keeps the owner of the files rather than setting it to UID and GID
+	KeepOwner bool
+	UID, GID  int
+	// ContentIndex collects the trigrams of the content of each regular file, if set
+	ContentIndex *ContentIndexBuilder
+	// Progress is updated while the directory is packed, if set
+	Progress *Progress
+}
+
+// Pack writes the content of dir as tar file to w and indexes it in the same pass, so that each
+// file is read once. Entries are written in lexical order, and neither access nor change times
+// are recorded, hence the tar file only changes if the content or the normalised metadata does.
+// Hard links are stored as regular files, sockets are skipped.
+func Pack(dir string, w io.Writer, db *badger.DB, opts PackOptions) error {
+	var (
+		out  = &countingWriter{W: w}
+		tarw = tar.NewWriter(out)
+		iw   = newIndexWriter(db, opts.Progress)
+	)
+	defer iw.Cancel()
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+		name = filepath.ToSlash(name)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var link string
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			log.WithError(err).WithField("path", path).Warn("skipping file")
+			return nil
+		}
+		hdr.Name = name
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Name += "/"
+		}
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.ModTime = hdr.ModTime.Round(time.Second)
+		if !opts.ModTime.IsZero() {
+			hdr.ModTime = opts.ModTime.Round(time.Second)
+		}
+		if !opts.KeepOwner {
+			hdr.Uid, hdr.Gid = opts.UID, opts.GID
+			hdr.Uname, hdr.Gname = "", ""
+		}
+
+		err = tarw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		// the header is written right away, hence the content starts here
+		entry := indexEntry{Offset: out.N, TarHeader: hdr}
+
+		if hdr.Typeflag == tar.TypeReg {
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			if opts.ContentIndex != nil {
+				err = opts.ContentIndex.Add(name, io.TeeReader(f, tarw))
+			} else {
+				_, err = io.Copy(tarw, f)
+			}
+			f.Close()
+			if err != nil {
+				return fmt.Errorf("cannot pack %s: %w", name, err)
+			}
+		}
+
+		hdr.Name = name
+		return iw.Put(entry)
+	})
+	if err != nil {
+		return err
+	}
+
+	// flushing pads the last entry, hence the end-of-archive marker starts here
+	err = tarw.Flush()
+	if err != nil {
+		return err
+	}
+	end, err := json.Marshal(out.N)
+	if err != nil {
+		return err
+	}
+	err = tarw.Close()
+	if err != nil {
+		return err
+	}
+	iw.SetBytes(out.N)
+	err = iw.Flush()
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(metaKeyEnd), end)
+	})
+	if err != nil {
+		return err
+	}
+	return storeProduceMeta(db, produceMeta{ContentIndex: opts.ContentIndex != nil})
+}
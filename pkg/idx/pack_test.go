@@ -0,0 +1,102 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPack(t *testing.T) {
+	dir := t.TempDir()
+	for fn, content := range map[string]string{
+		"hello.txt":   fileHelloTXT,
+		"foo/bar.txt": fileFooSlashBarTXT,
+		"foo/empty":   "",
+		"b/c/d.txt":   "d",
+	} {
+		fn = filepath.Join(dir, fn)
+		err := os.MkdirAll(filepath.Dir(fn), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(fn, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := os.Symlink("foo/bar.txt", filepath.Join(dir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := idx.PackOptions{ModTime: time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)}
+	pack := func() ([]byte, *badger.DB) {
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		buf := bytes.NewBuffer(nil)
+		err = idx.Pack(dir, buf, db, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes(), db
+	}
+	archive, db := pack()
+
+	var names []string
+	tarf := tar.NewReader(bytes.NewReader(archive))
+	for hdr, err := tarf.Next(); err != io.EOF; hdr, err = tarf.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if diff := cmp.Diff([]string{"b/", "b/c/", "b/c/d.txt", "foo/", "foo/bar.txt", "foo/empty", "hello.txt", "link"}, names); diff != "" {
+		t.Errorf("archive entries mismatch (-want +got):\n%s", diff)
+	}
+
+	packed, err := idx.OpenTarIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generatedDB, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generatedDB.Close()
+	err = idx.ProduceIndex(generatedDB, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	generated, err := idx.OpenTarIndex(generatedDB, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(dumpIndex(t, generated), dumpIndex(t, packed)); diff != "" {
+		t.Errorf("packed index mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(dumpAttrs(t, generated), dumpAttrs(t, packed)); diff != "" {
+		t.Errorf("packed index attributes mismatch (-want +got):\n%s", diff)
+	}
+
+	// packing is deterministic, regardless of when the files were last touched
+	now := time.Now()
+	err = os.Chtimes(filepath.Join(dir, "hello.txt"), now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := pack()
+	if !bytes.Equal(archive, again) {
+		t.Error("packing the same content twice produced different archives")
+	}
+}
@@ -0,0 +1,466 @@
+package idx
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"sync"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// The paged index is a variant of the compact index for archives with too many entries to
+// fetch the whole index up front. Every directory has a page which holds all of its children,
+// so that listing a directory takes a single range request.
+//
+// All integers are little endian. The file consists of
+//   - a header, see pagedHeader
+//   - metadata: a JSON object of the index meta keys
+//   - the root page, followed by the pages of all other directories in breadth-first order
+//
+// A page starts with the number of entries, followed by a compact index record per entry and
+// a string table holding the names and link names of the entries. String offsets are relative
+// to the start of the page. In addition to the compact index record, each record holds the
+// offset of the page of a directory, and rec[68:72] holds its size. If the header has the
+// pagedFlagAggregates flag, each page ends with the aggregate of its directory.
+const (
+	pagedMagic      = "WSFSPIX1"
+	pagedHeaderSize = 64
+	pagedEntrySize  = compactEntrySize + 8
+
+	// pagedPrefetch is the number of bytes read when opening a paged index. This usually covers the
+	// header, metadata and root page.
+	pagedPrefetch = 64 << 10
+	// pagedCacheSize is the maximum number of pages kept in memory
+	pagedCacheSize = 4096
+
+	// pagedFlagAggregates marks indices whose pages end with the aggregate of their directory
+	pagedFlagAggregates = 1 << 0
+)
+
+type pagedHeader struct {
+	Entries  uint64
+	MetaOff  uint64
+	MetaSize uint64
+	RootOff  uint64
+	RootSize uint64
+	Flags    uint32
+}
+
+func (h *pagedHeader) marshal() []byte {
+	res := make([]byte, pagedHeaderSize)
+	copy(res, pagedMagic)
+	binary.LittleEndian.PutUint32(res[8:], 1)
+	binary.LittleEndian.PutUint64(res[16:], h.Entries)
+	binary.LittleEndian.PutUint64(res[24:], h.MetaOff)
+	binary.LittleEndian.PutUint64(res[32:], h.MetaSize)
+	binary.LittleEndian.PutUint64(res[40:], h.RootOff)
+	binary.LittleEndian.PutUint64(res[48:], h.RootSize)
+	binary.LittleEndian.PutUint32(res[56:], h.Flags)
+	return res
+}
+
+func (h *pagedHeader) unmarshal(buf []byte, size int64) error {
+	if len(buf) < pagedHeaderSize || string(buf[:8]) != pagedMagic {
+		return fmt.Errorf("not a paged index")
+	}
+	if v := binary.LittleEndian.Uint32(buf[8:]); v != 1 {
+		return fmt.Errorf("unsupported paged index version %d", v)
+	}
+	h.Entries = binary.LittleEndian.Uint64(buf[16:])
+	h.MetaOff = binary.LittleEndian.Uint64(buf[24:])
+	h.MetaSize = binary.LittleEndian.Uint64(buf[32:])
+	h.RootOff = binary.LittleEndian.Uint64(buf[40:])
+	h.RootSize = binary.LittleEndian.Uint64(buf[48:])
+	h.Flags = binary.LittleEndian.Uint32(buf[56:])
+
+	for _, section := range [][2]uint64{
+		{h.MetaOff, h.MetaSize},
+		{h.RootOff, h.RootSize},
+	} {
+		if section[0] > uint64(size) || section[1] > uint64(size)-section[0] {
+			return fmt.Errorf("paged index is truncated")
+		}
+	}
+	return nil
+}
+
+// IsPagedIndex returns true if the header, i.e. the beginning of a file, belongs to a paged index
+func IsPagedIndex(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(pagedMagic))
+}
+
+// WritePagedIndex converts a badger index to the paged index format. Entries whose parent
+// directory is not part of the index cannot be listed and are left out.
+func WritePagedIndex(db *badger.DB, out io.Writer) error {
+	entries, meta, err := loadIndexEntries(db)
+	if err != nil {
+		return err
+	}
+
+	// entries are grouped by parent directory already
+	children := make(map[string][]indexEntry)
+	for start := 0; start < len(entries); {
+		parent, _ := compactSplitPath(entries[start].TarHeader.Name)
+		end := start + 1
+		for end < len(entries) {
+			p, _ := compactSplitPath(entries[end].TarHeader.Name)
+			if p != parent {
+				break
+			}
+			end++
+		}
+		children[parent] = entries[start:end]
+		start = end
+	}
+
+	var (
+		dirs       = []string{""}
+		pageSize   = make(map[string]uint64)
+		hdr        = pagedHeader{Flags: pagedFlagAggregates}
+		aggregates = dirAggregates(entries)
+	)
+	for i := 0; i < len(dirs); i++ {
+		size := uint64(4 + compactAggregateSize)
+		for _, c := range children[dirs[i]] {
+			_, name := compactSplitPath(c.TarHeader.Name)
+			size += pagedEntrySize + uint64(len(name)) + uint64(len(c.TarHeader.Linkname))
+			if c.TarHeader.Typeflag == tar.TypeDir {
+				dirs = append(dirs, c.TarHeader.Name)
+			}
+		}
+		if size > math.MaxUint32 {
+			return fmt.Errorf("directory %s is too large for a paged index", dirs[i])
+		}
+		pageSize[dirs[i]] = size
+		hdr.Entries += uint64(len(children[dirs[i]]))
+	}
+
+	metaJSON, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	hdr.MetaOff = pagedHeaderSize
+	hdr.MetaSize = uint64(len(metaJSON))
+
+	pageOff := make(map[string]uint64, len(dirs))
+	off := hdr.MetaOff + hdr.MetaSize
+	for _, d := range dirs {
+		pageOff[d] = off
+		off += pageSize[d]
+	}
+	hdr.RootOff, hdr.RootSize = pageOff[""], pageSize[""]
+
+	_, err = out.Write(hdr.marshal())
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(metaJSON)
+	if err != nil {
+		return err
+	}
+	for _, d := range dirs {
+		cs := children[d]
+		page := make([]byte, 4+len(cs)*pagedEntrySize, pageSize[d])
+		binary.LittleEndian.PutUint32(page, uint32(len(cs)))
+		for i, c := range cs {
+			_, name := compactSplitPath(c.TarHeader.Name)
+			rec := page[4+i*pagedEntrySize : 4+(i+1)*pagedEntrySize]
+			// pages only hold the name, the path is derived from the parent directory
+			h := *c.TarHeader
+			h.Name = name
+			putCompactEntry(rec, indexEntry{Offset: c.Offset, TarHeader: &h}, uint32(len(page)), uint32(len(page)+len(name)))
+			page = append(page, name...)
+			page = append(page, c.TarHeader.Linkname...)
+			if c.TarHeader.Typeflag == tar.TypeDir {
+				binary.LittleEndian.PutUint32(rec[68:], uint32(pageSize[c.TarHeader.Name]))
+				binary.LittleEndian.PutUint64(rec[compactEntrySize:], pageOff[c.TarHeader.Name])
+			}
+		}
+		page = page[:len(page)+compactAggregateSize]
+		putCompactAggregate(page[len(page)-compactAggregateSize:], aggregates[d])
+		_, err = out.Write(page)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// OpenPagedIndex opens a paged index for an archive. Only the header, metadata and root page are
+// read up front. All other pages are read when a directory is first listed. Closing the index closes
+// both the index and the archive reader.
+func OpenPagedIndex(index io.ReaderAt, size int64, tarfile io.ReaderAt) (Index, error) {
+	n := int64(pagedPrefetch)
+	if n > size {
+		n = size
+	}
+	prefetch := make([]byte, n)
+	_, err := index.ReadAt(prefetch, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read paged index: %w", err)
+	}
+
+	res := &pagedIndex{
+		R:     index,
+		pages: make(map[uint64]*pagedPage),
+	}
+	err = res.Header.unmarshal(prefetch, size)
+	if err != nil {
+		return nil, err
+	}
+
+	read := func(off, size uint64) ([]byte, error) {
+		if off+size <= uint64(len(prefetch)) {
+			return prefetch[off : off+size], nil
+		}
+		buf := make([]byte, size)
+		_, err := index.ReadAt(buf, int64(off))
+		if err != nil && !(err == io.EOF && size == 0) {
+			return nil, err
+		}
+		return buf, nil
+	}
+	metaJSON, err := read(res.Header.MetaOff, res.Header.MetaSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read paged index metadata: %w", err)
+	}
+	err = json.Unmarshal(metaJSON, &res.Meta)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal paged index metadata: %w", err)
+	}
+	res.TarFile, err = compactArchiveReader(tarfile, res.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := read(res.Header.RootOff, res.Header.RootSize)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root page: %w", err)
+	}
+	res.root, err = res.parsePage(root, "")
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+var _ Index = (*pagedIndex)(nil)
+
+type pagedIndex struct {
+	R       io.ReaderAt
+	Header  pagedHeader
+	Meta    map[string][]byte
+	TarFile io.ReaderAt
+
+	root  *pagedPage
+	mu    sync.Mutex
+	pages map[uint64]*pagedPage
+}
+
+// pagedPage is a parsed page
+type pagedPage struct {
+	Entries []*pagedIndexEntry
+	// Aggregate is the aggregate of the directory of the page, if the index records them
+	Aggregate *DirAggregate
+}
+
+// Close implements Index
+func (pi *pagedIndex) Close() error {
+	pi.mu.Lock()
+	pi.pages = make(map[uint64]*pagedPage)
+	pi.mu.Unlock()
+	return firstError(closeReader(pi.R), closeReader(pi.TarFile))
+}
+
+// RootEntries implements Index
+func (pi *pagedIndex) RootEntries(ctx context.Context) ([]Entry, error) {
+	return pagedEntries(pi.root.Entries), nil
+}
+
+// Children implements Index
+func (pi *pagedIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
+	e, ok := of.(*pagedIndexEntry)
+	if !ok {
+		return nil, fmt.Errorf("entry does not belong to a paged index")
+	}
+	if e.PageSize == 0 {
+		return nil, nil
+	}
+	page, err := pi.page(e)
+	if err != nil {
+		return nil, err
+	}
+	return pagedEntries(page.Entries), nil
+}
+
+// page returns the page of a directory, reading it unless it's cached
+func (pi *pagedIndex) page(e *pagedIndexEntry) (*pagedPage, error) {
+	pi.mu.Lock()
+	res, ok := pi.pages[e.PageOff]
+	pi.mu.Unlock()
+	if ok {
+		return res, nil
+	}
+
+	page := make([]byte, e.PageSize)
+	_, err := pi.R.ReadAt(page, int64(e.PageOff))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read page of %s: %w", e.Path(), err)
+	}
+	res, err = pi.parsePage(page, e.Path())
+	if err != nil {
+		return nil, fmt.Errorf("cannot read page of %s: %w", e.Path(), err)
+	}
+
+	pi.mu.Lock()
+	if len(pi.pages) >= pagedCacheSize {
+		for k := range pi.pages {
+			delete(pi.pages, k)
+			break
+		}
+	}
+	pi.pages[e.PageOff] = res
+	pi.mu.Unlock()
+
+	return res, nil
+}
+
+func pagedEntries(entries []*pagedIndexEntry) []Entry {
+	res := make([]Entry, len(entries))
+	for i := range entries {
+		res[i] = entries[i]
+	}
+	return res
+}
+
+func (pi *pagedIndex) parsePage(page []byte, parent string) (*pagedPage, error) {
+	if len(page) < 4 {
+		return nil, fmt.Errorf("page is too short")
+	}
+	count := uint64(binary.LittleEndian.Uint32(page))
+	if 4+count*pagedEntrySize > uint64(len(page)) {
+		return nil, fmt.Errorf("page is too short for %d entries", count)
+	}
+	var aggregate *DirAggregate
+	if pi.Header.Flags&pagedFlagAggregates != 0 {
+		if 4+count*pagedEntrySize+compactAggregateSize > uint64(len(page)) {
+			return nil, fmt.Errorf("page is too short for its aggregate")
+		}
+		aggregate = compactAggregate(page[len(page)-compactAggregateSize:])
+	}
+	str := func(off, l uint32) (string, error) {
+		if uint64(off)+uint64(l) > uint64(len(page)) {
+			return "", fmt.Errorf("invalid string %d+%d", off, l)
+		}
+		return string(page[off : off+l]), nil
+	}
+
+	res := make([]*pagedIndexEntry, count)
+	for i := range res {
+		rec := page[4+i*pagedEntrySize : 4+(i+1)*pagedEntrySize]
+		name, err := str(binary.LittleEndian.Uint32(rec[0:]), binary.LittleEndian.Uint32(rec[4:]))
+		if err != nil {
+			return nil, err
+		}
+		link, err := str(binary.LittleEndian.Uint32(rec[8:]), binary.LittleEndian.Uint32(rec[12:]))
+		if err != nil {
+			return nil, err
+		}
+		if parent != "" {
+			name = parent + "/" + name
+		}
+		res[i] = &pagedIndexEntry{
+			fileBackedIndexEntry: fileBackedIndexEntry{
+				TarFile: pi.TarFile,
+				Entry:   compactEntry(rec, name, link),
+			},
+			PageOff:  binary.LittleEndian.Uint64(rec[compactEntrySize:]),
+			PageSize: binary.LittleEndian.Uint32(rec[68:]),
+			Index:    pi,
+		}
+	}
+	return &pagedPage{Entries: res, Aggregate: aggregate}, nil
+}
+
+// readPagedIndex converts a paged index to a badger index
+func readPagedIndex(r io.ReaderAt, size int64, db *badger.DB) error {
+	index, err := OpenPagedIndex(r, size, nil)
+	if err != nil {
+		return err
+	}
+	pi := index.(*pagedIndex)
+
+	wb := db.NewWriteBatch()
+	defer wb.Cancel()
+	for k, v := range pi.Meta {
+		err = wb.Set([]byte(metaKeyPrefix+k), v)
+		if err != nil {
+			return err
+		}
+	}
+
+	var walk func(entries []Entry) error
+	walk = func(entries []Entry) error {
+		for _, e := range entries {
+			pe := e.(*pagedIndexEntry)
+			val, err := json.Marshal(pe.Entry)
+			if err != nil {
+				return err
+			}
+			err = wb.Set([]byte(pe.Path()), val)
+			if err != nil {
+				return err
+			}
+			if !pe.Dir() {
+				continue
+			}
+			children, err := pi.Children(context.Background(), pe)
+			if err != nil {
+				return err
+			}
+			err = walk(children)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	root, _ := pi.RootEntries(context.Background())
+	err = walk(root)
+	if err != nil {
+		return err
+	}
+	err = wb.Flush()
+	if err != nil {
+		return err
+	}
+	return storeDirAggregates(db)
+}
+
+// pagedIndexEntry is a tar entry read from a paged index
+type pagedIndexEntry struct {
+	fileBackedIndexEntry
+
+	PageOff  uint64
+	PageSize uint32
+	Index    *pagedIndex
+}
+
+// Aggregate implements AggregateEntry
+func (e *pagedIndexEntry) Aggregate() (*DirAggregate, error) {
+	if e.PageSize == 0 || e.Index.Header.Flags&pagedFlagAggregates == 0 {
+		return nil, nil
+	}
+	page, err := e.Index.page(e)
+	if err != nil {
+		return nil, err
+	}
+	return page.Aggregate, nil
+}
@@ -0,0 +1,136 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPagedIndex(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "hello.txt", Mode: 0644, Size: int64(len(fileHelloTXT))})
+	tarw.Write([]byte(fileHelloTXT))
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "link", Linkname: "a/b/c.txt", Mode: 0777})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "a/", Mode: 0755})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "a/b/", Mode: 0755})
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a/b/c.txt", Mode: 0644, Size: int64(len(fileFooSlashBarTXT))})
+	tarw.Write([]byte(fileFooSlashBarTXT))
+	tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "big/", Mode: 0755})
+	for i := 0; i < 2000; i++ {
+		content := fmt.Sprintf("file %d", i)
+		tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: fmt.Sprintf("big/file-%04d", i), Mode: 0644, Size: int64(len(content))})
+		tarw.Write([]byte(content))
+	}
+	tarw.Close()
+	archive := buf.Bytes()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = idx.ProduceIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	paged := bytes.NewBuffer(nil)
+	err = idx.WritePagedIndex(db, paged)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	for fn, content := range map[string][]byte{"archive.tar": archive, "archive.index": paged.Bytes()} {
+		err = os.WriteFile(filepath.Join(dir, fn), content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var requests, served int64
+	files := http.FileServer(http.Dir(dir))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/archive.index" {
+			atomic.AddInt64(&requests, 1)
+			w = &countingResponseWriter{ResponseWriter: w, N: &served}
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	index, err := idx.Open(context.Background(), srv.URL+"/archive.tar", idx.OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	if n := atomic.LoadInt64(&served); n >= int64(paged.Len())/2 {
+		t.Errorf("opening fetched %d bytes of a %d byte index", n, paged.Len())
+	}
+
+	root, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var big idx.Entry
+	for _, e := range root {
+		if e.Name() == "big" {
+			big = e
+		}
+	}
+	if big == nil {
+		t.Fatal("root has no big directory")
+	}
+	for i, expectedRequests := range []int64{1, 0} {
+		before := atomic.LoadInt64(&requests)
+		children, err := index.Children(context.Background(), big)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(children) != 2000 {
+			t.Errorf("big has %d children, expected 2000", len(children))
+		}
+		if act := atomic.LoadInt64(&requests) - before; act != expectedRequests {
+			t.Errorf("listing big the %d. time took %d requests, expected %d", i+1, act, expectedRequests)
+		}
+	}
+
+	badgerIndex, err := idx.OpenTarIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectation := dumpIndex(t, badgerIndex)
+	if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+		t.Errorf("paged index mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(dumpAttrs(t, badgerIndex), dumpAttrs(t, index)); diff != "" {
+		t.Errorf("paged index attributes mismatch (-want +got):\n%s", diff)
+	}
+
+	converted, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer converted.Close()
+	err = idx.ReadCompactIndex(bytes.NewReader(paged.Bytes()), int64(paged.Len()), converted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	convertedIndex, err := idx.OpenTarIndex(converted, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(expectation, dumpIndex(t, convertedIndex)); diff != "" {
+		t.Errorf("converted index mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,215 @@
+package idx
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// PermMatch selects how Query.Perm is compared with the permission bits of entries
+type PermMatch int
+
+const (
+	// PermIgnore doesn't filter by permission bits
+	PermIgnore PermMatch = iota
+	// PermExact selects entries whose permission bits are Perm
+	PermExact
+	// PermAll selects entries which have all bits of Perm set
+	PermAll
+	// PermAny selects entries which have any bit of Perm set
+	PermAny
+)
+
+// Query selects the entries of an index which pass all of its filters
+type Query struct {
+	// Name is a glob which the base name of entries has to match, see path.Match
+	Name string
+	// Path is a glob which the path of entries has to match. Unlike path.Match, ** matches any
+	// number of directories. Directories which can't contain matches are not listed.
+	Path string
+	// Types lists the types of entries to select like find -type does: f, d, l, c, b and p
+	Types string
+	// MinSize is the smallest size of entries. The size of directories is the total size of the
+	// files below them if the index records aggregates, see DirAggregate.
+	MinSize int64
+	// MaxSize is the largest size of entries, unless it's negative
+	MaxSize int64
+	// NewerThan and OlderThan limit the modification time of entries, unless they're zero
+	NewerThan, OlderThan time.Time
+	// Perm filters by permission bits as configured by PermMatch
+	Perm      uint32
+	PermMatch PermMatch
+}
+
+// QueryIndex walks an index depth-first and calls fn for each entry which matches the query. The
+// info of directories includes their aggregate if the index records them.
+func QueryIndex(ctx context.Context, index Index, q Query, fn func(path string, info *EntryInfo) error) error {
+	q.Path = strings.TrimPrefix(q.Path, "/")
+	if q.Path != "" {
+		if _, err := path.Match(strings.ReplaceAll(q.Path, "**", "*"), ""); err != nil {
+			return fmt.Errorf("invalid path glob %q: %w", q.Path, err)
+		}
+	}
+	if q.Name != "" {
+		if _, err := path.Match(q.Name, ""); err != nil {
+			return fmt.Errorf("invalid name glob %q: %w", q.Name, err)
+		}
+	}
+	for _, t := range q.Types {
+		if !strings.ContainsRune("fdlcbp", t) {
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+
+	entries, err := index.RootEntries(ctx)
+	if err != nil {
+		return err
+	}
+	return queryEntries(ctx, index, q, "", entries, fn)
+}
+
+func queryEntries(ctx context.Context, index Index, q Query, prefix string, entries []Entry, fn func(path string, info *EntryInfo) error) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := prefix + e.Name()
+		info, err := entryInfo(e)
+		if err != nil {
+			return fmt.Errorf("cannot stat %s: %w", p, err)
+		}
+		if ae, ok := e.(AggregateEntry); ok && e.Dir() {
+			info.Aggregate, err = ae.Aggregate()
+			if err != nil {
+				return fmt.Errorf("cannot read aggregate of %s: %w", p, err)
+			}
+		}
+		if q.matches(p, info) {
+			err = fn(p, info)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !e.Dir() || (q.Path != "" && !globMatchesPrefix(q.Path, p)) {
+			continue
+		}
+		children, err := index.Children(ctx, e)
+		if err != nil {
+			return fmt.Errorf("cannot list %s: %w", p, err)
+		}
+		err = queryEntries(ctx, index, q, p+"/", children, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *Query) matches(p string, info *EntryInfo) bool {
+	if q.Name != "" {
+		if ok, _ := path.Match(q.Name, path.Base(p)); !ok {
+			return false
+		}
+	}
+	if q.Path != "" && !globMatches(q.Path, p) {
+		return false
+	}
+	if q.Types != "" && !strings.ContainsRune(q.Types, entryTypeLetter(info)) {
+		return false
+	}
+	size := info.Size
+	if info.Aggregate != nil {
+		size = info.Aggregate.Size
+	}
+	if q.MinSize > 0 && size < uint64(q.MinSize) {
+		return false
+	}
+	if q.MaxSize >= 0 && size > uint64(q.MaxSize) {
+		return false
+	}
+	if !q.NewerThan.IsZero() && !info.Mtime.After(q.NewerThan) {
+		return false
+	}
+	if !q.OlderThan.IsZero() && !info.Mtime.Before(q.OlderThan) {
+		return false
+	}
+
+	perm := info.Mode & 07777
+	switch q.PermMatch {
+	case PermExact:
+		return perm == q.Perm
+	case PermAll:
+		return perm&q.Perm == q.Perm
+	case PermAny:
+		return q.Perm == 0 || perm&q.Perm != 0
+	}
+	return true
+}
+
+// entryTypeLetter returns the letter find -type uses for the type of an entry
+func entryTypeLetter(info *EntryInfo) rune {
+	switch info.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		return 'd'
+	case syscall.S_IFLNK:
+		return 'l'
+	case syscall.S_IFCHR:
+		return 'c'
+	case syscall.S_IFBLK:
+		return 'b'
+	case syscall.S_IFIFO:
+		return 'p'
+	default:
+		return 'f'
+	}
+}
+
+// globMatches matches a path against a glob in which ** matches any number of path segments
+func globMatches(pattern, p string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(p, "/"))
+}
+
+func matchSegments(pattern, p []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(p); i++ {
+				if matchSegments(pattern[1:], p[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(p) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], p[0]); !ok {
+			return false
+		}
+		pattern, p = pattern[1:], p[1:]
+	}
+	return len(p) == 0
+}
+
+// globMatchesPrefix returns true if paths below the directory dir can match the glob
+func globMatchesPrefix(pattern, dir string) bool {
+	segs := strings.Split(pattern, "/")
+	for i, d := range strings.Split(dir, "/") {
+		if segs[i] == "**" {
+			return true
+		}
+		if i >= len(segs)-1 {
+			// the last segment of the glob matches the entries of the directory, not the directory itself
+			return false
+		}
+		if ok, _ := path.Match(segs[i], d); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,95 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestQueryIndex(t *testing.T) {
+	mtime := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	for _, hdr := range []*tar.Header{
+		{Typeflag: tar.TypeDir, Name: "usr/", Mode: 0755},
+		{Typeflag: tar.TypeDir, Name: "usr/lib/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "usr/lib/libfoo.so.1", Mode: 0755, Size: 2048},
+		{Typeflag: tar.TypeSymlink, Name: "usr/lib/libfoo.so", Linkname: "libfoo.so.1", Mode: 0777},
+		{Typeflag: tar.TypeDir, Name: "usr/lib/x86_64/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "usr/lib/x86_64/libbar.so", Mode: 0644, Size: 10, ModTime: mtime.Add(time.Hour)},
+		{Typeflag: tar.TypeDir, Name: "usr/bin/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "usr/bin/sudo", Mode: 04755, Size: 100},
+		{Typeflag: tar.TypeDir, Name: "etc/", Mode: 0755},
+		{Typeflag: tar.TypeReg, Name: "etc/passwd", Mode: 0644, Size: 1},
+	} {
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = mtime
+		}
+		tarw.WriteHeader(hdr)
+		tarw.Write(make([]byte, hdr.Size))
+	}
+	tarw.Close()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.ProduceIndex(db, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := idx.OpenTarIndex(db, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+
+	tests := []struct {
+		Name        string
+		Query       idx.Query
+		Expectation []string
+	}{
+		{
+			Name:        "all",
+			Query:       idx.Query{MaxSize: -1},
+			Expectation: []string{"etc", "etc/passwd", "usr", "usr/bin", "usr/bin/sudo", "usr/lib", "usr/lib/libfoo.so", "usr/lib/libfoo.so.1", "usr/lib/x86_64", "usr/lib/x86_64/libbar.so"},
+		},
+		{Name: "name", Query: idx.Query{Name: "lib*.so", MaxSize: -1}, Expectation: []string{"usr/lib/libfoo.so", "usr/lib/x86_64/libbar.so"}},
+		{Name: "path", Query: idx.Query{Path: "usr/lib/*.so*", MaxSize: -1}, Expectation: []string{"usr/lib/libfoo.so", "usr/lib/libfoo.so.1"}},
+		{Name: "path with **", Query: idx.Query{Path: "/usr/**/*.so", MaxSize: -1}, Expectation: []string{"usr/lib/libfoo.so", "usr/lib/x86_64/libbar.so"}},
+		{Name: "type", Query: idx.Query{Types: "dl", MaxSize: -1}, Expectation: []string{"etc", "usr", "usr/bin", "usr/lib", "usr/lib/libfoo.so", "usr/lib/x86_64"}},
+		{Name: "size", Query: idx.Query{Types: "f", MinSize: 10, MaxSize: 100}, Expectation: []string{"usr/bin/sudo", "usr/lib/x86_64/libbar.so"}},
+		{Name: "empty files", Query: idx.Query{Types: "f", MaxSize: 0}},
+		{Name: "newer", Query: idx.Query{NewerThan: mtime, MaxSize: -1}, Expectation: []string{"usr/lib/x86_64/libbar.so"}},
+		{Name: "older", Query: idx.Query{Types: "f", OlderThan: mtime.Add(time.Minute), MaxSize: -1}, Expectation: []string{"etc/passwd", "usr/bin/sudo", "usr/lib/libfoo.so.1"}},
+		{Name: "perm all", Query: idx.Query{Perm: 04000, PermMatch: idx.PermAll, MaxSize: -1}, Expectation: []string{"usr/bin/sudo"}},
+		{Name: "perm any", Query: idx.Query{Types: "f", Perm: 0111, PermMatch: idx.PermAny, MaxSize: -1}, Expectation: []string{"usr/bin/sudo", "usr/lib/libfoo.so.1"}},
+		{Name: "perm exact", Query: idx.Query{Perm: 0644, PermMatch: idx.PermExact, MaxSize: -1}, Expectation: []string{"etc/passwd", "usr/lib/x86_64/libbar.so"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			var act []string
+			err := idx.QueryIndex(context.Background(), index, test.Query, func(path string, info *idx.EntryInfo) error {
+				act = append(act, path)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("QueryIndex() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	err = idx.QueryIndex(context.Background(), index, idx.Query{Types: "x"}, func(string, *idx.EntryInfo) error { return nil })
+	if err == nil {
+		t.Error("QueryIndex() accepted an unknown type")
+	}
+}
@@ -0,0 +1,466 @@
+package idx
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/snabb/httpreaderat"
+)
+
+const (
+	dockerHubRegistry = "registry-1.docker.io"
+
+	// maxManifestSize limits the size of manifests we're willing to download
+	maxManifestSize = 4 << 20
+)
+
+var manifestMediaTypes = []string{
+	mediaTypeOCIIndex,
+	mediaTypeOCIManifest,
+	mediaTypeDockerList,
+	mediaTypeDockerManifest,
+}
+
+func init() {
+	RegisterBackend(Backend{
+		Name:    "registry",
+		Schemes: []string{"oci", "oci+http"},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			// oci://ghcr.io/owner/image:tag, oci+http://localhost:5000/image@sha256:...
+			ref := src.Host + src.Path
+			if src.Opaque != "" {
+				ref = src.Opaque
+			}
+			return OpenRegistryImage(ctx, ref, RegistryOptions{
+				Platform:  opts.Platform,
+				Username:  opts.Username,
+				Password:  opts.Password,
+				PlainHTTP: src.Scheme == "oci+http",
+			})
+		},
+	})
+}
+
+// RegistryOptions configure access to an OCI distribution registry
+type RegistryOptions struct {
+	// Platform selects a manifest from a multi-platform image, e.g. linux/amd64
+	Platform string
+	// Username and Password are used for basic auth and to obtain bearer tokens.
+	// If empty the registry is accessed anonymously.
+	Username string
+	Password string
+	// PlainHTTP talks to the registry without TLS
+	PlainHTTP bool
+	// Transport is used for all requests. Defaults to http.DefaultTransport
+	Transport http.RoundTripper
+}
+
+// ImageRef references an image in a registry
+type ImageRef struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseImageRef parses image references like ubuntu:22.04, ghcr.io/owner/image@sha256:...
+// or localhost:5000/foo/bar. References without a registry point to Docker Hub.
+func ParseImageRef(ref string) (ImageRef, error) {
+	var res ImageRef
+	if ref == "" {
+		return res, fmt.Errorf("empty image reference")
+	}
+
+	if name, digest, ok := strings.Cut(ref, "@"); ok {
+		ref, res.Digest = name, digest
+	}
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		ref, res.Tag = ref[:i], ref[i+1:]
+	}
+
+	if first, rest, ok := strings.Cut(ref, "/"); ok && (strings.ContainsAny(first, ".:") || first == "localhost") {
+		res.Registry, res.Repository = first, rest
+	} else {
+		res.Registry, res.Repository = dockerHubRegistry, ref
+	}
+	if res.Registry == dockerHubRegistry && !strings.Contains(res.Repository, "/") {
+		res.Repository = "library/" + res.Repository
+	}
+	if res.Tag == "" && res.Digest == "" {
+		res.Tag = "latest"
+	}
+	if res.Repository == "" {
+		return res, fmt.Errorf("invalid image reference %q: missing repository", ref)
+	}
+
+	return res, nil
+}
+
+// Reference returns the digest if there is one, or the tag otherwise
+func (r ImageRef) Reference() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r ImageRef) String() string {
+	res := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		res += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		res += "@" + r.Digest
+	}
+	return res
+}
+
+// OpenRegistryImage pulls an image from an OCI distribution registry. Layers which DefaultIndexCache
+// holds no index of are read through once to index them, see openOCILayer. Apart from that only the
+// manifests are downloaded upfront, and layer blobs are read through range requests.
+func OpenRegistryImage(ctx context.Context, ref string, opts RegistryOptions) (Index, error) {
+	imgRef, err := ParseImageRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := "https"
+	if opts.PlainHTTP {
+		scheme = "http"
+	}
+	transport := opts.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	store := &registryStore{
+		BaseURL: scheme + "://" + imgRef.Registry + "/v2/" + imgRef.Repository,
+		Client: &http.Client{
+			Transport: &registryAuthTransport{
+				Base:     transport,
+				Username: opts.Username,
+				Password: opts.Password,
+			},
+		},
+	}
+
+	desc, err := store.Resolve(ctx, imgRef.Reference())
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve %s: %w", imgRef, err)
+	}
+	if imgRef.Digest != "" && desc.Digest != imgRef.Digest {
+		return nil, fmt.Errorf("registry returned %s for %s", desc.Digest, imgRef)
+	}
+	log.WithField("ref", imgRef.String()).WithField("digest", desc.Digest).WithField("mediaType", desc.MediaType).Debug("resolved image")
+
+	return openOCIImage(ctx, store, desc, opts.Platform)
+}
+
+// registryStore reads blobs from a repository in an OCI distribution registry
+type registryStore struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+// Resolve turns a tag or digest into the descriptor of the manifest it points to
+func (s *registryStore) Resolve(ctx context.Context, reference string) (ociDescriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, s.BaseURL+"/manifests/"+reference, nil)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestMediaTypes, ", "))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ociDescriptor{}, fmt.Errorf("HEAD %s: %s", req.URL, resp.Status)
+	}
+
+	res := ociDescriptor{
+		MediaType: strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0]),
+		Digest:    resp.Header.Get("Docker-Content-Digest"),
+		Size:      resp.ContentLength,
+	}
+	if res.Digest == "" {
+		// Some registries omit the digest header on HEAD requests. In that case
+		// we fetch the manifest by its reference and compute the digest ourselves.
+		content, mediaType, err := s.get(ctx, "/manifests/"+reference, manifestMediaTypes)
+		if err != nil {
+			return ociDescriptor{}, err
+		}
+		res = ociDescriptor{MediaType: mediaType, Digest: digestOf(content), Size: int64(len(content))}
+	}
+	return res, nil
+}
+
+func (s *registryStore) get(ctx context.Context, path string, accept []string) (content []byte, mediaType string, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.BaseURL+path, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ", "))
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("GET %s: %s", req.URL, resp.Status)
+	}
+
+	content, err = io.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+	if err != nil {
+		return nil, "", err
+	}
+	mediaType = strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	return content, mediaType, nil
+}
+
+// Fetch implements blobStore
+func (s *registryStore) Fetch(ctx context.Context, desc ociDescriptor) ([]byte, error) {
+	path := "/blobs/" + desc.Digest
+	var accept []string
+	for _, mt := range manifestMediaTypes {
+		if mt == desc.MediaType {
+			path = "/manifests/" + desc.Digest
+			accept = []string{desc.MediaType}
+			break
+		}
+	}
+
+	content, _, err := s.get(ctx, path, accept)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyDigest(desc.Digest, content)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Open implements blobStore. The blob is requested on first read only, so that mounting an image
+// whose layer indices are cached costs no more than resolving its manifests.
+func (s *registryStore) Open(ctx context.Context, desc ociDescriptor) (io.ReaderAt, error) {
+	req, err := http.NewRequest(http.MethodGet, s.BaseURL+"/blobs/"+desc.Digest, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &lazyReaderAt{Open: func() (io.ReaderAt, error) {
+		return httpreaderat.New(s.Client, req, nil)
+	}}, nil
+}
+
+// lazyReaderAt opens the underlying reader on first read
+type lazyReaderAt struct {
+	Open func() (io.ReaderAt, error)
+
+	mu sync.Mutex
+	r  io.ReaderAt
+}
+
+// ReadAt implements io.ReaderAt
+func (l *lazyReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	l.mu.Lock()
+	if l.r == nil {
+		r, err := l.Open()
+		if err != nil {
+			l.mu.Unlock()
+			return 0, err
+		}
+		l.r = r
+	}
+	r := l.r
+	l.mu.Unlock()
+	return r.ReadAt(p, off)
+}
+
+// Close closes the underlying reader if it's been opened
+func (l *lazyReaderAt) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.r == nil {
+		return nil
+	}
+	return closeReader(l.r)
+}
+
+// registryAuthTransport answers authentication challenges of a registry. Bearer tokens
+// are obtained from the token service named in the challenge and reused for subsequent
+// requests to the same host.
+type registryAuthTransport struct {
+	Base     http.RoundTripper
+	Username string
+	Password string
+
+	mu   sync.Mutex
+	auth map[string]string
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *registryAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	auth := t.auth[req.URL.Host]
+	t.mu.Unlock()
+
+	resp, err := t.Base.RoundTrip(withAuthorization(req, auth))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized || req.Body != nil {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	if challenge == "" {
+		return resp, nil
+	}
+
+	newAuth, err := t.authenticate(req.Context(), challenge)
+	if err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("cannot authenticate with %s: %w", req.URL.Host, err)
+	}
+	resp.Body.Close()
+
+	t.mu.Lock()
+	if t.auth == nil {
+		t.auth = make(map[string]string)
+	}
+	t.auth[req.URL.Host] = newAuth
+	t.mu.Unlock()
+
+	return t.Base.RoundTrip(withAuthorization(req, newAuth))
+}
+
+// authenticate answers a WWW-Authenticate challenge with the value of an Authorization header
+func (t *registryAuthTransport) authenticate(ctx context.Context, challenge string) (string, error) {
+	scheme, params := parseAuthChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if t.Username == "" {
+			return "", fmt.Errorf("registry requires basic auth but no credentials were provided")
+		}
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth(t.Username, t.Password)
+		return req.Header.Get("Authorization"), nil
+
+	case "bearer":
+		realm := params["realm"]
+		if realm == "" {
+			return "", fmt.Errorf("bearer challenge without realm")
+		}
+		u, err := url.Parse(realm)
+		if err != nil {
+			return "", fmt.Errorf("invalid realm %q: %w", realm, err)
+		}
+		q := u.Query()
+		for _, k := range []string{"service", "scope"} {
+			if v := params[k]; v != "" {
+				q.Set(k, v)
+			}
+		}
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		if t.Username != "" {
+			req.SetBasicAuth(t.Username, t.Password)
+		}
+		resp, err := t.Base.RoundTrip(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("GET %s: %s", u.Redacted(), resp.Status)
+		}
+
+		var token struct {
+			Token       string `json:"token"`
+			AccessToken string `json:"access_token"`
+		}
+		err = json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token)
+		if err != nil {
+			return "", fmt.Errorf("cannot decode token: %w", err)
+		}
+		if token.Token == "" {
+			token.Token = token.AccessToken
+		}
+		if token.Token == "" {
+			return "", fmt.Errorf("token service returned no token")
+		}
+		return "Bearer " + token.Token, nil
+
+	default:
+		return "", fmt.Errorf("unsupported auth scheme %q", scheme)
+	}
+}
+
+func withAuthorization(req *http.Request, auth string) *http.Request {
+	if auth == "" {
+		return req
+	}
+	res := req.Clone(req.Context())
+	res.Header.Set("Authorization", auth)
+	return res
+}
+
+// parseAuthChallenge parses a WWW-Authenticate header, e.g.
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/ubuntu:pull"
+func parseAuthChallenge(challenge string) (scheme string, params map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params = make(map[string]string)
+	for rest != "" {
+		var key string
+		key, rest, _ = strings.Cut(rest, "=")
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		var val string
+		rest = strings.TrimSpace(rest)
+		if strings.HasPrefix(rest, `"`) {
+			var (
+				sb  strings.Builder
+				end = len(rest)
+			)
+			for i := 1; i < len(rest); i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+					sb.WriteByte(rest[i])
+					continue
+				}
+				if rest[i] == '"' {
+					end = i + 1
+					break
+				}
+				sb.WriteByte(rest[i])
+			}
+			val, rest = sb.String(), rest[end:]
+			_, rest, _ = strings.Cut(rest, ",")
+		} else {
+			val, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[key] = strings.TrimSpace(val)
+		}
+	}
+	return scheme, params
+}
+
+func digestOf(content []byte) string {
+	sum := sha256.Sum256(content)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
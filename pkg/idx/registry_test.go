@@ -0,0 +1,235 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseImageRef(t *testing.T) {
+	tests := []struct {
+		Ref         string
+		Expectation idx.ImageRef
+	}{
+		{Ref: "ubuntu", Expectation: idx.ImageRef{Registry: "registry-1.docker.io", Repository: "library/ubuntu", Tag: "latest"}},
+		{Ref: "owner/image:1.2", Expectation: idx.ImageRef{Registry: "registry-1.docker.io", Repository: "owner/image", Tag: "1.2"}},
+		{Ref: "ghcr.io/owner/image@sha256:abc", Expectation: idx.ImageRef{Registry: "ghcr.io", Repository: "owner/image", Digest: "sha256:abc"}},
+		{Ref: "localhost:5000/foo:v1@sha256:abc", Expectation: idx.ImageRef{Registry: "localhost:5000", Repository: "foo", Tag: "v1", Digest: "sha256:abc"}},
+	}
+	for _, test := range tests {
+		t.Run(test.Ref, func(t *testing.T) {
+			act, err := idx.ParseImageRef(test.Ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.Expectation, act); diff != "" {
+				t.Errorf("ParseImageRef() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// fakeRegistry serves a single repository and requires bearer token auth
+type fakeRegistry struct {
+	Repo      string
+	Manifests map[string]fakeManifest
+	Blobs     map[string][]byte
+
+	url          string
+	blobRequests int32
+}
+
+type fakeManifest struct {
+	MediaType string
+	Content   []byte
+}
+
+func (reg *fakeRegistry) addBlob(content []byte) (digest string) {
+	sum := sha256.Sum256(content)
+	digest = "sha256:" + hex.EncodeToString(sum[:])
+	reg.Blobs[digest] = content
+	return digest
+}
+
+func (reg *fakeRegistry) addManifest(mediaType string, obj interface{}, tags ...string) (digest string, size int) {
+	content, _ := json.Marshal(obj)
+	sum := sha256.Sum256(content)
+	digest = "sha256:" + hex.EncodeToString(sum[:])
+	for _, name := range append(tags, digest) {
+		reg.Manifests[name] = fakeManifest{MediaType: mediaType, Content: content}
+	}
+	return digest, len(content)
+}
+
+func (reg *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/token" {
+		if r.URL.Query().Get("scope") != "repository:"+reg.Repo+":pull" {
+			http.Error(w, "invalid scope", http.StatusForbidden)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+		return
+	}
+	if r.Header.Get("Authorization") != "Bearer secret" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test",scope="repository:%s:pull"`, reg.url, reg.Repo))
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pfx := "/v2/" + reg.Repo + "/"
+	if !strings.HasPrefix(r.URL.Path, pfx) {
+		http.NotFound(w, r)
+		return
+	}
+	kind, ref, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, pfx), "/")
+	switch kind {
+	case "manifests":
+		m, ok := reg.Manifests[ref]
+		if !ok || !strings.Contains(r.Header.Get("Accept"), m.MediaType) {
+			http.NotFound(w, r)
+			return
+		}
+		sum := sha256.Sum256(m.Content)
+		w.Header().Set("Content-Type", m.MediaType)
+		w.Header().Set("Docker-Content-Digest", "sha256:"+hex.EncodeToString(sum[:]))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(m.Content))
+	case "blobs":
+		atomic.AddInt32(&reg.blobRequests, 1)
+		b, ok := reg.Blobs[ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(b))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestOpenRegistryImage(t *testing.T) {
+	reg := &fakeRegistry{
+		Repo:      "foo/bar",
+		Manifests: make(map[string]fakeManifest),
+		Blobs:     make(map[string][]byte),
+	}
+	srv := httptest.NewServer(reg)
+	defer srv.Close()
+	reg.url = srv.URL
+
+	cache := idx.NewIndexCache(t.TempDir())
+	defer func(c *idx.IndexCache) { idx.DefaultIndexCache = c }(idx.DefaultIndexCache)
+	idx.DefaultIndexCache = cache
+
+	platformImage := func(platform string) map[string]interface{} {
+		layer := gzipMembers(t, buildTar(t,
+			tarFile{Name: "etc/", Type: tar.TypeDir},
+			tarFile{Name: "etc/platform", Type: tar.TypeReg, Content: platform},
+		))
+		config := reg.addBlob([]byte("{}"))
+		digest, size := reg.addManifest("application/vnd.oci.image.manifest.v1+json", map[string]interface{}{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+			"config":        map[string]interface{}{"mediaType": "application/vnd.oci.image.config.v1+json", "digest": config, "size": 2},
+			"layers": []interface{}{
+				map[string]interface{}{"mediaType": "application/vnd.oci.image.layer.v1.tar+gzip", "digest": reg.addBlob(layer), "size": len(layer)},
+			},
+		})
+		goos, arch, _ := strings.Cut(platform, "/")
+		return map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    digest,
+			"size":      size,
+			"platform":  map[string]string{"os": goos, "architecture": arch},
+		}
+	}
+	listDigest, _ := reg.addManifest("application/vnd.oci.image.index.v1+json", map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests":     []interface{}{platformImage("linux/amd64"), platformImage("linux/arm64")},
+	}, "v1")
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	tests := []struct {
+		Name        string
+		Ref         string
+		Platform    string
+		Expectation []string
+		Err         string
+	}{
+		{
+			Name:        "tag",
+			Ref:         host + "/foo/bar:v1",
+			Platform:    "linux/arm64",
+			Expectation: []string{"etc/", "etc/platform:linux/arm64"},
+		},
+		{
+			Name:        "digest",
+			Ref:         host + "/foo/bar@" + listDigest,
+			Platform:    "linux/amd64",
+			Expectation: []string{"etc/", "etc/platform:linux/amd64"},
+		},
+		{
+			Name:     "unknown platform",
+			Ref:      host + "/foo/bar:v1",
+			Platform: "windows/amd64",
+			Err:      "no manifest for platform windows/amd64 - available platforms are: linux/amd64, linux/arm64",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index, err := idx.OpenRegistryImage(context.Background(), test.Ref, idx.RegistryOptions{
+				Platform:  test.Platform,
+				PlainHTTP: true,
+			})
+			if err != nil {
+				if diff := cmp.Diff(test.Err, err.Error()); diff != "" {
+					t.Errorf("OpenRegistryImage() error mismatch (-want +got):\n%s", diff)
+				}
+				return
+			}
+
+			defer index.Close()
+
+			if diff := cmp.Diff(test.Expectation, dumpIndex(t, index)); diff != "" {
+				t.Errorf("OpenRegistryImage() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	// the layer has been indexed before, hence mounting it again doesn't read it
+	atomic.StoreInt32(&reg.blobRequests, 0)
+	index, err := idx.OpenRegistryImage(context.Background(), host+"/foo/bar:v1", idx.RegistryOptions{
+		Platform:  "linux/arm64",
+		PlainHTTP: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	roots, err := index.RootEntries(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roots) != 1 || roots[0].Name() != "etc" {
+		t.Errorf("cached image has %d root entries, expected etc only", len(roots))
+	}
+	if n := atomic.LoadInt32(&reg.blobRequests); n != 0 {
+		t.Errorf("mounting a cached image issued %d blob requests, expected none", n)
+	}
+	if diff := cmp.Diff([]string{"etc/", "etc/platform:linux/arm64"}, dumpIndex(t, index)); diff != "" {
+		t.Errorf("cached OpenRegistryImage() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,174 @@
+package idx
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"syscall"
+)
+
+// SearchMatch is a line of a file which matches the pattern of a search
+type SearchMatch struct {
+	Path string
+	// Line is the number of the line, starting at 1
+	Line int
+	Text []byte
+}
+
+// Search walks an index depth-first and calls fn for each line of a regular file which matches the
+// regular expression, like grep -r does. Files are read line by line. Files which contain a NUL byte are
+// considered binary and are skipped from there on, which like with grep is the whole file if the NUL byte
+// is found in the first 64KiB. If candidates isn't nil, only those files are read, see ContentIndex.Candidates.
+func Search(ctx context.Context, index Index, re *regexp.Regexp, candidates []string, fn func(m SearchMatch) error) error {
+	if candidates != nil && len(candidates) == 0 {
+		return nil
+	}
+	var (
+		dirs  map[string]bool
+		files = make(map[string]bool, len(candidates))
+	)
+	if candidates != nil {
+		dirs = make(map[string]bool)
+	}
+	for _, p := range candidates {
+		files[p] = true
+		for p != "" {
+			p, _ = compactSplitPath(p)
+			dirs[p] = true
+		}
+	}
+
+	entries, err := index.RootEntries(ctx)
+	if err != nil {
+		return err
+	}
+	s := &searcher{
+		Index: index,
+		Re:    re,
+		Dirs:  dirs,
+		Files: files,
+		Fn:    fn,
+	}
+	return s.search(ctx, "", entries)
+}
+
+type searcher struct {
+	Index Index
+	Re    *regexp.Regexp
+	// Dirs and Files restrict the search to the candidates, unless Dirs is nil
+	Dirs  map[string]bool
+	Files map[string]bool
+	Fn    func(m SearchMatch) error
+}
+
+func (s *searcher) search(ctx context.Context, prefix string, entries []Entry) error {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		p := prefix + e.Name()
+		if e.Dir() {
+			if s.Dirs != nil && !s.Dirs[p] {
+				continue
+			}
+			children, err := s.Index.Children(ctx, e)
+			if err != nil {
+				return fmt.Errorf("cannot list %s: %w", p, err)
+			}
+			err = s.search(ctx, p+"/", children)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if s.Dirs != nil && !s.Files[p] {
+			continue
+		}
+		if typ := e.StableMode(); typ != 0 && typ != syscall.S_IFREG {
+			continue
+		}
+		err := s.searchFile(p, e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	// searchBufferSize is the size of the buffer files are read through. Like grep, files with a
+	// NUL byte in the first buffer are considered binary.
+	searchBufferSize = 64 << 10
+	// maxSearchLineSize limits how much of a line is matched, so that files without line breaks
+	// don't take up memory
+	maxSearchLineSize = 1 << 20
+)
+
+func (s *searcher) searchFile(p string, e Entry) error {
+	info, err := entryInfo(e)
+	if err != nil {
+		return fmt.Errorf("cannot stat %s: %w", p, err)
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(entryReaderAt{e}, 0, int64(info.Size)), searchBufferSize)
+	head, err := r.Peek(searchBufferSize)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("cannot read %s: %w", p, err)
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+
+	var line []byte
+	for n := 1; ; n++ {
+		line = line[:0]
+		var chunk []byte
+		for {
+			chunk, err = r.ReadSlice('\n')
+			if rest := maxSearchLineSize - len(line); len(chunk) > rest {
+				chunk = chunk[:rest]
+			}
+			line = append(line, chunk...)
+			if !errors.Is(err, bufio.ErrBufferFull) {
+				break
+			}
+		}
+		eof := errors.Is(err, io.EOF)
+		if err != nil && !eof {
+			return fmt.Errorf("cannot read %s: %w", p, err)
+		}
+		if eof && len(line) == 0 {
+			return nil
+		}
+		// files with a NUL byte past the first buffer are binary as well, we just notice late
+		if bytes.IndexByte(line, 0) >= 0 {
+			return nil
+		}
+
+		text := bytes.TrimSuffix(line, []byte("\n"))
+		if s.Re.Match(text) {
+			err = s.Fn(SearchMatch{Path: p, Line: n, Text: append([]byte(nil), text...)})
+			if err != nil {
+				return err
+			}
+		}
+		if eof {
+			return nil
+		}
+	}
+}
+
+// entryReaderAt reads the content of an entry
+type entryReaderAt struct {
+	Entry
+}
+
+// ReadAt implements io.ReaderAt
+func (r entryReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	return r.Entry.Read(p, off)
+}
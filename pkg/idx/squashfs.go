@@ -0,0 +1,682 @@
+package idx
+
+import (
+	"bytes"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	squashfsMagic          = 0x73717368
+	squashfsSuperblockSize = 96
+	squashfsMetadataSize   = 8192
+	squashfsNoFragment     = 0xffffffff
+	squashfsNoTable        = 0xffffffffffffffff
+
+	// squashfsUncompressedBlock is set on the size of data and fragment blocks stored verbatim
+	squashfsUncompressedBlock = 1 << 24
+	// squashfsUncompressedMetadata is set on the header of metadata blocks stored verbatim
+	squashfsUncompressedMetadata = 0x8000
+
+	// squashfsCacheSize is the number of decompressed blocks we keep around
+	squashfsCacheSize = 64
+)
+
+const (
+	squashfsBasicDir uint16 = iota + 1
+	squashfsBasicFile
+	squashfsBasicSymlink
+	squashfsBasicBlockDev
+	squashfsBasicCharDev
+	squashfsBasicFifo
+	squashfsBasicSocket
+	squashfsExtDir
+	squashfsExtFile
+	squashfsExtSymlink
+	squashfsExtBlockDev
+	squashfsExtCharDev
+	squashfsExtFifo
+	squashfsExtSocket
+)
+
+type squashfsSuperblock struct {
+	Magic              uint32
+	InodeCount         uint32
+	ModificationTime   uint32
+	BlockSize          uint32
+	FragmentCount      uint32
+	Compression        uint16
+	BlockLog           uint16
+	Flags              uint16
+	IDCount            uint16
+	VersionMajor       uint16
+	VersionMinor       uint16
+	RootInode          uint64
+	BytesUsed          uint64
+	IDTableStart       uint64
+	XattrIDTableStart  uint64
+	InodeTableStart    uint64
+	DirTableStart      uint64
+	FragmentTableStart uint64
+	ExportTableStart   uint64
+}
+
+func init() {
+	RegisterBackend(Backend{
+		Name: "squashfs",
+		Detect: func(src *url.URL, header []byte) bool {
+			return len(header) >= 4 && binary.LittleEndian.Uint32(header) == squashfsMagic
+		},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			return OpenSquashfs(sourceLocation(src))
+		},
+	})
+}
+
+// OpenSquashfs opens a SquashFS image from a local path or HTTP(S) URL
+func OpenSquashfs(location string) (Index, error) {
+	r, _, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	res, err := NewSquashfsIndex(r)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	return res, nil
+}
+
+// NewSquashfsIndex reads the superblock, id and fragment tables of the SquashFS image in r.
+// Inodes, directories and file content are read on demand.
+func NewSquashfsIndex(r io.ReaderAt) (Index, error) {
+	var sb squashfsSuperblock
+	err := binary.Read(io.NewSectionReader(r, 0, squashfsSuperblockSize), binary.LittleEndian, &sb)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read superblock: %w", err)
+	}
+	if sb.Magic != squashfsMagic {
+		return nil, fmt.Errorf("not a squashfs image")
+	}
+	if sb.VersionMajor != 4 {
+		return nil, fmt.Errorf("unsupported squashfs version %d.%d", sb.VersionMajor, sb.VersionMinor)
+	}
+
+	res := &squashfsIndex{
+		r:     r,
+		sb:    sb,
+		cache: make(map[int64]squashfsBlock),
+	}
+	switch sb.Compression {
+	case 1:
+		res.decompress = func(src []byte) ([]byte, error) {
+			zr, err := zlib.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(zr)
+		}
+	case 4:
+		res.decompress = func(src []byte) ([]byte, error) {
+			xr, err := xz.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(xr)
+		}
+	case 6:
+		dec, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		res.decompress = func(src []byte) ([]byte, error) {
+			return dec.DecodeAll(src, nil)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported squashfs compression %d", sb.Compression)
+	}
+
+	res.ids, err = res.readLookupTable(sb.IDTableStart, int(sb.IDCount), 4)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read id table: %w", err)
+	}
+	if sb.FragmentCount > 0 && sb.FragmentTableStart != squashfsNoTable {
+		res.fragments, err = res.readLookupTable(sb.FragmentTableStart, int(sb.FragmentCount), 16)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read fragment table: %w", err)
+		}
+	}
+
+	res.root, err = res.readInode("", sb.RootInode)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read root inode: %w", err)
+	}
+	if !res.root.Dir() {
+		return nil, fmt.Errorf("root inode is not a directory")
+	}
+
+	return res, nil
+}
+
+var _ Index = (*squashfsIndex)(nil)
+
+type squashfsIndex struct {
+	r          io.ReaderAt
+	sb         squashfsSuperblock
+	decompress func(src []byte) ([]byte, error)
+	ids        []byte
+	fragments  []byte
+	root       *squashfsEntry
+
+	mu    sync.Mutex
+	cache map[int64]squashfsBlock
+}
+
+// Close implements Index
+func (s *squashfsIndex) Close() error {
+	s.mu.Lock()
+	s.cache = make(map[int64]squashfsBlock)
+	s.mu.Unlock()
+	return closeReader(s.r)
+}
+
+// RootEntries implements Index
+func (s *squashfsIndex) RootEntries(ctx context.Context) ([]Entry, error) {
+	return s.readDir(s.root)
+}
+
+// Children implements Index
+func (s *squashfsIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
+	e, ok := of.(*squashfsEntry)
+	if !ok {
+		return nil, fmt.Errorf("entry %s does not belong to this index", of.Name())
+	}
+	return s.readDir(e)
+}
+
+// squashfsBlock is a decompressed block and the space it occupies in the image
+type squashfsBlock struct {
+	Data     []byte
+	DiskSize int64
+}
+
+// cached returns the decompressed block stored at pos, reading it using load if need be
+func (s *squashfsIndex) cached(pos int64, load func() (squashfsBlock, error)) (squashfsBlock, error) {
+	s.mu.Lock()
+	blk, ok := s.cache[pos]
+	s.mu.Unlock()
+	if ok {
+		return blk, nil
+	}
+
+	blk, err := load()
+	if err != nil {
+		return blk, err
+	}
+
+	s.mu.Lock()
+	if len(s.cache) >= squashfsCacheSize {
+		for k := range s.cache {
+			delete(s.cache, k)
+			break
+		}
+	}
+	s.cache[pos] = blk
+	s.mu.Unlock()
+	return blk, nil
+}
+
+// readMetadataBlock reads the metadata block at pos
+func (s *squashfsIndex) readMetadataBlock(pos int64) (squashfsBlock, error) {
+	return s.cached(pos, func() (squashfsBlock, error) {
+		// We don't know the size of the block before reading its header, but it's
+		// never larger than squashfsMetadataSize. Reading header and block in one go
+		// saves a round trip when the image is served via HTTP.
+		buf := make([]byte, 2+squashfsMetadataSize)
+		n, err := s.r.ReadAt(buf, pos)
+		if err != nil && !(errors.Is(err, io.EOF) && n >= 2) {
+			return squashfsBlock{}, err
+		}
+		h := binary.LittleEndian.Uint16(buf)
+		size := int(h &^ squashfsUncompressedMetadata)
+		if 2+size > n {
+			return squashfsBlock{}, fmt.Errorf("metadata block at %d is truncated", pos)
+		}
+
+		res := squashfsBlock{Data: buf[2 : 2+size], DiskSize: int64(2 + size)}
+		if h&squashfsUncompressedMetadata != 0 {
+			return res, nil
+		}
+		res.Data, err = s.decompress(res.Data)
+		return res, err
+	})
+}
+
+// metadataReader reads a sequence of bytes spanning one or more metadata blocks
+type squashfsMetadataReader struct {
+	s   *squashfsIndex
+	pos int64
+	buf []byte
+}
+
+func (s *squashfsIndex) metadataReader(block int64, offset int) (*squashfsMetadataReader, error) {
+	r := &squashfsMetadataReader{s: s, pos: block}
+	err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	if offset > len(r.buf) {
+		return nil, fmt.Errorf("metadata offset %d beyond block size %d", offset, len(r.buf))
+	}
+	r.buf = r.buf[offset:]
+	return r, nil
+}
+
+func (r *squashfsMetadataReader) next() error {
+	blk, err := r.s.readMetadataBlock(r.pos)
+	if err != nil {
+		return err
+	}
+	r.buf = blk.Data
+	r.pos += blk.DiskSize
+	return nil
+}
+
+// Read implements io.Reader
+func (r *squashfsMetadataReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		if len(r.buf) == 0 {
+			err = r.next()
+			if err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], r.buf)
+		r.buf = r.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// readLookupTable reads a table of fixed-size records which is stored in metadata blocks
+// whose positions are listed at start.
+func (s *squashfsIndex) readLookupTable(start uint64, count, recordSize int) ([]byte, error) {
+	size := count * recordSize
+	blocks := (size + squashfsMetadataSize - 1) / squashfsMetadataSize
+	ptrs := make([]uint64, blocks)
+	err := binary.Read(io.NewSectionReader(s.r, int64(start), int64(blocks*8)), binary.LittleEndian, ptrs)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]byte, 0, size)
+	for _, p := range ptrs {
+		blk, err := s.readMetadataBlock(int64(p))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, blk.Data...)
+	}
+	if len(res) < size {
+		return nil, fmt.Errorf("table is too short: expected %d bytes, got %d", size, len(res))
+	}
+	return res[:size], nil
+}
+
+func (s *squashfsIndex) id(idx uint16) uint32 {
+	if int(idx)*4+4 > len(s.ids) {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(s.ids[int(idx)*4:])
+}
+
+type squashfsInodeHeader struct {
+	Type        uint16
+	Permissions uint16
+	UIDIdx      uint16
+	GIDIdx      uint16
+	Mtime       uint32
+	InodeNumber uint32
+}
+
+// readInode reads the inode referenced by ref. The upper bits of the reference point to
+// the metadata block relative to the inode table, the lower 16 bits are the offset therein.
+func (s *squashfsIndex) readInode(name string, ref uint64) (*squashfsEntry, error) {
+	r, err := s.metadataReader(int64(s.sb.InodeTableStart+ref>>16), int(ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr squashfsInodeHeader
+	err = binary.Read(r, binary.LittleEndian, &hdr)
+	if err != nil {
+		return nil, err
+	}
+	res := &squashfsEntry{
+		idx:  s,
+		name: name,
+		hdr:  hdr,
+	}
+
+	le := binary.LittleEndian
+	switch hdr.Type {
+	case squashfsBasicDir:
+		var d struct {
+			BlockIdx    uint32
+			LinkCount   uint32
+			FileSize    uint16
+			BlockOffset uint16
+			ParentInode uint32
+		}
+		err = binary.Read(r, le, &d)
+		res.dirBlock, res.dirOffset, res.size, res.nlink = d.BlockIdx, d.BlockOffset, uint64(d.FileSize), d.LinkCount
+	case squashfsExtDir:
+		var d struct {
+			LinkCount   uint32
+			FileSize    uint32
+			BlockIdx    uint32
+			ParentInode uint32
+			IndexCount  uint16
+			BlockOffset uint16
+			XattrIdx    uint32
+		}
+		err = binary.Read(r, le, &d)
+		res.dirBlock, res.dirOffset, res.size, res.nlink = d.BlockIdx, d.BlockOffset, uint64(d.FileSize), d.LinkCount
+
+	case squashfsBasicFile:
+		var f struct {
+			BlocksStart uint32
+			FragIndex   uint32
+			BlockOffset uint32
+			FileSize    uint32
+		}
+		err = binary.Read(r, le, &f)
+		res.blocksStart, res.fragIndex, res.fragOffset, res.size, res.nlink = uint64(f.BlocksStart), f.FragIndex, f.BlockOffset, uint64(f.FileSize), 1
+	case squashfsExtFile:
+		var f struct {
+			BlocksStart uint64
+			FileSize    uint64
+			Sparse      uint64
+			LinkCount   uint32
+			FragIndex   uint32
+			BlockOffset uint32
+			XattrIdx    uint32
+		}
+		err = binary.Read(r, le, &f)
+		res.blocksStart, res.fragIndex, res.fragOffset, res.size, res.nlink = f.BlocksStart, f.FragIndex, f.BlockOffset, f.FileSize, f.LinkCount
+
+	case squashfsBasicSymlink, squashfsExtSymlink:
+		var l struct {
+			LinkCount  uint32
+			TargetSize uint32
+		}
+		err = binary.Read(r, le, &l)
+		if err != nil {
+			return nil, err
+		}
+		target := make([]byte, l.TargetSize)
+		_, err = io.ReadFull(r, target)
+		res.target, res.size, res.nlink = string(target), uint64(l.TargetSize), l.LinkCount
+
+	case squashfsBasicBlockDev, squashfsBasicCharDev, squashfsExtBlockDev, squashfsExtCharDev:
+		var d struct {
+			LinkCount uint32
+			Device    uint32
+		}
+		err = binary.Read(r, le, &d)
+		res.rdev, res.nlink = d.Device, d.LinkCount
+
+	case squashfsBasicFifo, squashfsBasicSocket, squashfsExtFifo, squashfsExtSocket:
+		err = binary.Read(r, le, &res.nlink)
+
+	default:
+		return nil, fmt.Errorf("unknown inode type %d", hdr.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if res.isFile() {
+		blockSize := uint64(s.sb.BlockSize)
+		count := res.size / blockSize
+		if res.fragIndex == squashfsNoFragment && res.size%blockSize != 0 {
+			count++
+		}
+		sizes := make([]uint32, count)
+		err = binary.Read(r, le, sizes)
+		if err != nil {
+			return nil, err
+		}
+		res.blockSizes = sizes
+	}
+
+	return res, nil
+}
+
+// readDir lists the directory. Listings consist of headers, each followed by up to 256 entries
+// whose inodes share the same metadata block.
+func (s *squashfsIndex) readDir(dir *squashfsEntry) ([]Entry, error) {
+	if !dir.Dir() {
+		return nil, syscall.ENOTDIR
+	}
+	// the listing size includes the implicit . and .. entries
+	if dir.size <= 3 {
+		return nil, nil
+	}
+	remaining := int64(dir.size) - 3
+
+	r, err := s.metadataReader(int64(s.sb.DirTableStart)+int64(dir.dirBlock), int(dir.dirOffset))
+	if err != nil {
+		return nil, err
+	}
+	lr := &io.LimitedReader{R: r, N: remaining}
+
+	var res []Entry
+	for lr.N > 0 {
+		var hdr struct {
+			Count       uint32
+			Start       uint32
+			InodeNumber uint32
+		}
+		err = binary.Read(lr, binary.LittleEndian, &hdr)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read directory header: %w", err)
+		}
+		for i := uint32(0); i <= hdr.Count; i++ {
+			var ent struct {
+				Offset      uint16
+				InodeOffset int16
+				Type        uint16
+				NameSize    uint16
+			}
+			err = binary.Read(lr, binary.LittleEndian, &ent)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read directory entry: %w", err)
+			}
+			name := make([]byte, int(ent.NameSize)+1)
+			_, err = io.ReadFull(lr, name)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read directory entry name: %w", err)
+			}
+
+			child, err := s.readInode(string(name), uint64(hdr.Start)<<16|uint64(ent.Offset))
+			if err != nil {
+				return nil, fmt.Errorf("cannot read inode of %s: %w", name, err)
+			}
+			res = append(res, child)
+		}
+	}
+	return res, nil
+}
+
+// readDataBlock reads and decompresses a data or fragment block
+func (s *squashfsIndex) readDataBlock(pos int64, size uint32) ([]byte, error) {
+	if size == 0 {
+		// sparse block
+		return make([]byte, s.sb.BlockSize), nil
+	}
+	blk, err := s.cached(pos, func() (squashfsBlock, error) {
+		n := int64(size &^ squashfsUncompressedBlock)
+		buf := make([]byte, n)
+		rn, err := s.r.ReadAt(buf, pos)
+		if err != nil && !(errors.Is(err, io.EOF) && int64(rn) == n) {
+			return squashfsBlock{}, err
+		}
+
+		res := squashfsBlock{Data: buf, DiskSize: n}
+		if size&squashfsUncompressedBlock != 0 {
+			return res, nil
+		}
+		res.Data, err = s.decompress(buf)
+		return res, err
+	})
+	return blk.Data, err
+}
+
+func (s *squashfsIndex) readFragment(index uint32) ([]byte, error) {
+	if int(index)*16+16 > len(s.fragments) {
+		return nil, fmt.Errorf("fragment %d out of range", index)
+	}
+	entry := s.fragments[int(index)*16:]
+	start := binary.LittleEndian.Uint64(entry)
+	size := binary.LittleEndian.Uint32(entry[8:])
+	return s.readDataBlock(int64(start), size)
+}
+
+var _ SymlinkEntry = (*squashfsEntry)(nil)
+
+type squashfsEntry struct {
+	idx   *squashfsIndex
+	name  string
+	hdr   squashfsInodeHeader
+	size  uint64
+	nlink uint32
+
+	// directories
+	dirBlock  uint32
+	dirOffset uint16
+
+	// regular files
+	blocksStart uint64
+	blockSizes  []uint32
+	fragIndex   uint32
+	fragOffset  uint32
+
+	target string
+	rdev   uint32
+}
+
+func (e *squashfsEntry) isFile() bool {
+	return e.hdr.Type == squashfsBasicFile || e.hdr.Type == squashfsExtFile
+}
+
+// Name implements Entry
+func (e *squashfsEntry) Name() string {
+	return e.name
+}
+
+// Dir implements Entry
+func (e *squashfsEntry) Dir() bool {
+	return e.hdr.Type == squashfsBasicDir || e.hdr.Type == squashfsExtDir
+}
+
+// Getattr implements Entry
+func (e *squashfsEntry) Getattr(out *fuse.Attr) (applyDefaults bool, err error) {
+	out.Ino = uint64(e.hdr.InodeNumber)
+	out.Mode = uint32(e.hdr.Permissions)
+	out.Uid = e.idx.id(e.hdr.UIDIdx)
+	out.Gid = e.idx.id(e.hdr.GIDIdx)
+	out.Mtime, out.Atime, out.Ctime = uint64(e.hdr.Mtime), uint64(e.hdr.Mtime), uint64(e.hdr.Mtime)
+	out.Nlink = e.nlink
+	out.Rdev = e.rdev
+	if !e.Dir() {
+		out.Size = e.size
+	}
+	return false, nil
+}
+
+// StableMode implements Entry
+func (e *squashfsEntry) StableMode() uint32 {
+	switch e.hdr.Type {
+	case squashfsBasicDir, squashfsExtDir:
+		return syscall.S_IFDIR
+	case squashfsBasicSymlink, squashfsExtSymlink:
+		return syscall.S_IFLNK
+	case squashfsBasicBlockDev, squashfsExtBlockDev:
+		return syscall.S_IFBLK
+	case squashfsBasicCharDev, squashfsExtCharDev:
+		return syscall.S_IFCHR
+	case squashfsBasicFifo, squashfsExtFifo:
+		return syscall.S_IFIFO
+	case squashfsBasicSocket, squashfsExtSocket:
+		return syscall.S_IFSOCK
+	default:
+		return syscall.S_IFREG
+	}
+}
+
+// Read implements Entry
+func (e *squashfsEntry) Read(dst []byte, offset int64) (n int, err error) {
+	if !e.isFile() {
+		return 0, syscall.EINVAL
+	}
+
+	blockSize := int64(e.idx.sb.BlockSize)
+	for n < len(dst) && offset+int64(n) < int64(e.size) {
+		pos := offset + int64(n)
+		blk := pos / blockSize
+
+		var data []byte
+		if blk < int64(len(e.blockSizes)) {
+			start := int64(e.blocksStart)
+			for _, s := range e.blockSizes[:blk] {
+				start += int64(s &^ squashfsUncompressedBlock)
+			}
+			data, err = e.idx.readDataBlock(start, e.blockSizes[blk])
+		} else {
+			// the tail end of the file lives in a fragment
+			var frag []byte
+			frag, err = e.idx.readFragment(e.fragIndex)
+			if err == nil {
+				tail := int64(e.size) % blockSize
+				if int64(e.fragOffset)+tail > int64(len(frag)) {
+					err = fmt.Errorf("fragment %d is too short", e.fragIndex)
+				} else {
+					data = frag[e.fragOffset : int64(e.fragOffset)+tail]
+				}
+			}
+		}
+		if err != nil {
+			return n, err
+		}
+
+		inBlock := pos - blk*blockSize
+		if inBlock >= int64(len(data)) {
+			return n, fmt.Errorf("block %d is too short", blk)
+		}
+		n += copy(dst[n:], data[inBlock:])
+	}
+	if n < len(dst) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Readlink implements SymlinkEntry
+func (e *squashfsEntry) Readlink() (string, error) {
+	if e.StableMode() != syscall.S_IFLNK {
+		return "", syscall.EINVAL
+	}
+	return e.target, nil
+}
@@ -0,0 +1,138 @@
+package idx_test
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/google/go-cmp/cmp"
+)
+
+// buildSquashfs produces a tiny SquashFS image:
+//
+//	/hello.txt      one zlib compressed block, tail in fragment 0
+//	/dir/link ->    ../hello.txt
+//	/dir/small      entirely in fragment 0
+func buildSquashfs(t *testing.T, hello, small string) []byte {
+	const blockSize = 4096
+	le := binary.LittleEndian
+	put := func(b *bytes.Buffer, vals ...interface{}) {
+		for _, v := range vals {
+			err := binary.Write(b, le, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte(hello[:blockSize]))
+	zw.Close()
+	fragment := hello[blockSize:] + small
+
+	img := bytes.NewBuffer(make([]byte, 96))
+	dataStart := img.Len()
+	img.Write(compressed.Bytes())
+	fragmentStart := img.Len()
+	img.WriteString(fragment)
+
+	inodeHeader := func(b *bytes.Buffer, typ uint16, perm uint16, ino uint32) {
+		put(b, typ, perm, uint16(0), uint16(1), uint32(1234567890), ino)
+	}
+
+	// inodes, offsets within the single uncompressed inode metadata block
+	var inodes bytes.Buffer
+	helloRef := inodes.Len()
+	inodeHeader(&inodes, 2, 0644, 1)
+	binary.Write(&inodes, le, []uint32{uint32(dataStart), 0, 0, uint32(len(hello)), uint32(compressed.Len())})
+	smallRef := inodes.Len()
+	inodeHeader(&inodes, 2, 0600, 2)
+	binary.Write(&inodes, le, []uint32{0, 0, uint32(len(hello) - blockSize), uint32(len(small))})
+	linkRef := inodes.Len()
+	inodeHeader(&inodes, 3, 0777, 3)
+	binary.Write(&inodes, le, []uint32{1, uint32(len("../hello.txt"))})
+	inodes.WriteString("../hello.txt")
+
+	type dirent struct {
+		Name string
+		Ref  int
+		Type uint16
+		Ino  uint32
+	}
+	var dirs bytes.Buffer
+	listing := func(entries ...dirent) (offset, size int) {
+		offset = dirs.Len()
+		binary.Write(&dirs, le, []uint32{uint32(len(entries) - 1), 0, 1})
+		for _, e := range entries {
+			put(&dirs, uint16(e.Ref), int16(e.Ino-1), e.Type, uint16(len(e.Name)-1))
+			dirs.WriteString(e.Name)
+		}
+		return offset, dirs.Len() - offset
+	}
+	subOffset, subSize := listing(dirent{"link", linkRef, 3, 3}, dirent{"small", smallRef, 2, 2})
+	dirRef := inodes.Len()
+	inodeHeader(&inodes, 1, 0755, 4)
+	put(&inodes, uint32(0), uint32(2), uint16(subSize+3), uint16(subOffset), uint32(5))
+	rootOffset, rootSize := listing(dirent{"dir", dirRef, 1, 4}, dirent{"hello.txt", helloRef, 2, 1})
+	rootRef := inodes.Len()
+	inodeHeader(&inodes, 1, 0755, 5)
+	put(&inodes, uint32(0), uint32(3), uint16(rootSize+3), uint16(rootOffset), uint32(6))
+
+	metadata := func(content []byte) {
+		binary.Write(img, le, uint16(len(content))|0x8000)
+		img.Write(content)
+	}
+	inodeTable := img.Len()
+	metadata(inodes.Bytes())
+	dirTable := img.Len()
+	metadata(dirs.Bytes())
+
+	fragBlock := img.Len()
+	var frags bytes.Buffer
+	put(&frags, uint64(fragmentStart), uint32(len(fragment))|1<<24, uint32(0))
+	metadata(frags.Bytes())
+	fragTable := img.Len()
+	binary.Write(img, le, uint64(fragBlock))
+
+	idBlock := img.Len()
+	var ids bytes.Buffer
+	binary.Write(&ids, le, []uint32{0, 33333})
+	metadata(ids.Bytes())
+	idTable := img.Len()
+	binary.Write(img, le, uint64(idBlock))
+
+	res := img.Bytes()
+	var sb bytes.Buffer
+	put(&sb,
+		uint32(0x73717368), uint32(5), uint32(1234567890), uint32(blockSize), uint32(1),
+		uint16(1), uint16(12), uint16(0), uint16(2), uint16(4), uint16(0),
+		uint64(rootRef), uint64(len(res)), uint64(idTable), ^uint64(0),
+		uint64(inodeTable), uint64(dirTable), uint64(fragTable), ^uint64(0),
+	)
+	copy(res, sb.Bytes())
+	return res
+}
+
+func TestSquashfsIndex(t *testing.T) {
+	hello := strings.Repeat("hello squashfs ", 300)
+	img := buildSquashfs(t, hello, "tiny")
+
+	index, err := idx.NewSquashfsIndex(bytes.NewReader(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectation := []string{
+		"dir/",
+		"dir/link->../hello.txt",
+		"dir/small:tiny",
+		"hello.txt:" + hello,
+	}
+	if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+		t.Errorf("NewSquashfsIndex() mismatch (-want +got):\n%s", diff)
+	}
+}
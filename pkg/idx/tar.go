@@ -2,13 +2,18 @@ package idx
 
 import (
 	"archive/tar"
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -21,12 +26,166 @@ import (
 	"github.com/snabb/httpreaderat"
 )
 
+func init() {
+	RegisterBackend(Backend{
+		Name: "tar",
+		Detect: func(src *url.URL, header []byte) bool {
+			switch {
+			case len(header) >= 262 && string(header[257:262]) == "ustar":
+				return true
+			case bytes.HasPrefix(header, []byte(cpioMagicNewc)), bytes.HasPrefix(header, []byte(cpioMagicCRC)):
+				return true
+			case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+				return true
+			}
+			return false
+		},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			index := opts.Index
+			if index == "" {
+				r, size, err := openLocation(sourceLocation(src))
+				if err != nil {
+					return nil, err
+				}
+				embedded, err := findEmbeddedIndex(r, size)
+				if err != nil {
+					closeReader(r)
+					return nil, err
+				}
+				if embedded != nil {
+					return openEmbeddedIndex(r, embedded)
+				}
+				closeReader(r)
+
+				idxURL := *src
+				idxURL.Path, idxURL.RawPath = defaultIndexPath(src.Path), ""
+				index = sourceLocation(&idxURL)
+			}
+			return openIndexedArchive(ctx, index, sourceLocation(src))
+		},
+	})
+}
+
+// defaultIndexPath derives the location of the index from the location of the archive, e.g. foo.index for foo.tar.gz
+func defaultIndexPath(archive string) string {
+	for _, ext := range []string{".tar.gz", ".tgz", ".cpio.gz", ".tar", ".cpio", ".gz"} {
+		if strings.HasSuffix(archive, ext) {
+			return strings.TrimSuffix(archive, ext) + ".index"
+		}
+	}
+	return archive + ".index"
+}
+
+// OpenRemoteTarIndex opens baseURL.tar, using the index embedded in the archive if there is one
+// and baseURL.index otherwise.
 func OpenRemoteTarIndex(ctx context.Context, baseURL string) (Index, error) {
-	tmpdir, err := os.MkdirTemp("", "wsfs-index-*")
+	r, size, err := openLocation(baseURL + ".tar")
+	if err != nil {
+		return nil, err
+	}
+	embedded, err := findEmbeddedIndex(r, size)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	if embedded != nil {
+		return openEmbeddedIndex(r, embedded)
+	}
+	closeReader(r)
+	return openIndexedArchive(ctx, baseURL+".index", baseURL+".tar")
+}
+
+// openIndexedArchive opens an archive using a compact, paged or badger index. Locally a badger index is
+// a directory, remotely it is a gzip compressed tar file of that directory.
+func openIndexedArchive(ctx context.Context, index, archive string) (Index, error) {
+	if !isURL(index) {
+		return OpenFileBackedTarIndex(index, archive)
+	}
+
+	if DefaultIndexCache != nil && DefaultIndexCache.has(index) {
+		// we've downloaded this index archive before, which saves detecting the format, unless the
+		// cache finds it's been replaced by a compact or paged index
+		res, err := openRemoteIndexedArchive(ctx, index, archive)
+		if !errors.Is(err, errNotIndexArchive) {
+			return res, err
+		}
+	}
+
+	r, size, err := openLocation(index)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(compactMagic))
+	_, err = r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		closeReader(r)
+		return nil, fmt.Errorf("cannot read index: %w", err)
+	}
+	if !IsCompactIndex(header) && !IsPagedIndex(header) {
+		closeReader(r)
+		return openRemoteIndexedArchive(ctx, index, archive)
+	}
+	tarfile, _, err := openLocation(archive)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	var res Index
+	if IsPagedIndex(header) {
+		res, err = OpenPagedIndex(r, size, tarfile)
+	} else {
+		res, err = OpenCompactIndex(r, size, tarfile)
+	}
 	if err != nil {
+		closeReader(r)
+		closeReader(tarfile)
 		return nil, err
 	}
+	return res, nil
+}
 
+// isIndexArchiveFile returns true if the file is gzip compressed, i.e. an index archive rather
+// than a compact or paged index
+func isIndexArchiveFile(fn string) bool {
+	f, err := os.Open(fn)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	_, err = io.ReadFull(f, magic)
+	return err == nil && magic[0] == 0x1f && magic[1] == 0x8b
+}
+
+// openLocalIndexArchive extracts an index archive to a temporary directory, like we do with remote
+// ones, and opens the archive using it
+func openLocalIndexArchive(index, archive string) (Index, error) {
+	f, err := os.Open(index)
+	if err != nil {
+		return nil, err
+	}
+	db, tmpdir, err := loadIndexArchive(f)
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot load index archive: %w", err)
+	}
+	tarfile, _, err := openLocation(archive)
+	if err != nil {
+		firstError(db.Close(), removeTmpdir(tmpdir))
+		return nil, err
+	}
+	res, err := openTarIndex(db, tarfile)
+	if err != nil {
+		firstError(db.Close(), closeReader(tarfile), removeTmpdir(tmpdir))
+		return nil, err
+	}
+	res.Tmpdir = tmpdir
+	return res, nil
+}
+
+// openRemoteIndexedArchive downloads the index, a gzip compressed tar file of the index database,
+// unless DefaultIndexCache holds an up-to-date copy, and reads the archive using range requests.
+func openRemoteIndexedArchive(ctx context.Context, indexURL, archiveURL string) (Index, error) {
 	// download the index
 	idxDlStart := time.Now()
 	var timeout time.Duration
@@ -36,40 +195,118 @@ func OpenRemoteTarIndex(ctx context.Context, baseURL string) (Index, error) {
 	client := &http.Client{
 		Timeout: timeout,
 	}
-	res, err := client.Get(baseURL + ".index")
+	var (
+		idx    *badger.DB
+		cached *CachedIndex
+		tmpdir string
+		err    error
+	)
+	if DefaultIndexCache != nil {
+		cached, err = DefaultIndexCache.Open(ctx, client, indexURL)
+		if err == nil {
+			idx = cached.DB
+		}
+	} else {
+		var res *http.Response
+		res, err = client.Get(indexURL)
+		if err != nil {
+			return nil, fmt.Errorf("cannot download index: %v", err)
+		}
+		defer res.Body.Close()
+		idx, tmpdir, err = loadIndexArchive(res.Body)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot download index: %v", err)
+		return nil, err
 	}
-	defer res.Body.Close()
+	log.WithField("duration", time.Since(idxDlStart)).Debug("downloaded index")
 
-	gzipR, err := gzip.NewReader(res.Body)
+	req, _ := http.NewRequest("GET", archiveURL, nil)
+	store := httpreaderat.NewDefaultStore()
+	htrdr, err := httpreaderat.New(nil, req, store)
 	if err != nil {
+		store.Close()
+		firstError(idx.Close(), removeTmpdir(tmpdir), releaseCachedIndex(cached))
 		return nil, err
 	}
-	defer gzipR.Close()
-	tarR := tar.NewReader(gzipR)
 
-	err = extractTarTo(tmpdir, tarR)
+	res, err := openTarIndex(idx, &storedHTTPReaderAt{HTTPReaderAt: htrdr, Store: store})
 	if err != nil {
+		store.Close()
+		firstError(idx.Close(), removeTmpdir(tmpdir), releaseCachedIndex(cached))
 		return nil, err
 	}
-	log.WithField("tmpdir", tmpdir).WithField("duration", time.Since(idxDlStart)).Debug("downloaded index")
+	res.Tmpdir = tmpdir
+	res.Cached = cached
+	return res, nil
+}
+
+// storedHTTPReaderAt releases the store of an HTTPReaderAt when closed
+type storedHTTPReaderAt struct {
+	*httpreaderat.HTTPReaderAt
+	Store httpreaderat.Store
+}
 
-	idx, err := badger.Open(badger.DefaultOptions(tmpdir))
+// Close implements io.Closer
+func (r *storedHTTPReaderAt) Close() error {
+	return r.Store.Close()
+}
+
+// loadIndexArchive extracts a gzip compressed tar file of an index database to a temporary
+// directory and opens it. The caller is responsible for removing tmpdir once it closed the database.
+func loadIndexArchive(in io.Reader) (db *badger.DB, tmpdir string, err error) {
+	tmpdir, err = os.MkdirTemp("", "wsfs-index-*")
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	err = extractIndexArchive(in, tmpdir)
+	if err != nil {
+		os.RemoveAll(tmpdir)
+		return nil, "", err
 	}
+	log.WithField("tmpdir", tmpdir).Debug("extracted index")
 
-	req, _ := http.NewRequest("GET", baseURL+".tar", nil)
-	htrdr, err := httpreaderat.New(nil, req, httpreaderat.NewDefaultStore())
+	db, err = badger.Open(badger.DefaultOptions(tmpdir))
 	if err != nil {
-		return nil, err
+		os.RemoveAll(tmpdir)
+		return nil, "", err
 	}
+	return db, tmpdir, nil
+}
 
-	return &fileBackedIndex{
-		TarFile: htrdr,
-		Index:   idx,
-	}, nil
+// removeTmpdir removes a temporary directory, if there is one
+func removeTmpdir(tmpdir string) error {
+	if tmpdir == "" {
+		return nil
+	}
+	return os.RemoveAll(tmpdir)
+}
+
+// releaseCachedIndex releases an index opened from the cache, if there is one
+func releaseCachedIndex(ci *CachedIndex) error {
+	if ci == nil {
+		return nil
+	}
+	return ci.Release()
+}
+
+// extractIndexArchive extracts a gzip compressed tar file of an index database to dst
+func extractIndexArchive(in io.Reader, dst string) error {
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+
+	gzipR, err := gzip.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer gzipR.Close()
+
+	err = extractTarTo(dst, tar.NewReader(gzipR))
+	if err != nil {
+		return err
+	}
+	return loadIndexArchiveRecords(dst)
 }
 
 func extractTarTo(dst string, tr *tar.Reader) error {
@@ -128,20 +365,62 @@ func extractTarTo(dst string, tr *tar.Reader) error {
 	}
 }
 
+// OpenFileBackedTarIndex opens a tar file using a local badger index directory, compact or paged
+// index file, or index archive
 func OpenFileBackedTarIndex(index, tarfile string) (Index, error) {
-	idx, err := badger.Open(badger.DefaultOptions(index))
+	stat, err := os.Stat(index)
 	if err != nil {
 		return nil, err
 	}
-	tarf, err := os.Open(tarfile)
+	if !stat.IsDir() {
+		if isIndexArchiveFile(index) {
+			return openLocalIndexArchive(index, tarfile)
+		}
+		return OpenCompactIndexFile(index, tarfile)
+	}
+
+	// read-only, so that a new version can be opened while the previous one is still mounted
+	db, err := badger.Open(badger.DefaultOptions(index).WithReadOnly(true))
 	if err != nil {
 		return nil, err
 	}
-
-	return OpenTarIndex(idx, tarf)
+	tarf, _, err := openLocation(tarfile)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return OpenTarIndex(db, tarf)
 }
 
+// OpenTarIndex serves a tar file using a badger index. Once opened, the index owns the database
+// and the tar file, i.e. closing the index closes both of them.
 func OpenTarIndex(index *badger.DB, tarfile io.ReaderAt) (Index, error) {
+	return openTarIndex(index, tarfile)
+}
+
+func openTarIndex(index *badger.DB, tarfile io.ReaderAt) (*fileBackedIndex, error) {
+	// archives which were gzip compressed when indexed need decompressing on read
+	var gz *gzipMeta
+	err := index.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(metaKeyGzip))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			gz = &gzipMeta{}
+			return json.Unmarshal(val, gz)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if gz != nil {
+		tarfile = NewGzipReaderAt(tarfile, gz.Size, gz.Checkpoints)
+	}
+
 	return &fileBackedIndex{
 		TarFile: tarfile,
 		Index:   index,
@@ -153,6 +432,21 @@ var _ Index = ((*fileBackedIndex)(nil))
 type fileBackedIndex struct {
 	TarFile io.ReaderAt
 	Index   *badger.DB
+
+	// Tmpdir holds the extracted index and is removed on Close
+	Tmpdir string
+	// Cached is the cache entry the index was opened from, which is released on Close
+	Cached *CachedIndex
+}
+
+// Close implements Index
+func (fs *fileBackedIndex) Close() error {
+	return firstError(
+		fs.Index.Close(),
+		closeReader(fs.TarFile),
+		removeTmpdir(fs.Tmpdir),
+		releaseCachedIndex(fs.Cached),
+	)
 }
 
 func (fs *fileBackedIndex) scan(ctx context.Context, include func(path []byte) bool) ([]Entry, error) {
@@ -168,7 +462,7 @@ func (fs *fileBackedIndex) scan(ctx context.Context, include func(path []byte) b
 			item := it.Item()
 			k := item.Key()
 
-			if !include(k) {
+			if bytes.HasPrefix(k, []byte(metaKeyPrefix)) || !include(k) {
 				continue
 			}
 
@@ -202,8 +496,7 @@ func (fs *fileBackedIndex) Children(ctx context.Context, of Entry) ([]Entry, err
 
 	depth := strings.Count(ofPath, "/") + 1
 	return fs.scan(ctx, func(path []byte) bool {
-		return bytes.HasPrefix(path, []byte(ofPath)) &&
-			string(path) != ofPath &&
+		return bytes.HasPrefix(path, []byte(ofPath+"/")) &&
 			depth == strings.Count(string(path), "/")
 	})
 }
@@ -226,6 +519,16 @@ func (e *fileBackedIndexEntry) Dir() bool {
 	return e.Entry.TarHeader.Typeflag == tar.TypeDir
 }
 
+// Digest implements DigestEntry
+func (e *fileBackedIndexEntry) Digest() string {
+	return e.Entry.Digest
+}
+
+// Aggregate implements AggregateEntry
+func (e *fileBackedIndexEntry) Aggregate() (*DirAggregate, error) {
+	return e.Entry.Aggregate, nil
+}
+
 // Read implements File
 func (e *fileBackedIndexEntry) Read(dst []byte, offset int64) (n int, err error) {
 	return e.TarFile.ReadAt(dst, e.Entry.Offset+offset)
@@ -241,6 +544,7 @@ func (e *fileBackedIndexEntry) Getattr(out *fuse.Attr) (applyDefaults bool, err
 	out.Mtime = uint64(hdr.ModTime.Unix())
 	out.Size = uint64(hdr.Size)
 	out.Uid = uint32(hdr.Uid)
+	out.Rdev = mkdev(hdr.Devmajor, hdr.Devminor)
 
 	return false, nil
 }
@@ -278,45 +582,332 @@ func (e *fileBackedIndexEntry) Path() string {
 	return e.Entry.TarHeader.Name
 }
 
-var _ Entry = (*fileBackedIndexEntry)(nil)
+// Readlink implements SymlinkEntry
+func (e *fileBackedIndexEntry) Readlink() (string, error) {
+	return e.Entry.TarHeader.Linkname, nil
+}
+
+var _ SymlinkEntry = (*fileBackedIndexEntry)(nil)
+var _ DigestEntry = (*fileBackedIndexEntry)(nil)
+var _ AggregateEntry = (*fileBackedIndexEntry)(nil)
+
+// mkdev encodes a device number the way Linux expects it in stat
+func mkdev(major, minor int64) uint32 {
+	return uint32((minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12))
+}
+
+// metaKeyPrefix marks keys which describe the index itself rather than an entry.
+// Paths never start with a NUL byte, hence there's no risk of collision.
+const metaKeyPrefix = "\x00wsfs/"
+
+// metaKeyGzip holds the gzipMeta of archives that were indexed in their compressed form
+const metaKeyGzip = metaKeyPrefix + "gzip"
+
+// metaKeyEnd holds the offset at which the end-of-archive marker of an uncompressed tar archive starts
+const metaKeyEnd = metaKeyPrefix + "end"
+
+// metaKeyOptions holds the produceMeta of indices which weren't produced using the default options
+const metaKeyOptions = metaKeyPrefix + "options"
+
+// produceMeta records the ProduceOptions an index was produced with, which AppendIndex applies
+// to the appended entries as well
+type produceMeta struct {
+	ContentDigests bool `json:",omitempty"`
+	ContentIndex   bool `json:",omitempty"`
+}
+
+// storeProduceMeta records the options an index was produced with, unless they're the defaults
+func storeProduceMeta(db *badger.DB, meta produceMeta) error {
+	if meta == (produceMeta{}) {
+		return nil
+	}
+	val, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(metaKeyOptions), val)
+	})
+}
+
+// loadProduceMeta returns the options an index was produced with
+func loadProduceMeta(db *badger.DB) (produceMeta, error) {
+	var res produceMeta
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(metaKeyOptions))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &res)
+		})
+	})
+	return res, err
+}
+
+type gzipMeta struct {
+	Size        int64
+	Checkpoints []GzipCheckpoint
+}
 
 type indexEntry struct {
 	Offset    int64
 	TarHeader *tar.Header
+	// Digest is the SHA-256 of the content of regular files if ProduceOptions.ContentDigests was set
+	Digest string `json:",omitempty"`
+	// Aggregate holds the totals of directories
+	Aggregate *DirAggregate `json:",omitempty"`
+}
+
+// ProduceOptions configures ProduceIndexWithOptions
+type ProduceOptions struct {
+	// ContentDigests records the SHA-256 of the content of each regular file of tar archives,
+	// so that VerifyIndex can check the content
+	ContentDigests bool
+	// ContentIndex collects the trigrams of the content of each regular file of tar archives, if set
+	ContentIndex *ContentIndexBuilder
+	// Progress is updated while the index is produced, if set
+	Progress *Progress
+}
+
+// ProduceIndex indexes a tar or cpio archive, either of which can be gzip compressed.
+// Offsets point into the uncompressed stream. For compressed archives the beginning of each gzip
+// member is stored in the index, so that reads can start decompressing from the closest member.
+func ProduceIndex(db *badger.DB, in io.Reader) error {
+	return ProduceIndexWithOptions(db, in, ProduceOptions{})
 }
 
+// ProduceIndexWithOptions indexes a tar or cpio archive like ProduceIndex does
+func ProduceIndexWithOptions(db *badger.DB, in io.Reader, opts ProduceOptions) error {
+	br := bufio.NewReaderSize(in, streamBufferSize)
+	magic, err := br.Peek(2)
+	if err != nil {
+		return fmt.Errorf("cannot detect archive type: %w", err)
+	}
+
+	var (
+		r  io.Reader = br
+		zr *GzipMemberReader
+	)
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		zr, err = NewGzipMemberReader(br)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+
+	ar := bufio.NewReaderSize(r, streamBufferSize)
+	magic, _ = ar.Peek(len(cpioMagicNewc))
+	if string(magic) == cpioMagicNewc || string(magic) == cpioMagicCRC {
+		if opts.ContentDigests {
+			return fmt.Errorf("content digests are only supported for tar archives")
+		}
+		if opts.ContentIndex != nil {
+			return fmt.Errorf("content indices are only supported for tar archives")
+		}
+		err = produceCpioIndex(db, ar, opts.Progress)
+	} else {
+		err = produceTarIndex(db, ar, 0, opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	if zr == nil {
+		return nil
+	}
+	meta, err := json.Marshal(gzipMeta{
+		Size:        zr.CompressedSize(),
+		Checkpoints: zr.Checkpoints,
+	})
+	if err != nil {
+		return err
+	}
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(metaKeyGzip), meta)
+	})
+}
+
+// ProduceIndexFromTarFile indexes an uncompressed tar archive
 func ProduceIndexFromTarFile(db *badger.DB, in io.Reader) error {
+	return produceTarIndex(db, in, 0, ProduceOptions{})
+}
+
+// produceTarIndex indexes a tar archive which starts at offset base, and records where its
+// end-of-archive marker starts, so that entries appended later can be indexed from there
+func produceTarIndex(db *badger.DB, in io.Reader, base int64, opts ProduceOptions) error {
 	indexingR := &indexingReader{
 		Reader: in,
+		Offset: base,
 	}
+	w := newIndexWriter(db, opts.Progress)
+	defer w.Cancel()
 
-	tarf := tar.NewReader(indexingR)
-	for hdr, err := tarf.Next(); err == nil; hdr, err = tarf.Next() {
-		hdr.Name = strings.TrimPrefix(hdr.Name, "./")
-		hdr.Name = strings.TrimSuffix(hdr.Name, "/")
+	end := base
 
-		hdrJson, err := json.Marshal(indexEntry{
+	tarf := tar.NewReader(indexingR)
+	for {
+		hdr, err := tarf.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read tar header at offset %d: %w", indexingR.Offset, err)
+		}
+		entry := indexEntry{
 			Offset:    indexingR.Offset,
 			TarHeader: hdr,
-		})
+		}
+		var sparse bool
+		end, sparse, err = tarEntryEnd(tarf, hdr, indexingR)
 		if err != nil {
 			return err
 		}
 
-		db.Update(func(txn *badger.Txn) error {
-			err := txn.Set([]byte(hdr.Name), hdrJson)
+		hdr.Name = strings.TrimPrefix(hdr.Name, "./")
+		hdr.Name = strings.TrimSuffix(hdr.Name, "/")
+		if hdr.Name == "" || hdr.Name == "." {
+			// the root directory itself
+			continue
+		}
+		if hdr.Name == embeddedIndexName || hdr.Name == embeddedFooterName {
+			// an index embedded in the archive is not part of its content
+			continue
+		}
+
+		if (opts.ContentDigests || opts.ContentIndex != nil) && hdr.Typeflag == tar.TypeReg && !sparse {
+			var (
+				h           = sha256.New()
+				r io.Reader = tarf
+			)
+			if opts.ContentDigests {
+				r = io.TeeReader(r, h)
+			}
+			if opts.ContentIndex != nil {
+				err = opts.ContentIndex.Add(hdr.Name, r)
+			} else {
+				_, err = io.Copy(io.Discard, r)
+			}
 			if err != nil {
-				return err
+				return fmt.Errorf("cannot read %s: %w", hdr.Name, err)
 			}
-			return txn.Commit()
-		})
-		log.WithField("name", hdr.Name).WithField("offset", indexingR.Offset).Debug("added file to index")
+			if opts.ContentDigests {
+				entry.Digest = "sha256:" + hex.EncodeToString(h.Sum(nil))
+			}
+		}
+
+		err = w.Put(entry)
+		if err != nil {
+			return err
+		}
+	}
+	w.SetBytes(indexingR.Offset)
+	err := w.Flush()
+	if err != nil {
+		return err
+	}
+	endJSON, err := json.Marshal(end)
+	if err != nil {
+		return err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(metaKeyEnd), endJSON)
+	})
+	if err != nil {
+		return err
+	}
+	err = storeProduceMeta(db, produceMeta{
+		ContentDigests: opts.ContentDigests,
+		ContentIndex:   opts.ContentIndex != nil,
+	})
+	if err != nil {
+		return err
 	}
 	_ = db.Flatten(5)
 
 	return nil
 }
 
+// tarEntryEnd returns the offset at which the entry tarf is positioned at ends, including its
+// padding, and whether the entry is a sparse file
+func tarEntryEnd(tarf *tar.Reader, hdr *tar.Header, r *indexingReader) (end int64, sparse bool, err error) {
+	sparse = hdr.Typeflag == tar.TypeGNUSparse
+	for k := range hdr.PAXRecords {
+		sparse = sparse || strings.HasPrefix(k, "GNU.sparse.")
+	}
+	if !sparse {
+		return r.Offset + tarBlockPadded(hdr.Size), false, nil
+	}
+
+	// sparse files take up less space in the archive than their size suggests
+	_, err = io.Copy(io.Discard, tarf)
+	if err != nil {
+		return 0, true, fmt.Errorf("cannot read %s: %w", hdr.Name, err)
+	}
+	return tarBlockPadded(r.Offset), true, nil
+}
+
+// tarBlockPadded rounds n up to the tar block size
+func tarBlockPadded(n int64) int64 {
+	return (n + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+}
+
+// ArchiveEnd returns the offset at which the end-of-archive marker of the uncompressed tar
+// archive an index was produced from starts. That's where entries are appended to the archive.
+func ArchiveEnd(db *badger.DB) (int64, error) {
+	var end int64
+	err := db.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(metaKeyGzip)); err == nil {
+			return fmt.Errorf("cannot append to compressed archives")
+		}
+		item, err := txn.Get([]byte(metaKeyEnd))
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("index does not record the end of its archive - please regenerate it")
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &end)
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return end, nil
+}
+
+// AppendIndex indexes the entries which were appended to an uncompressed tar archive since it was
+// indexed, e.g. using "tar --append". Like extracting the archive, appended entries replace entries
+// of the same name.
+//
+// Appended entries get content digests if the index has them. If the index was produced along
+// with a content index, opts.ContentIndex has to hold that content index, see AddContentIndex,
+// so that it can be updated with the appended files.
+func AppendIndex(db *badger.DB, archive io.ReaderAt, size int64, opts ProduceOptions) error {
+	end, err := ArchiveEnd(db)
+	if err != nil {
+		return err
+	}
+	produced, err := loadProduceMeta(db)
+	if err != nil {
+		return fmt.Errorf("cannot read index options: %w", err)
+	}
+	if produced.ContentIndex && opts.ContentIndex == nil {
+		return fmt.Errorf("index was produced along with a content index, which has to be updated as well")
+	}
+	opts.ContentDigests = produced.ContentDigests
+	if size < end {
+		return fmt.Errorf("archive is smaller (%d bytes) than when it was indexed (%d bytes)", size, end)
+	}
+	in := &readAheadReader{r: io.NewSectionReader(archive, end, size-end), size: size - end}
+	return produceTarIndex(db, in, end, opts)
+}
+
 type indexingReader struct {
 	io.Reader
 
@@ -329,6 +920,121 @@ func (r *indexingReader) Read(p []byte) (int, error) {
 	return n, err
 }
 
+// Seek implements io.Seeker if the underlying reader does. This lets tar.Reader skip over
+// file content rather than reading it.
+func (r *indexingReader) Seek(offset int64, whence int) (int64, error) {
+	s, ok := r.Reader.(io.Seeker)
+	if !ok {
+		return -1, fmt.Errorf("reader does not support seeking")
+	}
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1, err
+	}
+	pos, err := s.Seek(offset, whence)
+	if err != nil {
+		return -1, err
+	}
+	r.Offset += pos - cur
+	return pos, nil
+}
+
+// ProduceIndexFromRemoteTarFile indexes an uncompressed tar file at a local path or HTTP(S) URL.
+// Only the headers are read. File content is skipped, so that remote files are indexed using a
+// few range requests rather than downloading the entire archive. Unless it's nil, progress is
+// updated while the index is produced.
+func ProduceIndexFromRemoteTarFile(db *badger.DB, location string, progress *Progress) error {
+	r, size, err := openLocation(location)
+	if err != nil {
+		return err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	magic := make([]byte, 2)
+	_, err = r.ReadAt(magic, 0)
+	if err != nil {
+		return fmt.Errorf("cannot detect archive type: %w", err)
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return fmt.Errorf("cannot skip content of compressed archives - download the archive and index it locally")
+	}
+
+	in := &readAheadReader{r: r, size: size}
+	err = produceTarIndex(db, in, 0, ProduceOptions{Progress: progress})
+	if err != nil {
+		return err
+	}
+	log.WithField("fetched", in.Fetched).WithField("size", size).Info("indexed tar file")
+	return nil
+}
+
+// tarReadAhead is the number of bytes readAheadReader fetches at once. It's large enough to
+// contain the headers of many small files which follow one another.
+const tarReadAhead = 64 << 10
+
+// readAheadReader turns an io.ReaderAt into an io.ReadSeeker. Reads are served from a buffer
+// which is filled tarReadAhead bytes at a time. Seeking is free.
+type readAheadReader struct {
+	r    io.ReaderAt
+	size int64
+	pos  int64
+
+	buf      []byte
+	bufStart int64
+
+	// Fetched counts the bytes read from r
+	Fetched int64
+}
+
+// Read implements io.Reader
+func (r *readAheadReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	if r.pos < r.bufStart || r.pos >= r.bufStart+int64(len(r.buf)) {
+		n := r.size - r.pos
+		if n > tarReadAhead {
+			n = tarReadAhead
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, tarReadAhead)
+		}
+		buf := r.buf[:n]
+		rn, err := r.r.ReadAt(buf, r.pos)
+		r.Fetched += int64(rn)
+		if err != nil && !(errors.Is(err, io.EOF) && int64(rn) == n) {
+			return 0, err
+		}
+		r.buf, r.bufStart = buf[:rn], r.pos
+	}
+
+	n := copy(p, r.buf[r.pos-r.bufStart:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+// Seek implements io.Seeker
+func (r *readAheadReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
+
 type IndexEntry struct {
 	Offset int
 	Size   int
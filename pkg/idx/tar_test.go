@@ -5,8 +5,13 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/csweichel/wsfs/pkg/idx"
 	badger "github.com/dgraph-io/badger/v3"
@@ -169,3 +174,325 @@ func prepareTestIndex(t *testing.T) idx.Index {
 	}
 	return res
 }
+
+func TestProduceIndexFromRemoteTarFile(t *testing.T) {
+	longName := strings.Repeat("very-long-file-name-", 6) + ".txt"
+	large := strings.Repeat("x", 4<<20)
+
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	add := func(hdr *tar.Header, content string) {
+		hdr.Size = int64(len(content))
+		if hdr.Typeflag == tar.TypeDir {
+			hdr.Size = 0
+		}
+		err := tarw.WriteHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = tarw.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "large.bin", Mode: 0644}, large)
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: longName, Mode: 0644, Format: tar.FormatPAX}, "pax")
+	add(&tar.Header{Typeflag: tar.TypeDir, Name: "gnu/", Mode: 0755}, "")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "gnu/" + longName, Mode: 0644, Format: tar.FormatGNU}, "gnu")
+	add(&tar.Header{Typeflag: tar.TypeReg, Name: "small.txt", Mode: 0644}, fileHelloTXT)
+	err := tarw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := buf.Bytes()
+
+	var served int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(&countingResponseWriter{ResponseWriter: w, N: &served}, r, "", time.Time{}, bytes.NewReader(archive))
+	}))
+	defer srv.Close()
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = idx.ProduceIndexFromRemoteTarFile(db, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt64(&served); n > int64(len(archive))/10 {
+		t.Errorf("indexing fetched %d of %d bytes", n, len(archive))
+	}
+
+	index, err := idx.OpenTarIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var act []string
+	for _, e := range dumpIndex(t, index) {
+		act = append(act, e[:minInt(len(e), 200)])
+	}
+	expectation := []string{
+		"gnu/",
+		"gnu/" + longName + ":gnu",
+		"large.bin:" + large[:200-len("large.bin:")],
+		"small.txt:" + fileHelloTXT,
+		longName + ":pax",
+	}
+	if diff := cmp.Diff(expectation, act); diff != "" {
+		t.Errorf("ProduceIndexFromRemoteTarFile() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+	N *int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	atomic.AddInt64(w.N, int64(n))
+	return n, err
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func TestProduceIndexFromTarFileBatches(t *testing.T) {
+	const files = 5000
+
+	buf := bytes.NewBuffer(nil)
+	tarw := tar.NewWriter(buf)
+	add := func(name, content string) {
+		tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: int64(len(content))})
+		tarw.Write([]byte(content))
+	}
+	add("dup.txt", "old")
+	for i := 0; i < files; i++ {
+		add(fmt.Sprintf("f%05d", i), fmt.Sprint(i))
+	}
+	// later entries of the same name replace earlier ones, even if they're in a different batch
+	add("dup.txt", "new")
+	tarw.Close()
+	archive := buf.Bytes()
+
+	progress := &idx.Progress{}
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = idx.ProduceIndexWithOptions(db, bytes.NewReader(archive), idx.ProduceOptions{Progress: progress})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := progress.Entries(); n != files+2 {
+		t.Errorf("progress reports %d entries, expected %d", n, files+2)
+	}
+	if n := progress.Bytes(); n == 0 || n > int64(len(archive)) {
+		t.Errorf("progress reports %d bytes of %d", n, len(archive))
+	}
+
+	index, err := idx.OpenTarIndex(db, bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := dumpIndex(t, index)
+	if len(entries) != files+1 {
+		t.Errorf("index has %d entries, expected %d", len(entries), files+1)
+	}
+	if diff := cmp.Diff([]string{"dup.txt:new", "f00000:0", "f00001:1"}, entries[:3]); diff != "" {
+		t.Errorf("unexpected entries (-want +got):\n%s", diff)
+	}
+
+	// an archive truncated within a header fails rather than ending up as partial index
+	db, err = badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = idx.ProduceIndexFromTarFile(db, io.MultiReader(bytes.NewReader(archive[:len(archive)/2+612])))
+	if err == nil {
+		t.Error("indexing a truncated archive did not fail")
+	}
+}
+
+func TestAppendIndex(t *testing.T) {
+	archive := func(files ...string) []byte {
+		buf := bytes.NewBuffer(nil)
+		tarw := tar.NewWriter(buf)
+		for i := 0; i < len(files); i += 2 {
+			tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: files[i], Mode: 0644, Size: int64(len(files[i+1]))})
+			tarw.Write([]byte(files[i+1]))
+		}
+		tarw.Close()
+		return buf.Bytes()
+	}
+	original := archive("foo.txt", fileFooSlashBarTXT, "hello.txt", "old")
+
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = idx.ProduceIndexFromTarFile(db, bytes.NewReader(original))
+	if err != nil {
+		t.Fatal(err)
+	}
+	end, err := idx.ArchiveEnd(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if end != 4*512 {
+		t.Errorf("archive ends at %d, expected %d", end, 4*512)
+	}
+
+	// appending replaces the end-of-archive marker, like tar --append does
+	appended := append(append([]byte{}, original[:end]...), archive("hello.txt", fileHelloTXT, "new.txt", fileHidden)...)
+	err = idx.AppendIndex(db, bytes.NewReader(appended), int64(len(appended)), idx.ProduceOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := idx.OpenTarIndex(db, bytes.NewReader(appended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectation := []string{
+		"foo.txt:" + fileFooSlashBarTXT,
+		"hello.txt:" + fileHelloTXT,
+		"new.txt:" + fileHidden,
+	}
+	if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+		t.Errorf("unexpected entries (-want +got):\n%s", diff)
+	}
+
+	// the appended index matches one produced from scratch
+	fresh, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	err = idx.ProduceIndexFromTarFile(fresh, bytes.NewReader(appended))
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendedDigest, err := idx.IndexDigest(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	freshDigest, err := idx.IndexDigest(fresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if appendedDigest != freshDigest {
+		t.Errorf("appended index digest %s, expected %s", appendedDigest, freshDigest)
+	}
+
+	err = idx.AppendIndex(db, bytes.NewReader(original[:end]), end-512, idx.ProduceOptions{})
+	if err == nil {
+		t.Error("appending a shrunk archive did not fail")
+	}
+}
+
+func TestAppendIndexOptions(t *testing.T) {
+	archive := func(files ...string) []byte {
+		buf := bytes.NewBuffer(nil)
+		tarw := tar.NewWriter(buf)
+		for i := 0; i < len(files); i += 2 {
+			tarw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: files[i], Mode: 0644, Size: int64(len(files[i+1]))})
+			tarw.Write([]byte(files[i+1]))
+		}
+		tarw.Close()
+		return buf.Bytes()
+	}
+	original := archive("foo.txt", fileFooSlashBarTXT, "hello.txt", "old")
+	end := int64(4 * 512)
+	appended := append(append([]byte{}, original[:end]...), archive("hello.txt", fileHelloTXT, "new.txt", fileHidden)...)
+
+	// produce indexes an archive with content digests and a content index
+	produce := func(archive []byte) (*badger.DB, []byte) {
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := idx.NewContentIndexBuilder()
+		err = idx.ProduceIndexWithOptions(db, bytes.NewReader(archive), idx.ProduceOptions{ContentDigests: true, ContentIndex: content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		err = idx.WriteContentIndex(content, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db, buf.Bytes()
+	}
+	// digests lists the content digests of the files of an index
+	digests := func(db *badger.DB, archive []byte) []string {
+		index, err := idx.OpenTarIndex(db, bytes.NewReader(archive))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res []string
+		err = idx.QueryIndex(context.Background(), index, idx.Query{MaxSize: -1}, func(path string, info *idx.EntryInfo) error {
+			res = append(res, path+":"+info.Digest)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	db, content := produce(original)
+	defer db.Close()
+	err := idx.AppendIndex(db, bytes.NewReader(appended), int64(len(appended)), idx.ProduceOptions{})
+	if err == nil {
+		t.Fatal("appending to an index with a content index did not fail without one")
+	}
+
+	ci, err := idx.OpenContentIndex(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	updated := idx.NewContentIndexBuilder()
+	err = updated.AddContentIndex(ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = idx.AppendIndex(db, bytes.NewReader(appended), int64(len(appended)), idx.ProduceOptions{ContentIndex: updated})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updatedContent := bytes.NewBuffer(nil)
+	err = idx.WriteContentIndex(updated, updatedContent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the appended entries are indexed like they are when producing the index from scratch
+	fresh, freshContent := produce(appended)
+	defer fresh.Close()
+	if diff := cmp.Diff(digests(fresh, appended), digests(db, appended)); diff != "" {
+		t.Errorf("content digests mismatch (-want +got):\n%s", diff)
+	}
+	if !bytes.Equal(freshContent, updatedContent.Bytes()) {
+		t.Errorf("updated content index differs from the one produced from scratch")
+	}
+	ci, err = idx.OpenContentIndex(bytes.NewReader(updatedContent.Bytes()), int64(updatedContent.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	candidates, err := ci.Candidates("starts with")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"new.txt"}, candidates); diff != "" {
+		t.Errorf("Candidates() mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,293 @@
+package idx
+
+import (
+	"fmt"
+	"regexp/syntax"
+	"sort"
+	"unicode"
+	"unicode/utf8"
+)
+
+// trigramQueryOp combines the operands of a trigramQuery
+type trigramQueryOp int
+
+const (
+	// queryAll is passed by all files
+	queryAll trigramQueryOp = iota
+	// queryNone is passed by no file
+	queryNone
+	// queryAnd is passed by files which contain all trigrams and pass all sub queries
+	queryAnd
+	// queryOr is passed by files which contain any of the trigrams or pass any sub query
+	queryOr
+)
+
+// trigramQuery describes the trigrams a file has to contain to possibly match a regular expression
+type trigramQuery struct {
+	Op       trigramQueryOp
+	Trigrams []uint32
+	Sub      []*trigramQuery
+}
+
+var (
+	queryMatchAll  = &trigramQuery{Op: queryAll}
+	queryMatchNone = &trigramQuery{Op: queryNone}
+)
+
+func (q *trigramQuery) String() string {
+	switch q.Op {
+	case queryAll:
+		return "+"
+	case queryNone:
+		return "-"
+	}
+	var (
+		res string
+		sep = " "
+	)
+	if q.Op == queryOr {
+		sep = "|"
+	}
+	for _, t := range q.Trigrams {
+		if res != "" {
+			res += sep
+		}
+		res += fmt.Sprintf("%q", string([]byte{byte(t >> 16), byte(t >> 8), byte(t)}))
+	}
+	for _, sub := range q.Sub {
+		if res != "" {
+			res += sep
+		}
+		res += "(" + sub.String() + ")"
+	}
+	return res
+}
+
+func queryAndOf(a, b *trigramQuery) *trigramQuery {
+	switch {
+	case a.Op == queryAll || b.Op == queryNone:
+		return b
+	case b.Op == queryAll || a.Op == queryNone:
+		return a
+	}
+	res := &trigramQuery{Op: queryAnd}
+	for _, q := range []*trigramQuery{a, b} {
+		if q.Op == queryAnd {
+			res.Trigrams = append(res.Trigrams, q.Trigrams...)
+			res.Sub = append(res.Sub, q.Sub...)
+		} else {
+			res.Sub = append(res.Sub, q)
+		}
+	}
+	return res
+}
+
+func queryOrOf(a, b *trigramQuery) *trigramQuery {
+	switch {
+	case a.Op == queryNone || b.Op == queryAll:
+		return b
+	case b.Op == queryNone || a.Op == queryAll:
+		return a
+	}
+	res := &trigramQuery{Op: queryOr}
+	for _, q := range []*trigramQuery{a, b} {
+		if q.Op == queryOr {
+			res.Trigrams = append(res.Trigrams, q.Trigrams...)
+			res.Sub = append(res.Sub, q.Sub...)
+		} else {
+			res.Sub = append(res.Sub, q)
+		}
+	}
+	return res
+}
+
+// trigramQueryOfStrings is passed by files which contain any of the strings, which are folded like
+// the content index folds content already
+func trigramQueryOfStrings(strs []string) *trigramQuery {
+	res := queryMatchNone
+	for _, s := range strs {
+		if len(s) < 3 {
+			return queryMatchAll
+		}
+		q := &trigramQuery{Op: queryAnd}
+		seen := make(map[uint32]bool)
+		for i := 0; i+3 <= len(s); i++ {
+			t := uint32(s[i])<<16 | uint32(s[i+1])<<8 | uint32(s[i+2])
+			if !seen[t] {
+				seen[t] = true
+				q.Trigrams = append(q.Trigrams, t)
+			}
+		}
+		res = queryOrOf(res, q)
+	}
+	return res
+}
+
+// trigramMaxExact limits the number of strings regexpInfo.Exact holds
+const trigramMaxExact = 16
+
+// trigramMaxClass limits the size of character classes which are turned into strings
+const trigramMaxClass = 32
+
+// regexpInfo describes what a regular expression matches: if Exact is not nil, it matches exactly
+// one of its strings, or if Suffix is set, its matches end with one of them. Files which contain
+// a match pass Match.
+type regexpInfo struct {
+	Exact  []string
+	Suffix bool
+	Match  *trigramQuery
+}
+
+// query returns the trigram query files containing a match pass
+func (info regexpInfo) query() *trigramQuery {
+	if info.Exact == nil {
+		return info.Match
+	}
+	return queryAndOf(info.Match, trigramQueryOfStrings(info.Exact))
+}
+
+var (
+	regexpInfoEmpty   = regexpInfo{Exact: []string{""}, Match: queryMatchAll}
+	regexpInfoAnyText = regexpInfo{Match: queryMatchAll}
+)
+
+// trigramQueryOf computes the trigram query files which contain a match of a regular expression pass
+func trigramQueryOf(pattern string) (*trigramQuery, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	return analyzeRegexp(re.Simplify()).query(), nil
+}
+
+func analyzeRegexp(re *syntax.Regexp) regexpInfo {
+	switch re.Op {
+	case syntax.OpNoMatch:
+		return regexpInfo{Match: queryMatchNone}
+	case syntax.OpEmptyMatch, syntax.OpBeginLine, syntax.OpEndLine, syntax.OpBeginText, syntax.OpEndText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+		return regexpInfoEmpty
+	case syntax.OpLiteral:
+		res := regexpInfoEmpty
+		for _, r := range re.Rune {
+			runes := []rune{r}
+			if re.Flags&syntax.FoldCase != 0 {
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					runes = append(runes, f)
+				}
+			}
+			res = concatRegexpInfo(res, runesRegexpInfo(runes))
+		}
+		return res
+	case syntax.OpCharClass:
+		var runes []rune
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			for r := re.Rune[i]; r <= re.Rune[i+1]; r++ {
+				if len(runes) == trigramMaxClass {
+					return regexpInfoAnyText
+				}
+				runes = append(runes, r)
+			}
+		}
+		if len(runes) == 0 {
+			return regexpInfo{Match: queryMatchNone}
+		}
+		return runesRegexpInfo(runes)
+	case syntax.OpCapture:
+		return analyzeRegexp(re.Sub[0])
+	case syntax.OpQuest:
+		sub := analyzeRegexp(re.Sub[0])
+		if sub.Exact == nil || sub.Suffix {
+			return regexpInfoAnyText
+		}
+		return regexpInfo{Exact: unionStrings(sub.Exact, []string{""}), Match: queryMatchAll}
+	case syntax.OpPlus:
+		// at least one match of sub
+		return regexpInfo{Match: analyzeRegexp(re.Sub[0]).query()}
+	case syntax.OpRepeat:
+		if re.Min == 0 {
+			return regexpInfoAnyText
+		}
+		return regexpInfo{Match: analyzeRegexp(re.Sub[0]).query()}
+	case syntax.OpConcat:
+		res := regexpInfoEmpty
+		for _, sub := range re.Sub {
+			res = concatRegexpInfo(res, analyzeRegexp(sub))
+		}
+		return res
+	case syntax.OpAlternate:
+		res := regexpInfo{Exact: []string{}, Match: queryMatchNone}
+		for _, sub := range re.Sub {
+			res = alternateRegexpInfo(res, analyzeRegexp(sub))
+		}
+		return res
+	}
+	// any character and repetitions of anything can match text we can't tell anything about
+	return regexpInfoAnyText
+}
+
+// runesRegexpInfo describes a regular expression which matches any one of the runes
+func runesRegexpInfo(runes []rune) regexpInfo {
+	var strs []string
+	for _, r := range runes {
+		buf := make([]byte, utf8.UTFMax)
+		n := utf8.EncodeRune(buf, r)
+		for i := range buf[:n] {
+			buf[i] = foldASCII(buf[i])
+		}
+		strs = append(strs, string(buf[:n]))
+	}
+	strs = unionStrings(strs, nil)
+	if len(strs) > trigramMaxExact {
+		return regexpInfoAnyText
+	}
+	return regexpInfo{Exact: strs, Match: queryMatchAll}
+}
+
+func concatRegexpInfo(a, b regexpInfo) regexpInfo {
+	match := queryAndOf(a.Match, b.Match)
+	if a.Exact != nil && b.Exact != nil && !b.Suffix && len(a.Exact)*len(b.Exact) <= trigramMaxExact {
+		var exact []string
+		for _, x := range a.Exact {
+			for _, y := range b.Exact {
+				exact = append(exact, x+y)
+			}
+		}
+		return regexpInfo{Exact: unionStrings(exact, nil), Suffix: a.Suffix, Match: match}
+	}
+	// trigrams which span the boundary are lost, but either side still has to be matched, and the
+	// strings of b can still be extended by whatever follows
+	if a.Exact != nil {
+		match = queryAndOf(match, trigramQueryOfStrings(a.Exact))
+	}
+	if b.Exact == nil {
+		return regexpInfo{Match: match}
+	}
+	return regexpInfo{Exact: b.Exact, Suffix: true, Match: match}
+}
+
+func alternateRegexpInfo(a, b regexpInfo) regexpInfo {
+	if a.Exact != nil && b.Exact != nil && len(a.Exact)+len(b.Exact) <= trigramMaxExact {
+		return regexpInfo{
+			Exact:  unionStrings(a.Exact, b.Exact),
+			Suffix: a.Suffix || b.Suffix,
+			Match:  queryOrOf(a.Match, b.Match),
+		}
+	}
+	return regexpInfo{Match: queryOrOf(a.query(), b.query())}
+}
+
+// unionStrings returns the sorted union of a and b without duplicates, which is never nil
+func unionStrings(a, b []string) []string {
+	res := make([]string, 0, len(a)+len(b))
+	res = append(res, a...)
+	res = append(res, b...)
+	sort.Strings(res)
+	for i := 1; i < len(res); {
+		if res[i] == res[i-1] {
+			res = append(res[:i], res[i+1:]...)
+			continue
+		}
+		i++
+	}
+	return res
+}
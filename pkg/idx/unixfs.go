@@ -0,0 +1,392 @@
+package idx
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// UnixFS data types
+const (
+	unixfsRaw uint64 = iota
+	unixfsDirectory
+	unixfsFile
+	unixfsMetadata
+	unixfsSymlink
+	unixfsHAMTShard
+)
+
+// pbLink is a link of a dag-pb node
+type pbLink struct {
+	Hash cid
+	Name string
+}
+
+// unixfsData is the UnixFS metadata carried in the data field of dag-pb nodes
+type unixfsData struct {
+	Type       uint64
+	Data       []byte
+	FileSize   uint64
+	BlockSizes []uint64
+	Fanout     uint64
+	Mode       uint32
+	HasMode    bool
+	Mtime      int64
+}
+
+type unixfsNode struct {
+	Links []pbLink
+	FS    unixfsData
+}
+
+func (n *unixfsNode) isDir() bool {
+	return n.FS.Type == unixfsDirectory || n.FS.Type == unixfsHAMTShard
+}
+
+// size returns the size of a file's content
+func (n *unixfsNode) size() uint64 {
+	if n.FS.FileSize > 0 || len(n.Links) > 0 {
+		return n.FS.FileSize
+	}
+	return uint64(len(n.FS.Data))
+}
+
+// loadNode reads and decodes the block identified by id. Blocks using the raw codec are file content.
+func (c *carIndex) loadNode(id cid) (*unixfsNode, error) {
+	blk, err := c.block(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch id.Codec {
+	case multicodecRaw:
+		return &unixfsNode{FS: unixfsData{Type: unixfsRaw, Data: blk, FileSize: uint64(len(blk))}}, nil
+	case multicodecDagPB:
+	default:
+		return nil, fmt.Errorf("block %s uses unsupported codec 0x%x", id, id.Codec)
+	}
+
+	res := &unixfsNode{}
+	var data []byte
+	err = walkProtobuf(blk, func(field, wire, v uint64, b []byte) error {
+		switch {
+		case field == 1 && wire == 2:
+			data = b
+		case field == 2 && wire == 2:
+			var link pbLink
+			err := walkProtobuf(b, func(field, wire, v uint64, b []byte) error {
+				var err error
+				switch {
+				case field == 1 && wire == 2:
+					link.Hash, _, err = parseCID(b)
+				case field == 2 && wire == 2:
+					link.Name = string(b)
+				}
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			res.Links = append(res.Links, link)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode block %s: %w", id, err)
+	}
+
+	fs := &res.FS
+	err = walkProtobuf(data, func(field, wire, v uint64, b []byte) error {
+		switch field {
+		case 1:
+			fs.Type = v
+		case 2:
+			fs.Data = b
+		case 3:
+			fs.FileSize = v
+		case 4:
+			if wire != 2 {
+				fs.BlockSizes = append(fs.BlockSizes, v)
+				break
+			}
+			// packed encoding
+			for len(b) > 0 {
+				s, n := binary.Uvarint(b)
+				if n <= 0 {
+					return fmt.Errorf("invalid block size")
+				}
+				fs.BlockSizes = append(fs.BlockSizes, s)
+				b = b[n:]
+			}
+		case 6:
+			fs.Fanout = v
+		case 7:
+			fs.Mode, fs.HasMode = uint32(v), true
+		case 8:
+			return walkProtobuf(b, func(field, wire, v uint64, b []byte) error {
+				if field == 1 {
+					fs.Mtime = int64(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode UnixFS data of %s: %w", id, err)
+	}
+	return res, nil
+}
+
+// listDir lists a UnixFS directory, including sharded ones, and loads the nodes of its entries
+func (c *carIndex) listDir(dir *unixfsNode) ([]Entry, error) {
+	if !dir.isDir() {
+		return nil, syscall.ENOTDIR
+	}
+	links, err := c.dirLinks(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		res  = make([]Entry, len(links))
+		errs = make([]error, len(links))
+		wg   sync.WaitGroup
+		sema = make(chan struct{}, carConcurrency)
+	)
+	for i, l := range links {
+		wg.Add(1)
+		go func(i int, l pbLink) {
+			defer wg.Done()
+			sema <- struct{}{}
+			defer func() { <-sema }()
+
+			node, err := c.loadNode(l.Hash)
+			if err != nil {
+				errs[i] = fmt.Errorf("cannot load %s: %w", l.Name, err)
+				return
+			}
+			res[i] = &unixfsEntry{idx: c, name: l.Name, node: node}
+		}(i, l)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// dirLinks returns the links of a directory. Entries of HAMT sharded directories are spread
+// across sub-shards. Link names start with the hex index within their shard, sub-shards carry
+// nothing but that index.
+func (c *carIndex) dirLinks(dir *unixfsNode) ([]pbLink, error) {
+	if dir.FS.Type != unixfsHAMTShard {
+		return dir.Links, nil
+	}
+	if dir.FS.Fanout == 0 {
+		return nil, fmt.Errorf("HAMT shard without fanout")
+	}
+	prefix := len(fmt.Sprintf("%X", dir.FS.Fanout-1))
+
+	var res []pbLink
+	for _, l := range dir.Links {
+		if len(l.Name) < prefix {
+			return nil, fmt.Errorf("invalid HAMT link name %q", l.Name)
+		}
+		if len(l.Name) > prefix {
+			res = append(res, pbLink{Hash: l.Hash, Name: l.Name[prefix:]})
+			continue
+		}
+
+		shard, err := c.loadNode(l.Hash)
+		if err != nil {
+			return nil, err
+		}
+		links, err := c.dirLinks(shard)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, links...)
+	}
+	return res, nil
+}
+
+// readFile reads the content of a file node, which consists of its own data followed by the
+// content of the blocks it links to
+func (c *carIndex) readFile(n *unixfsNode, dst []byte, offset int64) (read int, err error) {
+	data := n.FS.Data
+	if offset < int64(len(data)) {
+		read = copy(dst, data[offset:])
+	}
+
+	pos := int64(len(data))
+	for i, l := range n.Links {
+		if read == len(dst) {
+			break
+		}
+		if i >= len(n.FS.BlockSizes) {
+			return read, fmt.Errorf("link %s has no block size", l.Hash)
+		}
+		size := int64(n.FS.BlockSizes[i])
+		want := offset + int64(read)
+		if want >= pos+size {
+			pos += size
+			continue
+		}
+
+		child, err := c.loadNode(l.Hash)
+		if err != nil {
+			return read, err
+		}
+		chunk := dst[read:]
+		if rem := pos + size - want; int64(len(chunk)) > rem {
+			chunk = chunk[:rem]
+		}
+		cn, err := c.readFile(child, chunk, want-pos)
+		read += cn
+		if err != nil {
+			return read, err
+		}
+		if cn < len(chunk) {
+			return read, fmt.Errorf("block %s is shorter than its declared size", l.Hash)
+		}
+		pos += size
+	}
+	return read, nil
+}
+
+// walkProtobuf calls fn for each field of the protobuf message in b. Varint and fixed-size values
+// are passed as v, length-delimited ones as b.
+func walkProtobuf(b []byte, fn func(field, wire, v uint64, b []byte) error) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		b = b[n:]
+
+		var (
+			field, wire = key >> 3, key & 7
+			v           uint64
+			data        []byte
+		)
+		switch wire {
+		case 0:
+			v, n = binary.Uvarint(b)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint in field %d", field)
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return io.ErrUnexpectedEOF
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return fmt.Errorf("invalid length in field %d", field)
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return io.ErrUnexpectedEOF
+			}
+			v, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d in field %d", wire, field)
+		}
+
+		err := fn(field, wire, v, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ SymlinkEntry = (*unixfsEntry)(nil)
+
+type unixfsEntry struct {
+	idx  *carIndex
+	name string
+	node *unixfsNode
+}
+
+// Name implements Entry
+func (e *unixfsEntry) Name() string {
+	return e.name
+}
+
+// Dir implements Entry
+func (e *unixfsEntry) Dir() bool {
+	return e.node.isDir()
+}
+
+// Getattr implements Entry
+func (e *unixfsEntry) Getattr(out *fuse.Attr) (applyDefaults bool, err error) {
+	switch {
+	case e.node.FS.HasMode:
+		out.Mode = e.node.FS.Mode & 07777
+	case e.Dir():
+		out.Mode = 0755
+	case e.node.FS.Type == unixfsSymlink:
+		out.Mode = 0777
+	default:
+		out.Mode = 0644
+	}
+	if !e.Dir() {
+		out.Size = e.node.size()
+	}
+	mtime := uint64(e.node.FS.Mtime)
+	out.Mtime, out.Atime, out.Ctime = mtime, mtime, mtime
+	return true, nil
+}
+
+// StableMode implements Entry
+func (e *unixfsEntry) StableMode() uint32 {
+	switch {
+	case e.Dir():
+		return syscall.S_IFDIR
+	case e.node.FS.Type == unixfsSymlink:
+		return syscall.S_IFLNK
+	default:
+		return syscall.S_IFREG
+	}
+}
+
+// Read implements Entry
+func (e *unixfsEntry) Read(dst []byte, offset int64) (n int, err error) {
+	if e.node.FS.Type != unixfsFile && e.node.FS.Type != unixfsRaw {
+		return 0, syscall.EINVAL
+	}
+	size := int64(e.node.size())
+	if offset >= size {
+		return 0, io.EOF
+	}
+	want := len(dst)
+	if rem := size - offset; int64(want) > rem {
+		dst = dst[:rem]
+	}
+
+	n, err = e.idx.readFile(e.node, dst, offset)
+	if err == nil && n < want {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Readlink implements SymlinkEntry
+func (e *unixfsEntry) Readlink() (string, error) {
+	if e.StableMode() != syscall.S_IFLNK {
+		return "", syscall.EINVAL
+	}
+	return string(e.node.FS.Data), nil
+}
@@ -0,0 +1,259 @@
+package idx
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v3"
+)
+
+// VerifyOptions configures VerifyIndex
+type VerifyOptions struct {
+	// Sample limits verification to this many randomly chosen entries, unless it's zero
+	Sample int
+	// Content checks the content of regular files against the digests recorded in the index,
+	// see ProduceOptions.ContentDigests
+	Content bool
+}
+
+// VerifyResult is the outcome of VerifyIndex
+type VerifyResult struct {
+	// Entries is the number of entries in the index
+	Entries int
+	// Checked is the number of entries which were verified
+	Checked int
+	// Mismatches lists the entries which don't match the archive, sorted by name
+	Mismatches []Mismatch
+}
+
+// Mismatch describes an entry which does not match the archive
+type Mismatch struct {
+	Name   string
+	Offset int64
+	Reason string
+}
+
+// verifyParallelism is the number of entries VerifyIndex checks concurrently. Remote archives are
+// read using a range request per entry, hence this hides some of their latency.
+const verifyParallelism = 8
+
+// VerifyIndex checks that the entries of an index match the tar archive at location, which is
+// a local path or an HTTP(S) URL. Each entry has to be preceded by a tar header of the same name,
+// type and size at the offset recorded in the index.
+func VerifyIndex(db *badger.DB, location string, opts VerifyOptions) (*VerifyResult, error) {
+	entries, meta, err := loadIndexEntries(db)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader(r)
+	archive, err := compactArchiveReader(r, meta)
+	if err != nil {
+		return nil, err
+	}
+	magic := make([]byte, len(cpioMagicNewc))
+	_, err = archive.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("cannot read archive: %w", err)
+	}
+	if string(magic) == cpioMagicNewc || string(magic) == cpioMagicCRC {
+		return nil, fmt.Errorf("cannot verify cpio archives")
+	}
+
+	res := &VerifyResult{Entries: len(entries)}
+	if opts.Sample > 0 && len(entries) > opts.Sample {
+		rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+		rnd.Shuffle(len(entries), func(i, j int) { entries[i], entries[j] = entries[j], entries[i] })
+		entries = entries[:opts.Sample]
+	}
+	// reading the archive front to back plays well with read-ahead and caches
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Offset < entries[j].Offset })
+	res.Checked = len(entries)
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		work = make(chan indexEntry)
+	)
+	for i := 0; i < verifyParallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				reason := verifyEntry(archive, e, opts)
+				if reason == "" {
+					continue
+				}
+				mu.Lock()
+				res.Mismatches = append(res.Mismatches, Mismatch{Name: e.TarHeader.Name, Offset: e.Offset, Reason: reason})
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, e := range entries {
+		work <- e
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Slice(res.Mismatches, func(i, j int) bool { return res.Mismatches[i].Name < res.Mismatches[j].Name })
+	return res, nil
+}
+
+// verifyEntry checks an entry against the archive and returns why it doesn't match, or an empty string if it does
+func verifyEntry(archive io.ReaderAt, e indexEntry, opts VerifyOptions) string {
+	if e.Offset < tarBlockSize || e.Offset%tarBlockSize != 0 {
+		return fmt.Sprintf("offset %d is not preceded by a tar header", e.Offset)
+	}
+	blk := make([]byte, tarBlockSize)
+	_, err := archive.ReadAt(blk, e.Offset-tarBlockSize)
+	if err != nil {
+		return fmt.Sprintf("cannot read tar header: %v", err)
+	}
+	hdr, err := parseTarHeaderBlock(blk)
+	if err != nil {
+		return err.Error()
+	}
+
+	th := e.TarHeader
+	if !tarTypesMatch(th.Typeflag, hdr.Typeflag) {
+		return fmt.Sprintf("type is %q in the archive, %q in the index", hdr.Typeflag, th.Typeflag)
+	}
+	if !tarNamesMatch(th.Name, hdr) {
+		return fmt.Sprintf("name is %q in the archive", hdr.Name)
+	}
+	// sizes which don't fit the header are stored in PAX records, which precede the header
+	if hdr.Size != th.Size && !(hdr.Size == 0 && th.Size > tarMaxOctalSize) && hdr.Typeflag != tar.TypeGNUSparse {
+		return fmt.Sprintf("size is %d in the archive, %d in the index", hdr.Size, th.Size)
+	}
+
+	if !opts.Content || e.Digest == "" {
+		return ""
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(archive, e.Offset, th.Size))
+	if err != nil {
+		return fmt.Sprintf("cannot read content: %v", err)
+	}
+	if digest := "sha256:" + hex.EncodeToString(h.Sum(nil)); digest != e.Digest {
+		return fmt.Sprintf("content digest is %s, %s in the index", digest, e.Digest)
+	}
+	return ""
+}
+
+const (
+	tarBlockSize = 512
+	// tarMaxOctalSize is the largest size the octal size field of a tar header can hold
+	tarMaxOctalSize = 1<<33 - 1
+)
+
+// tarHeaderBlock holds the fields of a single tar header block
+type tarHeaderBlock struct {
+	Name     string
+	Typeflag byte
+	Size     int64
+	// FullName is true if the name field is used in full, i.e. the name may have been truncated
+	FullName bool
+}
+
+// parseTarHeaderBlock parses a V7, ustar or GNU tar header block, without following any extended headers
+func parseTarHeaderBlock(blk []byte) (*tarHeaderBlock, error) {
+	chksum, err := parseTarOctal(blk[148:156])
+	if err != nil {
+		return nil, fmt.Errorf("no tar header: invalid checksum field")
+	}
+	var unsigned, signed int64
+	for i, b := range blk {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		unsigned += int64(b)
+		signed += int64(int8(b))
+	}
+	if chksum != unsigned && chksum != signed {
+		return nil, fmt.Errorf("no tar header: checksum mismatch")
+	}
+
+	res := &tarHeaderBlock{Typeflag: blk[156]}
+	name := blk[0:100]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	} else {
+		res.FullName = true
+	}
+	res.Name = string(name)
+	if string(blk[257:265]) == "ustar\x0000" {
+		prefix := blk[345:500]
+		if i := bytes.IndexByte(prefix, 0); i >= 0 {
+			prefix = prefix[:i]
+		}
+		if len(prefix) > 0 {
+			res.Name = string(prefix) + "/" + res.Name
+		}
+	}
+
+	size := blk[124:136]
+	if size[0]&0x80 != 0 {
+		// base-256 encoding of GNU tar
+		for _, b := range size[1:] {
+			res.Size = res.Size<<8 | int64(b)
+		}
+	} else {
+		res.Size, err = parseTarOctal(size)
+		if err != nil {
+			return nil, fmt.Errorf("no tar header: invalid size field")
+		}
+	}
+	return res, nil
+}
+
+func parseTarOctal(b []byte) (int64, error) {
+	s := strings.Trim(string(b), " \x00")
+	if s == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(s, 8, 64)
+}
+
+// tarTypesMatch compares the type of an indexed entry with the type of a header block
+func tarTypesMatch(indexed, archived byte) bool {
+	normalise := func(t byte) byte {
+		if t == tar.TypeRegA || t == tar.TypeGNUSparse {
+			return tar.TypeReg
+		}
+		return t
+	}
+	return normalise(indexed) == normalise(archived)
+}
+
+// tarNamesMatch compares the name of an indexed entry with the name of a header block. Names which
+// don't fit a header are stored in extended headers, leaving a truncated name in the header block.
+func tarNamesMatch(indexed string, hdr *tarHeaderBlock) bool {
+	archived := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "./"), "/")
+	if archived == indexed {
+		return true
+	}
+	if hdr.FullName && strings.HasPrefix(indexed, archived) {
+		return true
+	}
+	for _, c := range indexed {
+		if c >= 0x80 {
+			// PAX headers hold names which aren't ASCII, the header block a lossy version of it
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package idx_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/dgraph-io/badger/v3"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestVerifyIndex(t *testing.T) {
+	longName := strings.Repeat("very-long-file-name-", 6) + ".txt"
+	archive := func(extra ...string) []byte {
+		buf := bytes.NewBuffer(nil)
+		tarw := tar.NewWriter(buf)
+		add := func(hdr *tar.Header, content string) {
+			hdr.Size = int64(len(content))
+			tarw.WriteHeader(hdr)
+			tarw.Write([]byte(content))
+		}
+		for _, name := range extra {
+			add(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644}, name)
+		}
+		add(&tar.Header{Typeflag: tar.TypeDir, Name: "foo/", Mode: 0755}, "")
+		add(&tar.Header{Typeflag: tar.TypeReg, Name: "foo/bar.txt", Mode: 0644}, fileFooSlashBarTXT)
+		add(&tar.Header{Typeflag: tar.TypeSymlink, Name: "foo/link", Linkname: "bar.txt", Mode: 0777}, "")
+		add(&tar.Header{Typeflag: tar.TypeReg, Name: "pax/" + longName, Mode: 0644, Format: tar.FormatPAX}, "pax")
+		add(&tar.Header{Typeflag: tar.TypeReg, Name: "gnu/" + longName, Mode: 0644, Format: tar.FormatGNU}, "gnu")
+		add(&tar.Header{Typeflag: tar.TypeReg, Name: "./hello.txt", Mode: 0644}, fileHelloTXT)
+		tarw.Close()
+		return buf.Bytes()
+	}
+	produce := func(archive []byte) *badger.DB {
+		db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { db.Close() })
+		err = idx.ProduceIndexWithOptions(db, bytes.NewReader(archive), idx.ProduceOptions{ContentDigests: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	dir := t.TempDir()
+	write := func(name string, content []byte) string {
+		fn := filepath.Join(dir, name)
+		err := os.WriteFile(fn, content, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fn
+	}
+	mismatches := func(res *idx.VerifyResult) []string {
+		var names []string
+		for _, m := range res.Mismatches {
+			names = append(names, m.Name)
+		}
+		return names
+	}
+
+	original := archive()
+	db := produce(original)
+	tests := []struct {
+		Name        string
+		Archive     []byte
+		Opts        idx.VerifyOptions
+		Reindex     bool
+		Expectation []string
+	}{
+		{Name: "matching archive", Archive: original, Opts: idx.VerifyOptions{Content: true}},
+		{Name: "gzip compressed archive", Archive: gzipMembers(t, original), Opts: idx.VerifyOptions{Content: true}, Reindex: true},
+		{
+			Name:        "changed content",
+			Archive:     bytes.Replace(original, []byte(fileHelloTXT), []byte(strings.ToUpper(fileHelloTXT)), 1),
+			Opts:        idx.VerifyOptions{Content: true},
+			Expectation: []string{"hello.txt"},
+		},
+		{
+			Name:    "changed content without checking it",
+			Archive: bytes.Replace(original, []byte(fileHelloTXT), []byte(strings.ToUpper(fileHelloTXT)), 1),
+		},
+		{
+			Name:        "entries shifted",
+			Archive:     archive("new.txt"),
+			Expectation: []string{"foo", "foo/bar.txt", "foo/link", "gnu/" + longName, "hello.txt", "pax/" + longName},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			index := db
+			if test.Reindex {
+				index = produce(test.Archive)
+			}
+			res, err := idx.VerifyIndex(index, write("archive.tar", test.Archive), test.Opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.Checked != 6 || res.Entries != 6 {
+				t.Errorf("checked %d of %d entries, expected 6 of 6", res.Checked, res.Entries)
+			}
+			if diff := cmp.Diff(test.Expectation, mismatches(res)); diff != "" {
+				t.Errorf("unexpected mismatches (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("remote sample", func(t *testing.T) {
+		shifted := archive("new.txt")
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(shifted))
+		}))
+		defer srv.Close()
+
+		res, err := idx.VerifyIndex(db, srv.URL, idx.VerifyOptions{Sample: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.Checked != 2 || res.Entries != 6 {
+			t.Errorf("checked %d of %d entries, expected 2 of 6", res.Checked, res.Entries)
+		}
+		if len(res.Mismatches) != 2 {
+			t.Errorf("found %d mismatches, expected 2", len(res.Mismatches))
+		}
+	})
+}
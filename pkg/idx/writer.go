@@ -0,0 +1,205 @@
+package idx
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	badger "github.com/dgraph-io/badger/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Progress tracks how far producing an index got. It's safe to read while the index is produced.
+type Progress struct {
+	entries atomic.Int64
+	bytes   atomic.Int64
+}
+
+// Entries returns the number of entries added to the index so far
+func (p *Progress) Entries() int64 {
+	return p.entries.Load()
+}
+
+// Bytes returns how far into the (uncompressed) archive indexing got
+func (p *Progress) Bytes() int64 {
+	return p.bytes.Load()
+}
+
+// indexWriterBatchSize is the number of entries a worker of an indexWriter encodes at once
+const indexWriterBatchSize = 1024
+
+// indexWriter adds entries to a badger index. Entries are JSON encoded by a pool of workers, off
+// the goroutine which reads the archive, and written in the order they were added using a single
+// WriteBatch rather than a transaction per entry. Later entries of the same name win.
+type indexWriter struct {
+	db       *badger.DB
+	wb       *badger.WriteBatch
+	progress *Progress
+
+	batch []indexEntry
+	work  chan *indexWriterBatch
+	queue chan *indexWriterBatch
+
+	workers sync.WaitGroup
+	written chan struct{}
+	failed  chan struct{}
+	err     error
+	closed  bool
+}
+
+type indexWriterBatch struct {
+	Entries []indexEntry
+	Keys    [][]byte
+	Values  [][]byte
+	Err     error
+	Done    chan struct{}
+}
+
+// newIndexWriter starts writing entries to db, updating progress unless it's nil
+func newIndexWriter(db *badger.DB, progress *Progress) *indexWriter {
+	workers := runtime.GOMAXPROCS(0)
+	w := &indexWriter{
+		db:       db,
+		wb:       db.NewWriteBatch(),
+		progress: progress,
+		work:     make(chan *indexWriterBatch, workers),
+		queue:    make(chan *indexWriterBatch, 2*workers),
+		written:  make(chan struct{}),
+		failed:   make(chan struct{}),
+	}
+	w.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go w.encode()
+	}
+	go w.write()
+	return w
+}
+
+// Put adds an entry to the index. The entry must not be modified afterwards.
+func (w *indexWriter) Put(entry indexEntry) error {
+	w.batch = append(w.batch, entry)
+	if w.progress != nil {
+		w.progress.entries.Add(1)
+		if end := entry.Offset + entry.TarHeader.Size; end > w.progress.bytes.Load() {
+			w.progress.bytes.Store(end)
+		}
+	}
+	log.WithField("name", entry.TarHeader.Name).WithField("offset", entry.Offset).Debug("added file to index")
+
+	if len(w.batch) < indexWriterBatchSize {
+		return nil
+	}
+	return w.submit()
+}
+
+// SetBytes records how far into the archive indexing got
+func (w *indexWriter) SetBytes(n int64) {
+	if w.progress != nil {
+		w.progress.bytes.Store(n)
+	}
+}
+
+func (w *indexWriter) submit() error {
+	if len(w.batch) == 0 {
+		return nil
+	}
+	b := &indexWriterBatch{Entries: w.batch, Done: make(chan struct{})}
+	w.batch = make([]indexEntry, 0, indexWriterBatchSize)
+
+	// the queue preserves the order of batches while they're encoded concurrently
+	select {
+	case w.queue <- b:
+	case <-w.failed:
+		return w.err
+	}
+	select {
+	case w.work <- b:
+	case <-w.failed:
+		return w.err
+	}
+	return nil
+}
+
+func (w *indexWriter) encode() {
+	defer w.workers.Done()
+	for b := range w.work {
+		b.Keys = make([][]byte, len(b.Entries))
+		b.Values = make([][]byte, len(b.Entries))
+		for i, e := range b.Entries {
+			val, err := json.Marshal(e)
+			if err != nil {
+				b.Err = fmt.Errorf("cannot encode %s: %w", e.TarHeader.Name, err)
+				break
+			}
+			b.Keys[i], b.Values[i] = []byte(e.TarHeader.Name), val
+		}
+		close(b.Done)
+	}
+}
+
+func (w *indexWriter) write() {
+	defer close(w.written)
+	for b := range w.queue {
+		if w.err != nil {
+			// keep draining the queue, so that nobody blocks on it
+			continue
+		}
+		<-b.Done
+		err := b.Err
+		for i := 0; err == nil && i < len(b.Keys); i++ {
+			err = w.wb.Set(b.Keys[i], b.Values[i])
+			if err != nil {
+				err = fmt.Errorf("cannot add %s to index: %w", b.Keys[i], err)
+			}
+		}
+		if err != nil {
+			w.err = err
+			close(w.failed)
+		}
+	}
+}
+
+// stop shuts down the workers and waits for all submitted batches to be written
+func (w *indexWriter) stop() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	close(w.work)
+	w.workers.Wait()
+	<-w.written
+}
+
+// Flush writes all entries added so far, waits until they're committed and updates the aggregates
+// of all directories of the index
+func (w *indexWriter) Flush() error {
+	if w.closed {
+		return fmt.Errorf("index writer is closed")
+	}
+	err := w.submit()
+	w.stop()
+	if err == nil {
+		err = w.err
+	}
+	if err != nil {
+		w.wb.Cancel()
+		return err
+	}
+	err = w.wb.Flush()
+	if err != nil {
+		return err
+	}
+	return storeDirAggregates(w.db)
+}
+
+// Cancel discards all entries which haven't been flushed. It's safe to call after Flush.
+func (w *indexWriter) Cancel() {
+	if w.closed {
+		return
+	}
+	w.stop()
+	w.wb.Cancel()
+}
@@ -0,0 +1,383 @@
+package idx
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+func init() {
+	RegisterBackend(Backend{
+		Name: "zip",
+		Detect: func(src *url.URL, header []byte) bool {
+			// local file header, or the end of central directory record of an empty archive
+			return bytes.HasPrefix(header, []byte("PK\x03\x04")) || bytes.HasPrefix(header, []byte("PK\x05\x06"))
+		},
+		Open: func(ctx context.Context, src *url.URL, opts OpenOptions) (Index, error) {
+			return OpenZip(sourceLocation(src))
+		},
+	})
+}
+
+// OpenZip opens a zip archive from a local path or HTTP(S) URL. Zip archives carry their own
+// central directory, so no separate index is needed. Only the end of central directory record
+// and the central directory are read upfront, file content is read on demand.
+func OpenZip(location string) (Index, error) {
+	r, size, err := openLocation(location)
+	if err != nil {
+		return nil, err
+	}
+	if isURL(location) {
+		r, err = readZipDirectory(r, size)
+		if err != nil {
+			closeReader(r)
+			return nil, err
+		}
+	}
+	res, err := NewZipIndex(r, size)
+	if err != nil {
+		closeReader(r)
+		return nil, err
+	}
+	return res, nil
+}
+
+// NewZipIndex produces an index from the central directory of the zip archive in r
+func NewZipIndex(r io.ReaderAt, size int64) (Index, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &zipIndex{
+		r:        r,
+		children: make(map[string][]*zipEntry),
+	}
+	// entries by path, so that of entries which appear more than once the last one wins, as it
+	// does with unzip
+	entries := make(map[string]*zipEntry)
+	var ensureDir func(p string) *zipEntry
+	ensureDir = func(p string) *zipEntry {
+		if p == "." || p == "/" || p == "" {
+			return nil
+		}
+		if d, ok := entries[p]; ok {
+			return d
+		}
+		// directories without their own entry in the archive
+		d := &zipEntry{idx: res, path: p, implicit: true}
+		entries[p] = d
+		ensureDir(path.Dir(p))
+		res.children[path.Dir(p)] = append(res.children[path.Dir(p)], d)
+		return d
+	}
+
+	for _, f := range zr.File {
+		p := path.Clean(strings.TrimPrefix(f.Name, "/"))
+		if p == "." || p == ".." || strings.HasPrefix(p, "../") {
+			log.WithField("name", f.Name).Warn("skipping zip entry outside of the archive root")
+			continue
+		}
+
+		if e, ok := entries[p]; ok {
+			e.f, e.implicit = f, false
+			continue
+		}
+		ensureDir(path.Dir(p))
+		e := &zipEntry{idx: res, path: p, f: f}
+		entries[p] = e
+		res.children[path.Dir(p)] = append(res.children[path.Dir(p)], e)
+	}
+	for _, c := range res.children {
+		sort.Slice(c, func(i, j int) bool { return c[i].path < c[j].path })
+	}
+
+	return res, nil
+}
+
+const (
+	// zipEOCDSize is the size of the end of central directory record, without the comment
+	zipEOCDSize = 22
+	// zip64LocatorSize is the size of the zip64 end of central directory locator which precedes it
+	zip64LocatorSize = 20
+)
+
+// readZipDirectory reads the central directory of a zip archive at once, so that archive/zip
+// doesn't issue a range request for every few KiB of it when reading remote archives. The end of
+// central directory record is found in the tail of the archive, which it ends with up to a 64KiB
+// comment. Archives whose central directory we cannot find are left to archive/zip to report.
+func readZipDirectory(r io.ReaderAt, size int64) (io.ReaderAt, error) {
+	tailSize := int64(zipEOCDSize + 0xffff)
+	if tailSize > size {
+		tailSize = size
+	}
+	start := size - tailSize
+	tail := make([]byte, tailSize)
+	_, err := r.ReadAt(tail, start)
+	if err != nil && err != io.EOF {
+		return r, err
+	}
+	pos := bytes.LastIndex(tail, []byte("PK\x05\x06"))
+	if pos < 0 || len(tail)-pos < zipEOCDSize {
+		return r, nil
+	}
+	dirOffset := int64(binary.LittleEndian.Uint32(tail[pos+16:]))
+	if dirOffset == 0xffffffff && pos >= zip64LocatorSize && bytes.HasPrefix(tail[pos-zip64LocatorSize:], []byte("PK\x06\x07")) {
+		// the offset is found in the zip64 end of central directory record the locator points at
+		rec := make([]byte, 56)
+		_, err = r.ReadAt(rec, int64(binary.LittleEndian.Uint64(tail[pos-zip64LocatorSize+8:])))
+		if err != nil {
+			return r, err
+		}
+		dirOffset = int64(binary.LittleEndian.Uint64(rec[48:]))
+	}
+	if dirOffset < 0 || dirOffset > size {
+		return r, nil
+	}
+
+	if dirOffset < start {
+		head := make([]byte, start-dirOffset)
+		_, err = r.ReadAt(head, dirOffset)
+		if err != nil && err != io.EOF {
+			return r, err
+		}
+		tail = append(head, tail...)
+		start = dirOffset
+	}
+	return &tailReaderAt{ReaderAt: r, start: start, tail: tail}, nil
+}
+
+// tailReaderAt serves reads of the tail of a file from memory
+type tailReaderAt struct {
+	io.ReaderAt
+	start int64
+	tail  []byte
+}
+
+// ReadAt implements io.ReaderAt
+func (r *tailReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < r.start {
+		return r.ReaderAt.ReadAt(p, off)
+	}
+	if off-r.start >= int64(len(r.tail)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.tail[off-r.start:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close implements io.Closer
+func (r *tailReaderAt) Close() error {
+	return closeReader(r.ReaderAt)
+}
+
+var _ Index = (*zipIndex)(nil)
+
+type zipIndex struct {
+	r        io.ReaderAt
+	children map[string][]*zipEntry
+}
+
+// Close implements Index
+func (z *zipIndex) Close() error {
+	return closeReader(z.r)
+}
+
+func (z *zipIndex) list(dir string) []Entry {
+	children := z.children[dir]
+	res := make([]Entry, len(children))
+	for i := range children {
+		res[i] = children[i]
+	}
+	return res
+}
+
+// RootEntries implements Index
+func (z *zipIndex) RootEntries(ctx context.Context) ([]Entry, error) {
+	return z.list("."), nil
+}
+
+// Children implements Index
+func (z *zipIndex) Children(ctx context.Context, of Entry) ([]Entry, error) {
+	e, ok := of.(*zipEntry)
+	if !ok {
+		return nil, fmt.Errorf("entry %s does not belong to this index", of.Name())
+	}
+	return z.list(e.path), nil
+}
+
+var _ SymlinkEntry = (*zipEntry)(nil)
+
+type zipEntry struct {
+	idx      *zipIndex
+	path     string
+	f        *zip.File
+	implicit bool
+
+	dataOnce   sync.Once
+	dataOffset int64
+	dataErr    error
+
+	mu    sync.Mutex
+	rd    io.Reader
+	rdOff int64
+}
+
+// Name implements Entry
+func (e *zipEntry) Name() string {
+	return path.Base(e.path)
+}
+
+// Path returns the path of the entry within the archive
+func (e *zipEntry) Path() string {
+	return e.path
+}
+
+// Dir implements Entry
+func (e *zipEntry) Dir() bool {
+	return e.implicit || e.f.FileInfo().IsDir()
+}
+
+// Getattr implements Entry
+func (e *zipEntry) Getattr(out *fuse.Attr) (applyDefaults bool, err error) {
+	if e.implicit {
+		out.Mode = 0755
+		return true, nil
+	}
+
+	mode := e.f.Mode()
+	out.Mode = uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		out.Mode |= syscall.S_ISUID
+	}
+	if mode&fs.ModeSetgid != 0 {
+		out.Mode |= syscall.S_ISGID
+	}
+	if mode&fs.ModeSticky != 0 {
+		out.Mode |= syscall.S_ISVTX
+	}
+	if !e.Dir() {
+		out.Size = e.f.UncompressedSize64
+	}
+	mtime := uint64(e.f.Modified.Unix())
+	out.Mtime, out.Atime, out.Ctime = mtime, mtime, mtime
+
+	return true, nil
+}
+
+// StableMode implements Entry
+func (e *zipEntry) StableMode() uint32 {
+	if e.Dir() {
+		return syscall.S_IFDIR
+	}
+
+	mode := e.f.Mode()
+	switch {
+	case mode&fs.ModeSymlink != 0:
+		return syscall.S_IFLNK
+	case mode&fs.ModeNamedPipe != 0:
+		return syscall.S_IFIFO
+	case mode&fs.ModeSocket != 0:
+		return syscall.S_IFSOCK
+	case mode&fs.ModeCharDevice != 0:
+		return syscall.S_IFCHR
+	case mode&fs.ModeDevice != 0:
+		return syscall.S_IFBLK
+	default:
+		return syscall.S_IFREG
+	}
+}
+
+// Read implements Entry
+func (e *zipEntry) Read(dst []byte, offset int64) (n int, err error) {
+	if e.Dir() {
+		return 0, syscall.EISDIR
+	}
+	size := int64(e.f.UncompressedSize64)
+	if offset >= size {
+		return 0, io.EOF
+	}
+	if rem := size - offset; int64(len(dst)) > rem {
+		dst = dst[:rem]
+	}
+
+	// finding the data offset requires reading the local file header
+	e.dataOnce.Do(func() { e.dataOffset, e.dataErr = e.f.DataOffset() })
+	if e.dataErr != nil {
+		return 0, e.dataErr
+	}
+	dataOffset := e.dataOffset
+
+	switch e.f.Method {
+	case zip.Store:
+		return e.idx.r.ReadAt(dst, dataOffset+offset)
+
+	case zip.Deflate:
+		e.mu.Lock()
+		defer e.mu.Unlock()
+
+		// Deflated content can only be read front to back. We keep the decompressor around
+		// so that sequential reads continue where the previous one left off.
+		if e.rd == nil || e.rdOff > offset {
+			compressed := int64(e.f.CompressedSize64)
+			bufSize := streamBufferSize
+			if compressed < int64(bufSize) {
+				bufSize = int(compressed) + 1
+			}
+			e.rd = flate.NewReader(bufio.NewReaderSize(io.NewSectionReader(e.idx.r, dataOffset, compressed), bufSize))
+			e.rdOff = 0
+		}
+		if skip := offset - e.rdOff; skip > 0 {
+			n, err := io.CopyN(io.Discard, e.rd, skip)
+			e.rdOff += n
+			if err != nil {
+				e.rd = nil
+				return 0, err
+			}
+		}
+
+		n, err = io.ReadFull(e.rd, dst)
+		e.rdOff += int64(n)
+		if err != nil {
+			e.rd = nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return n, err
+
+	default:
+		return 0, fmt.Errorf("%s: unsupported compression method %d", e.path, e.f.Method)
+	}
+}
+
+// Readlink implements SymlinkEntry. Zip archives store the link target as file content.
+func (e *zipEntry) Readlink() (string, error) {
+	if e.StableMode() != syscall.S_IFLNK {
+		return "", syscall.EINVAL
+	}
+	buf := make([]byte, e.f.UncompressedSize64)
+	n, err := e.Read(buf, 0)
+	if err != nil && !(err == io.EOF && n == len(buf)) {
+		return "", err
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,136 @@
+package idx_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestZipIndex(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	add := func(name string, method uint16, mode fs.FileMode, content string) {
+		hdr := &zip.FileHeader{Name: name, Method: method}
+		hdr.SetMode(mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("META-INF/", zip.Store, fs.ModeDir|0755, "")
+	add("META-INF/MANIFEST.MF", zip.Deflate, 0644, "Manifest-Version: 1.0")
+	add("com/example/Main.class", zip.Store, 0644, "cafebabe")
+	add("com/example/large.txt", zip.Deflate, 0644, strings.Repeat("all work and no play ", 1000))
+	add("bin/run", zip.Deflate, 0755, "#!/bin/false")
+	// the last of entries with the same name wins
+	add("bin/run", zip.Deflate, 0755, "#!/bin/sh")
+	add("current", zip.Store, fs.ModeSymlink|0777, "com/example")
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := idx.NewZipIndex(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectation := []string{
+		"META-INF/",
+		"META-INF/MANIFEST.MF:Manifest-Version: 1.0",
+		"bin/",
+		"bin/run:#!/bin/sh",
+		"com/",
+		"com/example/",
+		"com/example/Main.class:cafebabe",
+		"com/example/large.txt:" + strings.Repeat("all work and no play ", 1000),
+		"current->com/example",
+	}
+	if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+		t.Errorf("NewZipIndex() mismatch (-want +got):\n%s", diff)
+	}
+
+	root, _ := index.RootEntries(context.Background())
+	var com idx.Entry
+	for _, e := range root {
+		if e.Name() == "com" {
+			com = e
+		}
+	}
+	children, _ := index.Children(context.Background(), com)
+	children, _ = index.Children(context.Background(), children[0])
+	var large idx.Entry
+	for _, e := range children {
+		if e.Name() == "large.txt" {
+			large = e
+		}
+	}
+	for _, off := range []int64{100, 20000, 5} {
+		dst := make([]byte, 21)
+		n, err := large.Read(dst, off)
+		if err != nil {
+			t.Fatalf("Read(%d): %v", off, err)
+		}
+		exp := strings.Repeat("all work and no play ", 1000)[off : off+21]
+		if diff := cmp.Diff(exp, string(dst[:n])); diff != "" {
+			t.Errorf("Read(%d) mismatch (-want +got):\n%s", off, diff)
+		}
+	}
+}
+
+func TestOpenZipRemote(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	zw := zip.NewWriter(buf)
+	var expectation []string
+	for i := 0; i < 2000; i++ {
+		name := fmt.Sprintf("file-%04d.txt", i)
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = w.Write([]byte(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectation = append(expectation, name+":"+name)
+	}
+	err := zw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		http.ServeContent(w, r, "archive.zip", time.Time{}, bytes.NewReader(buf.Bytes()))
+	}))
+	defer srv.Close()
+
+	index, err := idx.OpenZip(srv.URL + "/archive.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer index.Close()
+	// the central directory of about 100KiB is read at once, rather than in 4KiB reads
+	if n := atomic.LoadInt64(&requests); n > 3 {
+		t.Errorf("opening the archive took %d requests, expected at most 3", n)
+	}
+	if diff := cmp.Diff(expectation, dumpIndex(t, index)); diff != "" {
+		t.Errorf("OpenZip() mismatch (-want +got):\n%s", diff)
+	}
+}
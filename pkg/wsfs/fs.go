@@ -5,6 +5,7 @@ import (
 	"errors"
 	"io"
 	"path/filepath"
+	"sync"
 	"syscall"
 
 	"github.com/csweichel/wsfs/pkg/idx"
@@ -18,7 +19,55 @@ type Options struct {
 }
 
 func New(index idx.Index, opts Options) fs.InodeEmbedder {
-	return &indexedRoot{idx: index, opts: opts}
+	return newIndexedRoot(index, opts)
+}
+
+func newIndexedRoot(index idx.Index, opts Options) *indexedRoot {
+	return &indexedRoot{gen: &generation{Index: index}, opts: opts}
+}
+
+// Mount serves index at mountpoint. The server owns the index, i.e. the index is closed once
+// the filesystem is unmounted, or if mounting fails.
+func Mount(mountpoint string, index idx.Index, opts Options, mountOpts fuse.MountOptions) (*Server, error) {
+	root := newIndexedRoot(index, opts)
+	server, err := fs.Mount(mountpoint, root, &fs.Options{MountOptions: mountOpts})
+	if err != nil {
+		index.Close()
+		return nil, err
+	}
+	return &Server{Server: server, root: root}, nil
+}
+
+// Server is a mounted index
+type Server struct {
+	*fuse.Server
+
+	root      *indexedRoot
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Swap atomically replaces the mounted index, see indexedRoot.swap. The server owns the new index.
+func (s *Server) Swap(ctx context.Context, index idx.Index) error {
+	return s.root.swap(ctx, index)
+}
+
+// Wait waits until the filesystem is unmounted and closes the index
+func (s *Server) Wait() error {
+	s.Server.Wait()
+	s.closeOnce.Do(func() {
+		s.closeErr = s.root.generation().retire()
+	})
+	return s.closeErr
+}
+
+// Unmount unmounts the filesystem and closes the index
+func (s *Server) Unmount() error {
+	err := s.Server.Unmount()
+	if err != nil {
+		return err
+	}
+	return s.Wait()
 }
 
 // indexedRoot is the root of the Zip filesystem. Its only functionality
@@ -27,7 +76,25 @@ type indexedRoot struct {
 	fs.Inode
 
 	opts Options
-	idx  idx.Index
+
+	// mu is held for reading while inodes are created, and for writing while the index is swapped
+	mu  sync.RWMutex
+	gen *generation
+}
+
+func (zr *indexedRoot) generation() *generation {
+	zr.mu.RLock()
+	defer zr.mu.RUnlock()
+	return zr.gen
+}
+
+// acquireGeneration returns the current generation, which the caller has to release
+func (zr *indexedRoot) acquireGeneration() *generation {
+	zr.mu.RLock()
+	defer zr.mu.RUnlock()
+	// the current generation is only closed once it's been swapped out, which needs the lock
+	zr.gen.acquire()
+	return zr.gen
 }
 
 // The root populates the tree in its OnAdd method
@@ -38,28 +105,28 @@ func (zr *indexedRoot) OnAdd(ctx context.Context) {
 	// then construct a tree.  We construct the entire tree, and
 	// we don't want parts of the tree to disappear when the
 	// kernel is short on memory, so we use persistent inodes.
-	idx, ok := zr.idx.(idx.Index)
-	if !ok {
-		return
-	}
+	zr.mu.Lock()
+	defer zr.mu.Unlock()
 
-	root, err := idx.RootEntries(ctx)
+	root, err := zr.gen.Index.RootEntries(ctx)
 	if err != nil {
 		log.WithError(err).Warn("cannot retrieve root entries")
 	}
-
 	for _, f := range root {
-		dir, base := filepath.Split(f.Name())
-		log.WithField("base", base).WithField("dir", dir).WithField("name", f.Name()).Debug("adding inode")
+		zr.addRootEntry(ctx, zr.gen, f)
+	}
+}
 
-		p := &zr.Inode
-		ch := p.NewPersistentInode(ctx, &indexedFile{file: f, lazyIdx: idx, root: zr}, fs.StableAttr{
-			Mode: f.StableMode(),
-		})
+// addRootEntry adds an inode for f to the root. The caller must hold mu.
+func (zr *indexedRoot) addRootEntry(ctx context.Context, gen *generation, f idx.Entry) {
+	dir, base := filepath.Split(f.Name())
+	log.WithField("base", base).WithField("dir", dir).WithField("name", f.Name()).Debug("adding inode")
 
-		log.WithField("base", base).WithField("dir", dir).WithField("name", f.Name()).Debug("adding inode")
-		p.AddChild(base, ch, true)
-	}
+	p := &zr.Inode
+	ch := p.NewPersistentInode(ctx, &indexedFile{file: f, gen: gen, root: zr}, fs.StableAttr{
+		Mode: f.StableMode(),
+	})
+	p.AddChild(base, ch, true)
 }
 
 var _ fs.NodeGetattrer = (*indexedRoot)(nil)
@@ -79,10 +146,34 @@ func (zr *indexedRoot) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.A
 // indexedFile is a file read from an indexed filesystem.
 type indexedFile struct {
 	fs.Inode
+	root *indexedRoot
+
+	// mu guards the entry and the generation it belongs to, which change when the index is swapped
+	mu   sync.RWMutex
 	file idx.Entry
+	gen  *generation
+}
+
+func (zf *indexedFile) entry() (*generation, idx.Entry) {
+	zf.mu.RLock()
+	defer zf.mu.RUnlock()
+	return zf.gen, zf.file
+}
+
+// acquireEntry returns the entry and its generation, which the caller has to release unless
+// acquireEntry fails with ESTALE because the generation has been closed
+func (zf *indexedFile) acquireEntry() (*generation, idx.Entry, syscall.Errno) {
+	gen, file := zf.entry()
+	if !gen.acquire() {
+		return nil, nil, syscall.ESTALE
+	}
+	return gen, file, fs.OK
+}
 
-	root    *indexedRoot
-	lazyIdx idx.Index
+func (zf *indexedFile) setEntry(gen *generation, file idx.Entry) {
+	zf.mu.Lock()
+	defer zf.mu.Unlock()
+	zf.gen, zf.file = gen, file
 }
 
 // Getattr sets the minimum, which is the size. A more full-featured
@@ -90,7 +181,18 @@ type indexedFile struct {
 var _ fs.NodeGetattrer = (*indexedFile)(nil)
 
 func (zf *indexedFile) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut) syscall.Errno {
-	applyDefaults, err := zf.file.Getattr(&out.Attr)
+	var file idx.Entry
+	if h, ok := f.(*indexedHandle); ok {
+		file = h.file
+	} else {
+		gen, e, errno := zf.acquireEntry()
+		if errno != fs.OK {
+			return errno
+		}
+		defer releaseGeneration(gen)
+		file = e
+	}
+	applyDefaults, err := file.Getattr(&out.Attr)
 	if err != nil {
 		log.WithError(err).Warn("cannot getattr")
 		return syscall.EINVAL
@@ -109,14 +211,31 @@ func (zf *indexedFile) Open(ctx context.Context, flags uint32) (fs.FileHandle, u
 	// // one.  The file content is immutable, so hint the kernel to
 	// // cache the data.
 	// return nil, fuse.FOPEN_KEEP_CACHE, fs.OK
-	return nil, 0, fs.OK
+
+	// the handle keeps reading the entry it was opened with, even if the index is swapped meanwhile
+	gen, file, errno := zf.acquireEntry()
+	if errno != fs.OK {
+		return nil, 0, errno
+	}
+	return &indexedHandle{gen: gen, file: file}, 0, fs.OK
 }
 
 var _ fs.NodeReader = (*indexedFile)(nil)
 
 // Read simply returns the data that was already unpacked in the Open call
 func (zf *indexedFile) Read(ctx context.Context, f fs.FileHandle, dest []byte, off int64) (fuse.ReadResult, syscall.Errno) {
-	n, err := zf.file.Read(dest, off)
+	var file idx.Entry
+	if h, ok := f.(*indexedHandle); ok {
+		file = h.file
+	} else {
+		gen, e, errno := zf.acquireEntry()
+		if errno != fs.OK {
+			return nil, errno
+		}
+		defer releaseGeneration(gen)
+		file = e
+	}
+	n, err := file.Read(dest, off)
 	if err != nil && !errors.Is(err, io.EOF) {
 		return nil, syscall.EINVAL
 	}
@@ -128,14 +247,14 @@ var _ fs.NodeReaddirer = (*indexedFile)(nil)
 
 // Readdir implements fs.NodeReaddirer
 func (zf *indexedFile) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
-	if zf.lazyIdx == nil {
-		log.WithField("entry", zf.file).Warn("ReadDir without lazy index")
-		return nil, syscall.EINVAL
+	gen, file, errno := zf.acquireEntry()
+	if errno != fs.OK {
+		return nil, errno
 	}
-
-	children, err := zf.lazyIdx.Children(ctx, zf.file)
+	defer releaseGeneration(gen)
+	children, err := gen.Index.Children(ctx, file)
 	if err != nil && !errors.Is(err, context.Canceled) {
-		log.WithField("entry", zf.file).WithError(err).Warn("cannot load children")
+		log.WithField("entry", file).WithError(err).Warn("cannot load children")
 		return nil, syscall.EINVAL
 	}
 
@@ -147,7 +266,7 @@ func (zf *indexedFile) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno
 		})
 	}
 
-	log.WithField("name", zf.file.Name()).WithField("children", entries).Debug("readdir+")
+	log.WithField("name", file.Name()).WithField("children", entries).Debug("readdir+")
 
 	return fs.NewListDirStream(entries), syscall.F_OK
 }
@@ -156,9 +275,18 @@ var _ fs.NodeLookuper = (*indexedFile)(nil)
 
 // Lookup implements fs.NodeLookuper
 func (zf *indexedFile) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
-	children, err := zf.lazyIdx.Children(ctx, zf.file)
+	// a swap must not miss the inode we're about to create
+	zf.root.mu.RLock()
+	defer zf.root.mu.RUnlock()
+
+	gen, file, errno := zf.acquireEntry()
+	if errno != fs.OK {
+		return nil, errno
+	}
+	defer releaseGeneration(gen)
+	children, err := gen.Index.Children(ctx, file)
 	if err != nil && !errors.Is(err, context.Canceled) {
-		log.WithField("entry", zf.file).WithError(err).Warn("cannot lookup file")
+		log.WithField("entry", file).WithError(err).Warn("cannot lookup file")
 		return nil, syscall.EINVAL
 	}
 
@@ -185,11 +313,46 @@ func (zf *indexedFile) Lookup(ctx context.Context, name string, out *fuse.EntryO
 
 	log.WithField("name", name).WithField("res", res).WithField("attr", out.Attr).WithField("mode", res.StableMode()).Debug("lookup file")
 
-	return zf.NewPersistentInode(ctx, &indexedFile{
-		file:    res,
-		lazyIdx: zf.lazyIdx,
-		root:    zf.root,
+	// reuse the inode of earlier lookups, which a swap kept if the entry didn't change
+	if ch := zf.GetChild(name); ch != nil {
+		if node, ok := ch.Operations().(*indexedFile); ok {
+			if g, f := node.entry(); g == gen && f.StableMode() == res.StableMode() {
+				return ch, fs.OK
+			}
+		}
+	}
+
+	ch := zf.NewPersistentInode(ctx, &indexedFile{
+		file: res,
+		gen:  gen,
+		root: zf.root,
 	}, fs.StableAttr{
 		Mode: res.StableMode(),
-	}), fs.OK
+	})
+	// we add the child while holding the lock, so that a concurrent swap sees it
+	zf.AddChild(name, ch, true)
+	return ch, fs.OK
+}
+
+var _ fs.NodeReadlinker = (*indexedFile)(nil)
+
+// Readlink implements fs.NodeReadlinker
+func (zf *indexedFile) Readlink(ctx context.Context) ([]byte, syscall.Errno) {
+	gen, file, errno := zf.acquireEntry()
+	if errno != fs.OK {
+		return nil, errno
+	}
+	defer releaseGeneration(gen)
+	lnk, ok := file.(idx.SymlinkEntry)
+	if !ok {
+		return nil, syscall.EINVAL
+	}
+
+	target, err := lnk.Readlink()
+	if err != nil {
+		log.WithField("entry", file).WithError(err).Warn("cannot read link")
+		return nil, syscall.EIO
+	}
+
+	return []byte(target), fs.OK
 }
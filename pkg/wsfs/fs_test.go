@@ -8,12 +8,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/csweichel/wsfs/pkg/idx"
 	"github.com/csweichel/wsfs/pkg/wsfs"
-	fusefs "github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 )
 
@@ -69,6 +70,11 @@ func (mi mappedIndex) RootEntries(ctx context.Context) ([]idx.Entry, error) {
 	return mi, nil
 }
 
+// Close implements idx.Index
+func (mappedIndex) Close() error {
+	return nil
+}
+
 var _ idx.Index = ((mappedIndex)(nil))
 var _ idx.Entry = ((*mappedFile)(nil))
 
@@ -119,8 +125,7 @@ func TestCrawl(t *testing.T) {
 	}
 	defer os.RemoveAll(tempDir)
 
-	root := wsfs.New(index, wsfs.Options{})
-	server, err := fusefs.Mount(tempDir, root, nil)
+	server, err := wsfs.Mount(tempDir, index, wsfs.Options{}, fuse.MountOptions{})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -145,3 +150,98 @@ func TestCrawl(t *testing.T) {
 		return nil
 	})
 }
+
+// closeRecorder records whether the index was closed
+type closeRecorder struct {
+	mappedIndex
+	Closed atomic.Bool
+}
+
+// Close implements idx.Index
+func (c *closeRecorder) Close() error {
+	c.Closed.Store(true)
+	return nil
+}
+
+func TestSwap(t *testing.T) {
+	v1 := &closeRecorder{mappedIndex: mappedIndex{
+		newDir("d1",
+			newFile("same", "same"),
+			newFile("changed", "old"),
+			newFile("gone", "gone"),
+		),
+	}}
+	v2 := &closeRecorder{mappedIndex: mappedIndex{
+		newDir("d1",
+			newFile("same", "same"),
+			newFile("changed", "new content"),
+		),
+		newFile("added", "added"),
+	}}
+
+	tempDir, err := os.MkdirTemp("", "test-swap-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	server, err := wsfs.Mount(tempDir, v1, wsfs.Options{}, fuse.MountOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Unmount()
+
+	ino := func(fn string) uint64 {
+		stat, err := os.Stat(filepath.Join(tempDir, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stat.Sys().(*syscall.Stat_t).Ino
+	}
+	sameIno := ino("d1/same")
+	ino("d1/gone")
+	old, err := os.Open(filepath.Join(tempDir, "d1/changed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = server.Swap(context.Background(), v2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Closed.Load() {
+		t.Error("index was closed while a file was still open")
+	}
+
+	if act := ino("d1/same"); act != sameIno {
+		t.Errorf("inode of unchanged file changed from %d to %d", sameIno, act)
+	}
+	if _, err := os.Stat(filepath.Join(tempDir, "d1/gone")); !os.IsNotExist(err) {
+		t.Errorf("removed file still exists: %v", err)
+	}
+	for fn, expectation := range map[string]string{"d1/changed": "new content", "added": "added"} {
+		fc, err := os.ReadFile(filepath.Join(tempDir, fn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(fc) != expectation {
+			t.Errorf("%s: expected %q, got %q", fn, expectation, string(fc))
+		}
+	}
+
+	fc, err := io.ReadAll(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(fc) != "old" {
+		t.Errorf("open file: expected %q, got %q", "old", string(fc))
+	}
+	old.Close()
+	// the kernel releases the handle asynchronously
+	for i := 0; i < 100 && !v1.Closed.Load(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !v1.Closed.Load() {
+		t.Error("index was not closed once the last file was closed")
+	}
+}
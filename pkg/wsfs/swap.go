@@ -0,0 +1,208 @@
+package wsfs
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"syscall"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// generation is a version of the mounted index. Once it's been swapped out, it's closed as soon
+// as the last file opened from it is closed and the last operation using it has finished.
+type generation struct {
+	Index idx.Index
+
+	mu      sync.Mutex
+	refs    int
+	retired bool
+	closed  bool
+}
+
+// acquire keeps the generation open until release is called. It returns false if the generation
+// has been closed already, which happens to inodes a swap removed while the kernel still knows them.
+func (g *generation) acquire() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		return false
+	}
+	g.refs++
+	return true
+}
+
+func (g *generation) release() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.refs--
+	return g.closeIfUnused()
+}
+
+// retire marks the generation as swapped out
+func (g *generation) retire() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retired = true
+	return g.closeIfUnused()
+}
+
+func (g *generation) closeIfUnused() error {
+	if !g.retired || g.refs > 0 || g.closed {
+		return nil
+	}
+	g.closed = true
+	return g.Index.Close()
+}
+
+// indexedHandle is an open file. It reads the entry it was opened with, regardless of swaps.
+type indexedHandle struct {
+	gen  *generation
+	file idx.Entry
+}
+
+var _ fs.FileReleaser = (*indexedHandle)(nil)
+
+// Release implements fs.FileReleaser
+func (h *indexedHandle) Release(ctx context.Context) syscall.Errno {
+	releaseGeneration(h.gen)
+	return fs.OK
+}
+
+// swap replaces the index of the filesystem. All inodes the kernel knows of are matched against the
+// new index by their path: unchanged entries keep their inode, the kernel caches of changed entries
+// are invalidated, and entries which no longer exist or changed their type are removed. Files which
+// are open keep reading from the previous index, which is closed once the last of them is closed.
+func (zr *indexedRoot) swap(ctx context.Context, index idx.Index) error {
+	root, err := index.RootEntries(ctx)
+	if err != nil {
+		index.Close()
+		return err
+	}
+
+	// listing directories may take network round trips, hence we do so before taking the lock
+	// which lookups wait for, and only edit the tree while holding it
+	gen := &generation{Index: index}
+	listings := make(map[*fs.Inode][]idx.Entry)
+	zr.list(ctx, &zr.Inode, gen, root, listings)
+
+	zr.mu.Lock()
+	old := zr.gen
+	zr.gen = gen
+	var notify []func()
+	zr.update(&zr.Inode, gen, listings, &notify)
+	// the root doesn't look up its children, hence we add new entries right away
+	for _, e := range root {
+		_, base := filepath.Split(e.Name())
+		if zr.GetChild(base) == nil {
+			zr.addRootEntry(ctx, gen, e)
+			notify = append(notify, func() { zr.NotifyEntry(base) })
+		}
+	}
+	zr.mu.Unlock()
+
+	// The kernel takes the directory lock when it's notified, which a concurrent lookup might hold
+	// while waiting for us. Hence we notify only once we've released the lock.
+	for _, n := range notify {
+		n()
+	}
+	log.WithField("invalidated", len(notify)).Debug("swapped index")
+
+	return old.retire()
+}
+
+// list collects the entries of the new generation for dir and the directories below it whose
+// children the kernel knows
+func (zr *indexedRoot) list(ctx context.Context, dir *fs.Inode, gen *generation, entries []idx.Entry, listings map[*fs.Inode][]idx.Entry) {
+	listings[dir] = entries
+	byName := entriesByName(entries)
+	for name, ch := range dir.Children() {
+		node, ok := ch.Operations().(*indexedFile)
+		if !ok {
+			continue
+		}
+		_, prev := node.entry()
+		e, exists := byName[name]
+		if !exists || e.StableMode() != prev.StableMode() || !e.Dir() || len(ch.Children()) == 0 {
+			continue
+		}
+
+		children, err := gen.Index.Children(ctx, e)
+		if err != nil {
+			// update removes directories it has no listing for
+			log.WithError(err).WithField("entry", name).Warn("cannot load children - removing directory")
+			continue
+		}
+		zr.list(ctx, ch, gen, children, listings)
+	}
+}
+
+// update matches the known children of dir against entries of the new generation
+func (zr *indexedRoot) update(dir *fs.Inode, gen *generation, listings map[*fs.Inode][]idx.Entry, notify *[]func()) {
+	byName := entriesByName(listings[dir])
+	for name, ch := range dir.Children() {
+		name, ch := name, ch
+		node, ok := ch.Operations().(*indexedFile)
+		if !ok {
+			continue
+		}
+		_, prev := node.entry()
+
+		e, exists := byName[name]
+		if !exists || e.StableMode() != prev.StableMode() {
+			dir.RmChild(name)
+			*notify = append(*notify, func() { dir.NotifyEntry(name) })
+			continue
+		}
+
+		node.setEntry(gen, e)
+		if !sameEntry(prev, e) {
+			*notify = append(*notify, func() { ch.NotifyContent(0, 0) })
+		}
+		if !e.Dir() || len(ch.Children()) == 0 {
+			continue
+		}
+
+		// directories we couldn't list, or whose children were looked up while we were listing
+		if _, ok := listings[ch]; !ok {
+			dir.RmChild(name)
+			*notify = append(*notify, func() { dir.NotifyEntry(name) })
+			continue
+		}
+		zr.update(ch, gen, listings, notify)
+	}
+}
+
+func entriesByName(entries []idx.Entry) map[string]idx.Entry {
+	res := make(map[string]idx.Entry, len(entries))
+	for _, e := range entries {
+		_, base := filepath.Split(e.Name())
+		res[base] = e
+	}
+	return res
+}
+
+// sameEntry returns true if a and b have the same attributes and link target
+func sameEntry(a, b idx.Entry) bool {
+	var aattr, battr fuse.Attr
+	adefaults, aerr := a.Getattr(&aattr)
+	bdefaults, berr := b.Getattr(&battr)
+	if aerr != nil || berr != nil || adefaults != bdefaults || aattr != battr {
+		return false
+	}
+
+	alnk, aok := a.(idx.SymlinkEntry)
+	blnk, bok := b.(idx.SymlinkEntry)
+	if aok != bok {
+		return false
+	}
+	if !aok {
+		return true
+	}
+	atarget, aerr := alnk.Readlink()
+	btarget, berr := blnk.Readlink()
+	return aerr == nil && berr == nil && atarget == btarget
+}
@@ -0,0 +1,143 @@
+package wsfs
+
+import (
+	"context"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/csweichel/wsfs/pkg/idx"
+	"github.com/hanwen/go-fuse/v2/fs"
+	log "github.com/sirupsen/logrus"
+)
+
+// Directories whose index records aggregates have extended attributes which hold the totals of
+// everything below them, see idx.DirAggregate. This answers "how big is this subtree" without
+// walking it, e.g. using getfattr -n user.wsfs.size.
+const (
+	xattrSize  = "user.wsfs.size"
+	xattrFiles = "user.wsfs.files"
+	xattrMtime = "user.wsfs.mtime"
+)
+
+var aggregateXattrs = []string{xattrSize, xattrFiles, xattrMtime}
+
+func getAggregateXattr(a *idx.DirAggregate, attr string, dest []byte) (uint32, syscall.Errno) {
+	if a == nil {
+		return 0, syscall.ENODATA
+	}
+	var val string
+	switch attr {
+	case xattrSize:
+		val = strconv.FormatUint(a.Size, 10)
+	case xattrFiles:
+		val = strconv.FormatUint(a.Files, 10)
+	case xattrMtime:
+		val = a.Mtime.UTC().Format(time.RFC3339)
+	default:
+		return 0, syscall.ENODATA
+	}
+	if len(dest) < len(val) {
+		return uint32(len(val)), syscall.ERANGE
+	}
+	return uint32(copy(dest, val)), fs.OK
+}
+
+func listAggregateXattrs(a *idx.DirAggregate, dest []byte) (uint32, syscall.Errno) {
+	if a == nil {
+		return 0, fs.OK
+	}
+	var names []byte
+	for _, n := range aggregateXattrs {
+		names = append(names, n...)
+		names = append(names, 0)
+	}
+	if len(dest) < len(names) {
+		return uint32(len(names)), syscall.ERANGE
+	}
+	return uint32(copy(dest, names)), fs.OK
+}
+
+// aggregate returns the aggregate of the directory, or nil if it's not a directory or the index doesn't record it
+func (zf *indexedFile) aggregate() (*idx.DirAggregate, syscall.Errno) {
+	// reading the aggregate may read the index, which a concurrent swap must not close meanwhile
+	gen, file, errno := zf.acquireEntry()
+	if errno != fs.OK {
+		return nil, errno
+	}
+	defer releaseGeneration(gen)
+	ae, ok := file.(idx.AggregateEntry)
+	if !ok || !file.Dir() {
+		return nil, fs.OK
+	}
+	a, err := ae.Aggregate()
+	if err != nil {
+		log.WithField("entry", file).WithError(err).Warn("cannot read aggregate")
+		return nil, syscall.EIO
+	}
+	return a, fs.OK
+}
+
+var _ fs.NodeGetxattrer = (*indexedFile)(nil)
+
+// Getxattr implements fs.NodeGetxattrer
+func (zf *indexedFile) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	a, errno := zf.aggregate()
+	if errno != fs.OK {
+		return 0, errno
+	}
+	return getAggregateXattr(a, attr, dest)
+}
+
+var _ fs.NodeListxattrer = (*indexedFile)(nil)
+
+// Listxattr implements fs.NodeListxattrer
+func (zf *indexedFile) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	a, errno := zf.aggregate()
+	if errno != fs.OK {
+		return 0, errno
+	}
+	return listAggregateXattrs(a, dest)
+}
+
+// aggregate sums up the aggregates of the root entries
+func (zr *indexedRoot) aggregate(ctx context.Context) (*idx.DirAggregate, syscall.Errno) {
+	gen := zr.acquireGeneration()
+	defer releaseGeneration(gen)
+
+	a, err := idx.RootAggregate(ctx, gen.Index)
+	if err != nil {
+		log.WithError(err).Warn("cannot read root aggregate")
+		return nil, syscall.EIO
+	}
+	return a, fs.OK
+}
+
+func releaseGeneration(gen *generation) {
+	err := gen.release()
+	if err != nil {
+		log.WithError(err).Warn("cannot close swapped out index")
+	}
+}
+
+var _ fs.NodeGetxattrer = (*indexedRoot)(nil)
+
+// Getxattr implements fs.NodeGetxattrer
+func (zr *indexedRoot) Getxattr(ctx context.Context, attr string, dest []byte) (uint32, syscall.Errno) {
+	a, errno := zr.aggregate(ctx)
+	if errno != fs.OK {
+		return 0, errno
+	}
+	return getAggregateXattr(a, attr, dest)
+}
+
+var _ fs.NodeListxattrer = (*indexedRoot)(nil)
+
+// Listxattr implements fs.NodeListxattrer
+func (zr *indexedRoot) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
+	a, errno := zr.aggregate(ctx)
+	if errno != fs.OK {
+		return 0, errno
+	}
+	return listAggregateXattrs(a, dest)
+}